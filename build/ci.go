@@ -300,6 +300,8 @@ func doTest(cmdline []string) {
 
 	// Run analysis tools before the tests.
 	build.MustRun(goTool("vet", packages...))
+	// The embedded builds strip the whisper RPC service, vet them separately.
+	build.MustRun(goTool("vet", "-tags", "whisperlite", "./whisper/...", "./mobile", "./cmd/utils"))
 
 	// Run the actual tests.
 	gotest := goTool("test", buildFlags(env)...)
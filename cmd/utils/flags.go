@@ -1152,7 +1152,7 @@ func RegisterDashboardService(stack *node.Node, cfg *dashboard.Config, commit st
 // RegisterShhService configures Whisper and adds it to the given node.
 func RegisterShhService(stack *node.Node, cfg *whisper.Config) {
 	if err := stack.Register(func(n *node.ServiceContext) (node.Service, error) {
-		return whisper.New(cfg), nil
+		return newWhisperService(cfg), nil
 	}); err != nil {
 		Fatalf("Failed to register the Whisper service: %v", err)
 	}
@@ -0,0 +1,42 @@
+// Copyright 2017 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+// +build whisperlite
+
+package utils
+
+import (
+	"github.com/ethereum/go-ethereum/node"
+	"github.com/ethereum/go-ethereum/rpc"
+	whisper "github.com/ethereum/go-ethereum/whisper/whisperv6"
+)
+
+// liteWhisper adapts the minimal whisper build, which has no RPC service, to
+// the node.Service interface.
+type liteWhisper struct {
+	*whisper.Whisper
+}
+
+// APIs returns no RPC descriptors, the RPC service is stripped from the
+// minimal builds.
+func (liteWhisper) APIs() []rpc.API {
+	return nil
+}
+
+// newWhisperService creates the whisper service of the node.
+func newWhisperService(config *whisper.Config) node.Service {
+	return liteWhisper{whisper.New(config)}
+}
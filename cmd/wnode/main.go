@@ -89,6 +89,7 @@ var (
 	fileReader     = flag.Bool("filereader", false, "load and decrypt messages saved as files, display as plain text")
 	testMode       = flag.Bool("test", false, "use of predefined parameters for diagnostics (password, etc.)")
 	echoMode       = flag.Bool("echo", false, "echo mode: prints some arguments for diagnostics")
+	complianceMode = flag.Bool("compliance", false, "compliance mode: probes the protocol behavior of the bootstrap node and prints a report")
 
 	argVerbosity = flag.Int("verbosity", int(log.LvlError), "log verbosity level")
 	argTTL       = flag.Uint("ttl", 30, "time-to-live for messages in seconds")
@@ -108,6 +109,10 @@ var (
 
 func main() {
 	processArgs()
+	if *complianceMode {
+		runComplianceTests()
+		return
+	}
 	initialize()
 	run()
 	shutdown()
@@ -749,6 +754,34 @@ func requestExpiredMessagesLoop() {
 	}
 }
 
+func runComplianceTests() {
+	if len(*argEnode) == 0 {
+		argEnode = scanLineA("Please enter the peer's enode: ")
+	}
+	node, err := discover.ParseNode(*argEnode)
+	if err != nil {
+		utils.Fatalf("Failed to parse the enode: %s", err)
+	}
+
+	fmt.Printf("Probing %s \n", node)
+	report := whisper.RunComplianceTests(whisper.NewComplianceDialer(node, 10*time.Second), 5*time.Second)
+	for _, result := range report.Results {
+		status := "PASS"
+		if !result.Passed {
+			status = "FAIL"
+		}
+		fmt.Printf("%s %-18s expected: %s", status, result.Probe, result.Expected)
+		if len(result.Detail) > 0 {
+			fmt.Printf(" (%s)", result.Detail)
+		}
+		fmt.Println()
+	}
+	fmt.Printf("%d passed, %d failed \n", report.Passed, report.Failed)
+	if report.Failed > 0 {
+		os.Exit(1)
+	}
+}
+
 func extractIDFromEnode(s string) []byte {
 	n, err := discover.ParseNode(s)
 	if err != nil {
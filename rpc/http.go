@@ -41,6 +41,16 @@ const (
 
 var nullAddr, _ = net.ResolveTCPAddr("tcp", "127.0.0.1:0")
 
+// remoteAddrKey is the context key of the address of the HTTP client.
+type remoteAddrKey struct{}
+
+// RemoteAddrFromContext returns the address of the HTTP client issuing the
+// request, if the request was served over HTTP.
+func RemoteAddrFromContext(ctx context.Context) (string, bool) {
+	addr, ok := ctx.Value(remoteAddrKey{}).(string)
+	return addr, ok
+}
+
 type httpConn struct {
 	client    *http.Client
 	req       *http.Request
@@ -174,7 +184,8 @@ func (srv *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	defer codec.Close()
 
 	w.Header().Set("content-type", contentType)
-	srv.ServeSingleRequest(codec, OptionMethodInvocation)
+	ctx := context.WithValue(context.Background(), remoteAddrKey{}, r.RemoteAddr)
+	srv.serveRequest(ctx, codec, true, OptionMethodInvocation)
 }
 
 // validateRequest returns a non-zero response code and error message if the
@@ -17,6 +17,7 @@
 package rpc
 
 import (
+	"context"
 	"net/http"
 	"net/http/httptest"
 	"strings"
@@ -52,3 +53,27 @@ func testHTTPErrorResponse(t *testing.T, method, contentType, body string, expec
 		t.Fatalf("response code should be %d not %d", expected, code)
 	}
 }
+
+type RemoteAddrService struct{}
+
+func (s *RemoteAddrService) RemoteAddr(ctx context.Context) string {
+	addr, _ := RemoteAddrFromContext(ctx)
+	return addr
+}
+
+func TestHTTPRemoteAddr(t *testing.T) {
+	server := NewServer()
+	defer server.Stop()
+	if err := server.RegisterName("test", new(RemoteAddrService)); err != nil {
+		t.Fatal(err)
+	}
+	request := httptest.NewRequest(http.MethodPost, "http://url.com", strings.NewReader(`{"jsonrpc":"2.0","id":1,"method":"test_remoteAddr"}`))
+	request.Header.Set("content-type", contentType)
+	request.RemoteAddr = "10.0.0.1:1234"
+	recorder := httptest.NewRecorder()
+	server.ServeHTTP(recorder, request)
+
+	if body := recorder.Body.String(); !strings.Contains(body, `"result":"10.0.0.1:1234"`) {
+		t.Fatalf("remote address not passed to the handler: %s", body)
+	}
+}
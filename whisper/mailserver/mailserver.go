@@ -17,8 +17,11 @@
 package mailserver
 
 import (
+	"bytes"
+	"crypto/ecdsa"
 	"encoding/binary"
-	"fmt"
+	"sync"
+	"time"
 
 	"github.com/ethereum/go-ethereum/cmd/utils"
 	"github.com/ethereum/go-ethereum/common"
@@ -35,6 +38,21 @@ type WMailServer struct {
 	w   *whisper.Whisper
 	pow float64
 	key []byte
+	log log.Logger
+
+	delegatorsMu sync.RWMutex
+	delegators   map[string]struct{} // identities allowed to delegate the access (none means open access)
+
+	policyMu sync.RWMutex
+	policy   ArchivePolicy // policy deciding which envelopes are archived
+}
+
+// ArchivePolicy configures which envelopes are archived by the mail server.
+type ArchivePolicy struct {
+	// IgnoreOptOut archives the envelopes requesting not to be archived as
+	// well. The default honors the requests, as expected from the compliant
+	// mail servers.
+	IgnoreOptOut bool
 }
 
 type DBKey struct {
@@ -54,6 +72,15 @@ func NewDbKey(t uint32, h common.Hash) *DBKey {
 	return &k
 }
 
+// logger returns the logger of the mail server, or the root logger if the
+// server was not initialized.
+func (s *WMailServer) logger() log.Logger {
+	if s.log == nil {
+		return log.Root()
+	}
+	return s.log
+}
+
 func (s *WMailServer) Init(shh *whisper.Whisper, path string, password string, pow float64) {
 	var err error
 	if len(path) == 0 {
@@ -71,6 +98,7 @@ func (s *WMailServer) Init(shh *whisper.Whisper, path string, password string, p
 
 	s.w = shh
 	s.pow = pow
+	s.log = shh.Logger(whisper.LogSubsystemMail)
 
 	MailServerKeyID, err := s.w.AddSymKeyFromPassword(password)
 	if err != nil {
@@ -82,6 +110,56 @@ func (s *WMailServer) Init(shh *whisper.Whisper, path string, password string, p
 	}
 }
 
+// AddDelegator trusts the identity (e.g. the gateway of an organization) to
+// issue the delegation tokens. Once any delegator is added, only the requests
+// presenting a valid delegation chain are served.
+func (s *WMailServer) AddDelegator(pub *ecdsa.PublicKey) {
+	s.delegatorsMu.Lock()
+	defer s.delegatorsMu.Unlock()
+
+	if s.delegators == nil {
+		s.delegators = make(map[string]struct{})
+	}
+	s.delegators[string(crypto.FromECDSAPub(pub))] = struct{}{}
+}
+
+// RemoveDelegator revokes the trust of the identity to issue the delegation tokens.
+func (s *WMailServer) RemoveDelegator(pub *ecdsa.PublicKey) {
+	s.delegatorsMu.Lock()
+	defer s.delegatorsMu.Unlock()
+
+	delete(s.delegators, string(crypto.FromECDSAPub(pub)))
+}
+
+// delegationRequired checks if the requests must present a delegation chain.
+func (s *WMailServer) delegationRequired() bool {
+	s.delegatorsMu.RLock()
+	defer s.delegatorsMu.RUnlock()
+	return len(s.delegators) > 0
+}
+
+// isDelegator checks if the identity is trusted to issue the delegation tokens.
+func (s *WMailServer) isDelegator(pub *ecdsa.PublicKey) bool {
+	s.delegatorsMu.RLock()
+	defer s.delegatorsMu.RUnlock()
+	_, ok := s.delegators[string(crypto.FromECDSAPub(pub))]
+	return ok
+}
+
+// SetArchivePolicy replaces the policy deciding which envelopes are archived.
+func (s *WMailServer) SetArchivePolicy(policy ArchivePolicy) {
+	s.policyMu.Lock()
+	defer s.policyMu.Unlock()
+	s.policy = policy
+}
+
+// archivable checks if the envelope should be archived according to the policy.
+func (s *WMailServer) archivable(env *whisper.Envelope) bool {
+	s.policyMu.RLock()
+	defer s.policyMu.RUnlock()
+	return !env.NoArchive() || s.policy.IgnoreOptOut
+}
+
 func (s *WMailServer) Close() {
 	if s.db != nil {
 		s.db.Close()
@@ -89,21 +167,25 @@ func (s *WMailServer) Close() {
 }
 
 func (s *WMailServer) Archive(env *whisper.Envelope) {
+	if !s.archivable(env) {
+		s.logger().Trace("envelope opted out of archiving", "hash", env.Hash().Hex())
+		return
+	}
 	key := NewDbKey(env.Expiry-env.TTL, env.Hash())
 	rawEnvelope, err := rlp.EncodeToBytes(env)
 	if err != nil {
-		log.Error(fmt.Sprintf("rlp.EncodeToBytes failed: %s", err))
+		s.logger().Error("rlp.EncodeToBytes failed", "hash", env.Hash().Hex(), "err", err)
 	} else {
 		err = s.db.Put(key.raw, rawEnvelope, nil)
 		if err != nil {
-			log.Error(fmt.Sprintf("Writing to DB failed: %s", err))
+			s.logger().Error("Writing to DB failed", "hash", env.Hash().Hex(), "err", err)
 		}
 	}
 }
 
 func (s *WMailServer) DeliverMail(peer *whisper.Peer, request *whisper.Envelope) {
 	if peer == nil {
-		log.Error("Whisper peer is nil")
+		s.logger().Error("Whisper peer is nil")
 		return
 	}
 
@@ -126,7 +208,7 @@ func (s *WMailServer) processRequest(peer *whisper.Peer, lower, upper uint32, bl
 		var envelope whisper.Envelope
 		err = rlp.DecodeBytes(i.Value(), &envelope)
 		if err != nil {
-			log.Error(fmt.Sprintf("RLP decoding failed: %s", err))
+			s.logger().Error("RLP decoding failed", "err", err)
 		}
 
 		if whisper.BloomFilterMatch(bloom, envelope.Bloom()) {
@@ -136,7 +218,7 @@ func (s *WMailServer) processRequest(peer *whisper.Peer, lower, upper uint32, bl
 			} else {
 				err = s.w.SendP2PDirect(peer, &envelope)
 				if err != nil {
-					log.Error(fmt.Sprintf("Failed to send direct message to peer: %s", err))
+					s.logger().Error("Failed to send direct message to peer", "peer", common.ToHex(peer.ID()), "hash", envelope.Hash().Hex(), "err", err)
 					return nil
 				}
 			}
@@ -145,7 +227,7 @@ func (s *WMailServer) processRequest(peer *whisper.Peer, lower, upper uint32, bl
 
 	err = i.Error()
 	if err != nil {
-		log.Error(fmt.Sprintf("Level DB iterator error: %s", err))
+		s.logger().Error("Level DB iterator error", "err", err)
 	}
 
 	return ret
@@ -159,7 +241,7 @@ func (s *WMailServer) validateRequest(peerID []byte, request *whisper.Envelope)
 	f := whisper.Filter{KeySym: s.key}
 	decrypted := request.Open(&f)
 	if decrypted == nil {
-		log.Warn(fmt.Sprintf("Failed to decrypt p2p request"))
+		s.logger().Warn("Failed to decrypt p2p request", "peer", common.ToHex(peerID), "hash", request.Hash().Hex())
 		return false, 0, 0, nil
 	}
 
@@ -171,24 +253,46 @@ func (s *WMailServer) validateRequest(peerID []byte, request *whisper.Envelope)
 	// if you want to check the signature, you can do it here. e.g.:
 	// if !bytes.Equal(peerID, src) {
 	if src == nil {
-		log.Warn(fmt.Sprintf("Wrong signature of p2p request"))
+		s.logger().Warn("Wrong signature of p2p request", "peer", common.ToHex(peerID), "hash", request.Hash().Hex())
 		return false, 0, 0, nil
 	}
 
 	var bloom []byte
 	payloadSize := len(decrypted.Payload)
 	if payloadSize < 8 {
-		log.Warn(fmt.Sprintf("Undersized p2p request"))
+		s.logger().Warn("Undersized p2p request", "peer", common.ToHex(peerID), "hash", request.Hash().Hex())
 		return false, 0, 0, nil
 	} else if payloadSize == 8 {
 		bloom = whisper.MakeFullNodeBloom()
 	} else if payloadSize < 8+whisper.BloomFilterSize {
-		log.Warn(fmt.Sprintf("Undersized bloom filter in p2p request"))
+		s.logger().Warn("Undersized bloom filter in p2p request", "peer", common.ToHex(peerID), "hash", request.Hash().Hex())
 		return false, 0, 0, nil
 	} else {
 		bloom = decrypted.Payload[8 : 8+whisper.BloomFilterSize]
 	}
 
+	// the delegation chain (if any) follows the bloom filter, and is bound to
+	// the peer signing the request, so that a replayed request gains no access
+	if s.delegationRequired() {
+		if !bytes.Equal(peerID, src) {
+			s.logger().Warn("Delegated p2p request not signed by the peer", "peer", common.ToHex(peerID), "hash", request.Hash().Hex())
+			return false, 0, 0, nil
+		}
+		var chain []*whisper.DelegationToken
+		if payloadSize <= 8+whisper.BloomFilterSize {
+			s.logger().Warn("Missing delegation chain in p2p request", "peer", common.ToHex(peerID), "hash", request.Hash().Hex())
+			return false, 0, 0, nil
+		}
+		if err := rlp.DecodeBytes(decrypted.Payload[8+whisper.BloomFilterSize:], &chain); err != nil {
+			s.logger().Warn("Invalid delegation chain in p2p request", "peer", common.ToHex(peerID), "hash", request.Hash().Hex(), "err", err)
+			return false, 0, 0, nil
+		}
+		if _, err := whisper.VerifyDelegationChain(chain, decrypted.Src, s.isDelegator, uint64(time.Now().Unix())); err != nil {
+			s.logger().Warn("Delegation chain rejected", "peer", common.ToHex(peerID), "hash", request.Hash().Hex(), "err", err)
+			return false, 0, 0, nil
+		}
+	}
+
 	lower := binary.BigEndian.Uint32(decrypted.Payload[:4])
 	upper := binary.BigEndian.Uint32(decrypted.Payload[4:8])
 	return true, lower, upper, bloom
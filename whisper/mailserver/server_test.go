@@ -27,6 +27,7 @@ import (
 
 	"github.com/ethereum/go-ethereum/common"
 	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/rlp"
 	whisper "github.com/ethereum/go-ethereum/whisper/whisperv6"
 )
 
@@ -106,6 +107,34 @@ func TestMailServer(t *testing.T) {
 	deliverTest(t, &server, env)
 }
 
+func TestArchiveOptOut(t *testing.T) {
+	const password = "password_for_this_test"
+
+	dir, err := ioutil.TempDir("", "whisper-server-optout-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var server WMailServer
+	shh = whisper.New(&whisper.DefaultConfig)
+	shh.RegisterServer(&server)
+	server.Init(shh, dir, password, powRequirement)
+	defer server.Close()
+
+	env := generateEnvelope(t)
+	env.Flags = []uint64{whisper.EnvelopeNoArchive}
+	if server.archivable(env) {
+		t.Fatalf("envelope opted out of archiving is archived.")
+	}
+	server.SetArchivePolicy(ArchivePolicy{IgnoreOptOut: true})
+	if !server.archivable(env) {
+		t.Fatalf("opt-out honored despite the policy.")
+	}
+	if !server.archivable(generateEnvelope(t)) {
+		t.Fatalf("regular envelope is not archived.")
+	}
+}
+
 func deliverTest(t *testing.T, server *WMailServer, env *whisper.Envelope) {
 	id, err := shh.NewKeyPair()
 	if err != nil {
@@ -182,7 +211,10 @@ func createRequest(t *testing.T, p *ServerTestParams) *whisper.Envelope {
 	binary.BigEndian.PutUint32(data, p.low)
 	binary.BigEndian.PutUint32(data[4:], p.upp)
 	data = append(data, bloom...)
+	return wrapRequest(t, p, data)
+}
 
+func wrapRequest(t *testing.T, p *ServerTestParams, data []byte) *whisper.Envelope {
 	key, err := shh.GetSymKey(keyID)
 	if err != nil {
 		t.Fatalf("failed to retrieve sym key with seed %d: %s.", seed, err)
@@ -207,3 +239,68 @@ func createRequest(t *testing.T, p *ServerTestParams) *whisper.Envelope {
 	}
 	return env
 }
+
+func TestDelegatedAccess(t *testing.T) {
+	const password = "password_for_this_test"
+
+	dir, err := ioutil.TempDir("", "whisper-server-delegation-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var server WMailServer
+	shh = whisper.New(&whisper.DefaultConfig)
+	shh.RegisterServer(&server)
+	server.Init(shh, dir, password, powRequirement)
+	defer server.Close()
+
+	keyID, err = shh.AddSymKeyFromPassword(password)
+	if err != nil {
+		t.Fatalf("failed to create symmetric key for mail request: %s", err)
+	}
+
+	gateway, _ := crypto.GenerateKey()
+	client, _ := crypto.GenerateKey()
+	p := &ServerTestParams{
+		topic: whisper.TopicType{0x1F, 0x7E, 0xA1, 0x7F},
+		low:   uint32(time.Now().Unix()) - 100,
+		upp:   uint32(time.Now().Unix()),
+		key:   client,
+	}
+	src := crypto.FromECDSAPub(&client.PublicKey)
+
+	request := func(expiry uint64) *whisper.Envelope {
+		token, err := whisper.NewDelegationToken(gateway, &client.PublicKey, expiry, false)
+		if err != nil {
+			t.Fatalf("failed to issue token with seed %d: %s.", seed, err)
+		}
+		chain, _ := rlp.EncodeToBytes([]*whisper.DelegationToken{token})
+
+		data := make([]byte, 8)
+		binary.BigEndian.PutUint32(data, p.low)
+		binary.BigEndian.PutUint32(data[4:], p.upp)
+		data = append(data, whisper.TopicToBloom(p.topic)...)
+		return wrapRequest(t, p, append(data, chain...))
+	}
+	valid := request(uint64(time.Now().Unix()) + 60)
+
+	// open access until a delegator is configured
+	ok, _, _, _ := server.validateRequest(src, createRequest(t, p))
+	assert(ok, "request without delegation rejected in open mode", t)
+
+	server.AddDelegator(&gateway.PublicKey)
+	ok, _, _, _ = server.validateRequest(src, createRequest(t, p))
+	assert(!ok, "request without delegation accepted", t)
+	ok, lower, upper, _ := server.validateRequest(src, valid)
+	assert(ok && lower == p.low && upper == p.upp, "delegated request rejected", t)
+	other, _ := crypto.GenerateKey()
+	ok, _, _, _ = server.validateRequest(crypto.FromECDSAPub(&other.PublicKey), valid)
+	assert(!ok, "delegated request replayed by another peer accepted", t)
+	ok, _, _, _ = server.validateRequest(src, request(uint64(time.Now().Unix())-1))
+	assert(!ok, "expired delegation accepted", t)
+
+	server.RemoveDelegator(&gateway.PublicKey)
+	server.AddDelegator(&client.PublicKey)
+	ok, _, _, _ = server.validateRequest(src, valid)
+	assert(!ok, "delegation of an untrusted gateway accepted", t)
+}
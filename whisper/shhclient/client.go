@@ -20,6 +20,7 @@ import (
 	"context"
 
 	"github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/common"
 	"github.com/ethereum/go-ethereum/common/hexutil"
 	"github.com/ethereum/go-ethereum/rpc"
 	whisper "github.com/ethereum/go-ethereum/whisper/whisperv6"
@@ -77,6 +78,16 @@ func (sc *Client) SetMinimumPoW(ctx context.Context, pow float64) error {
 	return sc.c.CallContext(ctx, &ignored, "shh_setMinPoW", pow)
 }
 
+// GetEnvelope returns the public metadata of the envelope with the given hash,
+// if it is currently pooled by the node.
+func (sc *Client) GetEnvelope(ctx context.Context, hash common.Hash) (*whisper.EnvelopeInfo, error) {
+	var info whisper.EnvelopeInfo
+	if err := sc.c.CallContext(ctx, &info, "shh_getEnvelope", hash); err != nil {
+		return nil, err
+	}
+	return &info, nil
+}
+
 // Marks specific peer trusted, which will allow it to send historic (expired) messages.
 // Note This function is not adding new nodes, the node needs to exists as a peer.
 func (sc *Client) MarkTrustedPeer(ctx context.Context, enode string) error {
@@ -172,6 +183,13 @@ func (sc *Client) SubscribeMessages(ctx context.Context, criteria whisper.Criter
 	return sc.c.ShhSubscribe(ctx, ch, "messages", criteria)
 }
 
+// SubscribePeerEvents subscribes to the connect, disconnect and trust events
+// of the whisper peers of the node. This method is only supported on bi-directional
+// connections such as websockets and IPC.
+func (sc *Client) SubscribePeerEvents(ctx context.Context, ch chan<- *whisper.PeerEvent) (ethereum.Subscription, error) {
+	return sc.c.ShhSubscribe(ctx, ch, "peerEvents")
+}
+
 // NewMessageFilter creates a filter within the node. This filter can be used to poll
 // for new messages (see FilterMessages) that satisfy the given criteria. A filter can
 // timeout when it was polled for in whisper.filterTimeout.
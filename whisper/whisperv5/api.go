@@ -74,6 +74,9 @@ type Info struct {
 	Messages       int     `json:"messages"`       // Number of floating messages.
 	MinPow         float64 `json:"minPow"`         // Minimal accepted PoW
 	MaxMessageSize uint32  `json:"maxMessageSize"` // Maximum accepted message size
+
+	UnknownVersions int    `json:"unknownVersions"` // Number of the received envelopes of unknown versions
+	HighestVersion  uint64 `json:"highestVersion"`  // Highest envelope version received
 }
 
 // Info returns diagnostic information about the whisper node.
@@ -84,6 +87,9 @@ func (api *PublicWhisperAPI) Info(ctx context.Context) Info {
 		Messages:       len(api.w.messageQueue) + len(api.w.p2pMsgQueue),
 		MinPow:         api.w.MinPow(),
 		MaxMessageSize: api.w.MaxMessageSize(),
+
+		UnknownVersions: stats.unknownVersions,
+		HighestVersion:  stats.highestVersion,
 	}
 }
 
@@ -19,6 +19,7 @@ package whisperv5
 type Config struct {
 	MaxMessageSize     uint32  `toml:",omitempty"`
 	MinimumAcceptedPOW float64 `toml:",omitempty"`
+	StrictVersions     bool    `toml:",omitempty"` // Drop the envelopes of unknown (newer) versions instead of relaying them
 }
 
 var DefaultConfig = Config{
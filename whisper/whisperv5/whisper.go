@@ -43,6 +43,8 @@ type Statistics struct {
 	memoryUsed           int
 	cycles               int
 	totalMessagesCleared int
+	unknownVersions      int    // number of the received envelopes of unknown versions
+	highestVersion       uint64 // highest envelope version received so far
 }
 
 const (
@@ -64,6 +66,7 @@ type Whisper struct {
 	poolMu      sync.RWMutex              // Mutex to sync the message and expiration pools
 	envelopes   map[common.Hash]*Envelope // Pool of envelopes currently tracked by this node
 	expirations map[uint32]*set.SetNonTS  // Message expiration pool
+	dropped     map[common.Hash]uint32    // Expiry of the envelopes of unknown versions dropped in the strict mode
 
 	peerMu sync.RWMutex       // Mutex to sync the active peer set
 	peers  map[*Peer]struct{} // Set of currently active peers
@@ -78,6 +81,8 @@ type Whisper struct {
 	stats   Statistics // Statistics of whisper node
 
 	mailServer MailServer // MailServer interface
+
+	strictVersions bool // indicates if the envelopes of unknown versions are dropped instead of relayed
 }
 
 // New creates a Whisper client ready to communicate through the Ethereum P2P network.
@@ -91,10 +96,13 @@ func New(cfg *Config) *Whisper {
 		symKeys:      make(map[string][]byte),
 		envelopes:    make(map[common.Hash]*Envelope),
 		expirations:  make(map[uint32]*set.SetNonTS),
+		dropped:      make(map[common.Hash]uint32),
 		peers:        make(map[*Peer]struct{}),
 		messageQueue: make(chan *Envelope, messageQueueLimit),
 		p2pMsgQueue:  make(chan *Envelope, messageQueueLimit),
 		quit:         make(chan struct{}),
+
+		strictVersions: cfg.StrictVersions,
 	}
 
 	whisper.filters = NewFilters(whisper)
@@ -605,6 +613,22 @@ func (wh *Whisper) add(envelope *Envelope) (bool, error) {
 
 	hash := envelope.Hash()
 
+	// the envelopes of the newer versions can not be decrypted, but they
+	// indicate a network upgrade the operator should be aware of, so they
+	// are counted once, like the cached ones, even if dropped
+	unknown := envelope.Ver() > EnvelopeVersion
+	if unknown && wh.strictVersions {
+		wh.poolMu.Lock()
+		_, alreadyDropped := wh.dropped[hash]
+		wh.dropped[hash] = envelope.Expiry
+		wh.poolMu.Unlock()
+
+		if !alreadyDropped {
+			wh.observeUnknownVersion(envelope)
+		}
+		return false, nil // drop envelope without error
+	}
+
 	wh.poolMu.Lock()
 	_, alreadyCached := wh.envelopes[hash]
 	if !alreadyCached {
@@ -622,6 +646,9 @@ func (wh *Whisper) add(envelope *Envelope) (bool, error) {
 		log.Trace("whisper envelope already cached", "hash", envelope.Hash().Hex())
 	} else {
 		log.Trace("cached whisper envelope", "hash", envelope.Hash().Hex())
+		if unknown {
+			wh.observeUnknownVersion(envelope)
+		}
 		wh.statsMu.Lock()
 		wh.stats.memoryUsed += envelope.size()
 		wh.statsMu.Unlock()
@@ -633,11 +660,31 @@ func (wh *Whisper) add(envelope *Envelope) (bool, error) {
 	return true, nil
 }
 
+// observeUnknownVersion counts the envelope of an unknown version, warning
+// about every newer version the first time it is received.
+func (wh *Whisper) observeUnknownVersion(envelope *Envelope) {
+	version := envelope.Ver()
+	wh.statsMu.Lock()
+	wh.stats.unknownVersions++
+	newer := version > wh.stats.highestVersion
+	if newer {
+		wh.stats.highestVersion = version
+	}
+	wh.statsMu.Unlock()
+
+	if newer {
+		log.Warn("received envelope of unknown version, network upgrade?", "version", version, "supported", EnvelopeVersion)
+	} else {
+		log.Debug("received envelope of unknown version", "version", version, "hash", envelope.Hash().Hex())
+	}
+}
+
 // postEvent queues the message for further processing.
 func (w *Whisper) postEvent(envelope *Envelope, isP2P bool) {
 	// if the version of incoming message is higher than
 	// currently supported version, we can not decrypt it,
-	// and therefore just ignore this message
+	// and therefore just ignore this message (it was counted
+	// and relayed, unless dropped in the strict mode)
 	if envelope.Ver() <= EnvelopeVersion {
 		if isP2P {
 			w.p2pMsgQueue <- envelope
@@ -725,6 +772,11 @@ func (w *Whisper) expire() {
 			delete(w.expirations, expiry)
 		}
 	}
+	for hash, expiry := range w.dropped {
+		if expiry < now {
+			delete(w.dropped, hash)
+		}
+	}
 }
 
 // Stats returns the whisper node statistics.
@@ -849,3 +849,39 @@ func TestSymmetricSendKeyMismatch(t *testing.T) {
 		t.Fatalf("received a message when keys weren't matching")
 	}
 }
+
+func TestUnknownEnvelopeVersions(t *testing.T) {
+	InitSingleTest()
+
+	newer := func() *Envelope {
+		now := uint32(time.Now().Unix())
+		return &Envelope{Version: []byte{byte(EnvelopeVersion + 1)}, Expiry: now + DefaultTTL, TTL: DefaultTTL, Data: []byte{1}, EnvNonce: uint64(seed)}
+	}
+
+	w := New(&Config{MaxMessageSize: DefaultMaxMessageSize})
+	env := newer()
+	if cached, err := w.add(env); err != nil || !cached {
+		t.Fatalf("envelope of unknown version not relayed with seed %d: %v.", seed, err)
+	}
+	// the retransmissions of the same envelope are not counted again
+	if _, err := w.add(env); err != nil {
+		t.Fatalf("failed to add duplicate envelope with seed %d: %s.", seed, err)
+	}
+	if stats := w.Stats(); stats.unknownVersions != 1 || stats.highestVersion != EnvelopeVersion+1 {
+		t.Fatalf("envelope of unknown version not counted: %+v.", stats)
+	}
+	if len(w.messageQueue) != 0 {
+		t.Fatalf("envelope of unknown version queued for decryption.")
+	}
+
+	strict := New(&Config{MaxMessageSize: DefaultMaxMessageSize, StrictVersions: true})
+	env = newer()
+	for i := 0; i < 2; i++ {
+		if cached, err := strict.add(env); err != nil || cached {
+			t.Fatalf("envelope of unknown version relayed in strict mode with seed %d: %v.", seed, err)
+		}
+	}
+	if stats := strict.Stats(); stats.unknownVersions != 1 {
+		t.Fatalf("envelope of unknown version not counted in strict mode: %+v.", stats)
+	}
+}
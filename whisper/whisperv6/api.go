@@ -14,12 +14,13 @@
 // You should have received a copy of the GNU Lesser General Public License
 // along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
 
+// +build !whisperlite
+
 package whisperv6
 
 import (
 	"context"
 	"crypto/ecdsa"
-	"errors"
 	"fmt"
 	"sync"
 	"time"
@@ -34,18 +35,31 @@ import (
 
 const (
 	filterTimeout = 300 // filters are considered timeout out after filterTimeout seconds
-)
 
-// List of errors
-var (
-	ErrSymAsym              = errors.New("specify either a symmetric or an asymmetric key")
-	ErrInvalidSymmetricKey  = errors.New("invalid symmetric key")
-	ErrInvalidPublicKey     = errors.New("invalid public key")
-	ErrInvalidSigningPubKey = errors.New("invalid signing public key")
-	ErrTooLowPoW            = errors.New("message rejected, PoW too low")
-	ErrNoTopics             = errors.New("missing topic(s)")
+	notificationQueueLimit = 256 // number of events awaiting the notification of a single subscriber
 )
 
+// AdminNamespace is the RPC namespace of the administrative API, which has to
+// be enabled explicitly, separately from the public "shh" namespace.
+const AdminNamespace = "shhadmin"
+
+// APIs returns the RPC descriptors the Whisper implementation offers
+func (whisper *Whisper) APIs() []rpc.API {
+	return []rpc.API{
+		{
+			Namespace: ProtocolName,
+			Version:   ProtocolVersionStr,
+			Service:   NewPublicWhisperAPI(whisper),
+			Public:    true,
+		},
+		{
+			Namespace: AdminNamespace,
+			Version:   ProtocolVersionStr,
+			Service:   NewPrivateWhisperAPI(whisper),
+		},
+	}
+}
+
 // PublicWhisperAPI provides the whisper RPC service that can be
 // use publicly without security implications.
 type PublicWhisperAPI struct {
@@ -53,6 +67,9 @@ type PublicWhisperAPI struct {
 
 	mu       sync.Mutex
 	lastUsed map[string]time.Time // keeps track when a filter was polled for the last time.
+
+	quotas *clientQuotas // limits of the resources used by each client
+	mux    *filterMux    // shared filters of the subscriptions with identical criteria
 }
 
 // NewPublicWhisperAPI create a new RPC whisper service.
@@ -60,6 +77,8 @@ func NewPublicWhisperAPI(w *Whisper) *PublicWhisperAPI {
 	api := &PublicWhisperAPI{
 		w:        w,
 		lastUsed: make(map[string]time.Time),
+		quotas:   newClientQuotas(w.quotaLimits, w.hasIdentity, w.deleteIdentity),
+		mux:      newFilterMux(w),
 	}
 	return api
 }
@@ -69,14 +88,6 @@ func (api *PublicWhisperAPI) Version(ctx context.Context) string {
 	return ProtocolVersionStr
 }
 
-// Info contains diagnostic information.
-type Info struct {
-	Memory         int     `json:"memory"`         // Memory size of the floating messages in bytes.
-	Messages       int     `json:"messages"`       // Number of floating messages.
-	MinPow         float64 `json:"minPow"`         // Minimal accepted PoW
-	MaxMessageSize uint32  `json:"maxMessageSize"` // Maximum accepted message size
-}
-
 // Info returns diagnostic information about the whisper node.
 func (api *PublicWhisperAPI) Info(ctx context.Context) Info {
 	stats := api.w.Stats()
@@ -85,7 +96,57 @@ func (api *PublicWhisperAPI) Info(ctx context.Context) Info {
 		Messages:       len(api.w.messageQueue) + len(api.w.p2pMsgQueue),
 		MinPow:         api.w.MinPow(),
 		MaxMessageSize: api.w.MaxMessageSize(),
+		HashRate:       stats.hashRate,
+	}
+}
+
+// Capabilities returns the versions, ciphers, limits and features of the node.
+func (api *PublicWhisperAPI) Capabilities(ctx context.Context) *Capabilities {
+	return api.w.Capabilities()
+}
+
+// SelfTest runs the loopback self-test of the node, reporting the outcome of
+// every check.
+func (api *PublicWhisperAPI) SelfTest(ctx context.Context) *SelfTestReport {
+	return api.w.SelfTest(ctx)
+}
+
+// Dashboard returns the time series of the relay statistics over the last
+// minutes, for feeding the operator dashboards.
+func (api *PublicWhisperAPI) Dashboard(ctx context.Context, minutes int) []DashboardSample {
+	return api.w.Dashboard(minutes)
+}
+
+// GetEnvelope returns the public metadata of the pooled envelope with the
+// given hash. The envelope is neither decrypted nor validated otherwise.
+func (api *PublicWhisperAPI) GetEnvelope(ctx context.Context, hash common.Hash) (*EnvelopeInfo, error) {
+	env := api.w.GetEnvelope(hash)
+	if env == nil {
+		return nil, fmt.Errorf("envelope not found: %x", hash)
+	}
+	schema := api.w.schemaOf(env)
+	return &EnvelopeInfo{
+		Hash:     hash,
+		Version:  schema.version,
+		Topic:    env.Topic,
+		Bloom:    env.Bloom(),
+		Size:     env.size(),
+		TTL:      env.TTL,
+		Expiry:   env.Expiry,
+		PoW:      env.PoW(),
+		Nonce:    env.Nonce,
+		AESNonce: schema.salt(env),
+	}, nil
+}
+
+// Propagation returns the number of the distinct peers the envelope posted by
+// this node was forwarded to, giving a rough signal that it left the node.
+func (api *PublicWhisperAPI) Propagation(ctx context.Context, hash common.Hash) (int, error) {
+	peers, ok := api.w.Propagation(hash)
+	if !ok {
+		return 0, fmt.Errorf("envelope not sent by this node: %x", hash)
 	}
+	return peers, nil
 }
 
 // SetMaxMessageSize sets the maximum message size that is accepted.
@@ -117,21 +178,40 @@ func (api *PublicWhisperAPI) MarkTrustedPeer(ctx context.Context, enode string)
 // NewKeyPair generates a new public and private key pair for message decryption and encryption.
 // It returns an ID that can be used to refer to the keypair.
 func (api *PublicWhisperAPI) NewKeyPair(ctx context.Context) (string, error) {
-	return api.w.NewKeyPair()
+	if api.w.WatchOnly() {
+		return "", ErrWatchOnly
+	}
+	return api.addIdentity(ctx, api.w.NewKeyPair)
+}
+
+// addIdentity creates the identity within the quotas of the client, and tracks
+// it as idle until it decrypts the first message.
+func (api *PublicWhisperAPI) addIdentity(ctx context.Context, create func() (string, error)) (string, error) {
+	id, err := api.quotas.addIdentity(ctx, create)
+	if err == nil {
+		api.w.trackIdleIdentity(id)
+	}
+	return id, err
 }
 
 // AddPrivateKey imports the given private key.
 func (api *PublicWhisperAPI) AddPrivateKey(ctx context.Context, privateKey hexutil.Bytes) (string, error) {
+	if api.w.WatchOnly() {
+		return "", ErrWatchOnly
+	}
 	key, err := crypto.ToECDSA(privateKey)
 	if err != nil {
 		return "", err
 	}
-	return api.w.AddKeyPair(key)
+	return api.addIdentity(ctx, func() (string, error) {
+		return api.w.AddKeyPair(key)
+	})
 }
 
 // DeleteKeyPair removes the key with the given key if it exists.
 func (api *PublicWhisperAPI) DeleteKeyPair(ctx context.Context, key string) (bool, error) {
 	if ok := api.w.DeleteKeyPair(key); ok {
+		api.quotas.removeIdentity(ctx, key)
 		return true, nil
 	}
 	return false, fmt.Errorf("key pair %s not found", key)
@@ -166,19 +246,32 @@ func (api *PublicWhisperAPI) GetPrivateKey(ctx context.Context, id string) (hexu
 // It returns an ID that can be used to refer to the key.
 // Can be used encrypting and decrypting messages where the key is known to both parties.
 func (api *PublicWhisperAPI) NewSymKey(ctx context.Context) (string, error) {
-	return api.w.GenerateSymKey()
+	if api.w.WatchOnly() {
+		return "", ErrWatchOnly
+	}
+	return api.addIdentity(ctx, api.w.GenerateSymKey)
 }
 
 // AddSymKey import a symmetric key.
 // It returns an ID that can be used to refer to the key.
 // Can be used encrypting and decrypting messages where the key is known to both parties.
 func (api *PublicWhisperAPI) AddSymKey(ctx context.Context, key hexutil.Bytes) (string, error) {
-	return api.w.AddSymKeyDirect([]byte(key))
+	if api.w.WatchOnly() {
+		return "", ErrWatchOnly
+	}
+	return api.addIdentity(ctx, func() (string, error) {
+		return api.w.AddSymKeyDirect([]byte(key))
+	})
 }
 
 // GenerateSymKeyFromPassword derive a key from the given password, stores it, and returns its ID.
 func (api *PublicWhisperAPI) GenerateSymKeyFromPassword(ctx context.Context, passwd string) (string, error) {
-	return api.w.AddSymKeyFromPassword(passwd)
+	if api.w.WatchOnly() {
+		return "", ErrWatchOnly
+	}
+	return api.addIdentity(ctx, func() (string, error) {
+		return api.w.AddSymKeyFromPassword(passwd)
+	})
 }
 
 // HasSymKey returns an indication if the node has a symmetric key associated with the given key.
@@ -193,7 +286,11 @@ func (api *PublicWhisperAPI) GetSymKey(ctx context.Context, id string) (hexutil.
 
 // DeleteSymKey deletes the symmetric key that is associated with the given id.
 func (api *PublicWhisperAPI) DeleteSymKey(ctx context.Context, id string) bool {
-	return api.w.DeleteSymKey(id)
+	if api.w.DeleteSymKey(id) {
+		api.quotas.removeIdentity(ctx, id)
+		return true
+	}
+	return false
 }
 
 // MakeLightClient turns the node into light client, which does not forward
@@ -209,26 +306,44 @@ func (api *PublicWhisperAPI) CancelLightClient(ctx context.Context) bool {
 	return !api.w.lightClient
 }
 
-//go:generate gencodec -type NewMessage -field-override newMessageOverride -out gen_newmessage_json.go
+// PrivateWhisperAPI provides the administrative whisper RPC service, which
+// must not be exposed publicly since it gives access to all the keys. It is
+// registered under AdminNamespace, so serving the "shh" namespace over HTTP
+// or WS does not expose it.
+type PrivateWhisperAPI struct {
+	w *Whisper
+}
+
+// NewPrivateWhisperAPI creates a new administrative RPC whisper service.
+func NewPrivateWhisperAPI(w *Whisper) *PrivateWhisperAPI {
+	return &PrivateWhisperAPI{w: w}
+}
+
+// ExportKeys returns all the keys and filters of the node in one bundle,
+// encrypted with the given passphrase.
+func (api *PrivateWhisperAPI) ExportKeys(ctx context.Context, passphrase string) (hexutil.Bytes, error) {
+	return api.w.ExportKeys(passphrase)
+}
 
-// NewMessage represents a new whisper message that is posted through the RPC.
-type NewMessage struct {
-	SymKeyID   string    `json:"symKeyID"`
-	PublicKey  []byte    `json:"pubKey"`
-	Sig        string    `json:"sig"`
-	TTL        uint32    `json:"ttl"`
-	Topic      TopicType `json:"topic"`
-	Payload    []byte    `json:"payload"`
-	Padding    []byte    `json:"padding"`
-	PowTime    uint32    `json:"powTime"`
-	PowTarget  float64   `json:"powTarget"`
-	TargetPeer string    `json:"targetPeer"`
+// ImportKeys installs all the keys and filters of the bundle exported by
+// another node, keeping their IDs. Nothing is installed in case of error.
+func (api *PrivateWhisperAPI) ImportKeys(ctx context.Context, bundle hexutil.Bytes, passphrase string) (bool, error) {
+	if api.w.WatchOnly() {
+		return false, ErrWatchOnly
+	}
+	if err := api.w.ImportKeys(bundle, passphrase); err != nil {
+		return false, err
+	}
+	return true, nil
 }
 
-type newMessageOverride struct {
-	PublicKey hexutil.Bytes
-	Payload   hexutil.Bytes
-	Padding   hexutil.Bytes
+// SetPeerGroup tags the peer into the routing group restricting the topics
+// forwarded to it. The empty group reverts the peer to the default group.
+func (api *PrivateWhisperAPI) SetPeerGroup(ctx context.Context, peerID hexutil.Bytes, group string) (bool, error) {
+	if err := api.w.SetPeerGroup(peerID, group); err != nil {
+		return false, err
+	}
+	return true, nil
 }
 
 // Post a message on the Whisper network.
@@ -244,13 +359,22 @@ func (api *PublicWhisperAPI) Post(ctx context.Context, req NewMessage) (bool, er
 		return false, ErrSymAsym
 	}
 
+	if err = api.quotas.allowPost(ctx); err != nil {
+		return false, err
+	}
+
 	params := &MessageParams{
-		TTL:      req.TTL,
-		Payload:  req.Payload,
-		Padding:  req.Padding,
-		WorkTime: req.PowTime,
-		PoW:      req.PowTarget,
-		Topic:    req.Topic,
+		TTL:       req.TTL,
+		Payload:   req.Payload,
+		Padding:   req.Padding,
+		WorkTime:  req.PowTime,
+		PoW:       req.PowTarget,
+		Topic:     req.Topic,
+		Seq:       req.Seq,
+		Redacts:   req.Redacts,
+		NoArchive: req.NoArchive,
+
+		DeterministicPadding: req.DeterministicPadding,
 	}
 
 	// Set key that is used to sign the message
@@ -281,24 +405,36 @@ func (api *PublicWhisperAPI) Post(ctx context.Context, req NewMessage) (bool, er
 		}
 	}
 
+	// bind the peer-to-peer message to the session with the peer, if any
+	var target *discover.Node
+	if len(req.TargetPeer) > 0 {
+		if target, err = discover.ParseNode(req.TargetPeer); err != nil {
+			return false, fmt.Errorf("failed to parse target peer: %s", err)
+		}
+		params.Session = api.w.sessionWith(target.ID[:])
+	}
+
 	// encrypt and sent message
 	whisperMsg, err := NewSentMessage(params)
 	if err != nil {
 		return false, err
 	}
 
-	env, err := whisperMsg.Wrap(params)
+	env, err := whisperMsg.wrap(params)
 	if err != nil {
 		return false, err
 	}
+	// the messages addressed to this node itself are not sealed nor broadcast
+	if target == nil && api.w.Loopback(params) {
+		return true, api.w.SendLocal(env)
+	}
+	if err = api.w.Seal(ctx, env, params, nil); err != nil {
+		return false, err
+	}
 
 	// send to specific node (skip PoW check)
-	if len(req.TargetPeer) > 0 {
-		n, err := discover.ParseNode(req.TargetPeer)
-		if err != nil {
-			return false, fmt.Errorf("failed to parse target peer: %s", err)
-		}
-		return true, api.w.SendP2PMessage(n.ID[:], env)
+	if target != nil {
+		return true, api.w.SendP2PMessage(target.ID[:], env)
 	}
 
 	// ensure that the message PoW meets the node's minimum accepted PoW
@@ -306,28 +442,15 @@ func (api *PublicWhisperAPI) Post(ctx context.Context, req NewMessage) (bool, er
 		return false, ErrTooLowPoW
 	}
 
-	return true, api.w.Send(env)
-}
-
-//go:generate gencodec -type Criteria -field-override criteriaOverride -out gen_criteria_json.go
-
-// Criteria holds various filter options for inbound messages.
-type Criteria struct {
-	SymKeyID     string      `json:"symKeyID"`
-	PrivateKeyID string      `json:"privateKeyID"`
-	Sig          []byte      `json:"sig"`
-	MinPow       float64     `json:"minPow"`
-	Topics       []TopicType `json:"topics"`
-	AllowP2P     bool        `json:"allowP2P"`
-}
-
-type criteriaOverride struct {
-	Sig hexutil.Bytes
+	return true, api.w.SendWithDelivery(ctx, env, req.Delivery)
 }
 
 // Messages set up a subscription that fires events when messages arrive that match
 // the given set of criteria.
 func (api *PublicWhisperAPI) Messages(ctx context.Context, crit Criteria) (*rpc.Subscription, error) {
+	if api.w.WatchOnly() {
+		return nil, ErrWatchOnly
+	}
 	var (
 		symKeyGiven = len(crit.SymKeyID) > 0
 		pubKeyGiven = len(crit.PrivateKeyID) > 0
@@ -346,9 +469,10 @@ func (api *PublicWhisperAPI) Messages(ctx context.Context, crit Criteria) (*rpc.
 	}
 
 	filter := Filter{
-		PoW:      crit.MinPow,
-		Messages: make(map[common.Hash]*ReceivedMessage),
-		AllowP2P: crit.AllowP2P,
+		PoW:         crit.MinPow,
+		Messages:    make(map[common.Hash]*ReceivedMessage),
+		AllowP2P:    crit.AllowP2P,
+		maxMessages: api.quotas.queuedMessages(),
 	}
 
 	if len(crit.Sig) > 0 {
@@ -389,33 +513,62 @@ func (api *PublicWhisperAPI) Messages(ctx context.Context, crit Criteria) (*rpc.
 		}
 	}
 
-	id, err := api.w.Subscribe(&filter)
+	// the subscriptions with identical criteria share one filter, so that
+	// the popular channels are decrypted only once
+	rpcSub := notifier.CreateSubscription()
+	id, err := api.quotas.addFilter(ctx, func() (string, error) {
+		return api.mux.subscribe(&filter, func(messages []*Message) {
+			for _, rpcMessage := range messages {
+				if err := notifier.Notify(rpcSub.ID, rpcMessage); err != nil {
+					log.Error("Failed to send notification", "err", err)
+				}
+			}
+		})
+	}, nil)
 	if err != nil {
 		return nil, err
 	}
 
-	// create subscription and start waiting for message events
+	go func() {
+		select {
+		case <-rpcSub.Err():
+			api.mux.unsubscribe(id)
+			api.quotas.removeFilter(ctx, id)
+		case <-notifier.Closed():
+			api.mux.unsubscribe(id)
+		}
+	}()
+
+	return rpcSub, nil
+}
+
+// PeerEvents creates a subscription that fires events when whisper peers connect,
+// disconnect or are marked trusted.
+func (api *PublicWhisperAPI) PeerEvents(ctx context.Context) (*rpc.Subscription, error) {
+	notifier, supported := rpc.NotifierFromContext(ctx)
+	if !supported {
+		return nil, rpc.ErrNotificationsUnsupported
+	}
+
 	rpcSub := notifier.CreateSubscription()
 	go func() {
-		// for now poll internally, refactor whisper internal for channel support
-		ticker := time.NewTicker(250 * time.Millisecond)
-		defer ticker.Stop()
+		events := make(chan *PeerEvent)
+		sub := api.w.SubscribePeerEvents(events)
+		defer sub.Unsubscribe()
+
+		// the events are sent by the peer admission, which must not wait for the client
+		queue := newNotificationQueue(notifier, rpcSub.ID)
+		defer queue.close()
 
 		for {
 			select {
-			case <-ticker.C:
-				if filter := api.w.GetFilter(id); filter != nil {
-					for _, rpcMessage := range toMessage(filter.Retrieve()) {
-						if err := notifier.Notify(rpcSub.ID, rpcMessage); err != nil {
-							log.Error("Failed to send notification", "err", err)
-						}
-					}
-				}
+			case ev := <-events:
+				queue.push(ev)
+			case <-sub.Err():
+				return
 			case <-rpcSub.Err():
-				api.w.Unsubscribe(id)
 				return
 			case <-notifier.Closed():
-				api.w.Unsubscribe(id)
 				return
 			}
 		}
@@ -424,65 +577,112 @@ func (api *PublicWhisperAPI) Messages(ctx context.Context, crit Criteria) (*rpc.
 	return rpcSub, nil
 }
 
-//go:generate gencodec -type Message -field-override messageOverride -out gen_message_json.go
-
-// Message is the RPC representation of a whisper message.
-type Message struct {
-	Sig       []byte    `json:"sig,omitempty"`
-	TTL       uint32    `json:"ttl"`
-	Timestamp uint32    `json:"timestamp"`
-	Topic     TopicType `json:"topic"`
-	Payload   []byte    `json:"payload"`
-	Padding   []byte    `json:"padding"`
-	PoW       float64   `json:"pow"`
-	Hash      []byte    `json:"hash"`
-	Dst       []byte    `json:"recipientPublicKey,omitempty"`
-}
-
-type messageOverride struct {
-	Sig     hexutil.Bytes
-	Payload hexutil.Bytes
-	Padding hexutil.Bytes
-	Hash    hexutil.Bytes
-	Dst     hexutil.Bytes
-}
-
-// ToWhisperMessage converts an internal message into an API version.
-func ToWhisperMessage(message *ReceivedMessage) *Message {
-	msg := Message{
-		Payload:   message.Payload,
-		Padding:   message.Padding,
-		Timestamp: message.Sent,
-		TTL:       message.TTL,
-		PoW:       message.PoW,
-		Hash:      message.EnvelopeHash.Bytes(),
-		Topic:     message.Topic,
-	}
-
-	if message.Dst != nil {
-		b := crypto.FromECDSAPub(message.Dst)
-		if b != nil {
-			msg.Dst = b
-		}
+// PropagationEvents creates a subscription that fires events when the envelopes
+// posted by this node are forwarded to another distinct peer.
+func (api *PublicWhisperAPI) PropagationEvents(ctx context.Context) (*rpc.Subscription, error) {
+	notifier, supported := rpc.NotifierFromContext(ctx)
+	if !supported {
+		return nil, rpc.ErrNotificationsUnsupported
 	}
 
-	if isMessageSigned(message.Raw[0]) {
-		b := crypto.FromECDSAPub(message.SigToPubKey())
-		if b != nil {
-			msg.Sig = b
+	rpcSub := notifier.CreateSubscription()
+	go func() {
+		events := make(chan *PropagationEvent)
+		sub := api.w.SubscribePropagation(events)
+		defer sub.Unsubscribe()
+
+		// the events are sent by the broadcast, which must not wait for the client
+		queue := newNotificationQueue(notifier, rpcSub.ID)
+		defer queue.close()
+
+		for {
+			select {
+			case ev := <-events:
+				queue.push(ev)
+			case <-sub.Err():
+				return
+			case <-rpcSub.Err():
+				return
+			case <-notifier.Closed():
+				return
+			}
 		}
-	}
+	}()
+
+	return rpcSub, nil
+}
 
-	return &msg
+// GapRecoveryRequest is the request to recover the missed messages of the
+// channel of the sender from a mail server.
+type GapRecoveryRequest struct {
+	FilterID   string        `json:"filterID"`   // filter receiving the recovered messages
+	Sender     hexutil.Bytes `json:"sender"`     // public key of the sender
+	Topic      TopicType     `json:"topic"`      // topic of the channel
+	From       uint64        `json:"from"`       // first missed sequence number
+	To         uint64        `json:"to"`         // last missed sequence number
+	MailServer string        `json:"mailServer"` // enode of the mail server
+	SymKeyID   string        `json:"symKeyID"`   // symmetric key of the mail server
+	Sig        string        `json:"sig"`        // identity signing the request
+	PowTime    uint32        `json:"powTime"`
+	PowTarget  float64       `json:"powTarget"`
+}
+
+// RecoverGap requests the missed messages from the mail server, delivering the
+// recovered ones to the filter, and reports which remain unrecoverable.
+func (api *PublicWhisperAPI) RecoverGap(ctx context.Context, req GapRecoveryRequest) (*GapRecovery, error) {
+	n, err := discover.ParseNode(req.MailServer)
+	if err != nil {
+		return nil, err
+	}
+	params := &MailRequestParams{
+		Peer:     n.ID[:],
+		PoW:      req.PowTarget,
+		WorkTime: req.PowTime,
+	}
+	if params.KeySym, err = api.w.GetSymKey(req.SymKeyID); err != nil {
+		return nil, err
+	}
+	if params.Src, err = api.w.GetPrivateKey(req.Sig); err != nil {
+		return nil, err
+	}
+	gap := &GapEvent{Sender: req.Sender, Topic: req.Topic, From: req.From, To: req.To}
+	return api.w.RecoverGap(ctx, req.FilterID, gap, params)
 }
 
-// toMessage converts a set of messages to its RPC representation.
-func toMessage(messages []*ReceivedMessage) []*Message {
-	msgs := make([]*Message, len(messages))
-	for i, msg := range messages {
-		msgs[i] = ToWhisperMessage(msg)
+// GapEvents creates a subscription that fires events when gaps are detected in
+// the sequence numbers of the received messages, so that the missed messages
+// can be requested from a mail server.
+func (api *PublicWhisperAPI) GapEvents(ctx context.Context) (*rpc.Subscription, error) {
+	notifier, supported := rpc.NotifierFromContext(ctx)
+	if !supported {
+		return nil, rpc.ErrNotificationsUnsupported
 	}
-	return msgs
+
+	rpcSub := notifier.CreateSubscription()
+	go func() {
+		events := make(chan *GapEvent)
+		sub := api.w.SubscribeGapEvents(events)
+		defer sub.Unsubscribe()
+
+		// the gaps are detected by the delivery, which must not wait for the client
+		queue := newNotificationQueue(notifier, rpcSub.ID)
+		defer queue.close()
+
+		for {
+			select {
+			case ev := <-events:
+				queue.push(ev)
+			case <-sub.Err():
+				return
+			case <-rpcSub.Err():
+				return
+			case <-notifier.Closed():
+				return
+			}
+		}
+	}()
+
+	return rpcSub, nil
 }
 
 // GetFilterMessages returns the messages that match the filter criteria and
@@ -506,18 +706,34 @@ func (api *PublicWhisperAPI) GetFilterMessages(id string) ([]*Message, error) {
 	return messages, nil
 }
 
+// deleteFilter deletes the polled filter of the disconnected client.
+func (api *PublicWhisperAPI) deleteFilter(id string) {
+	api.mu.Lock()
+	defer api.mu.Unlock()
+
+	delete(api.lastUsed, id)
+	api.w.Unsubscribe(id)
+}
+
 // DeleteMessageFilter deletes a filter.
-func (api *PublicWhisperAPI) DeleteMessageFilter(id string) (bool, error) {
+func (api *PublicWhisperAPI) DeleteMessageFilter(ctx context.Context, id string) (bool, error) {
 	api.mu.Lock()
 	defer api.mu.Unlock()
 
 	delete(api.lastUsed, id)
-	return true, api.w.Unsubscribe(id)
+	if err := api.w.Unsubscribe(id); err != nil {
+		return false, err
+	}
+	api.quotas.removeFilter(ctx, id)
+	return true, nil
 }
 
 // NewMessageFilter creates a new filter that can be used to poll for
 // (new) messages that satisfy the given criteria.
-func (api *PublicWhisperAPI) NewMessageFilter(req Criteria) (string, error) {
+func (api *PublicWhisperAPI) NewMessageFilter(ctx context.Context, req Criteria) (string, error) {
+	if api.w.WatchOnly() {
+		return "", ErrWatchOnly
+	}
 	var (
 		src     *ecdsa.PublicKey
 		keySym  []byte
@@ -573,9 +789,15 @@ func (api *PublicWhisperAPI) NewMessageFilter(req Criteria) (string, error) {
 		AllowP2P: req.AllowP2P,
 		Topics:   topics,
 		Messages: make(map[common.Hash]*ReceivedMessage),
+
+		Priorities: req.Priorities,
+
+		maxMessages: api.quotas.queuedMessages(),
 	}
 
-	id, err := api.w.Subscribe(f)
+	id, err := api.quotas.addFilter(ctx, func() (string, error) {
+		return api.w.Subscribe(f)
+	}, api.deleteFilter)
 	if err != nil {
 		return "", err
 	}
@@ -586,3 +808,44 @@ func (api *PublicWhisperAPI) NewMessageFilter(req Criteria) (string, error) {
 
 	return id, nil
 }
+
+// notificationQueue notifies an RPC subscriber of the events from its own
+// goroutine, so that a slow subscriber never blocks the sender of the events.
+// The events not fitting into the queue are dropped.
+type notificationQueue struct {
+	notifier *rpc.Notifier
+	id       rpc.ID
+	queue    chan interface{}
+}
+
+func newNotificationQueue(notifier *rpc.Notifier, id rpc.ID) *notificationQueue {
+	q := &notificationQueue{
+		notifier: notifier,
+		id:       id,
+		queue:    make(chan interface{}, notificationQueueLimit),
+	}
+	go q.loop()
+	return q
+}
+
+// push queues the event for the notification, dropping it if the queue is full.
+func (q *notificationQueue) push(ev interface{}) {
+	select {
+	case q.queue <- ev:
+	default:
+		log.Debug("Notification queue overflow, event dropped", "id", q.id)
+	}
+}
+
+// close stops the notifications once the queued events are sent.
+func (q *notificationQueue) close() {
+	close(q.queue)
+}
+
+func (q *notificationQueue) loop() {
+	for ev := range q.queue {
+		if err := q.notifier.Notify(q.id, ev); err != nil {
+			log.Error("Failed to send notification", "err", err)
+		}
+	}
+}
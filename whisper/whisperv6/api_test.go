@@ -14,16 +14,21 @@
 // You should have received a copy of the GNU Lesser General Public License
 // along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
 
+// +build !whisperlite
+
 package whisperv6
 
 import (
 	"bytes"
+	"context"
 	"crypto/ecdsa"
+	"reflect"
 	"testing"
 	"time"
 
 	"github.com/ethereum/go-ethereum/common"
-	set "gopkg.in/fatih/set.v0"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/crypto"
 )
 
 func TestMultipleTopicCopyInNewMessageFilter(t *testing.T) {
@@ -31,7 +36,7 @@ func TestMultipleTopicCopyInNewMessageFilter(t *testing.T) {
 		privateKeys:   make(map[string]*ecdsa.PrivateKey),
 		symKeys:       make(map[string][]byte),
 		envelopes:     make(map[common.Hash]*Envelope),
-		expirations:   make(map[uint32]*set.SetNonTS),
+		buckets:       make(map[uint32]*envelopeBucket),
 		peers:         make(map[*Peer]struct{}),
 		messageQueue:  make(chan *Envelope, messageQueueLimit),
 		p2pMsgQueue:   make(chan *Envelope, messageQueueLimit),
@@ -57,7 +62,7 @@ func TestMultipleTopicCopyInNewMessageFilter(t *testing.T) {
 		Topics:   []TopicType{TopicType(t1), TopicType(t2)},
 	}
 
-	_, err = api.NewMessageFilter(crit)
+	_, err = api.NewMessageFilter(context.Background(), crit)
 	if err != nil {
 		t.Fatalf("Error creating the filter: %v", err)
 	}
@@ -76,3 +81,200 @@ func TestMultipleTopicCopyInNewMessageFilter(t *testing.T) {
 		t.Fatalf("Could not find filter with both topics")
 	}
 }
+
+func TestGetEnvelope(t *testing.T) {
+	InitSingleTest()
+
+	w := New(&DefaultConfig)
+	w.SetMinimumPowTest(0.0000001)
+	defer w.SetMinimumPowTest(DefaultMinimumPoW)
+	api := NewPublicWhisperAPI(w)
+
+	now := uint32(time.Now().Unix())
+	env := &Envelope{Expiry: now + DefaultTTL, TTL: DefaultTTL, Topic: TopicType{1, 2, 3, 4}, Data: []byte{1}, Nonce: uint64(seed)}
+	if _, err := w.add(env, false); err != nil {
+		t.Fatalf("failed to add envelope with seed %d: %s.", seed, err)
+	}
+
+	info, err := api.GetEnvelope(context.Background(), env.Hash())
+	if err != nil {
+		t.Fatalf("failed to get envelope with seed %d: %s.", seed, err)
+	}
+	if info.Topic != env.Topic || info.TTL != env.TTL || info.Size != env.size() || info.PoW != env.PoW() || info.Version != ProtocolVersion {
+		t.Fatalf("wrong envelope info with seed %d: %+v.", seed, info)
+	}
+	if len(info.AESNonce) != 0 {
+		t.Fatalf("salt reported for the envelope too short to carry it: %x.", info.AESNonce)
+	}
+	if _, err = api.GetEnvelope(context.Background(), common.Hash{}); err == nil {
+		t.Fatalf("unknown envelope found.")
+	}
+
+	// the salt of the symmetric encryption trails the data
+	params, err := generateMessageParams()
+	if err != nil {
+		t.Fatalf("failed generateMessageParams with seed %d: %s.", seed, err)
+	}
+	msg, err := NewSentMessage(params)
+	if err != nil {
+		t.Fatalf("failed to create new message with seed %d: %s.", seed, err)
+	}
+	if env, err = msg.Wrap(params); err != nil {
+		t.Fatalf("failed Wrap with seed %d: %s.", seed, err)
+	}
+	if _, err = w.add(env, false); err != nil {
+		t.Fatalf("failed to add envelope with seed %d: %s.", seed, err)
+	}
+	if info, err = api.GetEnvelope(context.Background(), env.Hash()); err != nil {
+		t.Fatalf("failed to get envelope with seed %d: %s.", seed, err)
+	}
+	if !bytes.Equal(info.AESNonce, env.Data[len(env.Data)-aesNonceLength:]) {
+		t.Fatalf("wrong salt with seed %d: %x.", seed, info.AESNonce)
+	}
+}
+
+func TestWatchOnly(t *testing.T) {
+	cfg := DefaultConfig
+	cfg.WatchOnly = true
+	w := New(&cfg)
+	api := NewPublicWhisperAPI(w)
+	ctx := context.Background()
+
+	if _, err := api.NewKeyPair(ctx); err != ErrWatchOnly {
+		t.Fatalf("key pair generated on a watch-only node: %v.", err)
+	}
+	if _, err := api.AddPrivateKey(ctx, hexutil.Bytes(make([]byte, 32))); err != ErrWatchOnly {
+		t.Fatalf("private key imported on a watch-only node: %v.", err)
+	}
+	if _, err := api.NewSymKey(ctx); err != ErrWatchOnly {
+		t.Fatalf("symmetric key generated on a watch-only node: %v.", err)
+	}
+	if _, err := api.AddSymKey(ctx, hexutil.Bytes(make([]byte, aesKeyLength))); err != ErrWatchOnly {
+		t.Fatalf("symmetric key imported on a watch-only node: %v.", err)
+	}
+	if _, err := api.GenerateSymKeyFromPassword(ctx, "secret"); err != ErrWatchOnly {
+		t.Fatalf("symmetric key derived on a watch-only node: %v.", err)
+	}
+	if _, err := api.NewMessageFilter(ctx, Criteria{SymKeyID: "id"}); err != ErrWatchOnly {
+		t.Fatalf("filter installed on a watch-only node: %v.", err)
+	}
+	if _, err := api.Messages(ctx, Criteria{SymKeyID: "id"}); err != ErrWatchOnly {
+		t.Fatalf("subscription created on a watch-only node: %v.", err)
+	}
+
+	// the relaying is not affected
+	w.SetMinimumPowTest(0.0000001)
+	env := &Envelope{Expiry: uint32(time.Now().Unix()) + 10, TTL: 10, Data: []byte{1}}
+	if _, err := w.add(env, false); err != nil {
+		t.Fatalf("envelope rejected by a watch-only node: %s.", err)
+	}
+}
+
+func TestLocalLoopback(t *testing.T) {
+	cfg := DefaultConfig
+	cfg.LocalLoopback = true
+	w := New(&cfg)
+	w.Start(nil)
+	defer w.Stop()
+	api := NewPublicWhisperAPI(w)
+
+	id, err := w.NewKeyPair()
+	if err != nil {
+		t.Fatalf("failed to generate key pair: %s.", err)
+	}
+	key, _ := w.GetPrivateKey(id)
+	filter := &Filter{KeyAsym: key}
+	if _, err = w.Subscribe(filter); err != nil {
+		t.Fatalf("failed to subscribe: %s.", err)
+	}
+
+	// the PoW target could not be reached if the message was sealed
+	req := NewMessage{PublicKey: crypto.FromECDSAPub(&key.PublicKey), Payload: []byte{1}, PowTarget: 100, PowTime: 60}
+	start := time.Now()
+	if _, err = api.Post(context.Background(), req); err != nil {
+		t.Fatalf("failed to post: %s.", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("message addressed to self sealed: took %v.", elapsed)
+	}
+	var received []*ReceivedMessage
+	for i := 0; i < 10 && len(received) == 0; i++ {
+		time.Sleep(50 * time.Millisecond)
+		received = filter.Retrieve()
+	}
+	if len(received) != 1 || !bytes.Equal(received[0].Payload, req.Payload) {
+		t.Fatalf("message addressed to self not delivered: %d messages.", len(received))
+	}
+	if n := len(w.Envelopes()); n != 0 {
+		t.Fatalf("message addressed to self added to the pool: %d envelopes.", n)
+	}
+
+	other, _ := crypto.GenerateKey()
+	if w.Loopback(&MessageParams{Dst: &other.PublicKey}) {
+		t.Fatalf("message addressed to a remote identity delivered locally.")
+	}
+}
+
+func TestLocalBus(t *testing.T) {
+	cfg := DefaultConfig
+	cfg.LocalBus = true
+	w := New(&cfg)
+	w.Start(nil)
+	defer w.Stop()
+	api := NewPublicWhisperAPI(w)
+
+	if len(w.Protocols()) != 0 {
+		t.Fatalf("local bus runs the whisper protocol.")
+	}
+	if caps := w.Capabilities(); !caps.LocalBus || caps.MinPoW != 0 || caps.P2PDirect {
+		t.Fatalf("wrong local bus features: %+v.", caps)
+	}
+
+	keyID, err := w.GenerateSymKey()
+	if err != nil {
+		t.Fatalf("failed to generate symmetric key: %s.", err)
+	}
+	key, _ := w.GetSymKey(keyID)
+	topic := TopicType{1, 2, 3, 4}
+	filter := &Filter{KeySym: key, Topics: [][]byte{topic[:]}}
+	if _, err = w.Subscribe(filter); err != nil {
+		t.Fatalf("failed to subscribe: %s.", err)
+	}
+
+	// the PoW target could not be reached if the message was sealed
+	start := time.Now()
+	req := NewMessage{SymKeyID: keyID, Topic: topic, Payload: []byte{1}, PowTarget: 100, PowTime: 60}
+	if _, err = api.Post(context.Background(), req); err != nil {
+		t.Fatalf("failed to post: %s.", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("message sealed on the local bus: took %v.", elapsed)
+	}
+	var received []*ReceivedMessage
+	for i := 0; i < 10 && len(received) == 0; i++ {
+		time.Sleep(50 * time.Millisecond)
+		received = filter.Retrieve()
+	}
+	if len(received) != 1 || !bytes.Equal(received[0].Payload, req.Payload) {
+		t.Fatalf("message not delivered on the local bus: %d messages.", len(received))
+	}
+}
+
+func TestAdminNamespace(t *testing.T) {
+	w := New(&DefaultConfig)
+
+	// the key export must not be reachable through the public namespace
+	admin := map[string]bool{"ExportKeys": true, "ImportKeys": true, "SetPeerGroup": true}
+	for _, api := range w.APIs() {
+		typ := reflect.TypeOf(api.Service)
+		for i := 0; i < typ.NumMethod(); i++ {
+			name := typ.Method(i).Name
+			if admin[name] && api.Namespace != AdminNamespace {
+				t.Fatalf("administrative method %s exposed in namespace %q.", name, api.Namespace)
+			}
+		}
+		if api.Namespace == AdminNamespace && api.Public {
+			t.Fatalf("administrative API marked public.")
+		}
+	}
+}
@@ -0,0 +1,77 @@
+// Copyright 2017 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+// Contains the envelope flags of the extended envelope format. The flags are
+// appended to the envelope as an optional trailing RLP element, so that the
+// envelopes without flags encode exactly as before. The nodes advertise the
+// flags they understand in the handshake, and the flagged envelopes are only
+// forwarded to the peers which understand all of their flags, since the older
+// nodes would reject them as malformed. The flags are covered by the PoW, so
+// they can not be stripped on the way without invalidating the envelope.
+
+package whisperv6
+
+import "fmt"
+
+const (
+	// EnvelopeNoArchive requests the mail servers not to archive the envelope,
+	// for the ephemeral traffic which should never be retrievable later.
+	EnvelopeNoArchive = uint64(1)
+
+	// EnvelopeSequenced marks the envelopes carrying the messages with the
+	// sequence number preceding the payload, which the older nodes would take
+	// for a part of the payload.
+	EnvelopeSequenced = uint64(2)
+
+	// EnvelopeTombstone marks the envelopes carrying the tombstones, with the
+	// hash of the redacted envelope preceding the payload.
+	EnvelopeTombstone = uint64(4)
+
+	// EnvelopeSession marks the envelopes carrying the messages bound to a
+	// session, with the transcript of the session preceding the payload.
+	EnvelopeSession = uint64(8)
+
+	// envelopeFlagsSupported is the mask of the envelope flags understood by
+	// this node, advertised to the peers in the handshake.
+	envelopeFlagsSupported = EnvelopeNoArchive | EnvelopeSequenced | EnvelopeTombstone | EnvelopeSession
+)
+
+// flags returns the bitmask of the envelope flags.
+func (e *Envelope) flags() uint64 {
+	if len(e.Flags) == 0 {
+		return 0
+	}
+	return e.Flags[0]
+}
+
+// NoArchive checks if the envelope requests not to be archived.
+func (e *Envelope) NoArchive() bool {
+	return e.flags()&EnvelopeNoArchive != 0
+}
+
+// validFlags checks that the flags are encoded canonically: at most a single
+// non-zero bitmask, the envelopes without flags omitting it altogether.
+func (e *Envelope) validFlags() error {
+	if len(e.Flags) > 1 || (len(e.Flags) == 1 && e.Flags[0] == 0) {
+		return fmt.Errorf("non-canonical envelope flags %v", e.Flags)
+	}
+	return nil
+}
+
+// understands checks if the peer understands all the flags of the envelope.
+func (peer *Peer) understands(envelope *Envelope) bool {
+	return envelope.flags()&^peer.envelopeFlags == 0
+}
@@ -0,0 +1,234 @@
+// Copyright 2017 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package whisperv6
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/rlp"
+)
+
+func TestEnvelopeFlags(t *testing.T) {
+	InitSingleTest()
+
+	params, err := generateMessageParams()
+	if err != nil {
+		t.Fatalf("failed generateMessageParams with seed %d: %s.", seed, err)
+	}
+	params.PoW = 0.0000001
+	msg, err := NewSentMessage(params)
+	if err != nil {
+		t.Fatalf("failed to create new message with seed %d: %s.", seed, err)
+	}
+	plain, err := msg.Wrap(params)
+	if err != nil {
+		t.Fatalf("failed Wrap with seed %d: %s.", seed, err)
+	}
+	if plain.NoArchive() || len(plain.Flags) != 0 {
+		t.Fatalf("envelope flagged without the request, seed: %d.", seed)
+	}
+
+	// the envelopes without flags must encode exactly as before
+	legacy, _ := rlp.EncodeToBytes([]interface{}{plain.Expiry, plain.TTL, plain.Topic, plain.Data, plain.Nonce})
+	if encoded, _ := rlp.EncodeToBytes(plain); !bytes.Equal(encoded, legacy) {
+		t.Fatalf("envelope without flags encoded differently, seed: %d.", seed)
+	}
+
+	params.NoArchive = true
+	if msg, err = NewSentMessage(params); err != nil {
+		t.Fatalf("failed to create new message with seed %d: %s.", seed, err)
+	}
+	flagged, err := msg.Wrap(params)
+	if err != nil {
+		t.Fatalf("failed Wrap with seed %d: %s.", seed, err)
+	}
+	encoded, _ := rlp.EncodeToBytes(flagged)
+	var decoded Envelope
+	if err = rlp.DecodeBytes(encoded, &decoded); err != nil {
+		t.Fatalf("failed to decode flagged envelope with seed %d: %s.", seed, err)
+	}
+	if !decoded.NoArchive() || decoded.Hash() != flagged.Hash() {
+		t.Fatalf("flags lost in transit, seed: %d.", seed)
+	}
+
+	// stripping the flags invalidates the PoW
+	stripped := decoded
+	stripped.Flags, stripped.pow, stripped.hash = nil, 0, [32]byte{}
+	if bytes.Equal(stripped.rlpWithoutNonce(), decoded.rlpWithoutNonce()) {
+		t.Fatalf("flags not covered by the PoW, seed: %d.", seed)
+	}
+
+	schema := envelopeSchemas[ProtocolVersion]
+	for _, flags := range [][]uint64{{0}, {EnvelopeNoArchive, 0}} {
+		decoded.Flags = flags
+		if err = schema.validate(&decoded); err == nil {
+			t.Fatalf("non-canonical flags %v accepted.", flags)
+		}
+	}
+
+	legacyPeer := newPeer(nil, nil, nil)
+	if legacyPeer.understands(flagged) || !legacyPeer.understands(plain) {
+		t.Fatalf("flagged envelope forwarded to the peer without the extended format.")
+	}
+	legacyPeer.envelopeFlags = envelopeFlagsSupported
+	if !legacyPeer.understands(flagged) {
+		t.Fatalf("flagged envelope not forwarded to the peer understanding it.")
+	}
+}
+
+func TestSequencedEnvelopeFlag(t *testing.T) {
+	InitSingleTest()
+
+	params, err := generateMessageParams()
+	if err != nil {
+		t.Fatalf("failed generateMessageParams with seed %d: %s.", seed, err)
+	}
+	params.PoW = 0.00001
+	params.Seq = 1
+	msg, err := NewSentMessage(params)
+	if err != nil {
+		t.Fatalf("failed to create new message with seed %d: %s.", seed, err)
+	}
+	env, err := msg.Wrap(params)
+	if err != nil {
+		t.Fatalf("failed Wrap with seed %d: %s.", seed, err)
+	}
+	if env.flags() != EnvelopeSequenced {
+		t.Fatalf("sequenced envelope not flagged: %v.", env.Flags)
+	}
+
+	// the peers advertising only the archive flag are not aware of the sequence numbers
+	peer := newPeer(nil, nil, nil)
+	peer.envelopeFlags = EnvelopeNoArchive
+	if peer.understands(env) {
+		t.Fatalf("sequenced envelope forwarded to the peer unaware of the sequence numbers.")
+	}
+
+	w := New(&DefaultConfig)
+	batch, err := w.NewBatchEnvelope([]*MessageParams{params}, &MessageParams{TTL: DefaultTTL, PoW: 0.00001, WorkTime: 1})
+	if err != nil {
+		t.Fatalf("failed to create batch envelope with seed %d: %s.", seed, err)
+	}
+	if batch.flags() != EnvelopeSequenced {
+		t.Fatalf("batch of the sequenced messages not flagged: %v.", batch.Flags)
+	}
+}
+
+func TestBatchEnvelopeNoArchive(t *testing.T) {
+	InitSingleTest()
+
+	params, err := generateMessageParams()
+	if err != nil {
+		t.Fatalf("failed generateMessageParams with seed %d: %s.", seed, err)
+	}
+	w := New(&DefaultConfig)
+	options := &MessageParams{TTL: DefaultTTL, PoW: 0.00001, WorkTime: 1}
+	batch, err := w.NewBatchEnvelope([]*MessageParams{params}, options)
+	if err != nil {
+		t.Fatalf("failed to create batch envelope with seed %d: %s.", seed, err)
+	}
+	if batch.NoArchive() || len(batch.Flags) != 0 {
+		t.Fatalf("batch flagged without the request: %v.", batch.Flags)
+	}
+
+	// the request of a contained message is carried by the batch
+	params.NoArchive = true
+	if batch, err = w.NewBatchEnvelope([]*MessageParams{params}, options); err != nil {
+		t.Fatalf("failed to create batch envelope with seed %d: %s.", seed, err)
+	}
+	if !batch.NoArchive() {
+		t.Fatalf("batch of the ephemeral message not flagged: %v.", batch.Flags)
+	}
+
+	// and so is the request of the batch itself
+	params.NoArchive = false
+	options.NoArchive = true
+	if batch, err = w.NewBatchEnvelope([]*MessageParams{params}, options); err != nil {
+		t.Fatalf("failed to create batch envelope with seed %d: %s.", seed, err)
+	}
+	if !batch.NoArchive() {
+		t.Fatalf("batch requested ephemeral not flagged: %v.", batch.Flags)
+	}
+}
+
+func TestTombstoneEnvelopeFlag(t *testing.T) {
+	InitSingleTest()
+
+	params, err := generateMessageParams()
+	if err != nil {
+		t.Fatalf("failed generateMessageParams with seed %d: %s.", seed, err)
+	}
+	params.PoW = 0.00001
+	params.Redacts = common.Hash{1}
+	msg, err := NewSentMessage(params)
+	if err != nil {
+		t.Fatalf("failed to create new message with seed %d: %s.", seed, err)
+	}
+	env, err := msg.Wrap(params)
+	if err != nil {
+		t.Fatalf("failed Wrap with seed %d: %s.", seed, err)
+	}
+	if env.flags() != EnvelopeTombstone {
+		t.Fatalf("tombstone envelope not flagged: %v.", env.Flags)
+	}
+
+	// the peers unaware of the tombstones would deliver the redacted hash as the payload
+	peer := newPeer(nil, nil, nil)
+	peer.envelopeFlags = EnvelopeNoArchive | EnvelopeSequenced
+	if peer.understands(env) {
+		t.Fatalf("tombstone envelope forwarded to the peer unaware of the tombstones.")
+	}
+	peer.envelopeFlags = envelopeFlagsSupported
+	if !peer.understands(env) {
+		t.Fatalf("tombstone envelope not forwarded to the peer aware of the tombstones.")
+	}
+}
+
+func TestSessionEnvelopeFlag(t *testing.T) {
+	InitSingleTest()
+
+	params, err := generateMessageParams()
+	if err != nil {
+		t.Fatalf("failed generateMessageParams with seed %d: %s.", seed, err)
+	}
+	params.PoW = 0.00001
+	params.Session = common.Hash{1}
+	msg, err := NewSentMessage(params)
+	if err != nil {
+		t.Fatalf("failed to create new message with seed %d: %s.", seed, err)
+	}
+	env, err := msg.Wrap(params)
+	if err != nil {
+		t.Fatalf("failed Wrap with seed %d: %s.", seed, err)
+	}
+	if env.flags() != EnvelopeSession {
+		t.Fatalf("session envelope not flagged: %v.", env.Flags)
+	}
+
+	// the peers unaware of the sessions would deliver the transcript as the payload
+	peer := newPeer(nil, nil, nil)
+	peer.envelopeFlags = EnvelopeNoArchive | EnvelopeSequenced | EnvelopeTombstone
+	if peer.understands(env) {
+		t.Fatalf("session envelope forwarded to the peer unaware of the sessions.")
+	}
+	peer.envelopeFlags = envelopeFlagsSupported
+	if !peer.understands(env) {
+		t.Fatalf("session envelope not forwarded to the peer aware of the sessions.")
+	}
+}
@@ -0,0 +1,131 @@
+// Copyright 2017 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+// Contains the batch envelopes, carrying several messages (each with its own
+// topic and key) sealed with a single proof of work.
+
+package whisperv6
+
+import (
+	"context"
+	"errors"
+
+	"github.com/ethereum/go-ethereum/rlp"
+)
+
+// BatchTopic is the topic of the envelopes carrying a batch of messages. The
+// nodes accepting the batches (see Config.AcceptBatches) add it to the bloom
+// filter along with the topics of their filters.
+var BatchTopic = TopicType{0xba, 0x7c, 0x4e, 0xd0}
+
+// batchItem is a single encrypted message inside a batch envelope.
+type batchItem struct {
+	Topic TopicType
+	Data  []byte
+}
+
+// NewBatchEnvelope signs and encrypts each of the messages as Wrap does, and
+// bundles them into a single envelope sealed by the node according to the
+// options (only TTL, WorkTime, PoW and NoArchive of the options are used). This
+// amortizes the proof of work for the senders publishing many small messages
+// at once.
+//
+// All the topics must pass the outbound topic firewall, and must be routed to
+// the same peer groups, since a batch is forwarded only to the groups permitted
+// all of its topics.
+func (whisper *Whisper) NewBatchEnvelope(messages []*MessageParams, options *MessageParams) (*Envelope, error) {
+	if len(messages) == 0 {
+		return nil, errors.New("empty batch")
+	}
+	topics := make([]TopicType, len(messages))
+	for i, params := range messages {
+		if params.Topic == BatchTopic {
+			return nil, errors.New("batch topic not allowed inside a batch")
+		}
+		if !whisper.mayOriginate(params.Topic) {
+			return nil, ErrTopicNotAllowed
+		}
+		topics[i] = params.Topic
+	}
+	if !whisper.routing.consistent(topics) {
+		return nil, errors.New("batch topics routed to different peer groups")
+	}
+
+	items := make([]batchItem, len(messages))
+	var flags uint64
+	if options.NoArchive {
+		flags |= EnvelopeNoArchive
+	}
+	for i, params := range messages {
+		msg, err := NewSentMessage(params)
+		if err != nil {
+			return nil, err
+		}
+		inner, err := msg.wrap(params)
+		if err != nil {
+			return nil, err
+		}
+		items[i] = batchItem{Topic: inner.Topic, Data: inner.Data}
+		flags |= inner.flags()
+	}
+	payload, err := rlp.EncodeToBytes(items)
+	if err != nil {
+		return nil, err
+	}
+
+	ttl := options.TTL
+	if ttl == 0 {
+		ttl = DefaultTTL
+	}
+	env := NewEnvelope(ttl, BatchTopic, &sentMessage{Raw: payload})
+	if flags != 0 {
+		// the flags of the contained messages are lost, so the batch carries them
+		env.Flags = []uint64{flags}
+	}
+	if err = whisper.Seal(context.Background(), env, options, nil); err != nil {
+		return nil, err
+	}
+	return env, nil
+}
+
+// unbatch splits the batch envelope into the envelopes of the contained
+// messages, sharing the expiry, nonce and proof of work of the batch, as well
+// as the schema and the session it was received in.
+func (e *Envelope) unbatch() ([]*Envelope, error) {
+	var items []batchItem
+	if err := rlp.DecodeBytes(e.Data, &items); err != nil {
+		return nil, err
+	}
+	pow := e.PoW()
+	envelopes := make([]*Envelope, 0, len(items))
+	for _, item := range items {
+		if item.Topic == BatchTopic {
+			continue // nested batches are not supported
+		}
+		envelopes = append(envelopes, &Envelope{
+			Expiry: e.Expiry,
+			TTL:    e.TTL,
+			Topic:  item.Topic,
+			Data:   item.Data,
+			Nonce:  e.Nonce,
+			pow:    pow,
+
+			session: e.session,
+			schema:  e.schema,
+		})
+	}
+	return envelopes, nil
+}
@@ -18,9 +18,11 @@ package whisperv6
 
 import (
 	"crypto/sha256"
+	mrand "math/rand"
 	"testing"
 
 	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/rlp"
 	"golang.org/x/crypto/pbkdf2"
 )
 
@@ -206,3 +208,69 @@ func BenchmarkPoW(b *testing.B) {
 		}
 	}
 }
+
+// telemetryDatapoint returns the parameters of a typical sensor reading.
+func telemetryDatapoint(key []byte) *MessageParams {
+	payload := make([]byte, 24)
+	mrand.Read(payload)
+	return &MessageParams{
+		KeySym:   key,
+		Topic:    TopicType{0x7e, 0x1e},
+		Payload:  payload,
+		PoW:      0.00001,
+		WorkTime: 1,
+	}
+}
+
+func BenchmarkTelemetryDefaultProfile(b *testing.B) {
+	InitSingleTest()
+	key := make([]byte, aesKeyLength)
+	mrand.Read(key)
+
+	var size int
+	for i := 0; i < b.N; i++ {
+		params := telemetryDatapoint(key)
+		params.TTL = DefaultTTL
+		msg, err := NewSentMessage(params)
+		if err != nil {
+			b.Fatalf("failed NewSentMessage with seed %d: %s.", seed, err)
+		}
+		env, err := msg.Wrap(params)
+		if err != nil {
+			b.Fatalf("failed Wrap with seed %d: %s.", seed, err)
+		}
+		blob, _ := rlp.EncodeToBytes(env)
+		size += len(blob)
+	}
+	b.ReportMetric(float64(size)/float64(b.N), "bytes/datapoint")
+}
+
+func BenchmarkTelemetryCompactProfile(b *testing.B) {
+	InitSingleTest()
+	key := make([]byte, aesKeyLength)
+	mrand.Read(key)
+
+	profile := DefaultTelemetryProfile
+	profile.PoW = 0.00001
+
+	w := New(&DefaultConfig)
+	var size, points int
+	batch := make([]*MessageParams, 0, profile.BatchSize)
+	for i := 0; i < b.N; i++ {
+		params := telemetryDatapoint(key)
+		if err := profile.apply(params); err != nil {
+			b.Fatalf("failed apply with seed %d: %s.", seed, err)
+		}
+		if batch = append(batch, params); len(batch) < profile.BatchSize && i < b.N-1 {
+			continue
+		}
+		env, err := w.NewBatchEnvelope(batch, &MessageParams{TTL: profile.TTL, WorkTime: profile.WorkTime, PoW: profile.PoW})
+		if err != nil {
+			b.Fatalf("failed NewBatchEnvelope with seed %d: %s.", seed, err)
+		}
+		blob, _ := rlp.EncodeToBytes(env)
+		size, points = size+len(blob), points+len(batch)
+		batch = batch[:0]
+	}
+	b.ReportMetric(float64(size)/float64(points), "bytes/datapoint")
+}
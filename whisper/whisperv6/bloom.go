@@ -0,0 +1,112 @@
+// Copyright 2017 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+// Contains the parameters of the topic bloom filters, and the helpers to choose
+// them for a target false-positive rate.
+
+package whisperv6
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+
+	"github.com/ethereum/go-ethereum/crypto"
+)
+
+const (
+	maxBloomFilterSize = 1024 // in bytes
+	maxBloomHashes     = 16   // two bytes of the topic hash per bit
+)
+
+// BloomParams are the parameters of the topic bloom filters. The default ones
+// are defined by the protocol (EIP-627), the others are only understood by the
+// peers which advertise them in the handshake.
+type BloomParams struct {
+	Size   int // Size of the filter in bytes
+	Hashes int // Number of bits set for every topic
+}
+
+// DefaultBloomParams are the parameters of the bloom filters defined by the protocol.
+var DefaultBloomParams = BloomParams{Size: BloomFilterSize, Hashes: 3}
+
+// Validate checks that the parameters are within the supported limits.
+func (p BloomParams) Validate() error {
+	if p.Size < 1 || p.Size > maxBloomFilterSize {
+		return fmt.Errorf("invalid bloom filter size: %d", p.Size)
+	}
+	if p.Hashes < 1 || p.Hashes > maxBloomHashes {
+		return fmt.Errorf("invalid number of bloom filter hashes: %d", p.Hashes)
+	}
+	return nil
+}
+
+// TopicToBloom converts the topic to a bloom filter with these parameters. The
+// default parameters produce the same filters as the package-level TopicToBloom,
+// the others derive the bits from the hash of the topic.
+func (p BloomParams) TopicToBloom(topic TopicType) []byte {
+	if p == DefaultBloomParams {
+		return TopicToBloom(topic)
+	}
+	b := make([]byte, p.Size)
+	hash := crypto.Keccak256(topic[:])
+	bits := uint16(p.Size * 8)
+	for i := 0; i < p.Hashes; i++ {
+		index := binary.BigEndian.Uint16(hash[2*i:]) % bits
+		b[index/8] |= 1 << (index % 8)
+	}
+	return b
+}
+
+// envelopeBloom returns the bloom filter of the envelope topic, reusing the
+// cached one for the default parameters.
+func (p BloomParams) envelopeBloom(e *Envelope) []byte {
+	if p == DefaultBloomParams {
+		return e.Bloom()
+	}
+	return p.TopicToBloom(e.Topic)
+}
+
+// FalsePositiveRate estimates the probability that a topic not added to the
+// filter matches it, once the given number of topics are added.
+func (p BloomParams) FalsePositiveRate(topics int) float64 {
+	m, k, n := float64(p.Size*8), float64(p.Hashes), float64(topics)
+	return math.Pow(1-math.Exp(-k*n/m), k)
+}
+
+// OptimalBloomParams returns the smallest parameters achieving the target
+// false-positive rate for the given number of topics, within the supported limits.
+func OptimalBloomParams(topics int, rate float64) BloomParams {
+	if topics < 1 {
+		topics = 1
+	}
+	bits := -float64(topics) * math.Log(rate) / (math.Ln2 * math.Ln2)
+	p := BloomParams{Size: int(math.Ceil(bits / 8))}
+	if p.Size < 1 {
+		p.Size = 1
+	}
+	if p.Size > maxBloomFilterSize {
+		p.Size = maxBloomFilterSize
+	}
+	p.Hashes = int(math.Round(float64(p.Size*8) / float64(topics) * math.Ln2))
+	if p.Hashes < 1 {
+		p.Hashes = 1
+	}
+	if p.Hashes > maxBloomHashes {
+		p.Hashes = maxBloomHashes
+	}
+	return p
+}
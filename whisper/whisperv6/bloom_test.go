@@ -0,0 +1,199 @@
+// Copyright 2017 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package whisperv6
+
+import (
+	"bytes"
+	"math"
+	"math/bits"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/p2p"
+	"github.com/ethereum/go-ethereum/p2p/discover"
+)
+
+func TestBloomParams(t *testing.T) {
+	topic := TopicType{0xde, 0xad, 0xbe, 0xef}
+	if !bytes.Equal(DefaultBloomParams.TopicToBloom(topic), TopicToBloom(topic)) {
+		t.Fatalf("default parameters differ from the protocol.")
+	}
+
+	params := BloomParams{Size: 128, Hashes: 5}
+	bloom := params.TopicToBloom(topic)
+	set := 0
+	for _, b := range bloom {
+		set += bits.OnesCount8(b)
+	}
+	if len(bloom) != params.Size || set == 0 || set > params.Hashes {
+		t.Fatalf("wrong bloom filter: size %d, %d bits set.", len(bloom), set)
+	}
+
+	for _, invalid := range []BloomParams{{0, 3}, {maxBloomFilterSize + 1, 3}, {64, 0}, {64, maxBloomHashes + 1}} {
+		if invalid.Validate() == nil {
+			t.Fatalf("invalid parameters accepted: %+v.", invalid)
+		}
+	}
+
+	optimal := OptimalBloomParams(100, 0.01)
+	if err := optimal.Validate(); err != nil {
+		t.Fatalf("invalid optimal parameters: %s.", err)
+	}
+	if rate := optimal.FalsePositiveRate(100); rate > 0.011 {
+		t.Fatalf("false positive rate above the target: %f (%+v).", rate, optimal)
+	}
+	if rate := DefaultBloomParams.FalsePositiveRate(0); rate != 0 {
+		t.Fatalf("false positive rate of the empty filter: %f.", rate)
+	}
+	if rate := DefaultBloomParams.FalsePositiveRate(1000); math.Abs(rate-1) > 0.01 {
+		t.Fatalf("false positive rate of the saturated filter: %f.", rate)
+	}
+}
+
+func TestBloomParamsHandshake(t *testing.T) {
+	cfg := DefaultConfig
+	cfg.BloomFilterSize, cfg.BloomHashes = 128, 5
+	w := New(&cfg)
+	w.Start(nil)
+	defer w.Stop()
+	events := make(chan *PeerEvent, 1)
+	sub := w.SubscribePeerEvents(events)
+	defer sub.Unsubscribe()
+
+	local, remote := p2p.MsgPipe()
+	go w.HandlePeer(p2p.NewPeer(discover.NodeID{1}, "test", nil), local)
+
+	packet, err := remote.ReadMsg()
+	if err != nil {
+		t.Fatalf("failed to read status message: %s.", err)
+	}
+	var status struct {
+		Version, PoW uint64
+		Bloom        []byte
+		Size, Hashes uint64
+		Flags        uint64
+		Features     uint64
+	}
+	if err = packet.Decode(&status); err != nil {
+		t.Fatalf("failed to decode status message: %s.", err)
+	}
+	if status.Size != 128 || status.Hashes != 5 {
+		t.Fatalf("wrong advertised bloom parameters: %d, %d.", status.Size, status.Hashes)
+	}
+	if status.Flags != envelopeFlagsSupported {
+		t.Fatalf("wrong advertised envelope flags: %d.", status.Flags)
+	}
+	if status.Features != w.features() {
+		t.Fatalf("wrong advertised features: %d.", status.Features)
+	}
+
+	// the remote peer uses parameters of its own
+	params := BloomParams{Size: 32, Hashes: 2}
+	topic := TopicType{1, 2, 3, 4}
+	if err = p2p.SendItems(remote, statusCode, ProtocolVersion, math.Float64bits(0.0), params.TopicToBloom(topic), uint64(params.Size), uint64(params.Hashes)); err != nil {
+		t.Fatalf("failed to send status message: %s.", err)
+	}
+	select {
+	case <-events:
+	case <-time.After(time.Second):
+		t.Fatalf("handshake not completed.")
+	}
+	peer := w.getPeers()[0]
+	if peer.bloomParams != params {
+		t.Fatalf("peer bloom parameters not applied: %+v.", peer.bloomParams)
+	}
+	if !peer.bloomMatch(&Envelope{Topic: topic}) {
+		t.Fatalf("envelope does not match the peer bloom filter.")
+	}
+	if err := peer.validBloom(make([]byte, BloomFilterSize), false); err == nil {
+		t.Fatalf("bloom filter of the default size accepted from the peer.")
+	}
+}
+
+func TestAdaptiveBloom(t *testing.T) {
+	cfg := DefaultConfig
+	cfg.AdaptiveBloom = true
+	w := New(&cfg)
+	manual := TopicType{9, 10, 11, 12}
+	if err := w.SetBloomFilter(addBloom(w.filtersBloom(), w.bloomParams.TopicToBloom(manual))); err != nil {
+		t.Fatalf("failed to restrict bloom filter: %s.", err)
+	}
+
+	kept, removed := TopicType{1, 2, 3, 4}, TopicType{5, 6, 7, 8}
+	key := make([]byte, aesKeyLength)
+	if _, err := w.Subscribe(&Filter{KeySym: key, Topics: [][]byte{kept[:]}}); err != nil {
+		t.Fatalf("failed to subscribe: %s.", err)
+	}
+	id, err := w.Subscribe(&Filter{KeySym: key, Topics: [][]byte{removed[:]}})
+	if err != nil {
+		t.Fatalf("failed to subscribe: %s.", err)
+	}
+	removedBloom := w.bloomParams.TopicToBloom(removed)
+	if !BloomFilterMatch(w.BloomFilter(), removedBloom) {
+		t.Fatalf("subscribed topic missing from bloom filter.")
+	}
+
+	if err = w.Unsubscribe(id); err != nil {
+		t.Fatalf("failed to unsubscribe: %s.", err)
+	}
+	now := time.Now()
+	w.refreshBloom(now)
+	if !BloomFilterMatch(w.BloomFilter(), removedBloom) {
+		t.Fatalf("bloom filter refreshed within the rate limit.")
+	}
+	w.refreshBloom(now.Add(bloomRefreshCycle))
+	if BloomFilterMatch(w.BloomFilter(), removedBloom) {
+		t.Fatalf("bloom filter not refreshed.")
+	}
+	if !BloomFilterMatch(w.BloomFilter(), w.bloomParams.TopicToBloom(kept)) {
+		t.Fatalf("installed topic dropped from bloom filter.")
+	}
+	if !BloomFilterMatch(w.BloomFilter(), w.bloomParams.TopicToBloom(manual)) {
+		t.Fatalf("manually set topic dropped from bloom filter.")
+	}
+
+	// the full nodes are never restricted
+	full := New(&cfg)
+	if _, err = full.Subscribe(&Filter{KeySym: key, Topics: [][]byte{kept[:]}}); err != nil {
+		t.Fatalf("failed to subscribe: %s.", err)
+	}
+	full.bloomRefresh.markStale()
+	full.refreshBloom(now.Add(bloomRefreshCycle))
+	if !isFullNode(full.BloomFilter()) {
+		t.Fatalf("full node bloom filter restricted.")
+	}
+}
+
+func TestBatchTopicBloom(t *testing.T) {
+	w := New(&DefaultConfig)
+	if !bytes.Equal(w.filtersBloom(), make([]byte, w.bloomParams.Size)) {
+		t.Fatalf("bloom filter of the node without filters not empty.")
+	}
+	key := make([]byte, aesKeyLength)
+	f := &Filter{KeySym: key, Topics: [][]byte{{1, 2, 3, 4}}}
+	batch := w.bloomParams.TopicToBloom(BatchTopic)
+	if BloomFilterMatch(w.filterBloom(f), batch) {
+		t.Fatalf("batch topic attracted by the node not accepting the batches.")
+	}
+
+	cfg := DefaultConfig
+	cfg.AcceptBatches = true
+	w = New(&cfg)
+	if !BloomFilterMatch(w.filterBloom(f), batch) {
+		t.Fatalf("batch topic not attracted by the node accepting the batches.")
+	}
+}
@@ -0,0 +1,141 @@
+// Copyright 2017 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+// Contains the adaptive refresh of the bloom filter. The installed filters only
+// ever add bits to the advertised bloom filter, so that no message of interest
+// is missed. The removed filters leave their bits behind, attracting the
+// traffic nobody is interested in any more. With the adaptive refresh, the
+// bloom filter is recomputed from the installed filters and announced again
+// once it shrinks materially, at most once per bloomRefreshCycle. The bits set
+// explicitly with SetBloomFilter are kept through the refreshes.
+
+package whisperv6
+
+import (
+	"math/bits"
+	"sync"
+	"time"
+)
+
+// bloomRefreshRatio is the fraction of the set bits of the advertised bloom
+// filter, which must be cleared by the recomputation to announce it again.
+const bloomRefreshRatio = 0.1
+
+// bloomRefresher tracks the staleness of the advertised bloom filter.
+type bloomRefresher struct {
+	mu     sync.Mutex
+	stale  bool      // Indicates if a filter was removed since the last refresh
+	last   time.Time // Time of the last announcement of the bloom filter
+	manual []byte    // Bloom filter set explicitly, nil if none
+}
+
+// setManual notes the bloom filter set explicitly.
+func (r *bloomRefresher) setManual(bloom []byte) {
+	r.mu.Lock()
+	r.manual = bloom
+	r.mu.Unlock()
+}
+
+// markStale notes the removal of a filter.
+func (r *bloomRefresher) markStale() {
+	r.mu.Lock()
+	r.stale = true
+	r.mu.Unlock()
+}
+
+// announced notes the announcement of the bloom filter.
+func (r *bloomRefresher) announced(now time.Time) {
+	r.mu.Lock()
+	r.last = now
+	r.mu.Unlock()
+}
+
+// filterBloom returns the bloom filter of the topics of the filter, along with
+// the batch topic if the node accepts the batches (which may carry any topic).
+func (whisper *Whisper) filterBloom(f *Filter) []byte {
+	aggregate := make([]byte, whisper.bloomParams.Size)
+	if whisper.acceptBatches {
+		aggregate = whisper.bloomParams.TopicToBloom(BatchTopic)
+	}
+	for _, t := range f.Topics {
+		aggregate = addBloom(aggregate, whisper.bloomParams.TopicToBloom(BytesToTopic(t)))
+	}
+	return aggregate
+}
+
+// filtersBloom recomputes the bloom filter of all the installed filters.
+func (whisper *Whisper) filtersBloom() []byte {
+	aggregate := make([]byte, whisper.bloomParams.Size)
+	whisper.filters.mutex.RLock()
+	for _, f := range whisper.filters.watchers {
+		aggregate = addBloom(aggregate, whisper.filterBloom(f))
+	}
+	whisper.filters.mutex.RUnlock()
+	return aggregate
+}
+
+// refreshBloom announces the recomputed bloom filter if it changed materially
+// since the last announcement. Only the restricted bloom filters are refreshed,
+// the full nodes keep receiving everything.
+func (whisper *Whisper) refreshBloom(now time.Time) {
+	if !whisper.adaptiveBloom {
+		return
+	}
+	r := &whisper.bloomRefresh
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if !r.stale || now.Sub(r.last) < bloomRefreshCycle {
+		return
+	}
+	r.stale = false
+
+	current := whisper.BloomFilter()
+	if isFullNode(current) {
+		return
+	}
+	fresh := whisper.filtersBloom()
+	if len(r.manual) == len(fresh) {
+		fresh = addBloom(fresh, r.manual)
+	}
+	if !bloomChanged(current, fresh) {
+		return
+	}
+	if err := whisper.setBloomFilter(fresh); err != nil {
+		whisper.Logger(LogSubsystemFilter).Warn("failed to refresh bloom filter", "err", err)
+		return
+	}
+	r.last = now
+	whisper.Logger(LogSubsystemFilter).Debug("refreshed bloom filter")
+}
+
+// bloomChanged checks if the recomputed bloom filter differs materially from
+// the advertised one: it either sets a missing bit, or clears a sufficient
+// fraction of the set bits.
+func bloomChanged(current, fresh []byte) bool {
+	if len(current) != len(fresh) {
+		return true
+	}
+	set, cleared := 0, 0
+	for i := range current {
+		if fresh[i]&^current[i] != 0 {
+			return true
+		}
+		set += bits.OnesCount8(current[i])
+		cleared += bits.OnesCount8(current[i] &^ fresh[i])
+	}
+	return cleared > 0 && float64(cleared) >= bloomRefreshRatio*float64(set)
+}
@@ -0,0 +1,214 @@
+// Copyright 2017 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+// Contains the bridge republishing the envelopes of the selected topics from
+// one whisper network onto another (e.g. from a private network to the public
+// one, or the other way around).
+//
+// The envelopes are republished as they are, since the bridge can not (and
+// need not) open them, but sealed again to satisfy the PoW requirement of the
+// destination. Sealing only replaces the nonce (the flags are kept, as they
+// are covered by the PoW), so the envelopes bridged in
+// both directions are recognized by the hash of their content without the
+// nonce, which prevents them from bouncing between the networks.
+
+package whisperv6
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/event"
+	"github.com/ethereum/go-ethereum/log"
+)
+
+const (
+	bridgeQueueLimit = 256 // number of envelopes awaiting the sealing in each direction
+	bridgeWorkTime   = 5   // default limit of the sealing time of a single envelope, in seconds
+)
+
+// BridgeConfig specifies the topics republished by the bridge.
+type BridgeConfig struct {
+	Topics        []TopicType // Topics republished from the first node to the second one
+	ReverseTopics []TopicType // Topics republished from the second node to the first one
+	PoW           float64     // PoW of the republished envelopes (zero means the minimum of the destination)
+	WorkTime      uint32      // Maximum time in seconds spent sealing a single envelope (zero means the default)
+}
+
+// Bridge republishes the envelopes of the selected topics between two nodes.
+type Bridge struct {
+	a, b *Whisper
+	cfg  BridgeConfig
+
+	mu   sync.Mutex
+	seen map[common.Hash]uint32 // Expiry of the bridged envelopes by the hash of their content
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+	log    log.Logger
+}
+
+// NewBridge creates a bridge between the two nodes. Both of them must be
+// started before the bridge, and stopping either of them stops the bridging
+// from it.
+func NewBridge(a, b *Whisper, cfg BridgeConfig) *Bridge {
+	if cfg.WorkTime == 0 {
+		cfg.WorkTime = bridgeWorkTime
+	}
+	return &Bridge{
+		a:    a,
+		b:    b,
+		cfg:  cfg,
+		seen: make(map[common.Hash]uint32),
+		log:  a.Logger(LogSubsystemPool),
+	}
+}
+
+// Start starts republishing the envelopes in both directions.
+func (bridge *Bridge) Start() {
+	bridge.ctx, bridge.cancel = context.WithCancel(context.Background())
+	bridge.run(bridge.a, bridge.b, bridge.cfg.Topics)
+	bridge.run(bridge.b, bridge.a, bridge.cfg.ReverseTopics)
+}
+
+// Stop stops the bridge, aborting the envelopes being sealed.
+func (bridge *Bridge) Stop() {
+	bridge.cancel()
+	bridge.wg.Wait()
+}
+
+// run republishes the envelopes of the topics from src to dst.
+func (bridge *Bridge) run(src, dst *Whisper, topics []TopicType) {
+	if len(topics) == 0 {
+		return
+	}
+	allowed := make(map[TopicType]struct{})
+	for _, topic := range topics {
+		allowed[topic] = struct{}{}
+	}
+	ch := make(chan *Envelope, bridgeQueueLimit)
+	sub := src.SubscribeEnvelopes(ch)
+	queue := make(chan *Envelope, bridgeQueueLimit)
+
+	bridge.wg.Add(2)
+	go func() {
+		defer bridge.wg.Done()
+		defer sub.Unsubscribe()
+		defer close(queue)
+		bridge.collect(ch, sub, allowed, queue)
+	}()
+	go func() {
+		defer bridge.wg.Done()
+		for envelope := range queue {
+			bridge.republish(envelope, dst)
+		}
+	}()
+}
+
+// collect passes the envelopes of the allowed topics to the sealing queue,
+// until the bridge or the source node is stopped. The subscription must not
+// be blocked by the sealing, so the envelopes not fitting into the queue are
+// dropped.
+func (bridge *Bridge) collect(ch <-chan *Envelope, sub event.Subscription, allowed map[TopicType]struct{}, queue chan<- *Envelope) {
+	expire := time.NewTicker(expirationCycle)
+	defer expire.Stop()
+
+	for {
+		select {
+		case envelope := <-ch:
+			if _, ok := allowed[envelope.Topic]; !ok {
+				continue
+			}
+			if !bridge.mark(envelope) {
+				continue // bridged from the other side, or already republished
+			}
+			select {
+			case queue <- envelope:
+			default:
+				bridge.log.Warn("bridge queue overflow, envelope dropped", "hash", envelope.Hash())
+			}
+		case <-expire.C:
+			bridge.expire(uint32(time.Now().Unix()))
+		case <-sub.Err():
+			return
+		case <-bridge.ctx.Done():
+			return
+		}
+	}
+}
+
+// contentHash returns the hash of the envelope without the nonce, which is
+// preserved when the envelope is sealed again.
+func contentHash(envelope *Envelope) common.Hash {
+	return crypto.Keccak256Hash(envelope.rlpWithoutNonce())
+}
+
+// mark records the envelope as bridged, reporting if it was not seen before.
+func (bridge *Bridge) mark(envelope *Envelope) bool {
+	hash := contentHash(envelope)
+
+	bridge.mu.Lock()
+	defer bridge.mu.Unlock()
+	if _, ok := bridge.seen[hash]; ok {
+		return false
+	}
+	bridge.seen[hash] = envelope.Expiry
+	return true
+}
+
+// expire forgets the bridged envelopes which expired.
+func (bridge *Bridge) expire(now uint32) {
+	bridge.mu.Lock()
+	defer bridge.mu.Unlock()
+	for hash, expiry := range bridge.seen {
+		if expiry < now {
+			delete(bridge.seen, hash)
+		}
+	}
+}
+
+// republish seals the copy of the envelope for the destination node (unless
+// the PoW of the original suffices), and sends it.
+func (bridge *Bridge) republish(envelope *Envelope, dst *Whisper) {
+	target := bridge.cfg.PoW
+	if target == 0 {
+		target = dst.MinPow()
+	}
+	out := envelope
+	if envelope.PoW() < target {
+		out = &Envelope{
+			Expiry: envelope.Expiry,
+			TTL:    envelope.TTL,
+			Topic:  envelope.Topic,
+			Data:   envelope.Data,
+			Flags:  append([]uint64(nil), envelope.Flags...),
+		}
+		params := &MessageParams{PoW: target, WorkTime: bridge.cfg.WorkTime}
+		if err := dst.Seal(bridge.ctx, out, params, nil); err != nil {
+			bridge.log.Debug("failed to seal bridged envelope", "hash", envelope.Hash(), "err", err)
+			return
+		}
+	}
+	if err := dst.Send(out); err != nil {
+		bridge.log.Debug("failed to republish bridged envelope", "hash", envelope.Hash(), "err", err)
+		return
+	}
+	bridge.log.Trace("republished bridged envelope", "hash", envelope.Hash(), "bridged", out.Hash())
+}
@@ -0,0 +1,125 @@
+// Copyright 2017 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package whisperv6
+
+import (
+	"testing"
+	"time"
+)
+
+// countContent returns the number of the envelopes in the pool of the node,
+// matching the content of the given envelope regardless of the nonce.
+func countContent(w *Whisper, envelope *Envelope) int {
+	n := 0
+	for _, e := range w.Envelopes() {
+		if contentHash(e) == contentHash(envelope) {
+			n++
+		}
+	}
+	return n
+}
+
+func TestBridge(t *testing.T) {
+	InitSingleTest()
+
+	bridged, private := TopicType{0xb1}, TopicType{0xb2}
+
+	a, b := New(&DefaultConfig), New(&DefaultConfig)
+	a.SetMinimumPowTest(0.0000001)
+	b.SetMinimumPowTest(2)
+	a.Start(nil)
+	defer a.Stop()
+	b.Start(nil)
+	defer b.Stop()
+
+	bridge := NewBridge(a, b, BridgeConfig{
+		Topics:        []TopicType{bridged},
+		ReverseTopics: []TopicType{bridged},
+	})
+	bridge.Start()
+	defer bridge.Stop()
+
+	now := uint32(time.Now().Unix())
+	env := &Envelope{Expiry: now + DefaultTTL, TTL: DefaultTTL, Topic: bridged, Data: []byte{1, 2, 3}, Nonce: uint64(seed)}
+	other := &Envelope{Expiry: now + DefaultTTL, TTL: DefaultTTL, Topic: private, Data: []byte{4, 5, 6}, Nonce: uint64(seed)}
+	for _, e := range []*Envelope{env, other} {
+		if err := a.Send(e); err != nil {
+			t.Fatalf("failed to send envelope with seed %d: %s.", seed, err)
+		}
+	}
+
+	// the envelope is sealed again, to satisfy the requirement of the destination
+	if !waitFor(5*time.Second, func() bool { return countContent(b, env) == 1 }) {
+		t.Fatalf("envelope was not bridged with seed %d.", seed)
+	}
+	for _, e := range b.Envelopes() {
+		if e.PoW() < 2 {
+			t.Fatalf("bridged envelope was not sealed with seed %d: %f.", seed, e.PoW())
+		}
+	}
+
+	// the envelope must not bounce back, nor the other topics cross the bridge
+	time.Sleep(100 * time.Millisecond)
+	if n := countContent(a, env); n != 1 {
+		t.Fatalf("bridged envelope bounced back with seed %d: %d copies.", seed, n)
+	}
+	if n := countContent(b, other); n != 0 {
+		t.Fatalf("envelope of the unbridged topic crossed the bridge with seed %d.", seed)
+	}
+}
+
+func TestBridgeFlags(t *testing.T) {
+	InitSingleTest()
+
+	topic := TopicType{0xb3}
+	a, b := New(&DefaultConfig), New(&DefaultConfig)
+	a.SetMinimumPowTest(0.0000001)
+	b.SetMinimumPowTest(0.0000001)
+	a.Start(nil)
+	defer a.Stop()
+	b.Start(nil)
+	defer b.Stop()
+
+	// the bridge seals the envelopes again in both directions
+	bridge := NewBridge(a, b, BridgeConfig{Topics: []TopicType{topic}, ReverseTopics: []TopicType{topic}, PoW: 2})
+	bridge.Start()
+	defer bridge.Stop()
+
+	now := uint32(time.Now().Unix())
+	forth := &Envelope{Expiry: now + DefaultTTL, TTL: DefaultTTL, Topic: topic, Data: []byte{1}, Nonce: uint64(seed), Flags: []uint64{EnvelopeNoArchive}}
+	back := &Envelope{Expiry: now + DefaultTTL, TTL: DefaultTTL, Topic: topic, Data: []byte{2}, Nonce: uint64(seed), Flags: []uint64{EnvelopeNoArchive}}
+	if err := a.Send(forth); err != nil {
+		t.Fatalf("failed to send envelope with seed %d: %s.", seed, err)
+	}
+	if err := b.Send(back); err != nil {
+		t.Fatalf("failed to send envelope with seed %d: %s.", seed, err)
+	}
+
+	for _, tt := range []struct {
+		dst      *Whisper
+		envelope *Envelope
+	}{{b, forth}, {a, back}} {
+		if !waitFor(5*time.Second, func() bool { return countContent(tt.dst, tt.envelope) == 1 }) {
+			t.Fatalf("flagged envelope was not bridged with seed %d.", seed)
+		}
+		for _, e := range tt.dst.Envelopes() {
+			if contentHash(e) == contentHash(tt.envelope) && (e.PoW() < 2 || e.flags() != EnvelopeNoArchive) {
+				t.Fatalf("wrong bridged envelope with seed %d: PoW %f, flags %v.", seed, e.PoW(), e.Flags)
+			}
+		}
+	}
+}
@@ -0,0 +1,137 @@
+// Copyright 2017 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package whisperv6
+
+import (
+	"github.com/ethereum/go-ethereum/common"
+)
+
+// bucketSpan is the number of seconds of expiry time covered by a single bucket.
+const bucketSpan = 60
+
+// envelopeBucket holds the pooled envelopes expiring within the same span of
+// time. The buckets are the primary index of the envelope pool: the expiry
+// drops the whole buckets, and the sync compares the per-bucket digests.
+type envelopeBucket struct {
+	index     uint32                    // Expiry time divided by bucketSpan
+	envelopes map[common.Hash]*Envelope // Envelopes expiring within the span of the bucket
+	digest    common.Hash               // XOR of the hashes of all the envelopes in the bucket
+	peak      highWater                 // Peak number of the envelopes, triggering the compaction
+}
+
+// bucketIndex returns the index of the bucket holding the envelopes with the
+// specified expiry time.
+func bucketIndex(expiry uint32) uint32 {
+	return expiry / bucketSpan
+}
+
+func newEnvelopeBucket(index uint32) *envelopeBucket {
+	return &envelopeBucket{
+		index:     index,
+		envelopes: make(map[common.Hash]*Envelope),
+	}
+}
+
+// start returns the earliest expiry time covered by the bucket.
+func (b *envelopeBucket) start() uint32 {
+	return b.index * bucketSpan
+}
+
+// end returns the first expiry time not covered by the bucket anymore.
+func (b *envelopeBucket) end() uint32 {
+	return (b.index + 1) * bucketSpan
+}
+
+// add inserts the envelope into the bucket, updating the digest.
+func (b *envelopeBucket) add(hash common.Hash, envelope *Envelope) {
+	if _, exist := b.envelopes[hash]; exist {
+		return
+	}
+	b.envelopes[hash] = envelope
+	b.xor(hash)
+}
+
+// remove deletes the envelope from the bucket, updating the digest.
+func (b *envelopeBucket) remove(hash common.Hash) {
+	if _, exist := b.envelopes[hash]; !exist {
+		return
+	}
+	b.peak.observe(len(b.envelopes))
+	delete(b.envelopes, hash)
+	b.xor(hash)
+}
+
+func (b *envelopeBucket) xor(hash common.Hash) {
+	for i := range b.digest {
+		b.digest[i] ^= hash[i]
+	}
+}
+
+// BucketEnvelopes retrieves the pooled envelopes expiring within the specified
+// time range (inclusive), scanning only the buckets covering the range.
+func (whisper *Whisper) BucketEnvelopes(from, to uint32) []*Envelope {
+	whisper.poolMu.RLock()
+	defer whisper.poolMu.RUnlock()
+
+	var all []*Envelope
+	for _, b := range whisper.buckets {
+		if b.end() <= from || b.start() > to {
+			continue
+		}
+		for _, envelope := range b.envelopes {
+			if envelope.Expiry >= from && envelope.Expiry <= to {
+				all = append(all, envelope)
+			}
+		}
+	}
+	return all
+}
+
+// bucketDigests returns the digests of all the non-empty buckets of the pool.
+// The own envelopes still held back are excluded, as from the listed hashes,
+// so that the digests reveal nothing about them.
+func (whisper *Whisper) bucketDigests() map[uint32]common.Hash {
+	whisper.poolMu.RLock()
+	defer whisper.poolMu.RUnlock()
+
+	digests := make(map[uint32]common.Hash, len(whisper.buckets))
+	held := make(map[uint32]int)
+	for index, b := range whisper.buckets {
+		if len(b.envelopes) > 0 {
+			digests[index] = b.digest
+		}
+	}
+	for hash := range whisper.held {
+		envelope, ok := whisper.envelopes[hash]
+		if !ok || !whisper.isHeld(hash) {
+			continue
+		}
+		index := bucketIndex(envelope.Expiry)
+		digest := digests[index]
+		for i := range digest {
+			digest[i] ^= hash[i]
+		}
+		digests[index] = digest
+		held[index]++
+	}
+	for index, n := range held {
+		if n == len(whisper.buckets[index].envelopes) {
+			delete(digests, index) // nothing but the held envelopes
+		}
+	}
+	return digests
+}
@@ -0,0 +1,73 @@
+// Copyright 2017 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package whisperv6
+
+import (
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+func TestEnvelopeBuckets(t *testing.T) {
+	InitSingleTest()
+
+	w := New(&DefaultConfig)
+	w.SetMinimumPowTest(0.0000001)
+	defer w.SetMinimumPowTest(DefaultMinimumPoW)
+
+	now := uint32(time.Now().Unix())
+	ttls := []uint32{1, 2, bucketSpan * 2, bucketSpan * 3}
+	envelopes := make([]*Envelope, len(ttls))
+	for i, ttl := range ttls {
+		env := &Envelope{Expiry: now + ttl, TTL: ttl, Data: []byte{byte(i)}, Nonce: uint64(seed)}
+		if _, err := w.add(env, false); err != nil {
+			t.Fatalf("failed to add envelope %d with seed %d: %s.", i, seed, err)
+		}
+		envelopes[i] = env
+	}
+
+	var digest common.Hash
+	for index, d := range w.bucketDigests() {
+		if index == bucketIndex(envelopes[0].Expiry) {
+			digest = d
+		}
+	}
+	if digest == (common.Hash{}) {
+		t.Fatalf("digest of the first bucket is missing, seed: %d.", seed)
+	}
+
+	found := w.BucketEnvelopes(now+bucketSpan*2, now+bucketSpan*3)
+	if len(found) != 2 {
+		t.Fatalf("wrong number of envelopes in range: %d, seed: %d.", len(found), seed)
+	}
+
+	// expire the first two envelopes, the rest must stay untouched
+	time.Sleep(3 * time.Second)
+	w.expire()
+	if len(w.Envelopes()) != 2 {
+		t.Fatalf("wrong number of envelopes after expiry: %d, seed: %d.", len(w.Envelopes()), seed)
+	}
+	for i, env := range envelopes {
+		if cached := w.isEnvelopeCached(env.Hash()); cached != (i >= 2) {
+			t.Fatalf("envelope %d cached: %v, seed: %d.", i, cached, seed)
+		}
+	}
+	if d, ok := w.bucketDigests()[bucketIndex(envelopes[0].Expiry)]; ok && d == digest {
+		t.Fatalf("digest of the expired bucket was not updated, seed: %d.", seed)
+	}
+}
@@ -0,0 +1,89 @@
+// Copyright 2017 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+// Contains the calibration of the local hash rate, translating the PoW into
+// the sealing time and back.
+
+package whisperv6
+
+import (
+	"context"
+	"math"
+	"time"
+
+	"github.com/ethereum/go-ethereum/log"
+)
+
+// sealTimeWarning is the sealing time of a typical message above which the
+// minimum PoW of the node is considered unattainable on this hardware.
+const sealTimeWarning = 10 * time.Second
+
+// typicalEnvelopeSize is the size of the envelope of a short message.
+const typicalEnvelopeSize = EnvelopeHeaderLength + padSizeLimit
+
+// measureHashRate hashes on the calling goroutine for the specified time, and
+// returns the number of hashes per second.
+func measureHashRate(duration time.Duration) float64 {
+	env := &Envelope{TTL: DefaultTTL, Data: make([]byte, padSizeLimit)}
+	var tried uint64
+	finish := time.Now().Add(duration).UnixNano()
+	env.mine(context.Background(), 0, 1, 0, finish, func(_ int, n uint64) { tried = n })
+	return float64(tried) / duration.Seconds()
+}
+
+// calibrate measures the hash rate of a single thread, and warns if the minimum
+// PoW of the node takes unreasonably long to reach.
+func (whisper *Whisper) calibrate() {
+	rate := measureHashRate(workBankBenchmarkTime)
+
+	whisper.statsMu.Lock()
+	whisper.stats.hashRate = rate
+	whisper.statsMu.Unlock()
+
+	if d := whisper.SealTime(whisper.MinPow(), typicalEnvelopeSize, DefaultTTL); d > sealTimeWarning {
+		log.Warn("Minimum whisper PoW unattainable in reasonable time on this hardware", "pow", whisper.MinPow(), "hashrate", rate, "sealtime", d)
+	}
+}
+
+// HashRate returns the number of hashes per second of a single thread, as
+// measured on startup (zero if not measured yet).
+func (s Statistics) HashRate() float64 {
+	return s.hashRate
+}
+
+// ExpectedPoW estimates the PoW reached by sealing an envelope of the given
+// size (in bytes) and TTL on a single thread for the work time. It returns
+// zero if the hash rate is not measured yet.
+func (whisper *Whisper) ExpectedPoW(size int, ttl uint32, workTime time.Duration) float64 {
+	hashes := whisper.Stats().hashRate * workTime.Seconds()
+	if hashes < 1 {
+		return 0
+	}
+	// the best of n hashes is expected to have about log2(n) leading zero bits
+	return math.Pow(2, math.Floor(math.Log2(hashes))) / float64(size) / float64(ttl)
+}
+
+// SealTime estimates the time needed to seal an envelope of the given size (in
+// bytes) and TTL with the PoW on a single thread. It returns zero if the hash
+// rate is not measured yet.
+func (whisper *Whisper) SealTime(pow float64, size int, ttl uint32) time.Duration {
+	rate := whisper.Stats().hashRate
+	if rate == 0 {
+		return 0
+	}
+	bits := math.Max(1, math.Ceil(math.Log2(pow*float64(size)*float64(ttl))))
+	return time.Duration(math.Pow(2, bits) / rate * float64(time.Second))
+}
@@ -0,0 +1,89 @@
+// Copyright 2017 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package whisperv6
+
+import "sort"
+
+// Ciphers supported for the message payloads.
+const (
+	CipherSymmetric  = "aes-256-gcm"
+	CipherAsymmetric = "ecies-secp256k1"
+)
+
+// Capabilities describes what the node supports and how it is configured, so
+// that the embedding applications can adapt at runtime.
+type Capabilities struct {
+	ProtocolVersion  uint64      `json:"protocolVersion"`
+	EnvelopeVersions []uint64    `json:"envelopeVersions"` // Versions of the envelopes the node validates
+	Ciphers          []string    `json:"ciphers"`
+	MaxMessageSize   uint32      `json:"maxMessageSize"`
+	MinPoW           float64     `json:"minPoW"`
+	MinPoWTolerance  float64     `json:"minPoWTolerance"` // PoW still tolerated while the peers adjust to a change
+	Bloom            BloomParams `json:"bloom"`
+
+	LightClient       bool `json:"lightClient"`       // The envelopes received from the peers are not forwarded
+	MailServer        bool `json:"mailServer"`        // A mail server is registered and answers the historic requests
+	MailClient        bool `json:"mailClient"`        // Historic messages may be requested from the mail servers
+	P2PDirect         bool `json:"p2pDirect"`         // Peer-to-peer messages may be sent to the trusted peers
+	WatchOnly         bool `json:"watchOnly"`         // Keys and filters are refused over RPC
+	AntiEntropySync   bool `json:"antiEntropySync"`   // The pools are periodically reconciled with the peers
+	DelayOwnEnvelopes bool `json:"delayOwnEnvelopes"` // The own envelopes are held back for a random cycle
+	BackgroundSealer  bool `json:"backgroundSealer"`  // The PoW is computed by the background work bank
+	LocalBus          bool `json:"localBus"`          // The node is an in-process bus, without peers and PoW
+}
+
+// features returns the bitmask of the protocol features of the node, which is
+// advertised to the peers in the handshake, following the envelope flags.
+func (whisper *Whisper) features() uint64 {
+	var features uint64
+	if whisper.antiEntropyCycle > 0 {
+		features |= featureSync
+	}
+	return features
+}
+
+// Capabilities returns the versions, ciphers, limits and features of the node.
+func (whisper *Whisper) Capabilities() *Capabilities {
+	versions := make([]uint64, 0, len(envelopeSchemas))
+	for version := range envelopeSchemas {
+		versions = append(versions, version)
+	}
+	sort.Slice(versions, func(i, j int) bool { return versions[i] < versions[j] })
+
+	whisper.lifecycleMu.Lock()
+	sealer := whisper.sealer != nil
+	whisper.lifecycleMu.Unlock()
+
+	return &Capabilities{
+		ProtocolVersion:   ProtocolVersion,
+		EnvelopeVersions:  versions,
+		Ciphers:           []string{CipherSymmetric, CipherAsymmetric},
+		MaxMessageSize:    whisper.MaxMessageSize(),
+		MinPoW:            whisper.MinPow(),
+		MinPoWTolerance:   whisper.MinPowTolerance(),
+		Bloom:             whisper.bloomParams,
+		LightClient:       whisper.lightClient,
+		MailServer:        whisper.mailServer != nil,
+		MailClient:        !whisper.localBus,
+		P2PDirect:         !whisper.localBus,
+		WatchOnly:         whisper.watchOnly,
+		AntiEntropySync:   whisper.antiEntropyCycle > 0,
+		DelayOwnEnvelopes: whisper.delayOwnEnvelopes,
+		BackgroundSealer:  sealer && !whisper.localBus,
+		LocalBus:          whisper.localBus,
+	}
+}
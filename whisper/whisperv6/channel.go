@@ -0,0 +1,159 @@
+// Copyright 2017 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+// Contains the broadcast channels: a single publisher signs the messages, while
+// the subscribers only hold the symmetric key of the channel along with the
+// public key of the publisher.
+//
+// The symmetric key keeps the messages private to the subscribers, but any of
+// them could post into the channel with it. The filters of the channel are thus
+// bound to the key of the publisher, rejecting the messages signed by anyone
+// else (or not signed at all) as spoofed.
+
+package whisperv6
+
+import (
+	"crypto/ecdsa"
+	"errors"
+	"fmt"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+)
+
+// ErrNotPublisher is returned when a subscriber attempts to publish into the channel.
+var ErrNotPublisher = errors.New("only the publisher may post into the channel")
+
+// Channel is a broadcast channel with a single publisher.
+type Channel struct {
+	whisper   *Whisper
+	topic     TopicType
+	key       []byte
+	publisher *ecdsa.PublicKey
+	signer    *ecdsa.PrivateKey // Key of the publisher, nil for the subscribers
+	filterID  string
+}
+
+// NewChannelKey generates a random symmetric key for a new channel.
+func NewChannelKey() ([]byte, error) {
+	return generateSecureRandomData(aesKeyLength)
+}
+
+// ChannelTopic returns the topic of the channel derived from its symmetric key
+// and the public key of its publisher.
+func ChannelTopic(key []byte, publisher *ecdsa.PublicKey) TopicType {
+	return BytesToTopic(crypto.Keccak256([]byte("channel-topic"), key, crypto.FromECDSAPub(publisher)))
+}
+
+// PublishChannel opens the channel as its publisher, able to post the messages.
+func (whisper *Whisper) PublishChannel(key []byte, signer *ecdsa.PrivateKey) (*Channel, error) {
+	if signer == nil {
+		return nil, fmt.Errorf("missing publisher key")
+	}
+	return whisper.openChannel(key, &signer.PublicKey, signer)
+}
+
+// JoinChannel subscribes to the channel, only accepting the messages signed by
+// the publisher.
+func (whisper *Whisper) JoinChannel(key []byte, publisher *ecdsa.PublicKey) (*Channel, error) {
+	return whisper.openChannel(key, publisher, nil)
+}
+
+func (whisper *Whisper) openChannel(key []byte, publisher *ecdsa.PublicKey, signer *ecdsa.PrivateKey) (*Channel, error) {
+	if len(key) != aesKeyLength || !validateDataIntegrity(key, aesKeyLength) {
+		return nil, ErrInvalidSymmetricKey
+	}
+	if !ValidatePublicKey(publisher) {
+		return nil, ErrInvalidSigningPubKey
+	}
+	c := &Channel{
+		whisper:   whisper,
+		topic:     ChannelTopic(key, publisher),
+		key:       common.CopyBytes(key),
+		publisher: publisher,
+		signer:    signer,
+	}
+	filter := &Filter{
+		Src:      publisher,
+		KeySym:   c.key,
+		Topics:   [][]byte{c.topic[:]},
+		Messages: make(map[common.Hash]*ReceivedMessage),
+	}
+	var err error
+	if c.filterID, err = whisper.Subscribe(filter); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// Topic returns the topic of the channel.
+func (c *Channel) Topic() TopicType {
+	return c.topic
+}
+
+// Publisher returns the public key of the publisher of the channel.
+func (c *Channel) Publisher() *ecdsa.PublicKey {
+	return c.publisher
+}
+
+// Publish signs and posts the message into the channel.
+func (c *Channel) Publish(payload []byte) error {
+	if c.signer == nil {
+		return ErrNotPublisher
+	}
+	params := &MessageParams{
+		TTL:      DefaultTTL,
+		Src:      c.signer,
+		KeySym:   c.key,
+		Topic:    c.topic,
+		WorkTime: 5,
+		PoW:      c.whisper.MinPow(),
+		Payload:  payload,
+	}
+	msg, err := NewSentMessage(params)
+	if err != nil {
+		return err
+	}
+	env, err := msg.Wrap(params)
+	if err != nil {
+		return err
+	}
+	return c.whisper.Send(env)
+}
+
+// Messages returns the messages of the publisher received since the last call.
+func (c *Channel) Messages() []*ReceivedMessage {
+	f := c.whisper.GetFilter(c.filterID)
+	if f == nil {
+		return nil
+	}
+	return f.Retrieve()
+}
+
+// Spoofed returns the number of the messages rejected by the channel, since
+// they were not signed by the publisher.
+func (c *Channel) Spoofed() uint64 {
+	f := c.whisper.GetFilter(c.filterID)
+	if f == nil {
+		return 0
+	}
+	return f.Spoofed()
+}
+
+// Close unsubscribes from the channel.
+func (c *Channel) Close() error {
+	return c.whisper.Unsubscribe(c.filterID)
+}
@@ -0,0 +1,95 @@
+// Copyright 2017 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package whisperv6
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/crypto"
+)
+
+func TestBroadcastChannel(t *testing.T) {
+	InitSingleTest()
+
+	w := New(&DefaultConfig)
+	w.SetMinimumPowTest(0.0000001)
+	defer w.SetMinimumPowTest(DefaultMinimumPoW)
+	w.Start(nil)
+	defer w.Stop()
+
+	publisher, err := crypto.GenerateKey()
+	if err != nil {
+		t.Fatalf("failed to generate key with seed %d: %s.", seed, err)
+	}
+	key, err := NewChannelKey()
+	if err != nil {
+		t.Fatalf("failed to generate channel key with seed %d: %s.", seed, err)
+	}
+	pub, err := w.PublishChannel(key, publisher)
+	if err != nil {
+		t.Fatalf("failed to publish channel with seed %d: %s.", seed, err)
+	}
+	defer pub.Close()
+	sub, err := w.JoinChannel(key, &publisher.PublicKey)
+	if err != nil {
+		t.Fatalf("failed to join channel with seed %d: %s.", seed, err)
+	}
+	defer sub.Close()
+	if sub.Topic() != pub.Topic() {
+		t.Fatalf("channel topics mismatch with seed %d.", seed)
+	}
+	if err := sub.Publish([]byte("spoof")); err != ErrNotPublisher {
+		t.Fatalf("subscriber was allowed to publish with seed %d: %v.", seed, err)
+	}
+
+	// a subscriber holding the channel key posts a message signed by its own key
+	impostor, err := crypto.GenerateKey()
+	if err != nil {
+		t.Fatalf("failed to generate key with seed %d: %s.", seed, err)
+	}
+	params := &MessageParams{TTL: DefaultTTL, Src: impostor, KeySym: key, Topic: sub.Topic(), Payload: []byte("spoof")}
+	msg, err := NewSentMessage(params)
+	if err != nil {
+		t.Fatalf("failed to create message with seed %d: %s.", seed, err)
+	}
+	env, err := msg.Wrap(params)
+	if err != nil {
+		t.Fatalf("failed to wrap message with seed %d: %s.", seed, err)
+	}
+	if err := w.Send(env); err != nil {
+		t.Fatalf("failed to send message with seed %d: %s.", seed, err)
+	}
+	if err := pub.Publish([]byte("genuine")); err != nil {
+		t.Fatalf("failed to publish message with seed %d: %s.", seed, err)
+	}
+
+	if !waitFor(time.Second, func() bool { return sub.Spoofed() == 1 }) {
+		t.Fatalf("spoofed message was not rejected with seed %d: %d.", seed, sub.Spoofed())
+	}
+	var received [][]byte
+	waitFor(time.Second, func() bool {
+		for _, m := range sub.Messages() {
+			received = append(received, m.Payload)
+		}
+		return len(received) > 0
+	})
+	if len(received) != 1 || !bytes.Equal(received[0], []byte("genuine")) {
+		t.Fatalf("wrong messages received from the channel with seed %d: %q.", seed, received)
+	}
+}
@@ -0,0 +1,154 @@
+// Copyright 2017 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+// +build whisperchaos
+
+// Contains the failure injection hooks for the resilience (chaos) tests of the
+// applications embedding whisper. The hooks are only compiled into the builds
+// with the whisperchaos tag, so they can never be enabled in production.
+
+package whisperv6
+
+import (
+	mrand "math/rand"
+	"sync"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/p2p"
+	"github.com/ethereum/go-ethereum/p2p/discover"
+)
+
+// FailureInjector decides which failures are injected into the node. It is
+// called concurrently from the message loops of all the peers.
+type FailureInjector interface {
+	// DropPacket reports if the packet exchanged with the peer is lost.
+	DropPacket(peer discover.NodeID, code uint64, outbound bool) bool
+
+	// Stall returns the delay of the packet received from the peer, holding
+	// up the message loop of the peer.
+	Stall(peer discover.NodeID, code uint64) time.Duration
+
+	// ClockSkew returns the offset of the clock used by the envelope pool.
+	ClockSkew() time.Duration
+
+	// FailDecryption reports if the envelope can not be opened by the filters.
+	FailDecryption(hash common.Hash) bool
+}
+
+// RandomFailures injects the failures at random, with the given rates.
+type RandomFailures struct {
+	LossRate       float64       // Fraction of the packets lost in each direction
+	StallRate      float64       // Fraction of the received packets stalled
+	StallTime      time.Duration // Delay of the stalled packets
+	Skew           time.Duration // Offset of the clock
+	DecryptionRate float64       // Fraction of the envelopes failing to decrypt
+}
+
+func (f *RandomFailures) DropPacket(peer discover.NodeID, code uint64, outbound bool) bool {
+	return code != statusCode && mrand.Float64() < f.LossRate
+}
+
+func (f *RandomFailures) Stall(peer discover.NodeID, code uint64) time.Duration {
+	if mrand.Float64() < f.StallRate {
+		return f.StallTime
+	}
+	return 0
+}
+
+func (f *RandomFailures) ClockSkew() time.Duration {
+	return f.Skew
+}
+
+func (f *RandomFailures) FailDecryption(hash common.Hash) bool {
+	return mrand.Float64() < f.DecryptionRate
+}
+
+// InjectFailures sets the injector of the failures, nil disabling the injection.
+// The peer connections are only affected once they are established again.
+func (whisper *Whisper) InjectFailures(injector FailureInjector) {
+	whisper.hooks.mu.Lock()
+	defer whisper.hooks.mu.Unlock()
+	whisper.hooks.injector = injector
+}
+
+// failureHooks pass the hook points of the protocol handler and the pool to the
+// failure injector.
+type failureHooks struct {
+	mu       sync.RWMutex
+	injector FailureInjector
+}
+
+func (hooks *failureHooks) get() FailureInjector {
+	hooks.mu.RLock()
+	defer hooks.mu.RUnlock()
+	return hooks.injector
+}
+
+// wrap injects the packet loss and the stalls into the connection of the peer.
+func (hooks *failureHooks) wrap(id discover.NodeID, rw p2p.MsgReadWriter) p2p.MsgReadWriter {
+	if injector := hooks.get(); injector != nil {
+		return &failureRW{MsgReadWriter: rw, id: id, injector: injector}
+	}
+	return rw
+}
+
+// now returns the skewed time of the pool.
+func (hooks *failureHooks) now() time.Time {
+	if injector := hooks.get(); injector != nil {
+		return time.Now().Add(injector.ClockSkew())
+	}
+	return time.Now()
+}
+
+// failDecryption reports if the opening of the envelope should fail.
+func (hooks *failureHooks) failDecryption(envelope *Envelope) bool {
+	if injector := hooks.get(); injector != nil {
+		return injector.FailDecryption(envelope.Hash())
+	}
+	return false
+}
+
+// failureRW drops and stalls the packets of a peer connection.
+type failureRW struct {
+	p2p.MsgReadWriter
+	id       discover.NodeID
+	injector FailureInjector
+}
+
+func (rw *failureRW) ReadMsg() (p2p.Msg, error) {
+	for {
+		msg, err := rw.MsgReadWriter.ReadMsg()
+		if err != nil {
+			return msg, err
+		}
+		if rw.injector.DropPacket(rw.id, msg.Code, false) {
+			msg.Discard()
+			continue
+		}
+		if delay := rw.injector.Stall(rw.id, msg.Code); delay > 0 {
+			time.Sleep(delay)
+		}
+		return msg, nil
+	}
+}
+
+func (rw *failureRW) WriteMsg(msg p2p.Msg) error {
+	if rw.injector.DropPacket(rw.id, msg.Code, true) {
+		return nil
+	}
+	return rw.MsgReadWriter.WriteMsg(msg)
+}
@@ -0,0 +1,41 @@
+// Copyright 2017 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+// +build !whisperchaos
+
+package whisperv6
+
+import (
+	"time"
+
+	"github.com/ethereum/go-ethereum/p2p"
+	"github.com/ethereum/go-ethereum/p2p/discover"
+)
+
+// failureHooks are no-op outside of the resilience tests, see chaos.go.
+type failureHooks struct{}
+
+func (*failureHooks) wrap(id discover.NodeID, rw p2p.MsgReadWriter) p2p.MsgReadWriter {
+	return rw
+}
+
+func (*failureHooks) now() time.Time {
+	return time.Now()
+}
+
+func (*failureHooks) failDecryption(envelope *Envelope) bool {
+	return false
+}
@@ -0,0 +1,107 @@
+// Copyright 2017 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+// +build whisperchaos
+
+package whisperv6
+
+import (
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/p2p"
+	"github.com/ethereum/go-ethereum/p2p/discover"
+)
+
+// envelopeLoss drops all the envelopes received from the peers.
+type envelopeLoss struct{ RandomFailures }
+
+func (*envelopeLoss) DropPacket(peer discover.NodeID, code uint64, outbound bool) bool {
+	return code == messagesCode && !outbound
+}
+
+func TestInjectedPacketLoss(t *testing.T) {
+	InitSingleTest()
+
+	w := New(&DefaultConfig)
+	w.SetMinimumPowTest(0.0000001)
+	defer w.SetMinimumPowTest(DefaultMinimumPoW)
+	w.Start(nil)
+	defer w.Stop()
+	w.InjectFailures(&envelopeLoss{})
+
+	remote, _ := connectTestPeer(t, w, discover.NodeID{1})
+	defer remote.Close()
+
+	now := uint32(time.Now().Unix())
+	env := &Envelope{Expiry: now + DefaultTTL, TTL: DefaultTTL, Data: []byte{1}, Nonce: uint64(seed)}
+	if err := p2p.Send(remote, messagesCode, []*Envelope{env}); err != nil {
+		t.Fatalf("failed to send envelope with seed %d: %s.", seed, err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if w.GetEnvelope(env.Hash()) != nil {
+		t.Fatalf("lost envelope was added to the pool with seed %d.", seed)
+	}
+}
+
+func TestInjectedClockSkew(t *testing.T) {
+	InitSingleTest()
+
+	w := New(&DefaultConfig)
+	w.SetMinimumPowTest(0.0000001)
+	defer w.SetMinimumPowTest(DefaultMinimumPoW)
+	w.Start(nil)
+	defer w.Stop()
+
+	// the envelope is valid for the node, until its clock runs ahead
+	now := uint32(time.Now().Unix())
+	env := &Envelope{Expiry: now + DefaultTTL, TTL: DefaultTTL, Data: []byte{1}, Nonce: uint64(seed)}
+	w.InjectFailures(&RandomFailures{Skew: time.Hour})
+	if _, err := w.add(env, false); err == nil {
+		t.Fatalf("expired envelope accepted with the skewed clock with seed %d.", seed)
+	}
+	w.InjectFailures(nil)
+	if _, err := w.add(env, false); err != nil {
+		t.Fatalf("failed to add envelope with seed %d: %s.", seed, err)
+	}
+}
+
+func TestInjectedDecryptionFailure(t *testing.T) {
+	InitSingleTest()
+
+	w := New(&DefaultConfig)
+	w.InjectFailures(&RandomFailures{DecryptionRate: 1})
+	filter, err := generateFilter(t, true)
+	if err != nil {
+		t.Fatalf("failed to generate filter with seed %d: %s.", seed, err)
+	}
+	filter.Src = nil
+	if _, err := w.Subscribe(filter); err != nil {
+		t.Fatalf("failed to install filter with seed %d: %s.", seed, err)
+	}
+
+	env := generateCompatibeEnvelope(t, filter)
+
+	w.filters.NotifyWatchers(env, false)
+	if messages := filter.Retrieve(); len(messages) != 0 {
+		t.Fatalf("envelope was decrypted despite the injected failure with seed %d.", seed)
+	}
+	w.InjectFailures(nil)
+	w.filters.NotifyWatchers(env, false)
+	if messages := filter.Retrieve(); len(messages) != 1 {
+		t.Fatalf("envelope was not decrypted without the injected failure with seed %d.", seed)
+	}
+}
@@ -0,0 +1,106 @@
+// Copyright 2017 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+// Contains the compaction of the maps backing the envelope pool and the key
+// storages. The Go maps never release their buckets after the deletions, so a
+// map grown during a traffic spike keeps its memory for the lifetime of the
+// node unless it is rebuilt.
+
+package whisperv6
+
+import (
+	"crypto/ecdsa"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+const (
+	compactionMinSize = 1024 // maps which never held more entries are not worth rebuilding
+	compactionRatio   = 4    // maps are rebuilt when the occupancy drops below 1/compactionRatio of the peak
+)
+
+// highWater tracks the peak number of entries of a map since it was built.
+// The entries are only ever dropped by the deletions, so observing the size
+// right before each deletion is sufficient to catch the peak.
+type highWater struct {
+	peak int
+}
+
+// observe records the current size of the map.
+func (hw *highWater) observe(size int) {
+	if size > hw.peak {
+		hw.peak = size
+	}
+}
+
+// sparse reports whether the map with the specified size should be rebuilt.
+func (hw *highWater) sparse(size int) bool {
+	return hw.peak >= compactionMinSize && size*compactionRatio < hw.peak
+}
+
+// reset starts tracking the freshly built map with the specified size.
+func (hw *highWater) reset(size int) {
+	hw.peak = size
+}
+
+// compactEnvelopes rebuilds the envelope map if it is sparse, reporting whether
+// the map was rebuilt.
+func compactEnvelopes(envelopes map[common.Hash]*Envelope, hw *highWater) (map[common.Hash]*Envelope, bool) {
+	if !hw.sparse(len(envelopes)) {
+		return envelopes, false
+	}
+	compacted := make(map[common.Hash]*Envelope, len(envelopes))
+	for hash, envelope := range envelopes {
+		compacted[hash] = envelope
+	}
+	hw.reset(len(compacted))
+	return compacted, true
+}
+
+// compact rebuilds the sparse maps of the envelope pool and the key storages,
+// so that the memory retained after a traffic spike is returned to the runtime.
+func (whisper *Whisper) compact() {
+	whisper.poolMu.Lock()
+	var compacted bool
+	whisper.envelopes, compacted = compactEnvelopes(whisper.envelopes, &whisper.envelopesPeak)
+	if compacted {
+		whisper.poolLog.Debug("compacted the envelope pool", "envelopes", len(whisper.envelopes))
+	}
+	for _, b := range whisper.buckets {
+		b.envelopes, _ = compactEnvelopes(b.envelopes, &b.peak)
+	}
+	whisper.poolMu.Unlock()
+
+	whisper.keyMu.Lock()
+	defer whisper.keyMu.Unlock()
+
+	if whisper.privateKeysPeak.sparse(len(whisper.privateKeys)) {
+		compacted := make(map[string]*ecdsa.PrivateKey, len(whisper.privateKeys))
+		for id, key := range whisper.privateKeys {
+			compacted[id] = key
+		}
+		whisper.privateKeys = compacted
+		whisper.privateKeysPeak.reset(len(compacted))
+	}
+	if whisper.symKeysPeak.sparse(len(whisper.symKeys)) {
+		compacted := make(map[string][]byte, len(whisper.symKeys))
+		for id, key := range whisper.symKeys {
+			compacted[id] = key
+		}
+		whisper.symKeys = compacted
+		whisper.symKeysPeak.reset(len(compacted))
+	}
+}
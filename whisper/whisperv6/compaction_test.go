@@ -0,0 +1,96 @@
+// Copyright 2017 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package whisperv6
+
+import (
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+func TestEmptyBucketRemoval(t *testing.T) {
+	w := New(&DefaultConfig)
+
+	now := uint32(time.Now().Unix())
+	if now%bucketSpan == 0 {
+		// the bucket of the current second must be partially expired
+		time.Sleep(time.Second)
+		now++
+	}
+	index := bucketIndex(now + 1)
+	b := newEnvelopeBucket(index)
+	env := &Envelope{Expiry: b.start(), Data: []byte{1}}
+	hash := common.Hash{1}
+	b.add(hash, env)
+	w.envelopes[hash] = env
+	w.buckets[index] = b
+
+	w.removeExpired()
+	if _, exist := w.buckets[index]; exist {
+		t.Fatalf("empty bucket is not removed.")
+	}
+	if len(w.envelopes) != 0 {
+		t.Fatalf("expired envelope is not removed.")
+	}
+}
+
+func TestCompaction(t *testing.T) {
+	w := New(&DefaultConfig)
+
+	var ids []string
+	for i := 0; i < 2*compactionMinSize; i++ {
+		id, err := w.AddSymKeyDirect(make([]byte, aesKeyLength))
+		if err != nil {
+			t.Fatalf("failed to add key %d: %s.", i, err)
+		}
+		ids = append(ids, id)
+	}
+	w.compact()
+	if w.symKeysPeak.peak != 0 {
+		t.Fatalf("peak recorded without deletions: %d.", w.symKeysPeak.peak)
+	}
+
+	kept := ids[:compactionMinSize/4]
+	for _, id := range ids[len(kept):] {
+		w.DeleteSymKey(id)
+	}
+	if w.symKeysPeak.peak != len(ids) {
+		t.Fatalf("wrong peak: %d instead of %d.", w.symKeysPeak.peak, len(ids))
+	}
+	w.compact()
+	if w.symKeysPeak.peak != len(kept) {
+		t.Fatalf("key storage is not compacted, peak: %d.", w.symKeysPeak.peak)
+	}
+	for _, id := range kept {
+		if !w.HasSymKey(id) {
+			t.Fatalf("key %s lost by the compaction.", id)
+		}
+	}
+
+	hw := highWater{peak: compactionMinSize - 1}
+	if hw.sparse(0) {
+		t.Fatalf("small map considered for the compaction.")
+	}
+	hw.observe(compactionMinSize * compactionRatio)
+	if hw.sparse(compactionMinSize) {
+		t.Fatalf("map considered sparse at the threshold.")
+	}
+	if !hw.sparse(compactionMinSize - 1) {
+		t.Fatalf("sparse map not detected.")
+	}
+}
@@ -0,0 +1,451 @@
+// Copyright 2017 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+// +build !whisperlite
+
+// Contains the compliance tester, probing the protocol behavior of a remote
+// whisper node (e.g. a third-party or forked implementation).
+
+package whisperv6
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/p2p"
+	"github.com/ethereum/go-ethereum/p2p/discover"
+	"github.com/ethereum/go-ethereum/rlp"
+)
+
+// unknownMessageCode is a message code not assigned by the protocol, which
+// must be ignored by the compliant nodes.
+const unknownMessageCode = 100
+
+var errComplianceTimeout = errors.New("timed out")
+
+// ComplianceDialer opens a new connection running the whisper protocol with
+// the tested node, returning the message stream (before the handshake) and a
+// function closing the connection.
+type ComplianceDialer func() (p2p.MsgReadWriter, func(), error)
+
+// ComplianceResult is the outcome of a single probe.
+type ComplianceResult struct {
+	Probe    string `json:"probe"`
+	Expected string `json:"expected"`
+	Passed   bool   `json:"passed"`
+	Detail   string `json:"detail,omitempty"`
+}
+
+// ComplianceReport is the outcome of all the probes.
+type ComplianceReport struct {
+	Results []ComplianceResult `json:"results"`
+	Passed  int                `json:"passed"`
+	Failed  int                `json:"failed"`
+}
+
+// complianceConn is a connection with the tested node, after the handshake.
+type complianceConn struct {
+	rw    p2p.MsgReadWriter
+	close func()
+	pow   float64 // PoW requirement advertised by the node
+}
+
+// complianceProbe checks a single aspect of the behavior of the node.
+type complianceProbe struct {
+	name     string
+	expected string
+	run      func(t *complianceTester) error
+}
+
+var complianceProbes = []complianceProbe{
+	{"handshake", "valid status of version 6", (*complianceTester).probeHandshake},
+	{"unknown-code", "unknown message codes ignored", (*complianceTester).probeUnknownCode},
+	{"malformed-rlp", "disconnect", (*complianceTester).probeMalformedRLP},
+	{"oversized-topic", "disconnect", (*complianceTester).probeOversizedTopic},
+	{"oversized-bloom", "disconnect", (*complianceTester).probeOversizedBloom},
+	{"valid-envelope", "envelope relayed", (*complianceTester).probeValidEnvelope},
+	{"low-pow", "envelope not relayed", (*complianceTester).probeLowPoW},
+	{"future-timestamp", "envelope not relayed", (*complianceTester).probeFutureTimestamp},
+}
+
+type complianceTester struct {
+	dial    ComplianceDialer
+	timeout time.Duration
+}
+
+// RunComplianceTests probes the behavior of the node over the connections
+// opened by the dialer, waiting up to the timeout for each observation (e.g.
+// the disconnection or the relay of an envelope).
+func RunComplianceTests(dial ComplianceDialer, timeout time.Duration) *ComplianceReport {
+	t := &complianceTester{dial: dial, timeout: timeout}
+	report := new(ComplianceReport)
+	for _, probe := range complianceProbes {
+		result := ComplianceResult{Probe: probe.name, Expected: probe.expected, Passed: true}
+		if err := probe.run(t); err != nil {
+			result.Passed = false
+			result.Detail = err.Error()
+			report.Failed++
+		} else {
+			report.Passed++
+		}
+		report.Results = append(report.Results, result)
+	}
+	return report
+}
+
+// connect opens a new connection and performs the handshake, advertising the
+// full bloom filter and no PoW requirement, so that the node relays everything.
+func (t *complianceTester) connect() (*complianceConn, error) {
+	rw, closeConn, err := t.dial()
+	if err != nil {
+		return nil, err
+	}
+	conn := &complianceConn{rw: rw, close: closeConn}
+
+	errc := make(chan error, 1)
+	go func() {
+		errc <- p2p.SendItems(rw, statusCode, ProtocolVersion, math.Float64bits(0), MakeFullNodeBloom())
+	}()
+	packet, err := t.read(rw)
+	if err != nil {
+		closeConn()
+		return nil, fmt.Errorf("no status received: %v", err)
+	}
+	defer packet.Discard()
+	if packet.Code != statusCode {
+		closeConn()
+		return nil, fmt.Errorf("message %d received before the status", packet.Code)
+	}
+	s := rlp.NewStream(packet.Payload, uint64(packet.Size))
+	if _, err = s.List(); err != nil {
+		closeConn()
+		return nil, fmt.Errorf("malformed status: %v", err)
+	}
+	version, err := s.Uint()
+	if err != nil || version != ProtocolVersion {
+		closeConn()
+		return nil, fmt.Errorf("wrong protocol version %d: %v", version, err)
+	}
+	if raw, err := s.Uint(); err == nil {
+		conn.pow = math.Float64frombits(raw)
+	}
+	if err = <-errc; err != nil {
+		closeConn()
+		return nil, fmt.Errorf("failed to send status: %v", err)
+	}
+	return conn, nil
+}
+
+// read reads the next message, failing after the timeout.
+func (t *complianceTester) read(rw p2p.MsgReader) (p2p.Msg, error) {
+	type result struct {
+		packet p2p.Msg
+		err    error
+	}
+	done := make(chan result, 1)
+	go func() {
+		packet, err := rw.ReadMsg()
+		done <- result{packet, err}
+	}()
+	select {
+	case res := <-done:
+		return res.packet, res.err
+	case <-time.After(t.timeout):
+		return p2p.Msg{}, errComplianceTimeout
+	}
+}
+
+// disconnected waits until the node closes the connection, discarding the
+// messages received in the meantime.
+func (t *complianceTester) disconnected(conn *complianceConn) bool {
+	deadline := time.Now().Add(t.timeout)
+	for time.Now().Before(deadline) {
+		packet, err := t.read(conn.rw)
+		if err != nil {
+			return err != errComplianceTimeout
+		}
+		packet.Discard()
+	}
+	return false
+}
+
+// relayed checks if the node relays the envelope to the observer connection.
+func (t *complianceTester) relayed(observer *complianceConn, hash common.Hash) (bool, error) {
+	deadline := time.Now().Add(t.timeout)
+	for time.Now().Before(deadline) {
+		packet, err := t.read(observer.rw)
+		if err != nil {
+			if err == errComplianceTimeout {
+				return false, nil
+			}
+			return false, fmt.Errorf("observer disconnected: %v", err)
+		}
+		if packet.Code != messagesCode {
+			packet.Discard()
+			continue
+		}
+		var envelopes []*Envelope
+		if err := packet.Decode(&envelopes); err != nil {
+			return false, fmt.Errorf("malformed envelopes relayed: %v", err)
+		}
+		for _, env := range envelopes {
+			if env.Hash() == hash {
+				return true, nil
+			}
+		}
+	}
+	return false, nil
+}
+
+// relay sends the envelope over one connection, and checks if the node relays
+// it to another one.
+func (t *complianceTester) relay(env *Envelope) (bool, error) {
+	observer, err := t.connect()
+	if err != nil {
+		return false, err
+	}
+	defer observer.close()
+	sender, err := t.connect()
+	if err != nil {
+		return false, err
+	}
+	defer sender.close()
+
+	if err = p2p.Send(sender.rw, messagesCode, []*Envelope{env}); err != nil {
+		return false, fmt.Errorf("failed to send envelope: %v", err)
+	}
+	return t.relayed(observer, env.Hash())
+}
+
+// expectDisconnect sends the raw message and checks that the node disconnects.
+func (t *complianceTester) expectDisconnect(code uint64, payload []byte) error {
+	conn, err := t.connect()
+	if err != nil {
+		return err
+	}
+	defer conn.close()
+
+	msg := p2p.Msg{Code: code, Size: uint32(len(payload)), Payload: bytes.NewReader(payload)}
+	if err = conn.rw.WriteMsg(msg); err != nil {
+		return nil // disconnected while sending
+	}
+	if !t.disconnected(conn) {
+		return errors.New("still connected")
+	}
+	return nil
+}
+
+// complianceEnvelope creates an envelope with the given PoW, sent at the given
+// time.
+func complianceEnvelope(pow float64, sent time.Time) (*Envelope, error) {
+	key, err := generateSecureRandomData(aesKeyLength)
+	if err != nil {
+		return nil, err
+	}
+	params := &MessageParams{
+		TTL:      DefaultTTL,
+		KeySym:   key,
+		Topic:    TopicType{0xc0, 0x3c, 0x1a, 0x2e},
+		PoW:      pow,
+		WorkTime: 5,
+		Payload:  []byte("compliance"),
+	}
+	msg, err := NewSentMessage(params)
+	if err != nil {
+		return nil, err
+	}
+	env, err := msg.wrap(params)
+	if err != nil {
+		return nil, err
+	}
+	env.Expiry = uint32(sent.Unix()) + params.TTL
+	if err = env.Seal(params); err != nil {
+		return nil, err
+	}
+	return env, nil
+}
+
+func (t *complianceTester) probeHandshake() error {
+	conn, err := t.connect()
+	if err != nil {
+		return err
+	}
+	conn.close()
+	if math.IsNaN(conn.pow) || math.IsInf(conn.pow, 0) || conn.pow < 0 {
+		return fmt.Errorf("invalid PoW requirement %f", conn.pow)
+	}
+	return nil
+}
+
+func (t *complianceTester) probeUnknownCode() error {
+	conn, err := t.connect()
+	if err != nil {
+		return err
+	}
+	defer conn.close()
+
+	if err = p2p.Send(conn.rw, unknownMessageCode, []byte{1, 2, 3}); err != nil {
+		return fmt.Errorf("disconnected: %v", err)
+	}
+	if t.disconnected(conn) {
+		return errors.New("disconnected")
+	}
+	return nil
+}
+
+func (t *complianceTester) probeMalformedRLP() error {
+	return t.expectDisconnect(messagesCode, []byte{0xff, 0xff, 0xff})
+}
+
+func (t *complianceTester) probeOversizedTopic() error {
+	payload, err := rlp.EncodeToBytes([]interface{}{
+		[]interface{}{uint32(time.Now().Unix()) + DefaultTTL, uint32(DefaultTTL), []byte{1, 2, 3, 4, 5}, []byte{1}, uint64(0)},
+	})
+	if err != nil {
+		return err
+	}
+	return t.expectDisconnect(messagesCode, payload)
+}
+
+func (t *complianceTester) probeOversizedBloom() error {
+	payload, err := rlp.EncodeToBytes(make([]byte, BloomFilterSize+1))
+	if err != nil {
+		return err
+	}
+	return t.expectDisconnect(bloomFilterExCode, payload)
+}
+
+func (t *complianceTester) probeValidEnvelope() error {
+	conn, err := t.connect()
+	if err != nil {
+		return err
+	}
+	conn.close()
+
+	env, err := complianceEnvelope(math.Max(conn.pow*2, 0.001), time.Now())
+	if err != nil {
+		return err
+	}
+	ok, err := t.relay(env)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return errors.New("not relayed")
+	}
+	return nil
+}
+
+func (t *complianceTester) probeLowPoW() error {
+	conn, err := t.connect()
+	if err != nil {
+		return err
+	}
+	conn.close()
+	if conn.pow <= 0 {
+		return nil // nothing is below the requirement
+	}
+
+	// the envelope is sealed until the PoW reaches a fraction of the requirement
+	var env *Envelope
+	for i := 0; i < 100; i++ {
+		if env, err = complianceEnvelope(conn.pow/1000, time.Now()); err != nil {
+			return err
+		}
+		if env.PoW() < conn.pow {
+			break
+		}
+	}
+	if env.PoW() >= conn.pow {
+		return errors.New("failed to create an envelope below the PoW requirement")
+	}
+	if ok, err := t.relay(env); err != nil || ok {
+		return fmt.Errorf("relayed: %v", err)
+	}
+	return nil
+}
+
+func (t *complianceTester) probeFutureTimestamp() error {
+	conn, err := t.connect()
+	if err != nil {
+		return err
+	}
+	conn.close()
+
+	env, err := complianceEnvelope(math.Max(conn.pow*2, 0.001), time.Now().Add(time.Hour))
+	if err != nil {
+		return err
+	}
+	if ok, err := t.relay(env); err != nil || ok {
+		return fmt.Errorf("relayed: %v", err)
+	}
+	return nil
+}
+
+// NewComplianceDialer returns the dialer connecting to the given node, using a
+// fresh ephemeral p2p server (hence a fresh identity) for every connection.
+func NewComplianceDialer(node *discover.Node, timeout time.Duration) ComplianceDialer {
+	return func() (p2p.MsgReadWriter, func(), error) {
+		key, err := crypto.GenerateKey()
+		if err != nil {
+			return nil, nil, err
+		}
+		conns := make(chan p2p.MsgReadWriter, 1)
+		quit := make(chan struct{})
+		server := &p2p.Server{
+			Config: p2p.Config{
+				PrivateKey:  key,
+				MaxPeers:    1,
+				Name:        "whisper-compliance",
+				NoDiscovery: true,
+				StaticNodes: []*discover.Node{node},
+				Protocols: []p2p.Protocol{{
+					Name:    ProtocolName,
+					Version: uint(ProtocolVersion),
+					Length:  NumberOfMessageCodes,
+					Run: func(p *p2p.Peer, rw p2p.MsgReadWriter) error {
+						select {
+						case conns <- rw:
+						default:
+							return errors.New("already connected")
+						}
+						<-quit
+						return nil
+					},
+				}},
+			},
+		}
+		if err := server.Start(); err != nil {
+			return nil, nil, err
+		}
+		closeConn := func() {
+			close(quit)
+			server.Stop()
+		}
+		select {
+		case rw := <-conns:
+			return rw, closeConn, nil
+		case <-time.After(timeout):
+			closeConn()
+			return nil, nil, fmt.Errorf("failed to connect to %v", node)
+		}
+	}
+}
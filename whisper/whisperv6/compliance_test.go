@@ -0,0 +1,83 @@
+// Copyright 2017 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+// +build !whisperlite
+
+package whisperv6
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/p2p"
+	"github.com/ethereum/go-ethereum/p2p/discover"
+)
+
+func TestComplianceReport(t *testing.T) {
+	w := New(&DefaultConfig)
+	w.Start(nil)
+	defer w.Stop()
+
+	var id byte
+	dial := func() (p2p.MsgReadWriter, func(), error) {
+		id++
+		local, remote := p2p.MsgPipe()
+		go func(id discover.NodeID) {
+			w.HandlePeer(p2p.NewPeer(id, "test", nil), local)
+			local.Close()
+		}(discover.NodeID{id})
+		return remote, func() { remote.Close() }, nil
+	}
+	report := RunComplianceTests(dial, time.Second)
+	if report.Failed != 0 || report.Passed != len(complianceProbes) {
+		t.Fatalf("compliant node failed: %+v.", report.Results)
+	}
+}
+
+func TestComplianceFailures(t *testing.T) {
+	// the node never disconnects nor relays anything
+	dial := func() (p2p.MsgReadWriter, func(), error) {
+		local, remote := p2p.MsgPipe()
+		go func() {
+			p2p.SendItems(local, statusCode, ProtocolVersion, math.Float64bits(0.2), MakeFullNodeBloom())
+			for {
+				packet, err := local.ReadMsg()
+				if err != nil {
+					return
+				}
+				packet.Discard()
+			}
+		}()
+		return remote, func() { remote.Close() }, nil
+	}
+	report := RunComplianceTests(dial, 200*time.Millisecond)
+
+	failed := make(map[string]bool)
+	for _, result := range report.Results {
+		if !result.Passed {
+			failed[result.Probe] = true
+		}
+	}
+	for _, probe := range []string{"malformed-rlp", "oversized-topic", "oversized-bloom", "valid-envelope"} {
+		if !failed[probe] {
+			t.Fatalf("probe %s passed on a non-compliant node: %+v.", probe, report.Results)
+		}
+	}
+	if report.Failed != len(failed) || report.Passed+report.Failed != len(complianceProbes) {
+		t.Fatalf("wrong report totals: %d passed, %d failed.", report.Passed, report.Failed)
+	}
+}
@@ -16,10 +16,62 @@
 
 package whisperv6
 
+import (
+	"time"
+
+	"github.com/ethereum/go-ethereum/p2p/discover"
+)
+
 // Config represents the configuration state of a whisper node.
 type Config struct {
 	MaxMessageSize     uint32  `toml:",omitempty"`
 	MinimumAcceptedPOW float64 `toml:",omitempty"`
+	SealWorkers        int     `toml:",omitempty"` // Number of background sealing workers (zero disables the work bank)
+	SealThreads        int     `toml:",omitempty"` // Number of workers reserved for sealing a single message (zero means all)
+	PoWVerifiers       int     `toml:",omitempty"` // Number of workers verifying the PoW of the received envelopes (zero means the number of CPUs)
+	MaxPeers           int     `toml:",omitempty"` // Maximum number of whisper peers (zero means unlimited)
+	ReservedPeers      int     `toml:",omitempty"` // Number of peer slots reserved for the trusted and static peers
+	DelayOwnEnvelopes  bool    `toml:",omitempty"` // Hold back the locally originated envelopes for a random transmission cycle
+	WatchOnly          bool    `toml:",omitempty"` // Refuse the keys and the decrypting filters over RPC (relaying and archiving only)
+	LocalLoopback      bool    `toml:",omitempty"` // Deliver the messages addressed to the local identities locally, without PoW and broadcast
+	LocalBus           bool    `toml:",omitempty"` // Serve as an in-process pub/sub bus only: no peers and no PoW
+	RejectionNotices   bool    `toml:",omitempty"` // Notify the peers about the reasons of their rejected envelopes
+	LatencyScheduling  bool    `toml:",omitempty"` // Transmit to the low-latency peers first within each cycle, probing the round-trip times
+	AdaptiveBloom      bool    `toml:",omitempty"` // Shrink the restricted bloom filter as the filters are removed (rate limited)
+	AcceptBatches      bool    `toml:",omitempty"` // Add the batch topic to the bloom filters of the installed filters, receiving the batches of messages
+
+	WebSocketRelay  string `toml:",omitempty"` // Listening address of the websocket relay serving the browser clients (empty disables the relay)
+	RelayMaxClients int    `toml:",omitempty"` // Maximum number of the websocket relay clients (zero means the default)
+
+	SyncAllowance     int           `toml:",omitempty"` // Tolerated clock skew and processing delay, in seconds
+	MessageQueueLimit int           `toml:",omitempty"` // Capacity of the queues of the messages waiting for the filters
+	ExpirationCycle   time.Duration `toml:",omitempty"` // Interval of the envelope expiration
+	TransmissionCycle time.Duration `toml:",omitempty"` // Interval of the envelope broadcast to the peers
+	MetricsPrefix     string        `toml:",omitempty"` // Prefix of the registered meters, distinct for every node in the process
+	AntiEntropyCycle  time.Duration `toml:",omitempty"` // Interval of the digest sync with the peers (zero disables the sync)
+	PeerWarmUp        time.Duration `toml:",omitempty"` // Grace period after the handshake, tolerating the envelopes sent before it settled
+	DeliveryGrace     time.Duration `toml:",omitempty"` // Period after the expiry, in which the late envelopes are still delivered to the local filters (zero disables)
+	GossipFanout      int           `toml:",omitempty"` // Number of peers each envelope is pushed to (zero floods all the peers, FanoutSqrt picks the square root)
+
+	BloomFilterSize int `toml:",omitempty"` // Size of the topic bloom filter in bytes (zero means the protocol default)
+	BloomHashes     int `toml:",omitempty"` // Number of bloom filter bits set per topic (zero means the protocol default)
+
+	OutboundTopicAllowlist []TopicType `toml:",omitempty"` // Topics the node may originate messages with (empty means any)
+	OutboundTopicBlocklist []TopicType `toml:",omitempty"` // Topics the node must not originate messages with
+
+	PeerGroups    []PeerGroup       `toml:",omitempty"` // Routing domains restricting the topics forwarded to the tagged peers
+	PeerAllowlist []discover.NodeID `toml:",omitempty"` // Node IDs of the only peers admitted to the handshake (empty means any, otherwise the relay clients are refused)
+
+	ClientMaxIdentities     int `toml:",omitempty"` // Maximum number of keys created by a single RPC client (zero means unlimited)
+	ClientMaxFilters        int `toml:",omitempty"` // Maximum number of filters installed by a single RPC client
+	ClientMaxPostsPerMinute int `toml:",omitempty"` // Maximum number of messages posted by a single RPC client per minute
+	ClientMaxQueuedMessages int `toml:",omitempty"` // Maximum number of messages waiting in a single filter of an RPC client
+
+	ClientMaxIdentitiesPerMinute int           `toml:",omitempty"` // Maximum number of keys created by a single RPC client per minute
+	IdleIdentityExpiry           time.Duration `toml:",omitempty"` // Age of the RPC created keys never used for decryption to be deleted (zero means never)
+	MaxIdleIdentities            int           `toml:",omitempty"` // Maximum number of the RPC created keys never used for decryption (zero means unlimited)
+
+	LogLevels map[string]string `toml:",omitempty"` // Verbosity overrides of the logging subsystems (e.g. "whisper/peer": "debug")
 }
 
 // DefaultConfig represents (shocker!) the default configuration.
@@ -27,3 +79,12 @@ var DefaultConfig = Config{
 	MaxMessageSize:     DefaultMaxMessageSize,
 	MinimumAcceptedPOW: DefaultMinimumPoW,
 }
+
+// quotaLimits holds the per-client limits, zero meaning unlimited.
+type quotaLimits struct {
+	identities          int
+	filters             int
+	postsPerMinute      int
+	identitiesPerMinute int
+	queuedMessages      int // maximum number of messages waiting in a single filter
+}
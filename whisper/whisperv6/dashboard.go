@@ -0,0 +1,185 @@
+// Copyright 2017 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+// Contains the time series of the relay statistics, aggregated for the operator
+// dashboards without any external metrics infrastructure.
+
+package whisperv6
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/ethereum/go-ethereum/p2p"
+)
+
+const (
+	dashboardInterval  = time.Minute // interval between the dashboard samples
+	dashboardHistory   = 60          // number of samples retained
+	dashboardTopTopics = 10          // number of the busiest topics reported per sample
+)
+
+// TopicUsage is the traffic of a single topic within a dashboard sample.
+type TopicUsage struct {
+	Topic     TopicType `json:"topic"`
+	Envelopes int       `json:"envelopes"`
+	Bytes     int       `json:"bytes"`
+}
+
+// DashboardSample contains the statistics of the node over a single interval.
+// The pool size, memory and peers are taken at the end of the interval, the
+// rest is accumulated over the interval.
+type DashboardSample struct {
+	Time      time.Time          `json:"time"`
+	PoolSize  int                `json:"poolSize"`
+	Memory    int                `json:"memory"`
+	Peers     int                `json:"peers"`
+	BytesIn   uint64             `json:"bytesIn"`
+	BytesOut  uint64             `json:"bytesOut"`
+	Added     int                `json:"added"`
+	Dropped   map[DropReason]int `json:"dropped"`
+	TopTopics []TopicUsage       `json:"topTopics"`
+}
+
+// dashboard accumulates the statistics of the current interval and keeps the
+// samples of the past intervals.
+type dashboard struct {
+	mu      sync.Mutex
+	current DashboardSample
+	topics  map[TopicType]*TopicUsage
+	samples []DashboardSample // oldest first
+}
+
+func newDashboard() *dashboard {
+	d := &dashboard{}
+	d.reset()
+	return d
+}
+
+// reset starts a new interval. It must be called with the mutex held.
+func (d *dashboard) reset() {
+	d.current = DashboardSample{Dropped: make(map[DropReason]int)}
+	d.topics = make(map[TopicType]*TopicUsage)
+}
+
+func (d *dashboard) added(envelope *Envelope) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.current.Added++
+	usage := d.topics[envelope.Topic]
+	if usage == nil {
+		usage = &TopicUsage{Topic: envelope.Topic}
+		d.topics[envelope.Topic] = usage
+	}
+	usage.Envelopes++
+	usage.Bytes += envelope.size()
+}
+
+func (d *dashboard) dropped(reason DropReason) {
+	d.mu.Lock()
+	d.current.Dropped[reason]++
+	d.mu.Unlock()
+}
+
+func (d *dashboard) traffic(in, out uint32) {
+	d.mu.Lock()
+	d.current.BytesIn += uint64(in)
+	d.current.BytesOut += uint64(out)
+	d.mu.Unlock()
+}
+
+// snapshot returns the statistics of the current interval, completed with the
+// state of the node.
+func (d *dashboard) snapshot(whisper *Whisper, now time.Time) DashboardSample {
+	sample := d.current
+	sample.Time = now
+	sample.Dropped = make(map[DropReason]int, len(d.current.Dropped))
+	for reason, n := range d.current.Dropped {
+		sample.Dropped[reason] = n
+	}
+	sample.TopTopics = make([]TopicUsage, 0, len(d.topics))
+	for _, usage := range d.topics {
+		sample.TopTopics = append(sample.TopTopics, *usage)
+	}
+	sort.Slice(sample.TopTopics, func(i, j int) bool {
+		return sample.TopTopics[i].Envelopes > sample.TopTopics[j].Envelopes
+	})
+	if len(sample.TopTopics) > dashboardTopTopics {
+		sample.TopTopics = sample.TopTopics[:dashboardTopTopics]
+	}
+
+	whisper.poolMu.RLock()
+	sample.PoolSize = len(whisper.envelopes)
+	whisper.poolMu.RUnlock()
+	whisper.peerMu.RLock()
+	sample.Peers = len(whisper.peers)
+	whisper.peerMu.RUnlock()
+	sample.Memory = whisper.Stats().memoryUsed
+	return sample
+}
+
+// sample closes the current interval, storing its statistics.
+func (d *dashboard) sample(whisper *Whisper, now time.Time) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.samples = append(d.samples, d.snapshot(whisper, now))
+	if len(d.samples) > dashboardHistory {
+		d.samples = d.samples[len(d.samples)-dashboardHistory:]
+	}
+	d.reset()
+}
+
+// Dashboard returns the samples of the last minutes (all the retained ones if
+// minutes is not positive), followed by the statistics of the ongoing interval.
+func (whisper *Whisper) Dashboard(minutes int) []DashboardSample {
+	d := whisper.dashboard
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	now := time.Now()
+	samples := make([]DashboardSample, 0, len(d.samples)+1)
+	for _, sample := range d.samples {
+		if minutes <= 0 || now.Sub(sample.Time) <= time.Duration(minutes)*time.Minute {
+			samples = append(samples, sample)
+		}
+	}
+	return append(samples, d.snapshot(whisper, now))
+}
+
+// dashboardRW counts the traffic of a peer connection for the dashboard.
+type dashboardRW struct {
+	p2p.MsgReadWriter
+	dashboard *dashboard
+}
+
+func (rw *dashboardRW) ReadMsg() (p2p.Msg, error) {
+	msg, err := rw.MsgReadWriter.ReadMsg()
+	if err == nil {
+		rw.dashboard.traffic(msg.Size, 0)
+	}
+	return msg, err
+}
+
+func (rw *dashboardRW) WriteMsg(msg p2p.Msg) error {
+	err := rw.MsgReadWriter.WriteMsg(msg)
+	if err == nil {
+		rw.dashboard.traffic(0, msg.Size)
+	}
+	return err
+}
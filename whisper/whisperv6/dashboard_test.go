@@ -0,0 +1,61 @@
+// Copyright 2017 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package whisperv6
+
+import (
+	"testing"
+	"time"
+)
+
+func TestDashboard(t *testing.T) {
+	InitSingleTest()
+
+	w := New(&DefaultConfig)
+	w.SetMinimumPowTest(0.0000001)
+
+	now := uint32(time.Now().Unix())
+	for i := 0; i < 3; i++ {
+		env := &Envelope{Expiry: now + 10, TTL: 10, Topic: TopicType{byte(i % 2)}, Data: []byte{byte(i)}, Nonce: uint64(seed)}
+		if _, err := w.add(env, false); err != nil {
+			t.Fatalf("failed to add envelope %d with seed %d: %s.", i, seed, err)
+		}
+	}
+	expired := &Envelope{Expiry: now - 1, TTL: 10, Data: []byte{0xff}}
+	w.add(expired, false)
+
+	w.dashboard.sample(w, time.Now().Add(-2*time.Minute))
+	w.dashboard.sample(w, time.Now())
+
+	samples := w.Dashboard(0)
+	if len(samples) != 3 {
+		t.Fatalf("wrong number of samples: %d.", len(samples))
+	}
+	first := samples[0]
+	if first.Added != 3 || first.PoolSize != 3 || first.Dropped[DropReasonExpired] != 1 {
+		t.Fatalf("wrong sample: %+v.", first)
+	}
+	if len(first.TopTopics) != 2 || first.TopTopics[0].Topic != (TopicType{0}) || first.TopTopics[0].Envelopes != 2 {
+		t.Fatalf("wrong top topics: %+v.", first.TopTopics)
+	}
+	if samples[1].Added != 0 || samples[1].PoolSize != 3 {
+		t.Fatalf("wrong second sample: %+v.", samples[1])
+	}
+
+	if n := len(w.Dashboard(1)); n != 2 {
+		t.Fatalf("wrong number of recent samples: %d.", n)
+	}
+}
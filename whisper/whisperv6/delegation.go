@@ -0,0 +1,108 @@
+// Copyright 2017 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+// Contains the delegation tokens, allowing a trusted identity (e.g. the gateway
+// of an organization) to grant the access to a mail server to its clients.
+
+package whisperv6
+
+import (
+	"crypto/ecdsa"
+	"errors"
+	"fmt"
+
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/rlp"
+)
+
+// MaxDelegationDepth is the maximum number of tokens in a delegation chain.
+const MaxDelegationDepth = 4
+
+// DelegationToken grants the access of its issuer to the delegate, until the
+// expiry. If the token is delegable, the delegate may issue tokens in turn.
+type DelegationToken struct {
+	Delegate  []byte // Public key of the delegate
+	Expiry    uint64 // Unix time until which the delegation is valid
+	Delegable bool   // Whether the delegate may delegate further
+	Signature []byte // Signature of the issuer
+}
+
+// sigHash returns the hash of the signed token fields.
+func (t *DelegationToken) sigHash() []byte {
+	data, _ := rlp.EncodeToBytes([]interface{}{t.Delegate, t.Expiry, t.Delegable})
+	return crypto.Keccak256(data)
+}
+
+// NewDelegationToken issues a token delegating the access of the issuer.
+func NewDelegationToken(issuer *ecdsa.PrivateKey, delegate *ecdsa.PublicKey, expiry uint64, delegable bool) (*DelegationToken, error) {
+	token := &DelegationToken{
+		Delegate:  crypto.FromECDSAPub(delegate),
+		Expiry:    expiry,
+		Delegable: delegable,
+	}
+	sig, err := crypto.Sign(token.sigHash(), issuer)
+	if err != nil {
+		return nil, err
+	}
+	token.Signature = sig
+	return token, nil
+}
+
+// Issuer recovers the public key of the issuer from the signature.
+func (t *DelegationToken) Issuer() (*ecdsa.PublicKey, error) {
+	return crypto.SigToPub(t.sigHash(), t.Signature)
+}
+
+// VerifyDelegationChain checks that the chain of tokens starts with an issuer
+// accepted by the trusted function, every next token is issued by the delegate
+// of the previous one, and the last delegate is the subject. All the tokens
+// must be valid at the specified time. The trusted root is returned.
+func VerifyDelegationChain(chain []*DelegationToken, subject *ecdsa.PublicKey, trusted func(*ecdsa.PublicKey) bool, now uint64) (*ecdsa.PublicKey, error) {
+	if len(chain) == 0 {
+		return nil, errors.New("empty delegation chain")
+	}
+	if len(chain) > MaxDelegationDepth {
+		return nil, fmt.Errorf("delegation chain too long: %d", len(chain))
+	}
+	root, err := chain[0].Issuer()
+	if err != nil {
+		return nil, fmt.Errorf("invalid signature of delegation token 0: %v", err)
+	}
+	if !trusted(root) {
+		return nil, errors.New("delegation chain issued by an untrusted identity")
+	}
+	for i, token := range chain {
+		if token.Expiry < now {
+			return nil, fmt.Errorf("delegation token %d expired", i)
+		}
+		if i > 0 {
+			issuer, err := token.Issuer()
+			if err != nil {
+				return nil, fmt.Errorf("invalid signature of delegation token %d: %v", i, err)
+			}
+			if !chain[i-1].Delegable {
+				return nil, fmt.Errorf("delegation token %d may not be delegated", i-1)
+			}
+			if !IsPubKeyEqual(issuer, crypto.ToECDSAPub(chain[i-1].Delegate)) {
+				return nil, fmt.Errorf("delegation token %d not issued by the previous delegate", i)
+			}
+		}
+	}
+	if !IsPubKeyEqual(subject, crypto.ToECDSAPub(chain[len(chain)-1].Delegate)) {
+		return nil, errors.New("delegation chain does not grant the access to the subject")
+	}
+	return root, nil
+}
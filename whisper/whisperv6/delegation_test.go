@@ -0,0 +1,72 @@
+// Copyright 2017 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package whisperv6
+
+import (
+	"crypto/ecdsa"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/crypto"
+)
+
+func TestDelegationChain(t *testing.T) {
+	keys := make([]*ecdsa.PrivateKey, 4)
+	for i := range keys {
+		keys[i], _ = crypto.GenerateKey()
+	}
+	root, gateway, client, stranger := keys[0], keys[1], keys[2], keys[3]
+	trusted := func(pub *ecdsa.PublicKey) bool { return IsPubKeyEqual(pub, &root.PublicKey) }
+
+	const now, expiry = 1000, 2000
+	issue := func(issuer *ecdsa.PrivateKey, delegate *ecdsa.PrivateKey, expiry uint64, delegable bool) *DelegationToken {
+		token, err := NewDelegationToken(issuer, &delegate.PublicKey, expiry, delegable)
+		if err != nil {
+			t.Fatalf("failed to issue token: %s.", err)
+		}
+		return token
+	}
+
+	chain := []*DelegationToken{issue(root, gateway, expiry, true), issue(gateway, client, expiry, false)}
+	if pub, err := VerifyDelegationChain(chain, &client.PublicKey, trusted, now); err != nil || !IsPubKeyEqual(pub, &root.PublicKey) {
+		t.Fatalf("valid chain rejected: %v.", err)
+	}
+
+	cases := []struct {
+		name    string
+		chain   []*DelegationToken
+		subject *ecdsa.PrivateKey
+	}{
+		{"empty", nil, client},
+		{"wrong subject", chain, stranger},
+		{"untrusted root", []*DelegationToken{issue(stranger, client, expiry, false)}, client},
+		{"expired", []*DelegationToken{issue(root, gateway, expiry, true), issue(gateway, client, now-1, false)}, client},
+		{"not delegable", []*DelegationToken{issue(root, gateway, expiry, false), issue(gateway, client, expiry, false)}, client},
+		{"broken link", []*DelegationToken{issue(root, gateway, expiry, true), issue(stranger, client, expiry, false)}, client},
+		{"too long", []*DelegationToken{chain[0], chain[0], chain[0], chain[0], chain[0]}, gateway},
+	}
+	for _, c := range cases {
+		if _, err := VerifyDelegationChain(c.chain, &c.subject.PublicKey, trusted, now); err == nil {
+			t.Fatalf("%s: invalid chain accepted.", c.name)
+		}
+	}
+
+	tampered := *chain[1]
+	tampered.Expiry++
+	if _, err := VerifyDelegationChain([]*DelegationToken{chain[0], &tampered}, &client.PublicKey, trusted, now); err == nil {
+		t.Fatalf("tampered token accepted.")
+	}
+}
@@ -0,0 +1,158 @@
+// Copyright 2017 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package whisperv6
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/p2p"
+)
+
+// DeliveryMode specifies the guarantee requested for the delivery of a message.
+type DeliveryMode string
+
+const (
+	// DeliveryBestEffort only adds the envelope to the pool, to be broadcast
+	// in the coming cycles (the default)
+	DeliveryBestEffort DeliveryMode = "bestEffort"
+
+	// DeliveryAcknowledged waits until any peer acknowledges the envelope
+	DeliveryAcknowledged DeliveryMode = "acknowledged"
+
+	// DeliveryArchived waits until a trusted peer running a mail server
+	// acknowledges the envelope, i.e. confirms it was archived
+	DeliveryArchived DeliveryMode = "archived"
+)
+
+// ErrDeliveryNotConfirmed is returned if the delivery was not confirmed by the
+// peers before the envelope expired or the context was cancelled.
+var ErrDeliveryNotConfirmed = errors.New("delivery not confirmed")
+
+// envelopeAck is the acknowledgement of the envelopes received by a peer.
+type envelopeAck struct {
+	Hashes   []common.Hash
+	Archived bool // Indicates if the peer archived the envelopes in a mail server
+}
+
+// pendingDelivery is a sent envelope awaiting the acknowledgement.
+type pendingDelivery struct {
+	mode DeliveryMode
+	done chan struct{}
+}
+
+// SendWithDelivery injects the envelope into the send queue as Send does, and
+// waits until the delivery is confirmed according to the requested mode. The
+// confirmation is awaited at most until the envelope expires.
+func (whisper *Whisper) SendWithDelivery(ctx context.Context, envelope *Envelope, mode DeliveryMode) error {
+	switch mode {
+	case "", DeliveryBestEffort:
+		return whisper.Send(envelope)
+	case DeliveryAcknowledged, DeliveryArchived:
+	default:
+		return fmt.Errorf("unknown delivery mode: %s", mode)
+	}
+
+	hash := envelope.Hash()
+	d := &pendingDelivery{mode: mode, done: make(chan struct{})}
+	whisper.deliveryMu.Lock()
+	whisper.deliveries[hash] = d
+	whisper.deliveryMu.Unlock()
+
+	defer func() {
+		whisper.deliveryMu.Lock()
+		delete(whisper.deliveries, hash)
+		whisper.deliveryMu.Unlock()
+	}()
+
+	if err := whisper.Send(envelope); err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithDeadline(ctx, time.Unix(int64(envelope.Expiry), 0))
+	defer cancel()
+	select {
+	case <-d.done:
+		return nil
+	case <-ctx.Done():
+		return ErrDeliveryNotConfirmed
+	}
+}
+
+// awaitingAck returns the hashes of the envelopes awaiting the acknowledgement.
+func (whisper *Whisper) awaitingAck(envelopes []*Envelope) []common.Hash {
+	whisper.deliveryMu.RLock()
+	defer whisper.deliveryMu.RUnlock()
+
+	if len(whisper.deliveries) == 0 {
+		return nil
+	}
+	var hashes []common.Hash
+	for _, envelope := range envelopes {
+		if _, ok := whisper.deliveries[envelope.Hash()]; ok {
+			hashes = append(hashes, envelope.Hash())
+		}
+	}
+	return hashes
+}
+
+// confirmDelivery completes the deliveries acknowledged by the peer. The
+// archival is only accepted from the trusted peers.
+func (whisper *Whisper) confirmDelivery(p *Peer, ack *envelopeAck) {
+	whisper.deliveryMu.Lock()
+	defer whisper.deliveryMu.Unlock()
+
+	for _, hash := range ack.Hashes {
+		d, ok := whisper.deliveries[hash]
+		if !ok {
+			continue
+		}
+		if d.mode == DeliveryArchived && !(ack.Archived && p.Trusted()) {
+			continue
+		}
+		close(d.done)
+		delete(whisper.deliveries, hash)
+		p.log.Trace("delivery confirmed", "hash", hash.Hex(), "mode", d.mode)
+	}
+}
+
+// requestAcks asks the peer to acknowledge the sent envelopes, which are
+// awaiting the confirmation of the delivery.
+func (peer *Peer) requestAcks(envelopes []*Envelope) error {
+	hashes := peer.host.awaitingAck(envelopes)
+	if len(hashes) == 0 {
+		return nil
+	}
+	return p2p.Send(peer.ws, ackRequestCode, hashes)
+}
+
+// handleAckRequest acknowledges the requested envelopes held in the pool.
+func (peer *Peer) handleAckRequest(hashes []common.Hash) error {
+	ack := envelopeAck{Archived: peer.host.mailServer != nil}
+	for _, hash := range hashes {
+		if peer.host.isEnvelopeCached(hash) {
+			ack.Hashes = append(ack.Hashes, hash)
+		}
+	}
+	if len(ack.Hashes) == 0 {
+		return nil
+	}
+	return p2p.Send(peer.ws, ackCode, &ack)
+}
@@ -0,0 +1,76 @@
+// Copyright 2017 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package whisperv6
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/p2p"
+	"github.com/ethereum/go-ethereum/p2p/discover"
+)
+
+func TestDeliveryGuarantees(t *testing.T) {
+	InitSingleTest()
+
+	w := New(&DefaultConfig)
+	w.SetMinimumPowTest(0.0000001)
+	defer w.SetMinimumPowTest(DefaultMinimumPoW)
+	w.Start(nil)
+	defer w.Stop()
+
+	remote, _ := connectTestPeer(t, w, discover.NodeID{1})
+	defer remote.Close()
+
+	for i, mode := range []DeliveryMode{DeliveryAcknowledged, DeliveryArchived} {
+		now := uint32(time.Now().Unix())
+		env := &Envelope{Expiry: now + DefaultTTL, TTL: DefaultTTL, Data: []byte{byte(i)}, Nonce: uint64(seed)}
+
+		ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+		errc := make(chan error, 1)
+		go func() { errc <- w.SendWithDelivery(ctx, env, mode) }()
+
+		// the archival is not accepted from the untrusted peers
+		var hashes []common.Hash
+		expectPacket(t, remote, ackRequestCode, &hashes)
+		if len(hashes) != 1 || hashes[0] != env.Hash() {
+			t.Fatalf("wrong ack request received in mode %s: %v.", mode, hashes)
+		}
+		if err := p2p.Send(remote, ackCode, &envelopeAck{Hashes: hashes, Archived: true}); err != nil {
+			t.Fatalf("failed to send ack: %s.", err)
+		}
+
+		err := <-errc
+		cancel()
+		switch mode {
+		case DeliveryAcknowledged:
+			if err != nil {
+				t.Fatalf("acknowledged delivery failed: %s.", err)
+			}
+		case DeliveryArchived:
+			if err != ErrDeliveryNotConfirmed {
+				t.Fatalf("archival confirmed by untrusted peer: %v.", err)
+			}
+		}
+	}
+
+	if err := w.SendWithDelivery(context.Background(), &Envelope{}, "unknown"); err == nil {
+		t.Fatalf("unknown delivery mode accepted.")
+	}
+}
@@ -26,6 +26,17 @@ Whisper is a pure identity-based messaging system. Whisper provides a low-level
 (non-application-specific) but easily-accessible API without being based upon
 or prejudiced by the low-level hardware attributes and characteristics,
 particularly the notion of singular endpoints.
+
+The embedded clients (e.g. mobile) may build with the whisperlite tag, which
+strips the RPC service along with its client quotas, the websocket relay, and
+the compliance and self-test diagnostics, keeping only the envelope, crypto and
+protocol core. The lite build does not depend on the rpc package, the embedders
+register it as a node service exposing no APIs (see mobile).
+The mail server lives in its own package, linked only if imported.
+
+The whisperchaos tag compiles in the failure injection hooks (see
+InjectFailures), allowing the embedders to test their integration against the
+packet loss, stalled peers, skewed clocks and failed decryption.
 */
 
 // Contains the Whisper protocol constant definitions
@@ -48,15 +59,31 @@ const (
 	messagesCode         = 1   // normal whisper message
 	powRequirementCode   = 2   // PoW requirement
 	bloomFilterExCode    = 3   // bloom filter exchange
+	syncDigestCode       = 4   // digests of the expiry buckets (anti-entropy sync)
+	syncHashesCode       = 5   // hashes of the envelopes in the mismatching buckets
+	syncRequestCode      = 6   // request for the missing envelopes
+	ackRequestCode       = 7   // request to acknowledge the received envelopes
+	ackCode              = 8   // acknowledgement of the received envelopes
+	sessionInitCode      = 9   // nonce of the session with a trusted peer
+	sessionMessageCode   = 10  // peer-to-peer message bound to the session transcript
+	rejectionNoticeCode  = 11  // notices of the envelopes rejected by the node
 	p2pRequestCode       = 126 // peer-to-peer message, used by Dapp protocol
 	p2pMessageCode       = 127 // peer-to-peer message (to be consumed by the peer, but not forwarded any further)
 	NumberOfMessageCodes = 128
 
+	featureSync = uint64(1) // handshake feature: the node runs the anti-entropy sync with its peers
+
 	SizeMask      = byte(3) // mask used to extract the size of payload size field from the flags
 	signatureFlag = byte(4)
+	sequenceFlag  = byte(8)  // the payload is preceded by the sequence number of the message
+	tombstoneFlag = byte(16) // the payload is preceded by the hash of the redacted envelope
+	sessionFlag   = byte(32) // the payload is preceded by the transcript of the session it is bound to
 
 	TopicLength     = 4  // in bytes
 	signatureLength = 65 // in bytes
+	seqHeaderLength = 8  // in bytes
+	tombstoneLength = 32 // in bytes
+	sessionLength   = 32 // in bytes
 	aesKeyLength    = 32 // in bytes
 	aesNonceLength  = 12 // in bytes; for more info please see cipher.gcmStandardNonceSize & aesgcm.NonceSize()
 	keyIDSize       = 32 // in bytes
@@ -71,9 +98,16 @@ const (
 
 	padSizeLimit      = 256 // just an arbitrary number, could be changed without breaking the protocol
 	messageQueueLimit = 1024
+	filterDedupLimit  = 8192 // number of delivered message hashes remembered by each filter
+	sequenceLimit     = 4096 // number of sender channels tracked for the gap detection
+	sequenceHistory   = 64   // number of recent sequence numbers remembered by each channel
 
 	expirationCycle   = time.Second
 	transmissionCycle = 300 * time.Millisecond
+	peerWarmUp        = 5 * time.Second  // grace period of the new peers, see Config.PeerWarmUp
+	gossipRepairCycle = 5 * time.Second  // anti-entropy cycle enforced by the fanout-limited gossip
+	latencyProbeCycle = 2 * time.Second  // interval of the round-trip probes of the latency-aware scheduling
+	bloomRefreshCycle = 10 * time.Second // minimum interval between the adaptive bloom filter announcements
 
 	DefaultTTL           = 50 // seconds
 	DefaultSyncAllowance = 10 // seconds
@@ -19,6 +19,7 @@
 package whisperv6
 
 import (
+	"context"
 	"crypto/ecdsa"
 	"encoding/binary"
 	"fmt"
@@ -42,11 +43,19 @@ type Envelope struct {
 	Data   []byte
 	Nonce  uint64
 
-	pow float64 // Message-specific PoW as described in the Whisper specification.
+	pow     float64 // Message-specific PoW as described in the Whisper specification.
+	powBits int     // Cached number of leading zero bits of the PoW hash, valid if pow is set.
 
 	// the following variables should not be accessed directly, use the corresponding function instead: Hash(), Bloom()
 	hash  common.Hash // Cached hash of the envelope to avoid rehashing every time.
 	bloom []byte
+
+	session common.Hash     // Transcript of the session the envelope was received in, zero if none
+	schema  *envelopeSchema // Schema of the protocol version the envelope was received in (nil means the default)
+
+	// Bitmask of the envelope flags (extended format), empty if none. The
+	// optional trailing element must be the last field of the struct.
+	Flags []uint64 `rlp:"tail"`
 }
 
 // size returns the size of envelope as it is sent (i.e. public fields only)
@@ -56,7 +65,11 @@ func (e *Envelope) size() int {
 
 // rlpWithoutNonce returns the RLP encoded envelope contents, except the nonce.
 func (e *Envelope) rlpWithoutNonce() []byte {
-	res, _ := rlp.EncodeToBytes([]interface{}{e.Expiry, e.TTL, e.Topic, e.Data})
+	fields := []interface{}{e.Expiry, e.TTL, e.Topic, e.Data}
+	if len(e.Flags) > 0 {
+		fields = append(fields, e.Flags)
+	}
+	res, _ := rlp.EncodeToBytes(fields)
 	return res
 }
 
@@ -74,49 +87,102 @@ func NewEnvelope(ttl uint32, topic TopicType, msg *sentMessage) *Envelope {
 	return &env
 }
 
+// SealProgress is a callback periodically invoked while an envelope is being
+// sealed, reporting the best PoW reached so far and the number of nonces tried.
+type SealProgress func(bestPoW float64, tried uint64)
+
+// sealProgressInterval is the number of nonces tried between two consecutive
+// cancellation checks and progress reports.
+const sealProgressInterval = 1024
+
 // Seal closes the envelope by spending the requested amount of time as a proof
 // of work on hashing the data.
 func (e *Envelope) Seal(options *MessageParams) error {
+	return e.SealContext(context.Background(), options, nil)
+}
+
+// SealContext is identical to Seal, but aborts the computation as soon as the
+// context is cancelled, and reports the progress to the (optional) callback.
+// If the sealing is aborted, the envelope retains the best nonce found so far.
+func (e *Envelope) SealContext(ctx context.Context, options *MessageParams, progress SealProgress) error {
 	if options.PoW == 0 {
 		// PoW is not required
 		return nil
 	}
 
-	var target, bestBit int
+	target := e.sealTarget(options)
+	finish := time.Now().Add(time.Duration(options.WorkTime) * time.Second).UnixNano()
+
+	var report func(int, uint64)
+	if progress != nil {
+		report = func(bestBit int, tried uint64) {
+			progress(e.bitsToPoW(bestBit), tried)
+		}
+	}
+	nonce, bestBit, err := e.mine(ctx, 0, 1, target, finish, report)
+	e.Nonce, e.pow = nonce, 0
+	if err != nil {
+		return err
+	}
+
+	if target > 0 && bestBit < target {
+		return fmt.Errorf("failed to reach the PoW target, specified pow time (%d seconds) was insufficient", options.WorkTime)
+	}
+
+	return nil
+}
+
+// sealTarget returns the number of leading zero bits required by the sealing
+// options, or zero if the sealing should just run for the specified WorkTime.
+func (e *Envelope) sealTarget(options *MessageParams) int {
 	if options.PoW < 0 {
 		// target is not set - the function should run for a period
 		// of time specified in WorkTime param. Since we can predict
 		// the execution time, we can also adjust Expiry.
 		e.Expiry += options.WorkTime
-	} else {
-		target = e.powToFirstBit(options.PoW)
+		return 0
 	}
+	return e.powToFirstBit(options.PoW)
+}
 
+// mine searches the nonces start, start+step, start+2*step, ... for the one
+// producing the highest number of leading zero bits, until either the target
+// is reached, the deadline passes or the context is cancelled. The report
+// callback (if any) receives the best result and the number of nonces tried.
+// The envelope itself is not modified, so that it can be mined concurrently.
+func (e *Envelope) mine(ctx context.Context, start, step uint64, target int, finish int64, report func(int, uint64)) (best uint64, bestBit int, err error) {
 	buf := make([]byte, 64)
 	h := crypto.Keccak256(e.rlpWithoutNonce())
 	copy(buf[:32], h)
 
-	finish := time.Now().Add(time.Duration(options.WorkTime) * time.Second).UnixNano()
-	for nonce := uint64(0); time.Now().UnixNano() < finish; {
-		for i := 0; i < 1024; i++ {
+	var tried uint64
+	for nonce := start; time.Now().UnixNano() < finish; {
+		select {
+		case <-ctx.Done():
+			return best, bestBit, ctx.Err()
+		default:
+		}
+		for i := 0; i < sealProgressInterval; i++ {
 			binary.BigEndian.PutUint64(buf[56:], nonce)
 			d := new(big.Int).SetBytes(crypto.Keccak256(buf))
 			firstBit := math.FirstBitSet(d)
+			tried++
 			if firstBit > bestBit {
-				e.Nonce, bestBit = nonce, firstBit
+				best, bestBit = nonce, firstBit
 				if target > 0 && bestBit >= target {
-					return nil
+					if report != nil {
+						report(bestBit, tried)
+					}
+					return best, bestBit, nil
 				}
 			}
-			nonce++
+			nonce += step
+		}
+		if report != nil {
+			report(bestBit, tried)
 		}
 	}
-
-	if target > 0 && bestBit < target {
-		return fmt.Errorf("failed to reach the PoW target, specified pow time (%d seconds) was insufficient", options.WorkTime)
-	}
-
-	return nil
+	return best, bestBit, nil
 }
 
 // PoW computes (if necessary) and returns the proof of work target
@@ -128,19 +194,51 @@ func (e *Envelope) PoW() float64 {
 	return e.pow
 }
 
+// calculatePoW calculates the PoW of the envelope, adjusted by the specified
+// number of seconds. The hash is only computed if the PoW was not calculated
+// before, otherwise the cached number of leading zero bits is reused.
 func (e *Envelope) calculatePoW(diff uint32) {
-	buf := make([]byte, 64)
-	h := crypto.Keccak256(e.rlpWithoutNonce())
-	copy(buf[:32], h)
-	binary.BigEndian.PutUint64(buf[56:], e.Nonce)
-	d := new(big.Int).SetBytes(crypto.Keccak256(buf))
-	firstBit := math.FirstBitSet(d)
-	x := gmath.Pow(2, float64(firstBit))
+	if e.pow == 0 {
+		buf := make([]byte, 64)
+		h := crypto.Keccak256(e.rlpWithoutNonce())
+		copy(buf[:32], h)
+		binary.BigEndian.PutUint64(buf[56:], e.Nonce)
+		d := new(big.Int).SetBytes(crypto.Keccak256(buf))
+		e.powBits = math.FirstBitSet(d)
+	}
+	x := gmath.Pow(2, float64(e.powBits))
 	x /= float64(e.size())
 	x /= float64(e.TTL + diff)
 	e.pow = x
 }
 
+// setPoWBits calculates the PoW of the envelope (adjusted by the specified number
+// of seconds) from the already known number of leading zero bits of its PoW hash.
+func (e *Envelope) setPoWBits(bits int, diff uint32) {
+	e.powBits = bits
+	x := gmath.Pow(2, float64(bits))
+	x /= float64(e.size())
+	x /= float64(e.TTL + diff)
+	e.pow = x
+}
+
+// powBeyondHash checks (without hashing) whether the envelope of this size and
+// TTL can not possibly reach the specified PoW, i.e. whether the requirement
+// exceeds the maximum number of bits of the PoW hash.
+func (e *Envelope) powBeyondHash(pow float64, diff uint32) bool {
+	x := pow * float64(e.size()) * float64(e.TTL+diff)
+	return gmath.Log2(x) > 256
+}
+
+// bitsToPoW converts the number of leading zero bits into the PoW value,
+// as it would be calculated for the envelope.
+func (e *Envelope) bitsToPoW(bits int) float64 {
+	x := gmath.Pow(2, float64(bits))
+	x /= float64(e.size())
+	x /= float64(e.TTL)
+	return x
+}
+
 func (e *Envelope) powToFirstBit(pow float64) int {
 	x := pow
 	x *= float64(e.size())
@@ -184,7 +282,7 @@ func (e *Envelope) DecodeRLP(s *rlp.Stream) error {
 
 // OpenAsymmetric tries to decrypt an envelope, potentially encrypted with a particular key.
 func (e *Envelope) OpenAsymmetric(key *ecdsa.PrivateKey) (*ReceivedMessage, error) {
-	message := &ReceivedMessage{Raw: e.Data}
+	message := &ReceivedMessage{Raw: e.Data, schema: e.schema}
 	err := message.decryptAsymmetric(key)
 	switch err {
 	case nil:
@@ -198,7 +296,7 @@ func (e *Envelope) OpenAsymmetric(key *ecdsa.PrivateKey) (*ReceivedMessage, erro
 
 // OpenSymmetric tries to decrypt an envelope, potentially encrypted with a particular key.
 func (e *Envelope) OpenSymmetric(key []byte) (msg *ReceivedMessage, err error) {
-	msg = &ReceivedMessage{Raw: e.Data}
+	msg = &ReceivedMessage{Raw: e.Data, schema: e.schema}
 	err = msg.decryptSymmetric(key)
 	if err != nil {
 		msg = nil
@@ -234,6 +332,10 @@ func (e *Envelope) Open(watcher *Filter) (msg *ReceivedMessage) {
 		if !ok {
 			return nil
 		}
+		// the message bound to a session is only valid within that session
+		if msg.Session != (common.Hash{}) && msg.Session != e.session {
+			return nil
+		}
 		msg.Topic = e.Topic
 		msg.PoW = e.PoW()
 		msg.TTL = e.TTL
@@ -0,0 +1,154 @@
+// Copyright 2017 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package whisperv6
+
+import (
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/event"
+	"github.com/ethereum/go-ethereum/p2p/discover"
+)
+
+// PeerEventType is the type of peer events emitted by a whisper node.
+type PeerEventType string
+
+const (
+	// PeerEventTypeConnect is the type of event emitted when a peer
+	// successfully completes the whisper handshake
+	PeerEventTypeConnect PeerEventType = "connect"
+
+	// PeerEventTypeDisconnect is the type of event emitted when a
+	// connected peer is dropped
+	PeerEventTypeDisconnect PeerEventType = "disconnect"
+
+	// PeerEventTypeTrust is the type of event emitted when a peer is
+	// marked trusted, i.e. allowed to send peer-to-peer messages
+	PeerEventTypeTrust PeerEventType = "trust"
+)
+
+// PeerEvent is an event emitted when whisper peers connect, disconnect or
+// change their trust status.
+type PeerEvent struct {
+	Type       PeerEventType   `json:"type"`
+	Peer       discover.NodeID `json:"peer"`
+	Name       string          `json:"name"`
+	RemoteAddr string          `json:"remoteAddress"`
+	Trusted    bool            `json:"trusted"`
+	PoW        float64         `json:"pow"` // PoW requirement advertised by the peer
+	Error      string          `json:"error,omitempty"`
+}
+
+// DropReason describes why an envelope was not accepted into the pool.
+type DropReason string
+
+const (
+	DropReasonFuture        DropReason = "future"        // created too far in the future
+	DropReasonVeryOld       DropReason = "veryOld"       // expired long ago, peer is misbehaving
+	DropReasonExpired       DropReason = "expired"       // recently expired, silently ignored
+	DropReasonOversized     DropReason = "oversized"     // exceeds the maximum message size
+	DropReasonLowPoW        DropReason = "lowPoW"        // below the minimum accepted PoW
+	DropReasonBloomMismatch DropReason = "bloomMismatch" // does not match the advertised bloom filter
+	DropReasonMalformed     DropReason = "malformed"     // violates the validation schema of its version
+)
+
+// DropEvent is an event emitted when an envelope is dropped by the node.
+type DropEvent struct {
+	Reason DropReason  `json:"reason"`
+	Hash   common.Hash `json:"hash"`
+	Topic  TopicType   `json:"topic"`
+	Size   int         `json:"size"`
+	PoW    float64     `json:"pow"`
+	Error  string      `json:"error,omitempty"`
+}
+
+// SubscribeDropEvents subscribes the given channel to the events of envelopes
+// dropped by the node. The events are delivered synchronously from the message
+// processing path, so the channel should be sufficiently buffered.
+func (whisper *Whisper) SubscribeDropEvents(ch chan<- *DropEvent) event.Subscription {
+	return whisper.track(whisper.dropFeed.Subscribe(ch))
+}
+
+// drop records the dropped envelope in the metrics and notifies the subscribers.
+// The error (if any) is passed through to be returned by the caller.
+func (whisper *Whisper) drop(reason DropReason, envelope *Envelope, err error) error {
+	whisper.meters.dropped[reason].Mark(1)
+	whisper.dashboard.dropped(reason)
+	ev := &DropEvent{
+		Reason: reason,
+		Hash:   envelope.Hash(),
+		Topic:  envelope.Topic,
+		Size:   envelope.size(),
+		PoW:    envelope.pow,
+	}
+	if err != nil {
+		ev.Error = err.Error()
+	}
+	whisper.dropFeed.Send(ev)
+	if err != nil {
+		return &dropError{reason: reason, err: err}
+	}
+	return nil
+}
+
+// dropError is the error of a dropped envelope, carrying the reason of the drop.
+type dropError struct {
+	reason DropReason
+	err    error
+}
+
+func (e *dropError) Error() string {
+	return e.err.Error()
+}
+
+// settling checks if the envelope was dropped for violating the requirements
+// that the peers might not have processed yet (i.e. the PoW or the bloom filter).
+func settling(err error) bool {
+	if e, ok := err.(*dropError); ok {
+		return e.reason == DropReasonLowPoW || e.reason == DropReasonBloomMismatch
+	}
+	return false
+}
+
+// SubscribeEnvelopes subscribes the given channel to the envelopes newly added
+// to the pool, except the peer-to-peer ones. The envelopes are delivered
+// synchronously from the message processing path, so the channel should be
+// sufficiently buffered, and the envelopes must not be modified.
+func (whisper *Whisper) SubscribeEnvelopes(ch chan<- *Envelope) event.Subscription {
+	return whisper.track(whisper.envelopeFeed.Subscribe(ch))
+}
+
+// SubscribePeerEvents subscribes the given channel to the whisper peer events.
+func (whisper *Whisper) SubscribePeerEvents(ch chan<- *PeerEvent) event.Subscription {
+	return whisper.track(whisper.peerFeed.Subscribe(ch))
+}
+
+// sendPeerEvent notifies the subscribers about the peer state change.
+func (whisper *Whisper) sendPeerEvent(typ PeerEventType, p *Peer, err error) {
+	ev := &PeerEvent{
+		Type:    typ,
+		Peer:    p.peer.ID(),
+		Name:    p.peer.Name(),
+		Trusted: p.Trusted(),
+		PoW:     p.PoWRequirement(),
+	}
+	if addr := p.peer.RemoteAddr(); addr != nil {
+		ev.RemoteAddr = addr.String()
+	}
+	if err != nil {
+		ev.Error = err.Error()
+	}
+	whisper.peerFeed.Send(ev)
+}
@@ -0,0 +1,114 @@
+// Copyright 2017 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package whisperv6
+
+import (
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/p2p/discover"
+)
+
+func waitPeerEvent(t *testing.T, events chan *PeerEvent, typ PeerEventType) *PeerEvent {
+	select {
+	case ev := <-events:
+		if ev.Type != typ {
+			t.Fatalf("unexpected peer event: %s instead of %s.", ev.Type, typ)
+		}
+		return ev
+	case <-time.After(time.Second):
+		t.Fatalf("peer event %s timed out.", typ)
+	}
+	return nil
+}
+
+func TestPeerEvents(t *testing.T) {
+	w := New(&DefaultConfig)
+	w.Start(nil)
+	defer w.Stop()
+
+	events := make(chan *PeerEvent, 10)
+	sub := w.SubscribePeerEvents(events)
+	defer sub.Unsubscribe()
+
+	id := discover.NodeID{1}
+	remote, errc := connectTestPeer(t, w, id)
+	if ev := waitPeerEvent(t, events, PeerEventTypeConnect); ev.Peer != id || ev.Trusted {
+		t.Fatalf("wrong connect event: %v.", ev)
+	}
+
+	if err := w.AllowP2PMessagesFromPeer(id[:]); err != nil {
+		t.Fatalf("failed to mark peer trusted: %s.", err)
+	}
+	if ev := waitPeerEvent(t, events, PeerEventTypeTrust); !ev.Trusted {
+		t.Fatalf("wrong trust event: %v.", ev)
+	}
+	// trusting the peer again must not produce another event
+	w.AllowP2PMessagesFromPeer(id[:])
+
+	remote.Close()
+	if ev := waitPeerEvent(t, events, PeerEventTypeDisconnect); ev.Error == "" {
+		t.Fatalf("disconnect event without reason: %v.", ev)
+	}
+	<-errc
+}
+
+func TestDropEvents(t *testing.T) {
+	InitSingleTest()
+
+	w := New(&DefaultConfig)
+	events := make(chan *DropEvent, 10)
+	sub := w.SubscribeDropEvents(events)
+	defer sub.Unsubscribe()
+
+	params, err := generateMessageParams()
+	if err != nil {
+		t.Fatalf("failed generateMessageParams with seed %d: %s.", seed, err)
+	}
+	params.PoW = 0.0000001
+	msg, err := NewSentMessage(params)
+	if err != nil {
+		t.Fatalf("failed to create new message with seed %d: %s.", seed, err)
+	}
+	env, err := msg.Wrap(params)
+	if err != nil {
+		t.Fatalf("failed Wrap with seed %d: %s.", seed, err)
+	}
+
+	w.SetMinimumPowTest(1000000.0)
+	if _, err = w.add(env, false); err == nil {
+		t.Fatalf("envelope with low PoW accepted, seed: %d.", seed)
+	}
+	select {
+	case ev := <-events:
+		if ev.Reason != DropReasonLowPoW || ev.Hash != env.Hash() || ev.Error == "" {
+			t.Fatalf("wrong drop event: %v.", ev)
+		}
+	default:
+		t.Fatalf("no drop event, seed: %d.", seed)
+	}
+
+	env.Expiry = uint32(time.Now().Unix()) - 1
+	env.hash = common.Hash{}
+	if ok, err := w.add(env, false); ok || err != nil {
+		t.Fatalf("expired envelope not dropped silently: %v, seed: %d.", err, seed)
+	}
+	if ev := <-events; ev.Reason != DropReasonExpired || ev.Error != "" {
+		t.Fatalf("wrong drop event: %v.", ev)
+	}
+}
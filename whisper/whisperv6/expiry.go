@@ -0,0 +1,72 @@
+// Copyright 2017 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package whisperv6
+
+import (
+	"errors"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+// ErrEnvelopeNotPooled is returned when registering an expiration callback for
+// an envelope which is not in the pool (never added or already expired).
+var ErrEnvelopeNotPooled = errors.New("envelope not in the pool")
+
+// ExpiryCallback is invoked when an envelope expires from the pool, i.e. it is
+// no longer propagated by the node. The callbacks are invoked from the expiration
+// loop of the node and must return quickly.
+type ExpiryCallback func(envelope *Envelope)
+
+// OnExpiry registers the callback to be invoked once the envelope with the given
+// hash expires from the pool. Several callbacks may be registered for the same
+// envelope, and are invoked in the order of registration.
+func (whisper *Whisper) OnExpiry(hash common.Hash, callback ExpiryCallback) error {
+	// the pool lock is held until the callback is registered, so the envelope
+	// can not expire in between, leaving the callback behind never invoked
+	whisper.poolMu.RLock()
+	defer whisper.poolMu.RUnlock()
+	if _, pooled := whisper.envelopes[hash]; !pooled {
+		return ErrEnvelopeNotPooled
+	}
+
+	whisper.expiryMu.Lock()
+	defer whisper.expiryMu.Unlock()
+	whisper.expiryCallbacks[hash] = append(whisper.expiryCallbacks[hash], callback)
+	return nil
+}
+
+// CancelExpiry unregisters all the expiration callbacks of the envelope.
+func (whisper *Whisper) CancelExpiry(hash common.Hash) {
+	whisper.expiryMu.Lock()
+	defer whisper.expiryMu.Unlock()
+	delete(whisper.expiryCallbacks, hash)
+}
+
+// notifyExpired invokes the callbacks registered for the expired envelopes.
+func (whisper *Whisper) notifyExpired(expired []*Envelope) {
+	for _, envelope := range expired {
+		hash := envelope.Hash()
+		whisper.expiryMu.Lock()
+		callbacks := whisper.expiryCallbacks[hash]
+		delete(whisper.expiryCallbacks, hash)
+		whisper.expiryMu.Unlock()
+
+		for _, callback := range callbacks {
+			callback(envelope)
+		}
+	}
+}
@@ -0,0 +1,105 @@
+// Copyright 2017 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package whisperv6
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestExpiryCallbacks(t *testing.T) {
+	InitSingleTest()
+
+	w := New(&DefaultConfig)
+	w.SetMinimumPowTest(0.0000001)
+
+	now := uint32(time.Now().Unix())
+	env := &Envelope{Expiry: now + 1, TTL: 1, Data: []byte{1}, Nonce: uint64(seed)}
+	cancelled := &Envelope{Expiry: now + 1, TTL: 1, Data: []byte{2}, Nonce: uint64(seed)}
+	for _, e := range []*Envelope{env, cancelled} {
+		if _, err := w.add(e, false); err != nil {
+			t.Fatalf("failed to add envelope with seed %d: %s.", seed, err)
+		}
+	}
+
+	var calls []*Envelope
+	callback := func(e *Envelope) { calls = append(calls, e) }
+	for _, e := range []*Envelope{env, env, cancelled} {
+		if err := w.OnExpiry(e.Hash(), callback); err != nil {
+			t.Fatalf("failed OnExpiry with seed %d: %s.", seed, err)
+		}
+	}
+	w.CancelExpiry(cancelled.Hash())
+	if err := w.OnExpiry((&Envelope{Data: []byte{3}}).Hash(), callback); err != ErrEnvelopeNotPooled {
+		t.Fatalf("callback registered for an unknown envelope: %v.", err)
+	}
+
+	w.expire()
+	if len(calls) != 0 {
+		t.Fatalf("callback invoked before the expiry.")
+	}
+
+	time.Sleep(time.Duration(now+2-uint32(time.Now().Unix())) * time.Second)
+	w.expire()
+	if len(calls) != 2 || calls[0] != env || calls[1] != env {
+		t.Fatalf("wrong callback invocations: %d.", len(calls))
+	}
+	if len(w.expiryCallbacks) != 0 {
+		t.Fatalf("callbacks not released after the expiry.")
+	}
+}
+
+func TestExpiryCallbacksConcurrent(t *testing.T) {
+	InitSingleTest()
+
+	w := New(&DefaultConfig)
+	w.SetMinimumPowTest(0.0000001)
+
+	now := uint32(time.Now().Unix())
+	var envelopes []*Envelope
+	for i := 0; i < 256; i++ {
+		env := &Envelope{Expiry: now + 1, TTL: 1, Data: []byte{byte(i)}, Nonce: uint64(seed)}
+		if _, err := w.add(env, false); err != nil {
+			t.Fatalf("failed to add envelope with seed %d: %s.", seed, err)
+		}
+		envelopes = append(envelopes, env)
+	}
+	time.Sleep(time.Duration(now+2-uint32(time.Now().Unix())) * time.Second)
+
+	// every callback registered while the envelopes expire must be invoked
+	var registered, invoked int32
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for _, env := range envelopes {
+			if w.OnExpiry(env.Hash(), func(*Envelope) { atomic.AddInt32(&invoked, 1) }) == nil {
+				atomic.AddInt32(&registered, 1)
+			}
+		}
+	}()
+	w.expire()
+	<-done
+	w.expire()
+
+	if registered != invoked {
+		t.Fatalf("callbacks registered during the expiry not invoked: %d registered, %d invoked.", registered, invoked)
+	}
+	if len(w.expiryCallbacks) != 0 {
+		t.Fatalf("callbacks left behind after the expiry: %d.", len(w.expiryCallbacks))
+	}
+}
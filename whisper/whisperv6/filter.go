@@ -37,6 +37,16 @@ type Filter struct {
 	SymKeyHash common.Hash       // The Keccak256Hash of the symmetric key, needed for optimization
 	id         string            // unique identifier
 
+	Score      func(*ReceivedMessage) int // Scores the importance of the messages, overriding the Priorities (optional)
+	Priorities map[common.Address]int     // Static priorities of the senders, by the address of their keys (optional)
+
+	maxMessages int    // maximum number of messages waiting to be retrieved (zero means unlimited)
+	spoofed     uint64 // number of the decrypted messages not signed by the Src
+
+	delivered      map[common.Hash]struct{}       // hashes of the recently delivered messages
+	deliveredOrder []common.Hash                  // the same hashes in the order of delivery, for eviction
+	signers        map[common.Hash]common.Address // signers of the delivered messages, linking their tombstones
+
 	Messages map[common.Hash]*ReceivedMessage
 	mutex    sync.RWMutex
 }
@@ -49,6 +59,7 @@ type Filters struct {
 	allTopicsMatcher map[*Filter]struct{}               // list all the filters that will be notified of a new message, no matter what its topic is
 
 	whisper *Whisper
+	log     log.Logger
 	mutex   sync.RWMutex
 }
 
@@ -59,6 +70,7 @@ func NewFilters(w *Whisper) *Filters {
 		topicMatcher:     make(map[TopicType]map[*Filter]struct{}),
 		allTopicsMatcher: make(map[*Filter]struct{}),
 		whisper:          w,
+		log:              w.Logger(LogSubsystemFilter),
 	}
 }
 
@@ -94,6 +106,44 @@ func (fs *Filters) Install(watcher *Filter) (string, error) {
 	return id, err
 }
 
+// installAll installs the filters under their preset IDs, failing without
+// installing any of them if one is invalid or its ID is already taken.
+func (fs *Filters) installAll(watchers []*Filter) error {
+	seen := make(map[string]struct{}, len(watchers))
+	for _, watcher := range watchers {
+		if watcher.KeySym != nil && watcher.KeyAsym != nil {
+			return fmt.Errorf("filters must choose between symmetric and asymmetric keys")
+		}
+		if len(watcher.id) != keyIDSize*2 {
+			return fmt.Errorf("invalid filter ID: %s", watcher.id)
+		}
+		if _, ok := seen[watcher.id]; ok {
+			return fmt.Errorf("duplicate filter ID: %s", watcher.id)
+		}
+		seen[watcher.id] = struct{}{}
+	}
+
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+
+	for _, watcher := range watchers {
+		if fs.watchers[watcher.id] != nil {
+			return fmt.Errorf("filter %s already exists", watcher.id)
+		}
+	}
+	for _, watcher := range watchers {
+		if watcher.Messages == nil {
+			watcher.Messages = make(map[common.Hash]*ReceivedMessage)
+		}
+		if watcher.expectsSymmetricEncryption() {
+			watcher.SymKeyHash = crypto.Keccak256Hash(watcher.KeySym)
+		}
+		fs.watchers[watcher.id] = watcher
+		fs.addTopicMatcher(watcher)
+	}
+	return nil
+}
+
 // Uninstall will remove a filter whose id has been specified from
 // the filter collection
 func (fs *Filters) Uninstall(id string) bool {
@@ -102,6 +152,9 @@ func (fs *Filters) Uninstall(id string) bool {
 	if fs.watchers[id] != nil {
 		fs.removeFromTopicMatchers(fs.watchers[id])
 		delete(fs.watchers, id)
+		if fs.whisper != nil {
+			fs.whisper.bloomRefresh.markStale()
+		}
 		return true
 	}
 	return false
@@ -155,6 +208,30 @@ func (fs *Filters) Get(id string) *Filter {
 // NotifyWatchers notifies any filter that has declared interest
 // for the envelope's topic.
 func (fs *Filters) NotifyWatchers(env *Envelope, p2pMessage bool) {
+	if env.Topic == BatchTopic {
+		envelopes, err := env.unbatch()
+		if err != nil {
+			fs.log.Trace("processing message: invalid batch", "hash", env.Hash().Hex(), "err", err)
+			return
+		}
+		for _, inner := range envelopes {
+			fs.NotifyWatchers(inner, p2pMessage)
+		}
+		return
+	}
+
+	// the subscribers of the gaps are notified after the filters are unlocked,
+	// so that they never hold up the delivery nor the changes of the filters
+	msg := fs.notify(env, p2pMessage)
+	if msg != nil && fs.whisper != nil {
+		fs.whisper.observeSequence(msg)
+		fs.whisper.identityUsed(msg)
+	}
+}
+
+// notify delivers the envelope to the interested filters, returning the message
+// opened by any of them (nil if none).
+func (fs *Filters) notify(env *Envelope, p2pMessage bool) *ReceivedMessage {
 	var msg *ReceivedMessage
 
 	fs.mutex.RLock()
@@ -163,7 +240,7 @@ func (fs *Filters) NotifyWatchers(env *Envelope, p2pMessage bool) {
 	candidates := fs.getWatchersByTopic(env.Topic)
 	for _, watcher := range candidates {
 		if p2pMessage && !watcher.AllowP2P {
-			log.Trace(fmt.Sprintf("msg [%x], filter [%s]: p2p messages are not allowed", env.Hash(), watcher.id))
+			fs.log.Trace("processing message: p2p messages are not allowed", "hash", env.Hash().Hex(), "filter", watcher.id)
 			continue
 		}
 
@@ -174,21 +251,30 @@ func (fs *Filters) NotifyWatchers(env *Envelope, p2pMessage bool) {
 			match = watcher.MatchEnvelope(env)
 			if match {
 				msg = env.Open(watcher)
+				if msg != nil && fs.whisper != nil && fs.whisper.hooks.failDecryption(env) {
+					msg = nil
+				}
 				if msg == nil {
-					log.Trace("processing message: failed to open", "message", env.Hash().Hex(), "filter", watcher.id)
+					fs.log.Trace("processing message: failed to open", "hash", env.Hash().Hex(), "filter", watcher.id)
 				}
 			} else {
-				log.Trace("processing message: does not match", "message", env.Hash().Hex(), "filter", watcher.id)
+				fs.log.Trace("processing message: does not match", "hash", env.Hash().Hex(), "filter", watcher.id)
 			}
 		}
 
 		if match && msg != nil {
-			log.Trace("processing message: decrypted", "hash", env.Hash().Hex())
+			fs.log.Trace("processing message: decrypted", "hash", env.Hash().Hex(), "filter", watcher.id)
 			if watcher.Src == nil || IsPubKeyEqual(msg.Src, watcher.Src) {
 				watcher.Trigger(msg)
+			} else {
+				fs.log.Trace("processing message: wrong signer", "hash", env.Hash().Hex(), "filter", watcher.id)
+				watcher.mutex.Lock()
+				watcher.spoofed++
+				watcher.mutex.Unlock()
 			}
 		}
 	}
+	return msg
 }
 
 func (f *Filter) expectsAsymmetricEncryption() bool {
@@ -200,31 +286,77 @@ func (f *Filter) expectsSymmetricEncryption() bool {
 }
 
 // Trigger adds a yet-unknown message to the filter's list of
-// received messages.
+// received messages. The messages already delivered by the filter are
+// ignored, regardless whether they arrive live or from a mail server.
 func (f *Filter) Trigger(msg *ReceivedMessage) {
 	f.mutex.Lock()
 	defer f.mutex.Unlock()
 
+	if _, delivered := f.delivered[msg.EnvelopeHash]; delivered {
+		return
+	}
+	if msg.IsTombstone() && !f.linksTombstone(msg) {
+		return // the original was not delivered by this filter, or signed by another key
+	}
 	if _, exist := f.Messages[msg.EnvelopeHash]; !exist {
+		msg = f.score(msg)
+		if f.maxMessages > 0 && len(f.Messages) >= f.maxMessages && !f.evictBelow(msg.Priority) {
+			return // the client does not keep up, drop the message
+		}
 		f.Messages[msg.EnvelopeHash] = msg
 	}
 }
 
+// markDelivered remembers the hashes of the retrieved messages, evicting the
+// oldest ones beyond filterDedupLimit. The filter must be locked by the caller.
+func (f *Filter) markDelivered(hash common.Hash) {
+	if f.delivered == nil {
+		f.delivered = make(map[common.Hash]struct{})
+	}
+	if _, exist := f.delivered[hash]; exist {
+		return
+	}
+	f.delivered[hash] = struct{}{}
+	f.deliveredOrder = append(f.deliveredOrder, hash)
+	if len(f.deliveredOrder) > filterDedupLimit {
+		delete(f.delivered, f.deliveredOrder[0])
+		delete(f.signers, f.deliveredOrder[0])
+		f.deliveredOrder = f.deliveredOrder[1:]
+	}
+}
+
+// Spoofed returns the number of the messages decrypted by the filter, but
+// rejected since they were not signed by the sender the filter expects.
+func (f *Filter) Spoofed() uint64 {
+	f.mutex.RLock()
+	defer f.mutex.RUnlock()
+	return f.spoofed
+}
+
 // Retrieve will return the list of all received messages associated
-// to a filter.
+// to a filter, in the order of their priority (see RetrieveTop).
 func (f *Filter) Retrieve() (all []*ReceivedMessage) {
 	f.mutex.Lock()
 	defer f.mutex.Unlock()
 
-	all = make([]*ReceivedMessage, 0, len(f.Messages))
-	for _, msg := range f.Messages {
-		all = append(all, msg)
+	all = f.queued()
+	for _, msg := range all {
+		f.deliver(msg)
 	}
 
 	f.Messages = make(map[common.Hash]*ReceivedMessage) // delete old messages
 	return all
 }
 
+// deliver marks the retrieved message as delivered. The filter must be locked
+// by the caller.
+func (f *Filter) deliver(msg *ReceivedMessage) {
+	f.markDelivered(msg.EnvelopeHash)
+	if msg.Src != nil {
+		f.rememberSigner(msg.EnvelopeHash, msg.Src)
+	}
+}
+
 // MatchMessage checks if the filter matches an already decrypted
 // message (i.e. a Message that has already been handled by
 // MatchEnvelope when checked by a previous filter).
@@ -17,6 +17,7 @@
 package whisperv6
 
 import (
+	"bytes"
 	"math/big"
 	mrand "math/rand"
 	"testing"
@@ -781,6 +782,18 @@ func TestWatchers(t *testing.T) {
 	total = 0
 	filters.NotifyWatchers(envelopes[0], true)
 
+	// the envelope was already delivered live, so it must not be delivered again
+	for i = 0; i < NumFilters; i++ {
+		mail = tst[i].f.Retrieve()
+		total += len(mail)
+	}
+	if total != 0 {
+		t.Fatalf("failed with seed %d: duplicate delivered: got %d, want 0.", seed, total)
+	}
+
+	f.delivered, f.deliveredOrder = nil, nil
+	filters.NotifyWatchers(envelopes[0], true)
+
 	for i = 0; i < NumFilters; i++ {
 		mail = tst[i].f.Retrieve()
 		total += len(mail)
@@ -865,3 +878,111 @@ func TestMatchSingleTopic_InsufficientLength_ReturnFalse(t *testing.T) {
 		t.FailNow()
 	}
 }
+
+func TestFilterDeduplication(t *testing.T) {
+	f := &Filter{Messages: make(map[common.Hash]*ReceivedMessage)}
+
+	msg := &ReceivedMessage{EnvelopeHash: common.Hash{1}}
+	f.Trigger(msg)
+	if n := len(f.Retrieve()); n != 1 {
+		t.Fatalf("wrong number of messages: %d.", n)
+	}
+
+	// the same envelope arriving again (e.g. from a mail server) must not be delivered twice
+	f.Trigger(&ReceivedMessage{EnvelopeHash: msg.EnvelopeHash})
+	if n := len(f.Retrieve()); n != 0 {
+		t.Fatalf("duplicate message delivered.")
+	}
+
+	// the oldest hashes are evicted beyond the limit
+	for i := 0; i < filterDedupLimit; i++ {
+		f.markDelivered(common.BigToHash(big.NewInt(int64(i + 2))))
+	}
+	if len(f.delivered) != filterDedupLimit {
+		t.Fatalf("wrong number of remembered hashes: %d.", len(f.delivered))
+	}
+	if _, exist := f.delivered[msg.EnvelopeHash]; exist {
+		t.Fatalf("oldest hash was not evicted.")
+	}
+}
+
+func TestBatchEnvelope(t *testing.T) {
+	InitSingleTest()
+
+	w := New(&DefaultConfig)
+	messages := make([]*MessageParams, 2)
+	filters := make([]*Filter, 2)
+	for i := range messages {
+		params, err := generateMessageParams()
+		if err != nil {
+			t.Fatalf("failed generateMessageParams with seed %d: %s.", seed, err)
+		}
+		params.Topic[0] = byte(i)
+		messages[i] = params
+
+		filters[i] = &Filter{
+			KeySym:   params.KeySym,
+			Topics:   [][]byte{params.Topic[:]},
+			Messages: make(map[common.Hash]*ReceivedMessage),
+		}
+		if _, err = w.Subscribe(filters[i]); err != nil {
+			t.Fatalf("failed subscribe with seed %d: %s.", seed, err)
+		}
+	}
+
+	env, err := w.NewBatchEnvelope(messages, &MessageParams{TTL: DefaultTTL, WorkTime: 1, PoW: 0.01})
+	if err != nil {
+		t.Fatalf("failed NewBatchEnvelope with seed %d: %s.", seed, err)
+	}
+	if env.Topic != BatchTopic {
+		t.Fatalf("wrong topic of the batch: %x.", env.Topic)
+	}
+	if !BloomFilterMatch(w.BloomFilter(), env.Bloom()) {
+		t.Fatalf("batch does not match the bloom filter of the subscriber.")
+	}
+
+	// the contained envelopes are opened as received with the batch
+	env.session, env.schema = common.Hash{1}, envelopeSchemas[ProtocolVersion]
+	inner, err := env.unbatch()
+	if err != nil || len(inner) != len(messages) {
+		t.Fatalf("failed to unbatch with seed %d: %v.", seed, err)
+	}
+	for i, e := range inner {
+		if e.session != env.session || e.schema != env.schema {
+			t.Fatalf("envelope %d: session or schema of the batch lost.", i)
+		}
+	}
+
+	w.filters.NotifyWatchers(env, false)
+	for i, f := range filters {
+		mail := f.Retrieve()
+		if len(mail) != 1 {
+			t.Fatalf("filter %d: wrong number of messages: %d.", i, len(mail))
+		}
+		if !bytes.Equal(mail[0].Payload, messages[i].Payload) {
+			t.Fatalf("filter %d: wrong payload.", i)
+		}
+		if mail[0].PoW != env.PoW() {
+			t.Fatalf("filter %d: proof of work not shared with the batch.", i)
+		}
+	}
+
+	options := &MessageParams{WorkTime: 1, PoW: 0.01}
+	if _, err = w.NewBatchEnvelope(messages, options); err != nil {
+		t.Fatalf("failed NewBatchEnvelope with seed %d: %s.", seed, err)
+	}
+	if options.TTL != 0 {
+		t.Fatalf("default TTL written into the options: %d.", options.TTL)
+	}
+
+	cfg := DefaultConfig
+	cfg.OutboundTopicBlocklist = []TopicType{messages[1].Topic}
+	if _, err = New(&cfg).NewBatchEnvelope(messages, options); err != ErrTopicNotAllowed {
+		t.Fatalf("batch of the blocked topic accepted: %v.", err)
+	}
+
+	messages[0].Topic = BatchTopic
+	if _, err = w.NewBatchEnvelope(messages, &MessageParams{WorkTime: 1}); err == nil {
+		t.Fatalf("nested batch accepted.")
+	}
+}
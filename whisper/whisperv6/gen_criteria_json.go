@@ -5,6 +5,7 @@ package whisperv6
 import (
 	"encoding/json"
 
+	"github.com/ethereum/go-ethereum/common"
 	"github.com/ethereum/go-ethereum/common/hexutil"
 )
 
@@ -13,12 +14,13 @@ var _ = (*criteriaOverride)(nil)
 // MarshalJSON marshals type Criteria to a json string
 func (c Criteria) MarshalJSON() ([]byte, error) {
 	type Criteria struct {
-		SymKeyID     string        `json:"symKeyID"`
-		PrivateKeyID string        `json:"privateKeyID"`
-		Sig          hexutil.Bytes `json:"sig"`
-		MinPow       float64       `json:"minPow"`
-		Topics       []TopicType   `json:"topics"`
-		AllowP2P     bool          `json:"allowP2P"`
+		SymKeyID     string                 `json:"symKeyID"`
+		PrivateKeyID string                 `json:"privateKeyID"`
+		Sig          hexutil.Bytes          `json:"sig"`
+		MinPow       float64                `json:"minPow"`
+		Topics       []TopicType            `json:"topics"`
+		AllowP2P     bool                   `json:"allowP2P"`
+		Priorities   map[common.Address]int `json:"priorities"`
 	}
 	var enc Criteria
 	enc.SymKeyID = c.SymKeyID
@@ -27,18 +29,20 @@ func (c Criteria) MarshalJSON() ([]byte, error) {
 	enc.MinPow = c.MinPow
 	enc.Topics = c.Topics
 	enc.AllowP2P = c.AllowP2P
+	enc.Priorities = c.Priorities
 	return json.Marshal(&enc)
 }
 
 // UnmarshalJSON unmarshals type Criteria to a json string
 func (c *Criteria) UnmarshalJSON(input []byte) error {
 	type Criteria struct {
-		SymKeyID     *string        `json:"symKeyID"`
-		PrivateKeyID *string        `json:"privateKeyID"`
-		Sig          *hexutil.Bytes `json:"sig"`
-		MinPow       *float64       `json:"minPow"`
-		Topics       []TopicType    `json:"topics"`
-		AllowP2P     *bool          `json:"allowP2P"`
+		SymKeyID     *string                `json:"symKeyID"`
+		PrivateKeyID *string                `json:"privateKeyID"`
+		Sig          *hexutil.Bytes         `json:"sig"`
+		MinPow       *float64               `json:"minPow"`
+		Topics       []TopicType            `json:"topics"`
+		AllowP2P     *bool                  `json:"allowP2P"`
+		Priorities   map[common.Address]int `json:"priorities"`
 	}
 	var dec Criteria
 	if err := json.Unmarshal(input, &dec); err != nil {
@@ -62,5 +66,8 @@ func (c *Criteria) UnmarshalJSON(input []byte) error {
 	if dec.AllowP2P != nil {
 		c.AllowP2P = *dec.AllowP2P
 	}
+	if dec.Priorities != nil {
+		c.Priorities = dec.Priorities
+	}
 	return nil
 }
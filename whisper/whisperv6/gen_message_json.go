@@ -22,6 +22,9 @@ func (m Message) MarshalJSON() ([]byte, error) {
 		PoW       float64       `json:"pow"`
 		Hash      hexutil.Bytes `json:"hash"`
 		Dst       hexutil.Bytes `json:"recipientPublicKey,omitempty"`
+		Seq       uint64        `json:"seq,omitempty"`
+		Redacts   hexutil.Bytes `json:"redacts,omitempty"`
+		Priority  int           `json:"priority,omitempty"`
 	}
 	var enc Message
 	enc.Sig = m.Sig
@@ -33,6 +36,9 @@ func (m Message) MarshalJSON() ([]byte, error) {
 	enc.PoW = m.PoW
 	enc.Hash = m.Hash
 	enc.Dst = m.Dst
+	enc.Seq = m.Seq
+	enc.Redacts = m.Redacts
+	enc.Priority = m.Priority
 	return json.Marshal(&enc)
 }
 
@@ -48,6 +54,9 @@ func (m *Message) UnmarshalJSON(input []byte) error {
 		PoW       *float64       `json:"pow"`
 		Hash      *hexutil.Bytes `json:"hash"`
 		Dst       *hexutil.Bytes `json:"recipientPublicKey,omitempty"`
+		Seq       *uint64        `json:"seq,omitempty"`
+		Redacts   *hexutil.Bytes `json:"redacts,omitempty"`
+		Priority  *int           `json:"priority,omitempty"`
 	}
 	var dec Message
 	if err := json.Unmarshal(input, &dec); err != nil {
@@ -80,5 +89,14 @@ func (m *Message) UnmarshalJSON(input []byte) error {
 	if dec.Dst != nil {
 		m.Dst = *dec.Dst
 	}
+	if dec.Seq != nil {
+		m.Seq = *dec.Seq
+	}
+	if dec.Redacts != nil {
+		m.Redacts = *dec.Redacts
+	}
+	if dec.Priority != nil {
+		m.Priority = *dec.Priority
+	}
 	return nil
 }
@@ -5,6 +5,7 @@ package whisperv6
 import (
 	"encoding/json"
 
+	"github.com/ethereum/go-ethereum/common"
 	"github.com/ethereum/go-ethereum/common/hexutil"
 )
 
@@ -13,16 +14,21 @@ var _ = (*newMessageOverride)(nil)
 // MarshalJSON marshals type NewMessage to a json string
 func (n NewMessage) MarshalJSON() ([]byte, error) {
 	type NewMessage struct {
-		SymKeyID   string        `json:"symKeyID"`
-		PublicKey  hexutil.Bytes `json:"pubKey"`
-		Sig        string        `json:"sig"`
-		TTL        uint32        `json:"ttl"`
-		Topic      TopicType     `json:"topic"`
-		Payload    hexutil.Bytes `json:"payload"`
-		Padding    hexutil.Bytes `json:"padding"`
-		PowTime    uint32        `json:"powTime"`
-		PowTarget  float64       `json:"powTarget"`
-		TargetPeer string        `json:"targetPeer"`
+		SymKeyID             string        `json:"symKeyID"`
+		PublicKey            hexutil.Bytes `json:"pubKey"`
+		Sig                  string        `json:"sig"`
+		TTL                  uint32        `json:"ttl"`
+		Topic                TopicType     `json:"topic"`
+		Payload              hexutil.Bytes `json:"payload"`
+		Padding              hexutil.Bytes `json:"padding"`
+		PowTime              uint32        `json:"powTime"`
+		PowTarget            float64       `json:"powTarget"`
+		TargetPeer           string        `json:"targetPeer"`
+		Delivery             DeliveryMode  `json:"delivery"`
+		Seq                  uint64        `json:"seq"`
+		Redacts              common.Hash   `json:"redacts"`
+		NoArchive            bool          `json:"noArchive"`
+		DeterministicPadding bool          `json:"deterministicPadding"`
 	}
 	var enc NewMessage
 	enc.SymKeyID = n.SymKeyID
@@ -35,22 +41,32 @@ func (n NewMessage) MarshalJSON() ([]byte, error) {
 	enc.PowTime = n.PowTime
 	enc.PowTarget = n.PowTarget
 	enc.TargetPeer = n.TargetPeer
+	enc.Delivery = n.Delivery
+	enc.Seq = n.Seq
+	enc.Redacts = n.Redacts
+	enc.NoArchive = n.NoArchive
+	enc.DeterministicPadding = n.DeterministicPadding
 	return json.Marshal(&enc)
 }
 
 // UnmarshalJSON unmarshals type NewMessage to a json string
 func (n *NewMessage) UnmarshalJSON(input []byte) error {
 	type NewMessage struct {
-		SymKeyID   *string        `json:"symKeyID"`
-		PublicKey  *hexutil.Bytes `json:"pubKey"`
-		Sig        *string        `json:"sig"`
-		TTL        *uint32        `json:"ttl"`
-		Topic      *TopicType     `json:"topic"`
-		Payload    *hexutil.Bytes `json:"payload"`
-		Padding    *hexutil.Bytes `json:"padding"`
-		PowTime    *uint32        `json:"powTime"`
-		PowTarget  *float64       `json:"powTarget"`
-		TargetPeer *string        `json:"targetPeer"`
+		SymKeyID             *string        `json:"symKeyID"`
+		PublicKey            *hexutil.Bytes `json:"pubKey"`
+		Sig                  *string        `json:"sig"`
+		TTL                  *uint32        `json:"ttl"`
+		Topic                *TopicType     `json:"topic"`
+		Payload              *hexutil.Bytes `json:"payload"`
+		Padding              *hexutil.Bytes `json:"padding"`
+		PowTime              *uint32        `json:"powTime"`
+		PowTarget            *float64       `json:"powTarget"`
+		TargetPeer           *string        `json:"targetPeer"`
+		Delivery             *DeliveryMode  `json:"delivery"`
+		Seq                  *uint64        `json:"seq"`
+		Redacts              *common.Hash   `json:"redacts"`
+		NoArchive            *bool          `json:"noArchive"`
+		DeterministicPadding *bool          `json:"deterministicPadding"`
 	}
 	var dec NewMessage
 	if err := json.Unmarshal(input, &dec); err != nil {
@@ -86,5 +102,20 @@ func (n *NewMessage) UnmarshalJSON(input []byte) error {
 	if dec.TargetPeer != nil {
 		n.TargetPeer = *dec.TargetPeer
 	}
+	if dec.Delivery != nil {
+		n.Delivery = *dec.Delivery
+	}
+	if dec.Seq != nil {
+		n.Seq = *dec.Seq
+	}
+	if dec.Redacts != nil {
+		n.Redacts = *dec.Redacts
+	}
+	if dec.NoArchive != nil {
+		n.NoArchive = *dec.NoArchive
+	}
+	if dec.DeterministicPadding != nil {
+		n.DeterministicPadding = *dec.DeterministicPadding
+	}
 	return nil
 }
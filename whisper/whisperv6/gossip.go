@@ -0,0 +1,150 @@
+// Copyright 2017 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+// Contains the fanout-limited gossip. By default every envelope is flooded to
+// all the peers. With a fanout configured, each envelope is pushed only to a
+// random sample of the peers which do not know it yet and run the anti-entropy
+// sync, which repairs whatever the sampling missed. On the well-connected relays this
+// trades some propagation latency for a much lower total bandwidth.
+
+package whisperv6
+
+import (
+	"math"
+	mrand "math/rand"
+	"sync"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+// FanoutSqrt configures the gossip to push each envelope to the square root
+// of the number of the peers.
+const FanoutSqrt = -1
+
+// gossipSampler selects the peers each envelope is pushed to.
+type gossipSampler struct {
+	fanout int // Configured fanout, FanoutSqrt or a positive number of peers
+
+	mu      sync.Mutex
+	targets map[common.Hash]map[*Peer]bool // Draws of the syncing peers for each envelope
+}
+
+func newGossipSampler(fanout int) *gossipSampler {
+	return &gossipSampler{
+		fanout:  fanout,
+		targets: make(map[common.Hash]map[*Peer]bool),
+	}
+}
+
+// size returns the number of the sampled peers each envelope is pushed to,
+// given the number of the peers running the sync.
+func (g *gossipSampler) size(peers int) int {
+	n := g.fanout
+	if n == FanoutSqrt {
+		n = int(math.Ceil(math.Sqrt(float64(peers))))
+	}
+	if n < 1 {
+		n = 1
+	}
+	return n
+}
+
+// selected reports whether the envelope should be pushed to the peer. Only the
+// peers running the sync may be skipped, since nothing would repair the
+// envelopes the others miss, so the peers without the sync always get the
+// envelope. The sample is drawn on the first query from the syncing peers which
+// are eligible for the envelope at that moment, and stays fixed until the
+// envelope expires. The syncing peers connecting (or starting to accept the
+// envelope) later are drawn on their first query, with the same odds.
+func (g *gossipSampler) selected(whisper *Whisper, envelope *Envelope, peer *Peer) bool {
+	if !peer.supports(featureSync) {
+		return true
+	}
+	hash := envelope.Hash()
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	targets, ok := g.targets[hash]
+	if !ok {
+		targets = g.sample(whisper, envelope)
+		g.targets[hash] = targets
+	}
+	if target, ok := targets[peer]; ok {
+		return target
+	}
+	if peer.marked(envelope) {
+		return false
+	}
+	syncing := whisper.syncingPeers()
+	target := mrand.Float64()*float64(syncing) < float64(g.size(syncing))
+	targets[peer] = target
+	return target
+}
+
+// sample draws the random syncing peers for the envelope, out of the ones which
+// do not know it yet and would accept it. All the eligible peers are recorded,
+// the ones not drawn as false.
+func (g *gossipSampler) sample(whisper *Whisper, envelope *Envelope) map[*Peer]bool {
+	targets := make(map[*Peer]bool)
+
+	whisper.peerMu.RLock()
+	var syncing int
+	candidates := make([]*Peer, 0, len(whisper.peers))
+	for p := range whisper.peers {
+		if !p.supports(featureSync) {
+			continue
+		}
+		syncing++
+		if !p.marked(envelope) && p.accepts(envelope) {
+			candidates = append(candidates, p)
+		}
+	}
+	whisper.peerMu.RUnlock()
+
+	n := g.size(syncing)
+	if n > len(candidates) {
+		n = len(candidates)
+	}
+	for i, j := range mrand.Perm(len(candidates)) {
+		targets[candidates[j]] = i < n
+	}
+	return targets
+}
+
+// syncingPeers returns the number of the connected peers running the sync.
+func (whisper *Whisper) syncingPeers() int {
+	whisper.peerMu.RLock()
+	defer whisper.peerMu.RUnlock()
+
+	var n int
+	for p := range whisper.peers {
+		if p.supports(featureSync) {
+			n++
+		}
+	}
+	return n
+}
+
+// forget drops the samples of the envelopes which left the pool.
+func (g *gossipSampler) forget(hashes []common.Hash) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	for _, hash := range hashes {
+		delete(g.targets, hash)
+	}
+}
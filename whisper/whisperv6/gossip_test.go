@@ -0,0 +1,104 @@
+// Copyright 2017 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package whisperv6
+
+import (
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/p2p"
+	"github.com/ethereum/go-ethereum/p2p/discover"
+)
+
+func TestGossipFanoutSize(t *testing.T) {
+	sqrt := newGossipSampler(FanoutSqrt)
+	for peers, want := range map[int]int{0: 1, 1: 1, 4: 2, 10: 4, 100: 10} {
+		if got := sqrt.size(peers); got != want {
+			t.Fatalf("wrong fanout for %d peers: %d instead of %d.", peers, got, want)
+		}
+	}
+	if got := newGossipSampler(3).size(100); got != 3 {
+		t.Fatalf("wrong fixed fanout: %d.", got)
+	}
+}
+
+func TestGossipSampling(t *testing.T) {
+	w := New(&Config{GossipFanout: FanoutSqrt})
+	if w.gossip == nil || w.antiEntropyCycle != gossipRepairCycle {
+		t.Fatalf("fanout-limited gossip is not configured.")
+	}
+
+	var peers []*Peer
+	for i := 0; i < 16; i++ {
+		p := newPeer(w, p2p.NewPeer(discover.NodeID{byte(i)}, "test", nil), nil)
+		p.features = featureSync
+		w.peers[p] = struct{}{}
+		peers = append(peers, p)
+	}
+	// the peers without the sync are never skipped
+	var legacy []*Peer
+	for i := 16; i < 18; i++ {
+		p := newPeer(w, p2p.NewPeer(discover.NodeID{byte(i)}, "test", nil), nil)
+		w.peers[p] = struct{}{}
+		legacy = append(legacy, p)
+	}
+	env := &Envelope{Expiry: 100, TTL: 10, Data: []byte{1}}
+	peers[0].mark(env)
+
+	selected := 0
+	for _, p := range peers {
+		if w.gossip.selected(w, env, p) {
+			if p == peers[0] {
+				t.Fatalf("envelope pushed to the peer which already knows it.")
+			}
+			selected++
+		}
+	}
+	if selected != 4 {
+		t.Fatalf("envelope pushed to %d peers instead of 4.", selected)
+	}
+	for _, p := range legacy {
+		if !w.gossip.selected(w, env, p) {
+			t.Fatalf("envelope not pushed to the peer without the sync.")
+		}
+	}
+
+	// the sample must stay fixed for the lifetime of the envelope
+	for _, p := range peers[1:] {
+		if w.gossip.selected(w, env, p) != w.gossip.targets[env.Hash()][p] {
+			t.Fatalf("sample changed between the queries.")
+		}
+	}
+
+	// the peers connecting later are drawn as well, the ones without the sync always
+	late := newPeer(w, p2p.NewPeer(discover.NodeID{18}, "test", nil), nil)
+	w.peers[late] = struct{}{}
+	if !w.gossip.selected(w, env, late) {
+		t.Fatalf("envelope not pushed to the late peer without the sync.")
+	}
+	late = newPeer(w, p2p.NewPeer(discover.NodeID{19}, "test", nil), nil)
+	late.features = featureSync
+	w.peers[late] = struct{}{}
+	drawn := w.gossip.selected(w, env, late)
+	if target, ok := w.gossip.targets[env.Hash()][late]; !ok || target != drawn {
+		t.Fatalf("late syncing peer not drawn into the sample.")
+	}
+	w.gossip.forget([]common.Hash{env.Hash()})
+	if len(w.gossip.targets) != 0 {
+		t.Fatalf("sample not dropped after the expiry.")
+	}
+}
@@ -0,0 +1,117 @@
+// Copyright 2017 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+// Contains the grace window of the delivery of the late envelopes.
+//
+// An envelope received moments before its expiry may only reach the pool after
+// it expired, e.g. when it waited for the PoW verification or in the queue of a
+// busy peer. Such envelopes are dropped from the pool as before, and neither
+// forwarded, but the valid ones are still delivered to the local filters within
+// a short grace window after the expiry, so that they do not vanish mid-flight.
+// The pool expiry is unaffected. The grace window is opt-in (see
+// Config.DeliveryGrace), the expired envelopes are dropped by default.
+//
+// The envelopes expired from the pool are remembered until the grace window is
+// over, so that their late copies are not delivered again (the copies of the
+// envelopes still pooled are recognized by the pool itself).
+
+package whisperv6
+
+import "github.com/ethereum/go-ethereum/common"
+
+// inGrace checks if the expired envelope is still within the grace window of
+// the delivery.
+func (whisper *Whisper) inGrace(envelope *Envelope, now uint32) bool {
+	return envelope.Expiry+whisper.graceSeconds() >= now
+}
+
+func (whisper *Whisper) graceSeconds() uint32 {
+	return uint32(whisper.deliveryGrace.Seconds())
+}
+
+// acceptsLate validates the expired envelope as if it was added to the pool.
+// The late envelopes are dropped silently anyway, so the violations are not
+// reported, and the PoW is only verified if it was not delivered yet.
+func (whisper *Whisper) acceptsLate(envelope *Envelope, sent, now uint32) bool {
+	if uint32(envelope.size()) > whisper.MaxMessageSize() || whisper.schemaOf(envelope).validate(envelope) != nil {
+		return false
+	}
+	bloom := whisper.bloomParams.envelopeBloom(envelope)
+	if !BloomFilterMatch(whisper.BloomFilter(), bloom) && !BloomFilterMatch(whisper.BloomFilterTolerance(), bloom) {
+		return false
+	}
+	if whisper.lateDelivered(envelope.Hash()) || whisper.isEnvelopeCached(envelope.Hash()) {
+		return false
+	}
+	return whisper.verifyPoW(envelope, sent, now) == nil
+}
+
+// deliverLate delivers the expired envelope to the local filters, unless it was
+// already delivered. The envelope is neither pooled nor forwarded.
+func (whisper *Whisper) deliverLate(envelope *Envelope, isP2P bool) {
+	hash := envelope.Hash()
+
+	// the pool is locked, so that the envelope can not be expired from it
+	// while checking that it was not delivered
+	whisper.poolMu.RLock()
+	_, pooled := whisper.envelopes[hash]
+	whisper.lateMu.Lock()
+	_, delivered := whisper.late[hash]
+	delivered = delivered || pooled
+	if !delivered {
+		whisper.late[hash] = envelope.Expiry
+	}
+	whisper.lateMu.Unlock()
+	whisper.poolMu.RUnlock()
+
+	if delivered {
+		whisper.poolLog.Trace("late envelope already delivered", "hash", hash.Hex())
+		return
+	}
+	whisper.poolLog.Debug("late envelope delivered within the grace window", "hash", hash.Hex())
+	whisper.postEvent(envelope, isP2P)
+}
+
+// rememberExpired records the envelopes expired from the pool as delivered,
+// and forgets the ones whose grace window is over. The pool must be locked by
+// the caller.
+func (whisper *Whisper) rememberExpired(expired []*Envelope, now uint32) {
+	whisper.lateMu.Lock()
+	defer whisper.lateMu.Unlock()
+
+	grace := whisper.graceSeconds()
+	for hash, expiry := range whisper.late {
+		if expiry+grace < now {
+			delete(whisper.late, hash)
+		}
+	}
+	if grace == 0 {
+		return
+	}
+	for _, envelope := range expired {
+		if envelope.Expiry+grace >= now {
+			whisper.late[envelope.Hash()] = envelope.Expiry
+		}
+	}
+}
+
+// lateDelivered checks if the late copies of the envelope are being ignored.
+func (whisper *Whisper) lateDelivered(hash common.Hash) bool {
+	whisper.lateMu.Lock()
+	defer whisper.lateMu.Unlock()
+	_, ok := whisper.late[hash]
+	return ok
+}
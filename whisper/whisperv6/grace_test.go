@@ -0,0 +1,158 @@
+// Copyright 2017 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package whisperv6
+
+import (
+	"testing"
+	"time"
+)
+
+// lateCopy returns a copy of the envelope, expiring at the given time.
+func lateCopy(env *Envelope, expiry uint32) *Envelope {
+	return &Envelope{Expiry: expiry, TTL: env.TTL, Topic: env.Topic, Data: env.Data, Nonce: env.Nonce}
+}
+
+// graceConfig is the default configuration with the grace window enabled.
+var graceConfig = Config{
+	MaxMessageSize:     DefaultMaxMessageSize,
+	MinimumAcceptedPOW: DefaultMinimumPoW,
+	DeliveryGrace:      2 * time.Second,
+}
+
+func TestLateDelivery(t *testing.T) {
+	InitSingleTest()
+
+	// the node is not started, so the delivered envelopes stay in the queue
+	w := New(&graceConfig)
+	w.SetMinimumPowTest(0.0000001)
+	defer w.SetMinimumPowTest(DefaultMinimumPoW)
+
+	f, err := generateFilter(t, true)
+	if err != nil {
+		t.Fatalf("failed to generate filter with seed %d: %s.", seed, err)
+	}
+	env := generateCompatibeEnvelope(t, f)
+	now := uint32(time.Now().Unix())
+
+	// expired on the way, but within the grace window
+	late := lateCopy(env, now-1)
+	ok, err := w.add(late, false)
+	if ok || err != nil {
+		t.Fatalf("late envelope not dropped silently with seed %d: %v, %v.", seed, ok, err)
+	}
+	if w.isEnvelopeCached(late.Hash()) {
+		t.Fatalf("late envelope pooled with seed %d.", seed)
+	}
+	if n := len(w.messageQueue); n != 1 {
+		t.Fatalf("late envelope not delivered with seed %d: %d.", seed, n)
+	}
+
+	// the late copies are only delivered once
+	if _, err := w.add(lateCopy(env, now-1), false); err != nil {
+		t.Fatalf("late copy rejected with seed %d: %s.", seed, err)
+	}
+	if n := len(w.messageQueue); n != 1 {
+		t.Fatalf("late envelope delivered twice with seed %d: %d.", seed, n)
+	}
+
+	// the envelopes beyond the grace window are dropped
+	if _, err := w.add(lateCopy(env, now-5), false); err != nil {
+		t.Fatalf("old envelope rejected with seed %d: %s.", seed, err)
+	}
+	if n := len(w.messageQueue); n != 1 {
+		t.Fatalf("envelope delivered beyond the grace window with seed %d: %d.", seed, n)
+	}
+}
+
+func TestLateDeliveryAfterPoolExpiry(t *testing.T) {
+	InitSingleTest()
+
+	w := New(&graceConfig)
+	w.SetMinimumPowTest(0.0000001)
+	defer w.SetMinimumPowTest(DefaultMinimumPoW)
+
+	f, err := generateFilter(t, true)
+	if err != nil {
+		t.Fatalf("failed to generate filter with seed %d: %s.", seed, err)
+	}
+	env := lateCopy(generateCompatibeEnvelope(t, f), uint32(time.Now().Unix()))
+	if ok, err := w.add(env, false); !ok || err != nil {
+		t.Fatalf("failed to add envelope with seed %d: %v, %v.", seed, ok, err)
+	}
+	if n := len(w.messageQueue); n != 1 {
+		t.Fatalf("envelope not delivered with seed %d: %d.", seed, n)
+	}
+
+	// the cleanup expires the envelope, racing with its late copy from a peer
+	time.Sleep(1100 * time.Millisecond)
+	w.expire()
+	if w.isEnvelopeCached(env.Hash()) {
+		t.Fatalf("envelope not expired with seed %d.", seed)
+	}
+	if _, err := w.add(lateCopy(env, env.Expiry), false); err != nil {
+		t.Fatalf("late copy rejected with seed %d: %s.", seed, err)
+	}
+	if n := len(w.messageQueue); n != 1 {
+		t.Fatalf("expired envelope delivered again with seed %d: %d.", seed, n)
+	}
+}
+
+func TestLateDeliveryDisabled(t *testing.T) {
+	InitSingleTest()
+
+	w := New(&DefaultConfig)
+	w.SetMinimumPowTest(0.0000001)
+	defer w.SetMinimumPowTest(DefaultMinimumPoW)
+
+	f, err := generateFilter(t, true)
+	if err != nil {
+		t.Fatalf("failed to generate filter with seed %d: %s.", seed, err)
+	}
+	env := lateCopy(generateCompatibeEnvelope(t, f), uint32(time.Now().Unix())-1)
+	if _, err := w.add(env, false); err != nil {
+		t.Fatalf("late envelope rejected with seed %d: %s.", seed, err)
+	}
+	if n := len(w.messageQueue); n != 0 {
+		t.Fatalf("late envelope delivered without the grace window with seed %d: %d.", seed, n)
+	}
+}
+
+func TestLateDeliveryReachesFilter(t *testing.T) {
+	InitSingleTest()
+
+	w := New(&graceConfig)
+	w.SetMinimumPowTest(0.0000001)
+	defer w.SetMinimumPowTest(DefaultMinimumPoW)
+	w.Start(nil)
+	defer w.Stop()
+
+	f, err := generateFilter(t, true)
+	if err != nil {
+		t.Fatalf("failed to generate filter with seed %d: %s.", seed, err)
+	}
+	f.Src = nil
+	if _, err := w.Subscribe(f); err != nil {
+		t.Fatalf("failed to install filter with seed %d: %s.", seed, err)
+	}
+	env := lateCopy(generateCompatibeEnvelope(t, f), uint32(time.Now().Unix())-1)
+	if _, err := w.add(env, false); err != nil {
+		t.Fatalf("late envelope rejected with seed %d: %s.", seed, err)
+	}
+	if !waitFor(5*time.Second, func() bool { return len(f.Retrieve()) == 1 }) {
+		t.Fatalf("late envelope not delivered to the filter with seed %d.", seed)
+	}
+}
@@ -0,0 +1,195 @@
+// Copyright 2017 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+// Contains the tracking of the idle identities. The gateways exposing the key
+// management over RPC can be driven to exhaust the memory by the clients
+// creating the identities in bulk. The identities created over RPC stay idle
+// until they decrypt the first message, and the idle ones are deleted once
+// they get too old, or when too many of them pile up (oldest first).
+
+package whisperv6
+
+import (
+	"container/list"
+	"sync"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+)
+
+// idleIdentity is an identity which did not decrypt any message yet.
+type idleIdentity struct {
+	id          string
+	fingerprint common.Hash // Hash of the public key, or of the symmetric key
+	created     time.Time
+}
+
+// idleIdentities tracks the idle identities in the order of their creation.
+type idleIdentities struct {
+	expiry time.Duration // Age of the idle identities to be deleted (zero means never)
+	limit  int           // Maximum number of the idle identities (zero means unlimited)
+
+	mu      sync.Mutex
+	order   *list.List // Idle identities, the oldest first
+	byID    map[string]*list.Element
+	byPrint map[common.Hash]*list.Element
+}
+
+func newIdleIdentities(expiry time.Duration, limit int) *idleIdentities {
+	return &idleIdentities{
+		expiry:  expiry,
+		limit:   limit,
+		order:   list.New(),
+		byID:    make(map[string]*list.Element),
+		byPrint: make(map[common.Hash]*list.Element),
+	}
+}
+
+// enabled checks if the idle identities are deleted at all.
+func (t *idleIdentities) enabled() bool {
+	return t != nil && (t.expiry > 0 || t.limit > 0)
+}
+
+// track starts tracking the new identity, returning the identities evicted
+// beyond the limit.
+func (t *idleIdentities) track(id string, fingerprint common.Hash, now time.Time) []string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if _, exist := t.byID[id]; exist {
+		return nil
+	}
+	if _, exist := t.byPrint[fingerprint]; exist {
+		// the same key imported twice, the first import represents both
+		return nil
+	}
+	el := t.order.PushBack(&idleIdentity{id: id, fingerprint: fingerprint, created: now})
+	t.byID[id], t.byPrint[fingerprint] = el, el
+
+	var evicted []string
+	for t.limit > 0 && t.order.Len() > t.limit {
+		evicted = append(evicted, t.remove(t.order.Front()))
+	}
+	return evicted
+}
+
+// used stops tracking the identity with the fingerprint, if idle.
+func (t *idleIdentities) used(fingerprint common.Hash) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if el, ok := t.byPrint[fingerprint]; ok {
+		t.remove(el)
+	}
+}
+
+// forget stops tracking the deleted identity.
+func (t *idleIdentities) forget(id string) {
+	if !t.enabled() {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if el, ok := t.byID[id]; ok {
+		t.remove(el)
+	}
+}
+
+// expired removes and returns the identities idle for longer than the expiry.
+func (t *idleIdentities) expired(now time.Time) []string {
+	if !t.enabled() || t.expiry <= 0 {
+		return nil
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	var ids []string
+	for el := t.order.Front(); el != nil && now.Sub(el.Value.(*idleIdentity).created) >= t.expiry; el = t.order.Front() {
+		ids = append(ids, t.remove(el))
+	}
+	return ids
+}
+
+// remove drops the element, returning the id of the identity. The tracker
+// must be locked by the caller.
+func (t *idleIdentities) remove(el *list.Element) string {
+	idle := t.order.Remove(el).(*idleIdentity)
+	delete(t.byID, idle.id)
+	delete(t.byPrint, idle.fingerprint)
+	return idle.id
+}
+
+// trackIdleIdentity starts tracking the identity created over RPC, deleting
+// the identities evicted beyond the limit.
+func (whisper *Whisper) trackIdleIdentity(id string) {
+	if !whisper.idle.enabled() {
+		return
+	}
+	var fingerprint common.Hash
+	whisper.keyMu.RLock()
+	if key, ok := whisper.privateKeys[id]; ok {
+		fingerprint = crypto.Keccak256Hash(crypto.FromECDSAPub(&key.PublicKey))
+	} else if key, ok := whisper.symKeys[id]; ok {
+		fingerprint = crypto.Keccak256Hash(key)
+	}
+	whisper.keyMu.RUnlock()
+
+	if fingerprint == (common.Hash{}) {
+		return
+	}
+	for _, evicted := range whisper.idle.track(id, fingerprint, time.Now()) {
+		whisper.deleteIdleIdentity(evicted)
+	}
+}
+
+// identityUsed marks the identity which decrypted the message as used.
+func (whisper *Whisper) identityUsed(msg *ReceivedMessage) {
+	if !whisper.idle.enabled() {
+		return
+	}
+	if msg.Dst != nil {
+		whisper.idle.used(crypto.Keccak256Hash(crypto.FromECDSAPub(msg.Dst)))
+	}
+	if msg.SymKeyHash != (common.Hash{}) {
+		whisper.idle.used(msg.SymKeyHash)
+	}
+}
+
+// expireIdleIdentities deletes the identities idle for longer than the expiry.
+func (whisper *Whisper) expireIdleIdentities() {
+	for _, id := range whisper.idle.expired(time.Now()) {
+		whisper.deleteIdleIdentity(id)
+	}
+}
+
+// hasIdentity checks if the key pair or the symmetric key exists.
+func (whisper *Whisper) hasIdentity(id string) bool {
+	return whisper.HasKeyPair(id) || whisper.HasSymKey(id)
+}
+
+// deleteIdentity deletes the identity, be it a key pair or a symmetric key.
+func (whisper *Whisper) deleteIdentity(id string) bool {
+	return whisper.DeleteKeyPair(id) || whisper.DeleteSymKey(id)
+}
+
+// deleteIdleIdentity deletes the idle identity.
+func (whisper *Whisper) deleteIdleIdentity(id string) {
+	if whisper.deleteIdentity(id) {
+		whisper.Logger(LogSubsystemFilter).Debug("deleted idle identity", "id", id)
+	}
+}
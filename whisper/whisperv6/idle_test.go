@@ -0,0 +1,125 @@
+// Copyright 2017 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+// +build !whisperlite
+
+package whisperv6
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/crypto"
+)
+
+func TestIdentityRateLimit(t *testing.T) {
+	cfg := DefaultConfig
+	cfg.ClientMaxIdentitiesPerMinute = 2
+	api := NewPublicWhisperAPI(New(&cfg))
+	ctx := context.Background()
+
+	for i := 0; i < 2; i++ {
+		if _, err := api.NewSymKey(ctx); err != nil {
+			t.Fatalf("failed to create symmetric key %d: %s.", i, err)
+		}
+	}
+	_, err := api.NewKeyPair(ctx)
+	if qerr, ok := err.(*QuotaExceededError); !ok || qerr.Quota != QuotaIdentitiesPerMinute {
+		t.Fatalf("identity rate limit was not enforced: %v.", err)
+	}
+}
+
+func TestIdleIdentityEviction(t *testing.T) {
+	cfg := DefaultConfig
+	cfg.MaxIdleIdentities = 2
+	w := New(&cfg)
+	api := NewPublicWhisperAPI(w)
+	ctx := context.Background()
+
+	var ids []string
+	for i := 0; i < 3; i++ {
+		id, err := api.NewSymKey(ctx)
+		if err != nil {
+			t.Fatalf("failed to create symmetric key %d: %s.", i, err)
+		}
+		ids = append(ids, id)
+	}
+	if w.HasSymKey(ids[0]) {
+		t.Fatalf("oldest idle identity was not evicted.")
+	}
+
+	// the used identity is not idle any more
+	key, _ := w.GetSymKey(ids[1])
+	w.identityUsed(&ReceivedMessage{SymKeyHash: crypto.Keccak256Hash(key)})
+	pairID, err := api.NewKeyPair(ctx)
+	if err != nil {
+		t.Fatalf("failed to create key pair: %s.", err)
+	}
+	if _, err = api.NewSymKey(ctx); err != nil {
+		t.Fatalf("failed to create symmetric key: %s.", err)
+	}
+	if !w.HasSymKey(ids[1]) {
+		t.Fatalf("used identity was evicted.")
+	}
+	if w.HasSymKey(ids[2]) {
+		t.Fatalf("idle identity was not evicted.")
+	}
+
+	// the identities created outside of RPC are not tracked
+	if _, err = w.NewKeyPair(); err != nil {
+		t.Fatalf("failed to create key pair: %s.", err)
+	}
+	if !w.HasKeyPair(pairID) {
+		t.Fatalf("idle identity evicted prematurely.")
+	}
+}
+
+func TestIdleIdentityExpiry(t *testing.T) {
+	cfg := DefaultConfig
+	cfg.ClientMaxIdentities = 1
+	cfg.IdleIdentityExpiry = time.Millisecond
+	w := New(&cfg)
+	api := NewPublicWhisperAPI(w)
+	ctx := context.Background()
+
+	id, err := api.NewKeyPair(ctx)
+	if err != nil {
+		t.Fatalf("failed to create key pair: %s.", err)
+	}
+	time.Sleep(10 * time.Millisecond)
+	w.expireIdleIdentities()
+	if w.HasKeyPair(id) {
+		t.Fatalf("idle identity did not expire.")
+	}
+	// the expired identity does not count against the quota
+	if _, err = api.NewKeyPair(ctx); err != nil {
+		t.Fatalf("expired identity still counted against the quota: %s.", err)
+	}
+}
+
+func TestIdleIdentitiesDisabled(t *testing.T) {
+	var untracked *idleIdentities
+	if untracked.enabled() {
+		t.Fatalf("nil tracker enabled.")
+	}
+	if newIdleIdentities(0, 0).enabled() {
+		t.Fatalf("tracker without the expiry and the limit enabled.")
+	}
+	if !newIdleIdentities(0, 1).enabled() {
+		t.Fatalf("tracker with the limit disabled.")
+	}
+}
@@ -0,0 +1,269 @@
+// Copyright 2017 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+// Contains the ingest stage of the received envelopes. The message loop of the
+// peer only decodes the envelopes, and passes them to the ingest goroutine of
+// the peer, which verifies their PoW in parallel (bounded by the verifiers
+// shared by all the peers) before adding them to the pool. Thus the slow
+// verification does not stall reading from the socket.
+//
+// The other messages of the peer wait for its pending envelopes, so that they
+// are still handled in the order the peer sent them (e.g. the acknowledgement
+// requests following the envelopes).
+
+package whisperv6
+
+import (
+	"errors"
+	"sync"
+
+	"github.com/ethereum/go-ethereum/p2p"
+)
+
+const ingestQueueLimit = 16 // number of received batches awaiting the verification, per peer
+
+// powVerifier bounds the number of the goroutines calculating the PoW of the
+// received envelopes across all the peers.
+type powVerifier struct {
+	slots chan struct{}
+}
+
+func newPowVerifier(workers int) *powVerifier {
+	return &powVerifier{slots: make(chan struct{}, workers)}
+}
+
+// verify calculates the PoW of the envelopes in parallel, caching it in them.
+func (v *powVerifier) verify(envelopes []*Envelope) {
+	var wg sync.WaitGroup
+	for _, env := range envelopes {
+		v.slots <- struct{}{}
+		wg.Add(1)
+		go func(env *Envelope) {
+			defer func() {
+				<-v.slots
+				wg.Done()
+			}()
+			env.PoW()
+		}(env)
+	}
+	wg.Wait()
+}
+
+// ingestStage processes the envelopes received from a single peer.
+type ingestStage struct {
+	whisper *Whisper
+	peer    *Peer
+	queue   chan []*Envelope
+	pending sync.WaitGroup // batches queued or being processed
+
+	mu     sync.Mutex
+	err    error         // first failure, after which the peer is disconnected
+	failed chan struct{} // closed on the first failure
+	done   chan struct{} // closed once the ingest goroutine exits
+}
+
+// startIngest starts the ingest goroutine of the peer.
+func (whisper *Whisper) startIngest(p *Peer) *ingestStage {
+	stage := &ingestStage{
+		whisper: whisper,
+		peer:    p,
+		queue:   make(chan []*Envelope, ingestQueueLimit),
+		failed:  make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+	go stage.loop()
+	return stage
+}
+
+func (stage *ingestStage) loop() {
+	defer close(stage.done)
+	for envelopes := range stage.queue {
+		if stage.error() == nil {
+			if err := stage.process(envelopes); err != nil {
+				stage.mu.Lock()
+				stage.err = err
+				close(stage.failed)
+				stage.mu.Unlock()
+			}
+		}
+		stage.pending.Done()
+	}
+}
+
+// submit queues the envelopes for the verification, blocking while the queue
+// is full. It fails if the stage already failed.
+func (stage *ingestStage) submit(envelopes []*Envelope) error {
+	stage.pending.Add(1)
+	select {
+	case stage.queue <- envelopes:
+		return nil
+	case <-stage.failed:
+		stage.pending.Done()
+		return stage.error()
+	}
+}
+
+// flush waits for all the queued envelopes to be processed, returning the
+// failure (if any).
+func (stage *ingestStage) flush() error {
+	stage.pending.Wait()
+	return stage.error()
+}
+
+// error returns the first failure of the stage.
+func (stage *ingestStage) error() error {
+	stage.mu.Lock()
+	defer stage.mu.Unlock()
+	return stage.err
+}
+
+// stop terminates the ingest goroutine, discarding the queued envelopes.
+func (stage *ingestStage) stop() {
+	stage.mu.Lock()
+	if stage.err == nil {
+		stage.err = errIngestStopped
+		close(stage.failed)
+	}
+	stage.mu.Unlock()
+	close(stage.queue)
+	<-stage.done
+}
+
+var (
+	errIngestStopped = errors.New("ingest stopped")
+	errIngestFailed  = errors.New("ingest failed")
+)
+
+// process verifies the envelopes and adds them to the pool, failing if the
+// peer sent any invalid ones.
+func (stage *ingestStage) process(envelopes []*Envelope) error {
+	whisper, p := stage.whisper, stage.peer
+
+	fresh := make([]*Envelope, 0, len(envelopes))
+	for _, env := range envelopes {
+		if !whisper.isEnvelopeCached(env.Hash()) {
+			fresh = append(fresh, env)
+		}
+	}
+	whisper.powVerifier.verify(fresh)
+
+	trouble := false
+	var notices []rejectionNotice
+	for _, env := range envelopes {
+		env.schema = p.schema // validated and decrypted according to the version of the peer
+		cached, err := whisper.add(env, whisper.lightClient)
+		if err != nil && whisper.rejectionNotices {
+			if notice, ok := rejection(env, err); ok {
+				notices = append(notices, notice)
+			}
+		}
+		if err != nil && p.warmingUp() && settling(err) {
+			// the envelope was sent before the peer processed our requirements
+			p.log.Debug("envelope tolerated during warm-up", "hash", env.Hash().Hex(), "err", err)
+		} else if err != nil {
+			trouble = true
+			p.log.Error("bad envelope received, peer will be disconnected", "hash", env.Hash().Hex(), "err", err)
+		}
+		if cached {
+			p.mark(env)
+		}
+	}
+
+	if len(notices) > 0 {
+		if err := p.sendRejections(notices); err != nil {
+			p.log.Trace("failed to send rejection notices", "err", err)
+		}
+	}
+	if trouble {
+		return errors.New("invalid envelope")
+	}
+	return nil
+}
+
+// packetReader reads the packets of the peer on a separate goroutine, so that
+// the message loop may wait for the packets and the ingest failures at once.
+// The next packet is only read once requested, after the previous one was
+// handled, as if the message loop read it directly.
+type packetReader struct {
+	requests chan struct{}
+	results  chan packetResult
+	done     chan struct{}
+	pending  bool // a packet was requested, but not returned yet
+}
+
+type packetResult struct {
+	packet p2p.Msg
+	err    error
+}
+
+func newPacketReader(rw p2p.MsgReader) *packetReader {
+	r := &packetReader{
+		requests: make(chan struct{}),
+		results:  make(chan packetResult),
+		done:     make(chan struct{}),
+	}
+	go r.loop(rw)
+	return r
+}
+
+func (r *packetReader) loop(rw p2p.MsgReader) {
+	for {
+		select {
+		case <-r.requests:
+		case <-r.done:
+			return
+		}
+		packet, err := rw.ReadMsg()
+		select {
+		case r.results <- packetResult{packet, err}:
+		case <-r.done:
+			if err == nil {
+				packet.Discard()
+			}
+			return
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// next returns the next packet of the peer, or errIngestFailed if the abort
+// channel is closed first.
+func (r *packetReader) next(abort <-chan struct{}) (p2p.Msg, error) {
+	// the packet requested before the abort is returned by the next call
+	if !r.pending {
+		select {
+		case r.requests <- struct{}{}:
+			r.pending = true
+		case <-abort:
+			return p2p.Msg{}, errIngestFailed
+		}
+	}
+	select {
+	case res := <-r.results:
+		r.pending = false
+		return res.packet, res.err
+	case <-abort:
+		return p2p.Msg{}, errIngestFailed
+	}
+}
+
+// close stops the reader. The pending read returns once the connection of
+// the peer is closed.
+func (r *packetReader) close() {
+	close(r.done)
+}
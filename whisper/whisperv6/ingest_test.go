@@ -0,0 +1,88 @@
+// Copyright 2017 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package whisperv6
+
+import (
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/p2p"
+	"github.com/ethereum/go-ethereum/p2p/discover"
+)
+
+func TestPowVerifier(t *testing.T) {
+	InitSingleTest()
+
+	now := uint32(time.Now().Unix())
+	envelopes := make([]*Envelope, 32)
+	for i := range envelopes {
+		envelopes[i] = &Envelope{Expiry: now + DefaultTTL, TTL: DefaultTTL, Data: []byte{byte(i)}, Nonce: uint64(seed) + uint64(i)}
+	}
+	newPowVerifier(3).verify(envelopes)
+	for i, env := range envelopes {
+		serial := &Envelope{Expiry: env.Expiry, TTL: env.TTL, Data: env.Data, Nonce: env.Nonce}
+		if env.pow == 0 || env.pow != serial.PoW() {
+			t.Fatalf("wrong PoW of envelope %d with seed %d: %f, want %f.", i, seed, env.pow, serial.PoW())
+		}
+	}
+}
+
+func TestIngestStage(t *testing.T) {
+	InitSingleTest()
+
+	cfg := DefaultConfig
+	cfg.PoWVerifiers = 2
+	w := New(&cfg)
+	w.SetMinimumPowTest(0.0000001)
+	defer w.SetMinimumPowTest(DefaultMinimumPoW)
+	w.Start(nil)
+	defer w.Stop()
+
+	remote, errc := connectTestPeer(t, w, discover.NodeID{1})
+	defer remote.Close()
+
+	// several batches are queued without waiting for their verification
+	now := uint32(time.Now().Unix())
+	var sent []*Envelope
+	for i := 0; i < 4; i++ {
+		batch := make([]*Envelope, 8)
+		for j := range batch {
+			batch[j] = &Envelope{Expiry: now + DefaultTTL, TTL: DefaultTTL, Data: []byte{byte(i), byte(j)}, Nonce: uint64(seed)}
+		}
+		if err := p2p.Send(remote, messagesCode, batch); err != nil {
+			t.Fatalf("failed to send envelopes with seed %d: %s.", seed, err)
+		}
+		sent = append(sent, batch...)
+	}
+	if !waitFor(time.Second, func() bool { return len(w.Envelopes()) == len(sent) }) {
+		t.Fatalf("wrong number of envelopes ingested with seed %d: %d.", seed, len(w.Envelopes()))
+	}
+
+	// the invalid envelope disconnects the peer, without waiting for its next packet
+	bad := []*Envelope{{Expiry: now - DefaultTTL, TTL: DefaultTTL, Data: []byte{0xff}, Nonce: uint64(seed)}}
+	if err := p2p.Send(remote, messagesCode, bad); err != nil {
+		t.Fatalf("failed to send envelope with seed %d: %s.", seed, err)
+	}
+	select {
+	case err := <-errc:
+		if err == nil {
+			t.Fatalf("peer disconnected without error.")
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("peer not disconnected after the invalid envelope with seed %d.", seed)
+	}
+}
@@ -0,0 +1,226 @@
+// Copyright 2017 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+// Contains the export and import of all the keys and filters of the node,
+// which allows to migrate a gateway to another node without downtime.
+
+package whisperv6
+
+import (
+	"crypto/cipher"
+	"crypto/ecdsa"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+	"golang.org/x/crypto/pbkdf2"
+)
+
+const (
+	keyBundleVersion    = byte(1)
+	keyBundleSaltSize   = 16
+	keyBundleIterations = 65536 // PBKDF2 iterations deriving the key of the bundle from the passphrase
+)
+
+// keyBundle is the plaintext of an exported bundle.
+type keyBundle struct {
+	Identities map[string][]byte `json:"identities"`
+	SymKeys    map[string][]byte `json:"symKeys"`
+	Filters    []bundleFilter    `json:"filters"`
+}
+
+// bundleFilter is an exported filter. The filter carries its own key material,
+// so that it can be bound again even if its key was not stored under any ID.
+type bundleFilter struct {
+	ID         string                 `json:"id"`
+	Src        []byte                 `json:"src,omitempty"`
+	KeyAsym    []byte                 `json:"keyAsym,omitempty"`
+	KeySym     []byte                 `json:"keySym,omitempty"`
+	Topics     [][]byte               `json:"topics"`
+	PoW        float64                `json:"pow"`
+	AllowP2P   bool                   `json:"allowP2P"`
+	Limit      int                    `json:"limit,omitempty"`      // maximum number of queued messages, the quota of the client
+	Priorities map[common.Address]int `json:"priorities,omitempty"` // static priorities of the senders (the scoring function is not exported)
+}
+
+// bundleKey derives the encryption key of the bundle from the passphrase.
+func (whisper *Whisper) bundleKey(passphrase string, salt []byte) (cipher.AEAD, error) {
+	return whisper.schema.newGCM(pbkdf2.Key([]byte(passphrase), salt, keyBundleIterations, whisper.schema.aesKeyLength, sha256.New))
+}
+
+// ExportKeys returns all the identities, symmetric keys and filters of the
+// node in one bundle, encrypted with the given passphrase.
+func (whisper *Whisper) ExportKeys(passphrase string) ([]byte, error) {
+	bundle := whisper.keyBundle()
+	plaintext, err := json.Marshal(&bundle)
+	if err != nil {
+		return nil, err
+	}
+	salt, err := generateSecureRandomData(keyBundleSaltSize)
+	if err != nil {
+		return nil, err
+	}
+	aesgcm, err := whisper.bundleKey(passphrase, salt)
+	if err != nil {
+		return nil, err
+	}
+	nonce, err := generateSecureRandomData(aesgcm.NonceSize())
+	if err != nil {
+		return nil, err
+	}
+	out := append([]byte{keyBundleVersion}, salt...)
+	out = append(out, nonce...)
+	return aesgcm.Seal(out, nonce, plaintext, out[:1]), nil
+}
+
+// keyBundle collects all the identities, symmetric keys and filters of the node.
+func (whisper *Whisper) keyBundle() keyBundle {
+	bundle := keyBundle{
+		Identities: make(map[string][]byte),
+		SymKeys:    make(map[string][]byte),
+	}
+	whisper.keyMu.RLock()
+	for id, key := range whisper.privateKeys {
+		bundle.Identities[id] = crypto.FromECDSA(key)
+	}
+	for id, key := range whisper.symKeys {
+		bundle.SymKeys[id] = key
+	}
+	whisper.keyMu.RUnlock()
+
+	whisper.filters.mutex.RLock()
+	for id, f := range whisper.filters.watchers {
+		exported := bundleFilter{ID: id, KeySym: f.KeySym, Topics: f.Topics, PoW: f.PoW, AllowP2P: f.AllowP2P, Limit: f.maxMessages, Priorities: f.Priorities}
+		if f.Src != nil {
+			exported.Src = crypto.FromECDSAPub(f.Src)
+		}
+		if f.KeyAsym != nil {
+			exported.KeyAsym = crypto.FromECDSA(f.KeyAsym)
+		}
+		bundle.Filters = append(bundle.Filters, exported)
+	}
+	whisper.filters.mutex.RUnlock()
+	return bundle
+}
+
+// ImportKeys decrypts the bundle exported by ExportKeys and installs all of
+// its keys and filters under their original IDs, so that the clients of the
+// previous node can keep using them. The import is atomic: nothing is
+// installed if any of the keys or filters is invalid or its ID already taken.
+func (whisper *Whisper) ImportKeys(data []byte, passphrase string) error {
+	nonceLength := whisper.schema.aesNonceLength
+	if len(data) < 1+keyBundleSaltSize+nonceLength {
+		return errors.New("key bundle too short")
+	}
+	if data[0] != keyBundleVersion {
+		return fmt.Errorf("unsupported key bundle version %d", data[0])
+	}
+	salt := data[1 : 1+keyBundleSaltSize]
+	nonce := data[1+keyBundleSaltSize : 1+keyBundleSaltSize+nonceLength]
+	aesgcm, err := whisper.bundleKey(passphrase, salt)
+	if err != nil {
+		return err
+	}
+	plaintext, err := aesgcm.Open(nil, nonce, data[1+keyBundleSaltSize+nonceLength:], data[:1])
+	if err != nil {
+		return errors.New("failed to decrypt key bundle, wrong passphrase?")
+	}
+	var bundle keyBundle
+	if err = json.Unmarshal(plaintext, &bundle); err != nil {
+		return fmt.Errorf("invalid key bundle: %v", err)
+	}
+
+	// decode everything before touching the node
+	identities, filters, err := bundle.decode()
+	if err != nil {
+		return err
+	}
+	if err = whisper.installBundle(identities, bundle.SymKeys, filters); err != nil {
+		return err
+	}
+	// the peers are notified about the new bloom filter without holding the keys
+	for _, f := range filters {
+		whisper.updateBloomFilter(f)
+	}
+	return nil
+}
+
+// installBundle installs the decoded keys and filters of the bundle, unless any
+// of their IDs is already taken.
+func (whisper *Whisper) installBundle(identities map[string]*ecdsa.PrivateKey, symKeys map[string][]byte, filters []*Filter) error {
+	whisper.keyMu.Lock()
+	defer whisper.keyMu.Unlock()
+
+	for id := range identities {
+		if whisper.privateKeys[id] != nil {
+			return fmt.Errorf("identity %s already exists", id)
+		}
+	}
+	for id := range symKeys {
+		if whisper.symKeys[id] != nil {
+			return fmt.Errorf("symmetric key %s already exists", id)
+		}
+	}
+	if err := whisper.filters.installAll(filters); err != nil {
+		return err
+	}
+	for id, key := range identities {
+		whisper.privateKeys[id] = key
+	}
+	for id, key := range symKeys {
+		whisper.symKeys[id] = key
+	}
+	return nil
+}
+
+// decode validates the keys of the bundle, and decodes the identities and the
+// filters.
+func (bundle *keyBundle) decode() (map[string]*ecdsa.PrivateKey, []*Filter, error) {
+	var err error
+	identities := make(map[string]*ecdsa.PrivateKey, len(bundle.Identities))
+	for id, raw := range bundle.Identities {
+		if identities[id], err = crypto.ToECDSA(raw); err != nil {
+			return nil, nil, fmt.Errorf("invalid identity %s: %v", id, err)
+		}
+	}
+	for id, key := range bundle.SymKeys {
+		if len(key) != defaultSchema.aesKeyLength {
+			return nil, nil, fmt.Errorf("invalid symmetric key %s: wrong size %d", id, len(key))
+		}
+	}
+	filters := make([]*Filter, 0, len(bundle.Filters))
+	for _, exported := range bundle.Filters {
+		if exported.Limit < 0 {
+			return nil, nil, fmt.Errorf("invalid message limit of filter %s: %d", exported.ID, exported.Limit)
+		}
+		f := &Filter{KeySym: exported.KeySym, Topics: exported.Topics, PoW: exported.PoW, AllowP2P: exported.AllowP2P, Priorities: exported.Priorities, maxMessages: exported.Limit, id: exported.ID}
+		if exported.Src != nil {
+			if f.Src = crypto.ToECDSAPub(exported.Src); f.Src == nil {
+				return nil, nil, fmt.Errorf("invalid source of filter %s", exported.ID)
+			}
+		}
+		if exported.KeyAsym != nil {
+			if f.KeyAsym, err = crypto.ToECDSA(exported.KeyAsym); err != nil {
+				return nil, nil, fmt.Errorf("invalid key of filter %s: %v", exported.ID, err)
+			}
+		}
+		filters = append(filters, f)
+	}
+	return identities, filters, nil
+}
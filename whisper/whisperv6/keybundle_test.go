@@ -0,0 +1,91 @@
+// Copyright 2017 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package whisperv6
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+func TestKeyBundle(t *testing.T) {
+	InitSingleTest()
+
+	src := New(&DefaultConfig)
+	asymID, err := src.NewKeyPair()
+	if err != nil {
+		t.Fatalf("failed to generate key pair with seed %d: %s.", seed, err)
+	}
+	symID, err := src.GenerateSymKey()
+	if err != nil {
+		t.Fatalf("failed to generate symmetric key with seed %d: %s.", seed, err)
+	}
+	symKey, _ := src.GetSymKey(symID)
+	filterID, err := src.Subscribe(&Filter{KeySym: symKey, Topics: [][]byte{{1, 2, 3, 4}}, AllowP2P: true, Priorities: map[common.Address]int{{1}: 5}, maxMessages: 8})
+	if err != nil {
+		t.Fatalf("failed to subscribe with seed %d: %s.", seed, err)
+	}
+
+	bundle, err := src.ExportKeys("secret")
+	if err != nil {
+		t.Fatalf("failed to export keys with seed %d: %s.", seed, err)
+	}
+
+	dst := New(&DefaultConfig)
+	if err = dst.ImportKeys(bundle, "wrong"); err == nil {
+		t.Fatalf("bundle decrypted with a wrong passphrase.")
+	}
+	if err = dst.ImportKeys(bundle, "secret"); err != nil {
+		t.Fatalf("failed to import keys with seed %d: %s.", seed, err)
+	}
+	orig, _ := src.GetPrivateKey(asymID)
+	if imported, err := dst.GetPrivateKey(asymID); err != nil || imported.D.Cmp(orig.D) != 0 {
+		t.Fatalf("identity not imported with seed %d: %v.", seed, err)
+	}
+	if imported, err := dst.GetSymKey(symID); err != nil || !bytes.Equal(imported, symKey) {
+		t.Fatalf("symmetric key not imported with seed %d: %v.", seed, err)
+	}
+	f := dst.GetFilter(filterID)
+	if f == nil || !bytes.Equal(f.KeySym, symKey) || !f.AllowP2P || len(f.Topics) != 1 {
+		t.Fatalf("filter not rebound with seed %d: %+v.", seed, f)
+	}
+	if f.maxMessages != 8 {
+		t.Fatalf("message limit of the filter lost with seed %d: %d.", seed, f.maxMessages)
+	}
+	if f.Priorities[common.Address{1}] != 5 {
+		t.Fatalf("sender priorities of the filter lost with seed %d: %v.", seed, f.Priorities)
+	}
+	if len(dst.filters.getWatchersByTopic(TopicType{1, 2, 3, 4})) != 1 {
+		t.Fatalf("rebound filter not matching its topic with seed %d.", seed)
+	}
+
+	// importing again must fail without installing anything
+	other, err := src.GenerateSymKey()
+	if err != nil {
+		t.Fatalf("failed to generate symmetric key with seed %d: %s.", seed, err)
+	}
+	if bundle, err = src.ExportKeys("secret"); err != nil {
+		t.Fatalf("failed to export keys with seed %d: %s.", seed, err)
+	}
+	if err = dst.ImportKeys(bundle, "secret"); err == nil {
+		t.Fatalf("conflicting bundle imported with seed %d.", seed)
+	}
+	if dst.HasSymKey(other) {
+		t.Fatalf("key of a failed import installed with seed %d.", seed)
+	}
+}
@@ -0,0 +1,152 @@
+// Copyright 2017 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+// Contains the latency-aware transmission scheduling. The round-trip time of
+// each peer is probed by requesting the acknowledgement of an envelope known
+// to the peer, and the fresh envelopes of every transmission cycle are sent to
+// the low-latency peers first, which in turn relay them further sooner.
+
+package whisperv6
+
+import (
+	"sort"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/p2p"
+)
+
+// latencyProbe is the round-trip probe awaiting the acknowledgement.
+type latencyProbe struct {
+	hash common.Hash
+	sent time.Time
+}
+
+// sendProbe requests the acknowledgement of an envelope known to the peer,
+// measuring the round-trip time. Nothing is sent if the peer knows none of
+// the pooled envelopes.
+func (peer *Peer) sendProbe() error {
+	var hash common.Hash
+	peer.known.Each(func(v interface{}) bool {
+		if known := v.(common.Hash); peer.host.isEnvelopeCached(known) {
+			hash = known
+			return false
+		}
+		return true
+	})
+	if hash == (common.Hash{}) {
+		return nil
+	}
+	peer.latencyMu.Lock()
+	peer.probe = latencyProbe{hash: hash, sent: time.Now()}
+	peer.latencyMu.Unlock()
+
+	return p2p.Send(peer.ws, ackRequestCode, []common.Hash{hash})
+}
+
+// observeAck completes the probe acknowledged by the peer, updating the
+// smoothed round-trip time.
+func (peer *Peer) observeAck(ack *envelopeAck) {
+	peer.latencyMu.Lock()
+	defer peer.latencyMu.Unlock()
+
+	if peer.probe.hash == (common.Hash{}) {
+		return
+	}
+	for _, hash := range ack.Hashes {
+		if hash == peer.probe.hash {
+			sample := time.Since(peer.probe.sent)
+			if peer.rtt == 0 {
+				peer.rtt = sample
+			} else {
+				peer.rtt = (7*peer.rtt + sample) / 8
+			}
+			peer.probe = latencyProbe{}
+			return
+		}
+	}
+}
+
+// latency returns the smoothed round-trip time of the peer, zero if not
+// measured yet.
+func (peer *Peer) latency() time.Duration {
+	peer.latencyMu.Lock()
+	defer peer.latencyMu.Unlock()
+	return peer.rtt
+}
+
+// PeerLatency returns the smoothed round-trip time of the peer, zero if not
+// measured yet. The latency is only probed with the latency-aware scheduling.
+func (whisper *Whisper) PeerLatency(peerID []byte) (time.Duration, error) {
+	p, err := whisper.getPeer(peerID)
+	if err != nil {
+		return 0, err
+	}
+	return p.latency(), nil
+}
+
+// transmissionOrder returns the peers ordered by their latency, the lowest
+// first. The peers not measured yet come last.
+func (whisper *Whisper) transmissionOrder() []*Peer {
+	whisper.peerMu.RLock()
+	peers := make([]*Peer, 0, len(whisper.peers))
+	latencies := make(map[*Peer]time.Duration, len(whisper.peers))
+	for p := range whisper.peers {
+		peers = append(peers, p)
+		latencies[p] = p.latency()
+	}
+	whisper.peerMu.RUnlock()
+
+	sort.Slice(peers, func(i, j int) bool {
+		li, lj := latencies[peers[i]], latencies[peers[j]]
+		if li == 0 || lj == 0 {
+			return lj == 0 && li != 0
+		}
+		return li < lj
+	})
+	return peers
+}
+
+// transmitStagger is the delay between triggering the broadcasts of the peers
+// consecutive in the order of their latency, giving the low-latency peers a
+// head start on the uplink.
+const transmitStagger = 2 * time.Millisecond
+
+// transmit runs a single transmission cycle, triggering the broadcast of the
+// peers in the order of their latency. The broadcasts run concurrently, so the
+// slow peers do not hold back the ones after them: only the small stagger is
+// kept between the triggers, shortened to fit into half of the cycle.
+func (whisper *Whisper) transmit(quit <-chan struct{}) {
+	peers := whisper.transmissionOrder()
+	stagger := transmitStagger
+	if n := time.Duration(len(peers)); n > 0 && stagger*n > whisper.transmissionCycle/2 {
+		stagger = whisper.transmissionCycle / 2 / n
+	}
+	for i, p := range peers {
+		if i > 0 && stagger > 0 {
+			select {
+			case <-time.After(stagger):
+			case <-quit:
+				return
+			}
+		}
+		select {
+		case p.transmit <- struct{}{}:
+		default:
+			// still busy with the previous cycle
+		}
+	}
+}
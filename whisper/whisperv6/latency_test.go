@@ -0,0 +1,166 @@
+// Copyright 2017 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package whisperv6
+
+import (
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/p2p"
+	"github.com/ethereum/go-ethereum/p2p/discover"
+)
+
+func TestTransmissionOrder(t *testing.T) {
+	w := New(&DefaultConfig)
+	latencies := []time.Duration{50 * time.Millisecond, 0, 10 * time.Millisecond, 30 * time.Millisecond}
+	for i, rtt := range latencies {
+		p := newPeer(w, p2p.NewPeer(discover.NodeID{byte(i)}, "test", nil), nil)
+		p.rtt = rtt
+		w.peers[p] = struct{}{}
+	}
+
+	order := w.transmissionOrder()
+	want := []time.Duration{10 * time.Millisecond, 30 * time.Millisecond, 50 * time.Millisecond, 0}
+	for i, p := range order {
+		if p.latency() != want[i] {
+			t.Fatalf("wrong transmission order at %d: %v, want %v.", i, p.latency(), want[i])
+		}
+	}
+}
+
+func TestLatencyScheduling(t *testing.T) {
+	InitSingleTest()
+
+	cfg := DefaultConfig
+	cfg.LatencyScheduling = true
+	cfg.MinimumAcceptedPOW = 0
+	w := New(&cfg)
+	w.Start(nil)
+	defer w.Stop()
+
+	id := discover.NodeID{1}
+	remote, errc := connectTestPeer(t, w, id)
+	defer func() {
+		remote.Close()
+		<-errc
+	}()
+
+	// the envelope received from the peer is known to it
+	now := uint32(time.Now().Unix())
+	env := &Envelope{Expiry: now + DefaultTTL, TTL: DefaultTTL, Data: []byte{1}, Nonce: uint64(seed)}
+	if err := p2p.Send(remote, messagesCode, []*Envelope{env}); err != nil {
+		t.Fatalf("failed to send envelope with seed %d: %s.", seed, err)
+	}
+	if !waitFor(time.Second, func() bool { return w.isEnvelopeCached(env.Hash()) }) {
+		t.Fatalf("envelope was not pooled with seed %d.", seed)
+	}
+	p, err := w.getPeer(id[:])
+	if err != nil {
+		t.Fatalf("failed to find the peer: %s.", err)
+	}
+	// the pipe is synchronous, the probe is only sent once read
+	go p.sendProbe()
+	var hashes []common.Hash
+	expectPacket(t, remote, ackRequestCode, &hashes)
+	if len(hashes) != 1 || hashes[0] != env.Hash() {
+		t.Fatalf("wrong probe: %v.", hashes)
+	}
+	time.Sleep(10 * time.Millisecond)
+	if err = p2p.Send(remote, ackCode, &envelopeAck{Hashes: hashes}); err != nil {
+		t.Fatalf("failed to acknowledge probe: %s.", err)
+	}
+	if !waitFor(time.Second, func() bool {
+		rtt, _ := w.PeerLatency(id[:])
+		return rtt >= 10*time.Millisecond
+	}) {
+		t.Fatalf("round-trip time was not measured.")
+	}
+
+	// the broadcast is triggered by the scheduler
+	params, err := generateMessageParams()
+	if err != nil {
+		t.Fatalf("failed to generate message parameters with seed %d: %s.", seed, err)
+	}
+	params.PoW = 0
+	msg, err := NewSentMessage(params)
+	if err != nil {
+		t.Fatalf("failed to create message with seed %d: %s.", seed, err)
+	}
+	sent, err := msg.Wrap(params)
+	if err != nil {
+		t.Fatalf("failed to wrap message with seed %d: %s.", seed, err)
+	}
+	if err = w.Send(sent); err != nil {
+		t.Fatalf("failed to send message with seed %d: %s.", seed, err)
+	}
+	var bundle []*Envelope
+	expectPacket(t, remote, messagesCode, &bundle)
+	if len(bundle) != 1 || bundle[0].Hash() != sent.Hash() {
+		t.Fatalf("wrong broadcast: %d envelopes.", len(bundle))
+	}
+}
+
+// TestTransmissionPropagation simulates a transmission cycle with the peers of
+// slow broadcasts, comparing the time the envelope takes to reach all of them
+// with the serial schedule waiting for each broadcast in turn.
+func TestTransmissionPropagation(t *testing.T) {
+	const (
+		peers     = 8
+		broadcast = 20 * time.Millisecond // time each peer takes to write the batch
+	)
+	w := New(&DefaultConfig)
+	w.transmissionCycle = time.Second
+
+	triggered := make(map[*Peer]chan time.Time)
+	for i := 0; i < peers; i++ {
+		p := newPeer(w, p2p.NewPeer(discover.NodeID{byte(i)}, "test", nil), nil)
+		p.rtt = time.Duration(peers-i) * 10 * time.Millisecond
+		w.peers[p] = struct{}{}
+		triggered[p] = make(chan time.Time, 1)
+		go func(p *Peer) {
+			<-p.transmit
+			triggered[p] <- time.Now()
+			time.Sleep(broadcast)
+		}(p)
+	}
+
+	order := w.transmissionOrder()
+	start := time.Now()
+	w.transmit(make(chan struct{}))
+
+	// the envelope reaches the peer half of the round trip after its broadcast
+	var scheduled, serial time.Duration
+	for i, p := range order {
+		var at time.Time
+		select {
+		case at = <-triggered[p]:
+		case <-time.After(time.Second):
+			t.Fatalf("broadcast of peer %d not triggered.", i)
+		}
+		if arrival := at.Sub(start) + broadcast + p.rtt/2; arrival > scheduled {
+			scheduled = arrival
+		}
+		if arrival := time.Duration(i+1)*broadcast + p.rtt/2; arrival > serial {
+			serial = arrival
+		}
+	}
+	t.Logf("envelope reaches all the peers after %v, %v with the serial schedule.", scheduled, serial)
+	if scheduled >= serial/2 {
+		t.Fatalf("no propagation gain over the serial schedule: %v, serial %v.", scheduled, serial)
+	}
+}
@@ -0,0 +1,140 @@
+// Copyright 2017 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package whisperv6
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+
+	"github.com/ethereum/go-ethereum/log"
+)
+
+// Logging subsystems of the whisper node. Each of them has its own logger,
+// the verbosity of which can be raised or lowered independently of the
+// global log verbosity.
+const (
+	LogSubsystemPool   = "whisper/pool"   // envelope pool, expiration and queues
+	LogSubsystemPeer   = "whisper/peer"   // peer handshake, message loop and broadcast
+	LogSubsystemFilter = "whisper/filter" // message filters and decryption
+	LogSubsystemMail   = "whisper/mail"   // mail server and historic messages
+)
+
+// subsystemLogger is a logger of a particular subsystem.
+type subsystemLogger struct {
+	log.Logger
+	level int32 // verbosity override (atomic), negative if the global verbosity applies
+}
+
+// subsystemLoggers holds the loggers of all the subsystems of a whisper node.
+type subsystemLoggers struct {
+	subsystems map[string]*subsystemLogger
+
+	outputMu sync.RWMutex
+	output   log.Handler // receives the records of the subsystems with overridden verbosity, nil for the root handler
+}
+
+// newSubsystemLoggers creates the loggers for all the whisper subsystems,
+// initially following the global log verbosity.
+func newSubsystemLoggers() *subsystemLoggers {
+	logs := &subsystemLoggers{
+		subsystems: make(map[string]*subsystemLogger),
+	}
+	for _, name := range []string{LogSubsystemPool, LogSubsystemPeer, LogSubsystemFilter, LogSubsystemMail} {
+		l := &subsystemLogger{Logger: log.New("module", name), level: -1}
+		l.SetHandler(log.FuncHandler(logs.handler(l)))
+		logs.subsystems[name] = l
+	}
+	return logs
+}
+
+// handler returns the function routing the records of the subsystem to the root
+// handler, filtered either by the global verbosity or, if overridden, by the
+// verbosity of the subsystem (and sent to the configured output, if any).
+func (logs *subsystemLoggers) handler(l *subsystemLogger) func(r *log.Record) error {
+	return func(r *log.Record) error {
+		lvl := atomic.LoadInt32(&l.level)
+		if lvl < 0 {
+			return log.Root().GetHandler().Log(r)
+		}
+		if r.Lvl > log.Lvl(lvl) {
+			return nil
+		}
+		logs.outputMu.RLock()
+		output := logs.output
+		logs.outputMu.RUnlock()
+
+		if output == nil {
+			output = log.Root().GetHandler()
+		}
+		return output.Log(r)
+	}
+}
+
+// get returns the logger of the subsystem, or an error if it does not exist.
+func (logs *subsystemLoggers) get(subsystem string) (*subsystemLogger, error) {
+	if logs == nil {
+		return nil, fmt.Errorf("logging not initialized")
+	}
+	l, ok := logs.subsystems[subsystem]
+	if !ok {
+		return nil, fmt.Errorf("unknown log subsystem: %s", subsystem)
+	}
+	return l, nil
+}
+
+// Logger returns the logger of the specified subsystem. Unknown subsystems
+// get the root logger.
+func (whisper *Whisper) Logger(subsystem string) log.Logger {
+	l, err := whisper.logs.get(subsystem)
+	if err != nil {
+		return log.Root()
+	}
+	return l
+}
+
+// SetLogLevel overrides the verbosity of the subsystem, regardless of the
+// global log verbosity.
+func (whisper *Whisper) SetLogLevel(subsystem string, lvl log.Lvl) error {
+	l, err := whisper.logs.get(subsystem)
+	if err != nil {
+		return err
+	}
+	atomic.StoreInt32(&l.level, int32(lvl))
+	return nil
+}
+
+// ResetLogLevel makes the subsystem follow the global log verbosity again.
+func (whisper *Whisper) ResetLogLevel(subsystem string) error {
+	l, err := whisper.logs.get(subsystem)
+	if err != nil {
+		return err
+	}
+	atomic.StoreInt32(&l.level, -1)
+	return nil
+}
+
+// SetLogOutput sets the handler receiving the log records of the subsystems
+// with overridden verbosity. By default they go to the root handler, which
+// may still filter out the records beyond the global verbosity (e.g. the glog
+// handler of geth), hence the records of the raised verbosity may need a
+// dedicated output. A nil handler restores the default.
+func (whisper *Whisper) SetLogOutput(h log.Handler) {
+	whisper.logs.outputMu.Lock()
+	defer whisper.logs.outputMu.Unlock()
+	whisper.logs.output = h
+}
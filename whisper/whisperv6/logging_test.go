@@ -0,0 +1,87 @@
+// Copyright 2017 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package whisperv6
+
+import (
+	"testing"
+
+	"github.com/ethereum/go-ethereum/log"
+)
+
+func TestSubsystemLogLevels(t *testing.T) {
+	cfg := DefaultConfig
+	cfg.LogLevels = map[string]string{LogSubsystemPeer: "debug"}
+	w := New(&cfg)
+
+	var records []*log.Record
+	w.SetLogOutput(log.FuncHandler(func(r *log.Record) error {
+		records = append(records, r)
+		return nil
+	}))
+
+	w.Logger(LogSubsystemPeer).New("peer", "test").Debug("peer message")
+	w.Logger(LogSubsystemPeer).Trace("filtered message")
+	if len(records) != 1 {
+		t.Fatalf("wrong number of records: %d.", len(records))
+	}
+	if ctx := records[0].Ctx; len(ctx) != 4 || ctx[1] != LogSubsystemPeer || ctx[3] != "test" {
+		t.Fatalf("wrong record context: %v.", ctx)
+	}
+
+	// the pool subsystem follows the global verbosity, so nothing reaches the output
+	w.Logger(LogSubsystemPool).Error("pool message")
+	if len(records) != 1 {
+		t.Fatalf("record of the pool subsystem was not routed to the root handler.")
+	}
+
+	if err := w.SetLogLevel(LogSubsystemPool, log.LvlTrace); err != nil {
+		t.Fatalf("failed to set the log level: %s.", err)
+	}
+	w.Logger(LogSubsystemPool).Trace("pool message")
+	if err := w.ResetLogLevel(LogSubsystemPeer); err != nil {
+		t.Fatalf("failed to reset the log level: %s.", err)
+	}
+	w.Logger(LogSubsystemPeer).Debug("peer message")
+	if len(records) != 2 || records[1].Msg != "pool message" {
+		t.Fatalf("wrong records: %v.", records)
+	}
+
+	if err := w.SetLogLevel("whisper/unknown", log.LvlTrace); err == nil {
+		t.Fatalf("unknown subsystem accepted.")
+	}
+}
+
+func TestSubsystemLogRootOutput(t *testing.T) {
+	root := log.Root().GetHandler()
+	defer log.Root().SetHandler(root)
+
+	var records []*log.Record
+	log.Root().SetHandler(log.FuncHandler(func(r *log.Record) error {
+		records = append(records, r)
+		return nil
+	}))
+
+	cfg := DefaultConfig
+	cfg.LogLevels = map[string]string{LogSubsystemFilter: "debug"}
+	w := New(&cfg)
+
+	w.Logger(LogSubsystemFilter).Debug("filter message")
+	w.Logger(LogSubsystemFilter).Trace("filtered message")
+	if len(records) != 1 || records[0].Msg != "filter message" {
+		t.Fatalf("wrong records of the root handler: %v.", records)
+	}
+}
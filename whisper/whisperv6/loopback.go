@@ -0,0 +1,56 @@
+// Copyright 2017 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+// Contains the local delivery of the messages addressed to the identities of
+// the node itself.
+
+package whisperv6
+
+import "crypto/ecdsa"
+
+// isLocalRecipient checks if the node holds the private key of the recipient.
+func (whisper *Whisper) isLocalRecipient(dst *ecdsa.PublicKey) bool {
+	if dst == nil {
+		return false
+	}
+	whisper.keyMu.RLock()
+	defer whisper.keyMu.RUnlock()
+
+	for _, key := range whisper.privateKeys {
+		if IsPubKeyEqual(&key.PublicKey, dst) {
+			return true
+		}
+	}
+	return false
+}
+
+// Loopback checks if the message would only be delivered locally, i.e. the
+// local loopback is enabled and the message is addressed to an identity of
+// this node. Such messages need neither the PoW nor the broadcast.
+func (whisper *Whisper) Loopback(params *MessageParams) bool {
+	return whisper.localLoopback && whisper.isLocalRecipient(params.Dst)
+}
+
+// SendLocal delivers the envelope to the local filters only, without adding it
+// to the pool. The envelope does not need to be sealed, hence the filters
+// requiring a minimum PoW will not receive it.
+func (whisper *Whisper) SendLocal(envelope *Envelope) error {
+	if !whisper.mayOriginate(envelope.Topic) {
+		return ErrTopicNotAllowed
+	}
+	whisper.postEvent(envelope, false)
+	return nil
+}
@@ -19,8 +19,7 @@
 package whisperv6
 
 import (
-	"crypto/aes"
-	"crypto/cipher"
+	"context"
 	"crypto/ecdsa"
 	crand "crypto/rand"
 	"encoding/binary"
@@ -37,15 +36,21 @@ import (
 // MessageParams specifies the exact way a message should be wrapped
 // into an Envelope.
 type MessageParams struct {
-	TTL      uint32
-	Src      *ecdsa.PrivateKey
-	Dst      *ecdsa.PublicKey
-	KeySym   []byte
-	Topic    TopicType
-	WorkTime uint32
-	PoW      float64
-	Payload  []byte
-	Padding  []byte
+	TTL       uint32
+	Src       *ecdsa.PrivateKey
+	Dst       *ecdsa.PublicKey
+	KeySym    []byte
+	Topic     TopicType
+	WorkTime  uint32
+	PoW       float64
+	Payload   []byte
+	Padding   []byte
+	Seq       uint64      // Sequence number of the message in the channel of the sender, zero if not used
+	Redacts   common.Hash // Envelope hash of the message redacted by this tombstone, zero if not a tombstone
+	NoArchive bool        // Request the mail servers not to archive the envelope
+	Session   common.Hash // Transcript of the session the peer-to-peer message is bound to, zero if not bound
+
+	DeterministicPadding bool // Derive the padding from the payload and the key instead of randomly
 }
 
 // SentMessage represents an end-user data packet to transmit through the
@@ -65,15 +70,30 @@ type ReceivedMessage struct {
 	Signature []byte
 	Salt      []byte
 
-	PoW   float64          // Proof of work as described in the Whisper spec
-	Sent  uint32           // Time when the message was posted into the network
-	TTL   uint32           // Maximum time to live allowed for the message
-	Src   *ecdsa.PublicKey // Message recipient (identity used to decode the message)
-	Dst   *ecdsa.PublicKey // Message recipient (identity used to decode the message)
-	Topic TopicType
+	PoW     float64          // Proof of work as described in the Whisper spec
+	Seq     uint64           // Sequence number of the message in the channel of the sender, zero if not used
+	Redacts common.Hash      // Envelope hash of the message redacted by this tombstone, zero if not a tombstone
+	Session common.Hash      // Transcript of the session the peer-to-peer message is bound to, zero if not bound
+	Sent    uint32           // Time when the message was posted into the network
+	TTL     uint32           // Maximum time to live allowed for the message
+	Src     *ecdsa.PublicKey // Message recipient (identity used to decode the message)
+	Dst     *ecdsa.PublicKey // Message recipient (identity used to decode the message)
+	Topic   TopicType
+
+	Priority int // Importance of the message, scored by the filter which delivered it
 
 	SymKeyHash   common.Hash // The Keccak256Hash of the key
 	EnvelopeHash common.Hash // Message envelope hash to act as a unique id
+
+	schema *envelopeSchema // Schema of the envelope the message was received in (nil means the default)
+}
+
+// lengths returns the schema giving the lengths of the message fields.
+func (msg *ReceivedMessage) lengths() *envelopeSchema {
+	if msg.schema == nil {
+		return defaultSchema
+	}
+	return msg.schema
 }
 
 func isMessageSigned(flags byte) bool {
@@ -91,19 +111,42 @@ func (msg *ReceivedMessage) isAsymmetricEncryption() bool {
 // NewSentMessage creates and initializes a non-signed, non-encrypted Whisper message.
 func NewSentMessage(params *MessageParams) (*sentMessage, error) {
 	const payloadSizeFieldMaxSize = 4
+	if params.Redacts != (common.Hash{}) && params.Src == nil {
+		return nil, ErrUnsignedTombstone
+	}
 	msg := sentMessage{}
 	msg.Raw = make([]byte, 1,
 		flagsLength+payloadSizeFieldMaxSize+len(params.Payload)+len(params.Padding)+signatureLength+padSizeLimit)
 	msg.Raw[0] = 0 // set all the flags to zero
-	msg.addPayloadSizeField(params.Payload)
-	msg.Raw = append(msg.Raw, params.Payload...)
+	// the sequence number, the redacted envelope and the session transcript are
+	// carried in the header of the payload
+	var header []byte
+	if params.Seq != 0 {
+		header = make([]byte, seqHeaderLength, seqHeaderLength+tombstoneLength+sessionLength)
+		binary.BigEndian.PutUint64(header, params.Seq)
+		msg.Raw[0] |= sequenceFlag
+	}
+	if params.Redacts != (common.Hash{}) {
+		header = append(header, params.Redacts[:]...)
+		msg.Raw[0] |= tombstoneFlag
+	}
+	if params.Session != (common.Hash{}) {
+		header = append(header, params.Session[:]...)
+		msg.Raw[0] |= sessionFlag
+	}
+	payload := params.Payload
+	if len(header) > 0 {
+		payload = append(header, params.Payload...)
+	}
+	msg.addPayloadSizeField(payload)
+	msg.Raw = append(msg.Raw, payload...)
 	err := msg.appendPadding(params)
 	return &msg, err
 }
 
 // addPayloadSizeField appends the auxiliary field containing the size of payload
 func (msg *sentMessage) addPayloadSizeField(payload []byte) {
-	fieldSize := getSizeOfPayloadSizeField(payload)
+	fieldSize := getSizeOfPayloadSizeField(len(payload))
 	field := make([]byte, 4)
 	binary.LittleEndian.PutUint32(field, uint32(len(payload)))
 	field = field[:fieldSize]
@@ -112,14 +155,40 @@ func (msg *sentMessage) addPayloadSizeField(payload []byte) {
 }
 
 // getSizeOfPayloadSizeField returns the number of bytes necessary to encode the size of payload
-func getSizeOfPayloadSizeField(payload []byte) int {
+func getSizeOfPayloadSizeField(payloadSize int) int {
 	s := 1
-	for i := len(payload); i >= 256; i /= 256 {
+	for i := payloadSize; i >= 256; i /= 256 {
 		s++
 	}
 	return s
 }
 
+// headerLength returns the length of the header preceding the payload, carrying
+// the sequence number, the redacted envelope and the session transcript.
+func (params *MessageParams) headerLength() int {
+	length := 0
+	if params.Seq != 0 {
+		length += seqHeaderLength
+	}
+	if params.Redacts != (common.Hash{}) {
+		length += tombstoneLength
+	}
+	if params.Session != (common.Hash{}) {
+		length += sessionLength
+	}
+	return length
+}
+
+// unpaddedSize returns the size of the raw message before the padding.
+func (params *MessageParams) unpaddedSize() int {
+	payloadSize := params.headerLength() + len(params.Payload)
+	size := flagsLength + getSizeOfPayloadSizeField(payloadSize) + payloadSize
+	if params.Src != nil {
+		size += signatureLength
+	}
+	return size
+}
+
 // appendPadding appends the padding specified in params.
 // If no padding is provided in params, then random padding is generated.
 func (msg *sentMessage) appendPadding(params *MessageParams) error {
@@ -129,15 +198,12 @@ func (msg *sentMessage) appendPadding(params *MessageParams) error {
 		return nil
 	}
 
-	rawSize := flagsLength + getSizeOfPayloadSizeField(params.Payload) + len(params.Payload)
-	if params.Src != nil {
-		rawSize += signatureLength
-	}
-	odd := rawSize % padSizeLimit
+	odd := params.unpaddedSize() % padSizeLimit
 	paddingSize := padSizeLimit - odd
 	pad := make([]byte, paddingSize)
-	_, err := crand.Read(pad)
-	if err != nil {
+	if params.DeterministicPadding {
+		deterministicPadding(pad, params)
+	} else if _, err := crand.Read(pad); err != nil {
 		return err
 	}
 	if !validateDataIntegrity(pad, paddingSize) {
@@ -147,6 +213,23 @@ func (msg *sentMessage) appendPadding(params *MessageParams) error {
 	return nil
 }
 
+// deterministicPadding fills the padding with the keccak stream seeded from
+// the key and the payload of the message. Unlike the random padding, it allows
+// to recompute the hash of a symmetric envelope from the original inputs, as
+// the salt, the expiry and the nonce are carried by the envelope in the clear.
+func deterministicPadding(pad []byte, params *MessageParams) {
+	key := params.KeySym
+	if params.Dst != nil {
+		key = crypto.FromECDSAPub(params.Dst)
+	}
+	seed := crypto.Keccak256([]byte("shh-padding"), key, params.Payload)
+	counter := make([]byte, 4)
+	for i := 0; i < len(pad); i += common.HashLength {
+		binary.BigEndian.PutUint32(counter, uint32(i/common.HashLength))
+		copy(pad[i:], crypto.Keccak256(seed, counter))
+	}
+}
+
 // sign calculates and sets the cryptographic signature for the message,
 // also setting the sign flag.
 func (msg *sentMessage) sign(key *ecdsa.PrivateKey) error {
@@ -185,15 +268,11 @@ func (msg *sentMessage) encryptSymmetric(key []byte) (err error) {
 	if !validateDataIntegrity(key, aesKeyLength) {
 		return errors.New("invalid key provided for symmetric encryption, size: " + strconv.Itoa(len(key)))
 	}
-	block, err := aes.NewCipher(key)
+	aesgcm, err := defaultSchema.newGCM(key)
 	if err != nil {
 		return err
 	}
-	aesgcm, err := cipher.NewGCM(block)
-	if err != nil {
-		return err
-	}
-	salt, err := generateSecureRandomData(aesNonceLength) // never use more than 2^32 random nonces with a given key
+	salt, err := generateSecureRandomData(aesgcm.NonceSize()) // never use more than 2^32 random nonces with a given key
 	if err != nil {
 		return err
 	}
@@ -235,6 +314,23 @@ func generateSecureRandomData(length int) ([]byte, error) {
 
 // Wrap bundles the message into an Envelope to transmit over the network.
 func (msg *sentMessage) Wrap(options *MessageParams) (envelope *Envelope, err error) {
+	return msg.WrapContext(context.Background(), options, nil)
+}
+
+// WrapContext is identical to Wrap, but the sealing of the envelope might be
+// cancelled via the context, and its progress observed via the callback.
+func (msg *sentMessage) WrapContext(ctx context.Context, options *MessageParams, progress SealProgress) (envelope *Envelope, err error) {
+	if envelope, err = msg.wrap(options); err != nil {
+		return nil, err
+	}
+	if err = envelope.SealContext(ctx, options, progress); err != nil {
+		return nil, err
+	}
+	return envelope, nil
+}
+
+// wrap signs and encrypts the message, and bundles it into an unsealed Envelope.
+func (msg *sentMessage) wrap(options *MessageParams) (envelope *Envelope, err error) {
 	if options.TTL == 0 {
 		options.TTL = DefaultTTL
 	}
@@ -253,32 +349,41 @@ func (msg *sentMessage) Wrap(options *MessageParams) (envelope *Envelope, err er
 	if err != nil {
 		return nil, err
 	}
-
 	envelope = NewEnvelope(options.TTL, options.Topic, msg)
-	if err = envelope.Seal(options); err != nil {
-		return nil, err
+	var flags uint64
+	if options.NoArchive {
+		flags |= EnvelopeNoArchive
+	}
+	if options.Seq != 0 {
+		flags |= EnvelopeSequenced
+	}
+	if options.Redacts != (common.Hash{}) {
+		flags |= EnvelopeTombstone
+	}
+	if options.Session != (common.Hash{}) {
+		flags |= EnvelopeSession
+	}
+	if flags != 0 {
+		envelope.Flags = []uint64{flags}
 	}
 	return envelope, nil
 }
 
 // decryptSymmetric decrypts a message with a topic key, using AES-GCM-256.
-// nonce size should be 12 bytes (see cipher.gcmStandardNonceSize).
+// The lengths of the key and the nonce are given by the schema of the message.
 func (msg *ReceivedMessage) decryptSymmetric(key []byte) error {
-	// symmetric messages are expected to contain the 12-byte nonce at the end of the payload
-	if len(msg.Raw) < aesNonceLength {
+	// symmetric messages are expected to contain the nonce at the end of the payload
+	schema := msg.lengths()
+	if len(msg.Raw) < schema.aesNonceLength {
 		return errors.New("missing salt or invalid payload in symmetric message")
 	}
-	salt := msg.Raw[len(msg.Raw)-aesNonceLength:]
+	salt := msg.Raw[len(msg.Raw)-schema.aesNonceLength:]
 
-	block, err := aes.NewCipher(key)
-	if err != nil {
-		return err
-	}
-	aesgcm, err := cipher.NewGCM(block)
+	aesgcm, err := schema.newGCM(key)
 	if err != nil {
 		return err
 	}
-	decrypted, err := aesgcm.Open(nil, salt, msg.Raw[:len(msg.Raw)-aesNonceLength], nil)
+	decrypted, err := aesgcm.Open(nil, salt, msg.Raw[:len(msg.Raw)-schema.aesNonceLength], nil)
 	if err != nil {
 		return err
 	}
@@ -303,6 +408,7 @@ func (msg *ReceivedMessage) ValidateAndParse() bool {
 		return false
 	}
 
+	signatureLength := msg.lengths().signatureLength
 	if isMessageSigned(msg.Raw[0]) {
 		end -= signatureLength
 		if end <= 1 {
@@ -329,6 +435,28 @@ func (msg *ReceivedMessage) ValidateAndParse() bool {
 
 	beg += payloadSize
 	msg.Padding = msg.Raw[beg:end]
+
+	if msg.Raw[0]&sequenceFlag != 0 {
+		if len(msg.Payload) < seqHeaderLength {
+			return false
+		}
+		msg.Seq = binary.BigEndian.Uint64(msg.Payload)
+		msg.Payload = msg.Payload[seqHeaderLength:]
+	}
+	if msg.Raw[0]&tombstoneFlag != 0 {
+		if msg.Src == nil || len(msg.Payload) < tombstoneLength {
+			return false
+		}
+		copy(msg.Redacts[:], msg.Payload)
+		msg.Payload = msg.Payload[tombstoneLength:]
+	}
+	if msg.Raw[0]&sessionFlag != 0 {
+		if len(msg.Payload) < sessionLength {
+			return false
+		}
+		copy(msg.Session[:], msg.Payload)
+		msg.Payload = msg.Payload[sessionLength:]
+	}
 	return true
 }
 
@@ -348,7 +476,7 @@ func (msg *ReceivedMessage) SigToPubKey() *ecdsa.PublicKey {
 // hash calculates the SHA3 checksum of the message flags, payload size field, payload and padding.
 func (msg *ReceivedMessage) hash() []byte {
 	if isMessageSigned(msg.Raw[0]) {
-		sz := len(msg.Raw) - signatureLength
+		sz := len(msg.Raw) - msg.lengths().signatureLength
 		return crypto.Keccak256(msg.Raw[:sz])
 	}
 	return crypto.Keccak256(msg.Raw)
@@ -18,6 +18,7 @@ package whisperv6
 
 import (
 	"bytes"
+	"context"
 	"crypto/aes"
 	"crypto/cipher"
 	mrand "math/rand"
@@ -205,6 +206,42 @@ func TestMessageSeal(t *testing.T) {
 	}
 }
 
+func TestMessageSealCancel(t *testing.T) {
+	InitSingleTest()
+
+	params, err := generateMessageParams()
+	if err != nil {
+		t.Fatalf("failed generateMessageParams with seed %d: %s.", seed, err)
+	}
+	msg, err := NewSentMessage(params)
+	if err != nil {
+		t.Fatalf("failed to create new message with seed %d: %s.", seed, err)
+	}
+	env := NewEnvelope(params.TTL, params.Topic, msg)
+
+	// unreachable target, so that sealing only stops when cancelled
+	params.WorkTime = 10
+	params.PoW = 1000000000.0
+
+	ctx, cancel := context.WithCancel(context.Background())
+	var reports int
+	progress := func(best float64, tried uint64) {
+		reports++
+		if tried == 0 || best <= 0 {
+			t.Fatalf("invalid progress report with seed %d: pow %f, tried %d.", seed, best, tried)
+		}
+		if reports == 3 {
+			cancel()
+		}
+	}
+	if err = env.SealContext(ctx, params, progress); err != context.Canceled {
+		t.Fatalf("sealing was not cancelled with seed %d: %v.", seed, err)
+	}
+	if reports != 3 {
+		t.Fatalf("unexpected number of progress reports with seed %d: %d.", seed, reports)
+	}
+}
+
 func TestEnvelopeOpen(t *testing.T) {
 	InitSingleTest()
 
@@ -469,3 +506,48 @@ func TestAesNonce(t *testing.T) {
 		t.Fatalf("Nonce size is wrong. This is a critical error. Apparently AES nonce size have changed in the new version of AES GCM package. Whisper will not be working until this problem is resolved.")
 	}
 }
+
+func TestDeterministicPadding(t *testing.T) {
+	InitSingleTest()
+
+	params, err := generateMessageParams()
+	if err != nil {
+		t.Fatalf("failed generateMessageParams with seed %d: %s.", seed, err)
+	}
+	params.DeterministicPadding = true
+	padding := func(params *MessageParams) []byte {
+		msg, err := NewSentMessage(params)
+		if err != nil {
+			t.Fatalf("failed to create new message with seed %d: %s.", seed, err)
+		}
+		env, err := msg.Wrap(params)
+		if err != nil {
+			t.Fatalf("failed to wrap with seed %d: %s.", seed, err)
+		}
+		decrypted := env.Open(&Filter{KeySym: params.KeySym})
+		if decrypted == nil {
+			t.Fatalf("failed to open with seed %d.", seed)
+		}
+		return decrypted.Padding
+	}
+
+	first := padding(params)
+	if len(first) == 0 || !bytes.Equal(first, padding(params)) {
+		t.Fatalf("padding is not deterministic with seed %d.", seed)
+	}
+	other := *params
+	other.Payload = append([]byte{1}, params.Payload...)
+	if bytes.Equal(first, padding(&other)) {
+		t.Fatalf("padding does not depend on the payload with seed %d.", seed)
+	}
+	other = *params
+	other.KeySym = make([]byte, aesKeyLength)
+	mrand.Read(other.KeySym)
+	if bytes.Equal(first, padding(&other)) {
+		t.Fatalf("padding does not depend on the key with seed %d.", seed)
+	}
+	params.DeterministicPadding = false
+	if bytes.Equal(first, padding(params)) {
+		t.Fatalf("random padding is deterministic with seed %d.", seed)
+	}
+}
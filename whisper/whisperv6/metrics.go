@@ -0,0 +1,55 @@
+// Copyright 2017 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+// Contains the meters used by the whisper protocol.
+
+package whisperv6
+
+import (
+	"github.com/ethereum/go-ethereum/metrics"
+)
+
+// DefaultMetricsPrefix is the prefix of the meters of a whisper node, unless
+// configured otherwise.
+const DefaultMetricsPrefix = "whisper"
+
+// envelopeMeters holds the meters of a single whisper node. The nodes running in
+// the same process under different prefixes do not mix up their statistics, while
+// the nodes sharing a prefix (e.g. the restarted ones) share the same meters.
+type envelopeMeters struct {
+	added metrics.Meter
+
+	// dropped counts the envelopes dropped for each particular reason
+	dropped map[DropReason]metrics.Meter
+}
+
+// newEnvelopeMeters returns the meters of a whisper node with the given prefix,
+// registering the ones not registered yet. The meters are reused rather than
+// created anew, so that they never pile up unregistered and running.
+func newEnvelopeMeters(prefix string) *envelopeMeters {
+	return &envelopeMeters{
+		added: metrics.GetOrRegisterMeter(prefix+"/envelopes/added", nil),
+		dropped: map[DropReason]metrics.Meter{
+			DropReasonFuture:        metrics.GetOrRegisterMeter(prefix+"/envelopes/drop/future", nil),
+			DropReasonVeryOld:       metrics.GetOrRegisterMeter(prefix+"/envelopes/drop/veryold", nil),
+			DropReasonExpired:       metrics.GetOrRegisterMeter(prefix+"/envelopes/drop/expired", nil),
+			DropReasonOversized:     metrics.GetOrRegisterMeter(prefix+"/envelopes/drop/oversized", nil),
+			DropReasonLowPoW:        metrics.GetOrRegisterMeter(prefix+"/envelopes/drop/lowpow", nil),
+			DropReasonBloomMismatch: metrics.GetOrRegisterMeter(prefix+"/envelopes/drop/bloom", nil),
+			DropReasonMalformed:     metrics.GetOrRegisterMeter(prefix+"/envelopes/drop/malformed", nil),
+		},
+	}
+}
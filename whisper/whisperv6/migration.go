@@ -0,0 +1,136 @@
+// Copyright 2017 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+// Contains the migration of the symmetric keys stored under the legacy names
+// (chosen by the applications predating the generated key IDs) to the IDs.
+//
+// The legacy names remain valid aliases of the migrated keys, so that the
+// applications (and the RPC clients) still referring to the keys by their
+// names keep working until they are upgraded. The filters are not affected,
+// since they hold the keys themselves rather than their IDs.
+
+package whisperv6
+
+import (
+	"encoding/hex"
+	"fmt"
+)
+
+// isKeyID checks if the string has the format of the generated key IDs.
+func isKeyID(id string) bool {
+	if len(id) != keyIDSize*2 {
+		return false
+	}
+	_, err := hex.DecodeString(id)
+	return err == nil
+}
+
+// ImportLegacySymKeys stores the symmetric keys held under the legacy names,
+// and returns the IDs assigned to them by their names. The keys already
+// imported under the same name keep their IDs.
+func (whisper *Whisper) ImportLegacySymKeys(keys map[string][]byte) (map[string]string, error) {
+	for name, key := range keys {
+		if isKeyID(name) {
+			return nil, fmt.Errorf("legacy key name %s is ambiguous with the key IDs", name)
+		}
+		if len(key) != aesKeyLength {
+			return nil, fmt.Errorf("wrong size of the key %s: %d", name, len(key))
+		}
+	}
+
+	whisper.keyMu.Lock()
+	defer whisper.keyMu.Unlock()
+
+	ids := make(map[string]string, len(keys))
+	for name, key := range keys {
+		if id, ok := whisper.legacyKeyNames[name]; ok && whisper.symKeys[id] != nil {
+			ids[name] = id
+			continue
+		}
+		id, err := whisper.migrateSymKey(name, key)
+		if err != nil {
+			return nil, err
+		}
+		ids[name] = id
+	}
+	return ids, nil
+}
+
+// MigrateSymKeyNames moves the symmetric keys stored under the legacy names
+// (e.g. restored from the old key bundles) to the generated IDs, and returns
+// the new IDs by the names.
+func (whisper *Whisper) MigrateSymKeyNames() (map[string]string, error) {
+	whisper.keyMu.Lock()
+	defer whisper.keyMu.Unlock()
+
+	ids := make(map[string]string)
+	for name, key := range whisper.symKeys {
+		if isKeyID(name) {
+			continue
+		}
+		id, err := whisper.migrateSymKey(name, key)
+		if err != nil {
+			return nil, err
+		}
+		delete(whisper.symKeys, name)
+		ids[name] = id
+	}
+	return ids, nil
+}
+
+// migrateSymKey stores the key under a new ID, aliased by the legacy name. It
+// must be called with the keyMu held.
+func (whisper *Whisper) migrateSymKey(name string, key []byte) (string, error) {
+	id, err := GenerateRandomID()
+	if err != nil {
+		return "", fmt.Errorf("failed to generate ID: %s", err)
+	}
+	if whisper.symKeys[id] != nil {
+		return "", fmt.Errorf("failed to generate unique ID")
+	}
+	whisper.symKeys[id] = key
+	whisper.legacyKeyNames[name] = id
+	return id, nil
+}
+
+// DropLegacyKeyNames removes the aliases of the migrated keys, once all the
+// applications refer to the keys by their IDs.
+func (whisper *Whisper) DropLegacyKeyNames() {
+	whisper.keyMu.Lock()
+	defer whisper.keyMu.Unlock()
+	whisper.legacyKeyNames = make(map[string]string)
+}
+
+// symKeyID resolves the legacy name of a migrated key to its ID. It must be
+// called with the keyMu held.
+func (whisper *Whisper) symKeyID(id string) string {
+	if whisper.symKeys[id] == nil {
+		if migrated, ok := whisper.legacyKeyNames[id]; ok {
+			return migrated
+		}
+	}
+	return id
+}
+
+// forgetLegacyNames removes the aliases of the deleted key. It must be called
+// with the keyMu held.
+func (whisper *Whisper) forgetLegacyNames(id string) {
+	for name, migrated := range whisper.legacyKeyNames {
+		if migrated == id {
+			delete(whisper.legacyKeyNames, name)
+		}
+	}
+}
@@ -0,0 +1,88 @@
+// Copyright 2017 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package whisperv6
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestLegacySymKeyMigration(t *testing.T) {
+	InitSingleTest()
+
+	w := New(&DefaultConfig)
+	family, work := make([]byte, aesKeyLength), make([]byte, aesKeyLength)
+	for i := range family {
+		family[i], work[i] = byte(i+1), byte(i+2)
+	}
+
+	// the keys held by the application under the legacy names
+	ids, err := w.ImportLegacySymKeys(map[string][]byte{"family": family})
+	if err != nil {
+		t.Fatalf("failed to import legacy keys with seed %d: %s.", seed, err)
+	}
+	for _, id := range []string{"family", ids["family"]} {
+		if key, err := w.GetSymKey(id); err != nil || !bytes.Equal(key, family) {
+			t.Fatalf("migrated key not found by %s with seed %d.", id, seed)
+		}
+	}
+	again, err := w.ImportLegacySymKeys(map[string][]byte{"family": family})
+	if err != nil || again["family"] != ids["family"] {
+		t.Fatalf("key imported twice with seed %d.", seed)
+	}
+	if _, err := w.ImportLegacySymKeys(map[string][]byte{ids["family"][:keyIDSize*2-2] + "00": work}); err == nil {
+		t.Fatalf("legacy name ambiguous with the key IDs accepted with seed %d.", seed)
+	}
+
+	// the keys stored under the legacy names (e.g. by an old key bundle)
+	w.keyMu.Lock()
+	w.symKeys["work"] = work
+	w.keyMu.Unlock()
+	filter := &Filter{KeySym: work}
+	filterID, err := w.Subscribe(filter)
+	if err != nil {
+		t.Fatalf("failed to subscribe with seed %d: %s.", seed, err)
+	}
+	moved, err := w.MigrateSymKeyNames()
+	if err != nil {
+		t.Fatalf("failed to migrate legacy keys with seed %d: %s.", seed, err)
+	}
+	if len(moved) != 1 || !isKeyID(moved["work"]) {
+		t.Fatalf("wrong keys migrated with seed %d: %v.", seed, moved)
+	}
+	w.keyMu.RLock()
+	_, stale := w.symKeys["work"]
+	w.keyMu.RUnlock()
+	if stale {
+		t.Fatalf("key left under the legacy name with seed %d.", seed)
+	}
+	if key, err := w.GetSymKey("work"); err != nil || !bytes.Equal(key, work) {
+		t.Fatalf("migrated key not found by its legacy name with seed %d.", seed)
+	}
+	if f := w.GetFilter(filterID); f == nil || !bytes.Equal(f.KeySym, work) {
+		t.Fatalf("filter of the migrated key was lost with seed %d.", seed)
+	}
+
+	// deleting the key by its name removes it, along with the alias
+	if !w.DeleteSymKey("family") || w.HasSymKey(ids["family"]) || w.HasSymKey("family") {
+		t.Fatalf("migrated key not deleted by its legacy name with seed %d.", seed)
+	}
+	w.DropLegacyKeyNames()
+	if w.HasSymKey("work") || !w.HasSymKey(moved["work"]) {
+		t.Fatalf("legacy names not dropped with seed %d.", seed)
+	}
+}
@@ -0,0 +1,217 @@
+// Copyright 2017 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+// +build !whisperlite
+
+// Contains the multiplexing of the RPC subscriptions with identical criteria
+// over a single installed filter.
+
+package whisperv6
+
+import (
+	"bytes"
+	"math"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/log"
+	"github.com/ethereum/go-ethereum/rlp"
+)
+
+const (
+	muxPollInterval = 250 * time.Millisecond
+	muxQueueLimit   = 16 // number of message batches awaiting the delivery to a single subscription
+)
+
+// sharedFilter is a filter installed once for all the subscriptions with
+// identical criteria, fanning out the delivered messages to each of them.
+type sharedFilter struct {
+	key  common.Hash
+	id   string
+	subs map[string]*muxSubscription // subscriptions by ID
+	quit chan struct{}
+}
+
+// muxSubscription is a subscription attached to a shared filter. The messages
+// are delivered from its own goroutine, so that a slow subscriber never holds
+// up the others sharing the filter; the batches not fitting into its queue are
+// dropped.
+type muxSubscription struct {
+	deliver func([]*Message)
+	queue   chan []*Message
+	quit    chan struct{}
+}
+
+// loop delivers the queued messages, until the subscription is released.
+func (sub *muxSubscription) loop() {
+	for {
+		select {
+		case messages := <-sub.queue:
+			sub.deliver(messages)
+		case <-sub.quit:
+			return
+		}
+	}
+}
+
+// filterMux installs one filter per distinct criteria of the subscriptions,
+// reference counting the subscriptions sharing it.
+type filterMux struct {
+	w   *Whisper
+	log log.Logger
+
+	mu     sync.Mutex
+	shared map[common.Hash]*sharedFilter
+	subs   map[string]*sharedFilter
+}
+
+func newFilterMux(w *Whisper) *filterMux {
+	return &filterMux{
+		w:      w,
+		log:    w.Logger(LogSubsystemFilter),
+		shared: make(map[common.Hash]*sharedFilter),
+		subs:   make(map[string]*sharedFilter),
+	}
+}
+
+// criteriaKey identifies the criteria of the filter. The order of the topics
+// does not matter.
+func criteriaKey(f *Filter) common.Hash {
+	crit := struct {
+		PoW      uint64
+		AllowP2P bool
+		KeySym   []byte
+		KeyAsym  []byte
+		Src      []byte
+		Topics   [][]byte
+	}{
+		PoW:      math.Float64bits(f.PoW),
+		AllowP2P: f.AllowP2P,
+		KeySym:   f.KeySym,
+		Topics:   make([][]byte, len(f.Topics)),
+	}
+	if f.KeyAsym != nil {
+		crit.KeyAsym = crypto.FromECDSAPub(&f.KeyAsym.PublicKey)
+	}
+	if f.Src != nil {
+		crit.Src = crypto.FromECDSAPub(f.Src)
+	}
+	copy(crit.Topics, f.Topics)
+	sort.Slice(crit.Topics, func(i, j int) bool { return bytes.Compare(crit.Topics[i], crit.Topics[j]) < 0 })
+
+	data, _ := rlp.EncodeToBytes(&crit)
+	return crypto.Keccak256Hash(data)
+}
+
+// subscribe attaches a new subscription to the filter with the same criteria,
+// installing the given one if there is none yet. It returns the ID of the
+// subscription, to be released by unsubscribe.
+func (mux *filterMux) subscribe(f *Filter, deliver func([]*Message)) (string, error) {
+	id, err := GenerateRandomID()
+	if err != nil {
+		return "", err
+	}
+	key := criteriaKey(f)
+
+	mux.mu.Lock()
+	defer mux.mu.Unlock()
+
+	shared := mux.shared[key]
+	if shared == nil {
+		filterID, err := mux.w.Subscribe(f)
+		if err != nil {
+			return "", err
+		}
+		shared = &sharedFilter{
+			key:  key,
+			id:   filterID,
+			subs: make(map[string]*muxSubscription),
+			quit: make(chan struct{}),
+		}
+		mux.shared[key] = shared
+		go mux.loop(shared)
+	}
+	sub := &muxSubscription{
+		deliver: deliver,
+		queue:   make(chan []*Message, muxQueueLimit),
+		quit:    make(chan struct{}),
+	}
+	go sub.loop()
+	shared.subs[id] = sub
+	mux.subs[id] = shared
+	return id, nil
+}
+
+// unsubscribe releases the subscription, uninstalling the shared filter with
+// the last one.
+func (mux *filterMux) unsubscribe(id string) {
+	mux.mu.Lock()
+	defer mux.mu.Unlock()
+
+	shared := mux.subs[id]
+	if shared == nil {
+		return
+	}
+	delete(mux.subs, id)
+	close(shared.subs[id].quit)
+	delete(shared.subs, id)
+	if len(shared.subs) == 0 {
+		close(shared.quit)
+		delete(mux.shared, shared.key)
+		mux.w.Unsubscribe(shared.id)
+	}
+}
+
+// filters returns the number of the installed shared filters.
+func (mux *filterMux) filters() int {
+	mux.mu.Lock()
+	defer mux.mu.Unlock()
+	return len(mux.shared)
+}
+
+// loop polls the shared filter, fanning out the messages to the subscriptions.
+func (mux *filterMux) loop(shared *sharedFilter) {
+	ticker := time.NewTicker(muxPollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			filter := mux.w.GetFilter(shared.id)
+			if filter == nil {
+				continue
+			}
+			messages := toMessage(filter.Retrieve())
+			if len(messages) == 0 {
+				continue
+			}
+			mux.mu.Lock()
+			for id, sub := range shared.subs {
+				select {
+				case sub.queue <- messages:
+				default:
+					mux.log.Debug("subscription queue overflow, messages dropped", "id", id, "count", len(messages))
+				}
+			}
+			mux.mu.Unlock()
+		case <-shared.quit:
+			return
+		}
+	}
+}
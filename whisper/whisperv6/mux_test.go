@@ -0,0 +1,119 @@
+// Copyright 2017 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+// +build !whisperlite
+
+package whisperv6
+
+import (
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+func TestFilterMux(t *testing.T) {
+	w := New(&DefaultConfig)
+	mux := newFilterMux(w)
+	key := make([]byte, aesKeyLength)
+	newFilter := func(topics ...[]byte) *Filter {
+		return &Filter{KeySym: key, Topics: topics}
+	}
+
+	received := make(chan int, 10)
+	deliver := func(n int) func([]*Message) {
+		return func(messages []*Message) { received <- n }
+	}
+	first, err := mux.subscribe(newFilter([]byte{1, 2, 3, 4}, []byte{5, 6, 7, 8}), deliver(1))
+	if err != nil {
+		t.Fatalf("failed to subscribe: %s.", err)
+	}
+	// the same criteria with the topics in another order
+	second, err := mux.subscribe(newFilter([]byte{5, 6, 7, 8}, []byte{1, 2, 3, 4}), deliver(2))
+	if err != nil {
+		t.Fatalf("failed to subscribe: %s.", err)
+	}
+	other, err := mux.subscribe(newFilter([]byte{9, 9, 9, 9}), deliver(3))
+	if err != nil {
+		t.Fatalf("failed to subscribe: %s.", err)
+	}
+	if n := mux.filters(); n != 2 {
+		t.Fatalf("wrong number of shared filters: %d.", n)
+	}
+	if n := len(w.filters.getWatchersByTopic(TopicType{1, 2, 3, 4})); n != 1 {
+		t.Fatalf("wrong number of installed filters: %d.", n)
+	}
+
+	// a message is delivered to both subscriptions sharing the filter
+	shared := w.GetFilter(mux.subs[first].id)
+	shared.Trigger(&ReceivedMessage{Raw: []byte{0}, EnvelopeHash: common.Hash{1}, Topic: TopicType{1, 2, 3, 4}})
+	got := make(map[int]bool)
+	for len(got) < 2 {
+		select {
+		case n := <-received:
+			got[n] = true
+		case <-time.After(2 * muxPollInterval):
+			t.Fatalf("message not delivered to all subscriptions: %v.", got)
+		}
+	}
+	if got[3] {
+		t.Fatalf("message delivered to a subscription with other criteria.")
+	}
+
+	mux.unsubscribe(first)
+	if w.GetFilter(shared.id) == nil {
+		t.Fatalf("shared filter uninstalled while still in use.")
+	}
+	mux.unsubscribe(second)
+	if w.GetFilter(shared.id) != nil {
+		t.Fatalf("shared filter not uninstalled with the last subscription.")
+	}
+	mux.unsubscribe(other)
+	if n := mux.filters(); n != 0 {
+		t.Fatalf("wrong number of shared filters after unsubscribing: %d.", n)
+	}
+}
+
+func TestFilterMuxSlowSubscriber(t *testing.T) {
+	w := New(&DefaultConfig)
+	mux := newFilterMux(w)
+	key := make([]byte, aesKeyLength)
+
+	// the first subscriber never returns from the delivery
+	stalled := make(chan struct{})
+	defer close(stalled)
+	slow, err := mux.subscribe(&Filter{KeySym: key, Topics: [][]byte{{1, 2, 3, 4}}}, func([]*Message) { <-stalled })
+	if err != nil {
+		t.Fatalf("failed to subscribe: %s.", err)
+	}
+	defer mux.unsubscribe(slow)
+	received := make(chan struct{}, muxQueueLimit+2)
+	fast, err := mux.subscribe(&Filter{KeySym: key, Topics: [][]byte{{1, 2, 3, 4}}}, func([]*Message) { received <- struct{}{} })
+	if err != nil {
+		t.Fatalf("failed to subscribe: %s.", err)
+	}
+	defer mux.unsubscribe(fast)
+
+	shared := w.GetFilter(mux.subs[fast].id)
+	for i := 0; i < 2; i++ {
+		shared.Trigger(&ReceivedMessage{Raw: []byte{0}, EnvelopeHash: common.Hash{byte(i + 1)}, Topic: TopicType{1, 2, 3, 4}})
+		select {
+		case <-received:
+		case <-time.After(4 * muxPollInterval):
+			t.Fatalf("message %d held up by the slow subscriber.", i)
+		}
+	}
+}
@@ -19,6 +19,7 @@ package whisperv6
 import (
 	"fmt"
 	"math"
+	mrand "math/rand"
 	"sync"
 	"time"
 
@@ -35,20 +36,42 @@ type Peer struct {
 	peer *p2p.Peer
 	ws   p2p.MsgReadWriter
 
+	stateMu        sync.RWMutex // Mutex to sync the trust and the PoW requirement
 	trusted        bool
+	privileged     bool // trusted or static connection, allowed to use the reserved slots
 	powRequirement float64
 	bloomMu        sync.Mutex
 	bloomFilter    []byte
+	bloomParams    BloomParams // Parameters of the bloom filter advertised by the peer
 	fullNode       bool
 
 	known *set.Set // Messages already known by the peer to avoid wasting bandwidth
 
+	warmUntil time.Time // End of the grace period following the handshake
+
+	sessionMu sync.Mutex
+	session   *peerSession // Session of the trusted link, binding the peer-to-peer messages
+
+	schema        *envelopeSchema // Validation schema of the protocol version spoken by the peer
+	envelopeFlags uint64          // Envelope flags understood by the peer (zero without the extended format)
+	features      uint64          // Protocol features advertised by the peer (zero without the extended handshake)
+
+	rejectionsOut rejectionLimiter // Rate limit of the rejection notices sent to the peer
+	rejectionsIn  rejectionLimiter // Rate limit of the rejection notices received from the peer
+
+	latencyMu sync.Mutex
+	rtt       time.Duration // Smoothed round-trip time (zero until measured)
+	probe     latencyProbe  // Round-trip probe awaiting the acknowledgement
+	transmit  chan struct{} // Broadcast triggers of the latency-aware scheduling
+
+	log log.Logger // Logger of the peer subsystem, with the peer id in the context
+
 	quit chan struct{}
 }
 
 // newPeer creates a new whisper peer object, but does not run the handshake itself.
 func newPeer(host *Whisper, remote *p2p.Peer, rw p2p.MsgReadWriter) *Peer {
-	return &Peer{
+	p := &Peer{
 		host:           host,
 		peer:           remote,
 		ws:             rw,
@@ -56,22 +79,32 @@ func newPeer(host *Whisper, remote *p2p.Peer, rw p2p.MsgReadWriter) *Peer {
 		powRequirement: 0.0,
 		known:          set.New(),
 		quit:           make(chan struct{}),
+		transmit:       make(chan struct{}, 1),
 		bloomFilter:    MakeFullNodeBloom(),
+		bloomParams:    DefaultBloomParams,
 		fullNode:       true,
+		log:            log.Root(),
+		schema:         defaultSchema,
 	}
+	if host != nil && host.peerLog != nil {
+		p.log = host.peerLog.New("peer", remote.ID())
+	}
+	return p
 }
 
 // start initiates the peer updater, periodically broadcasting the whisper packets
-// into the network.
+// into the network. The peer idling while the node is stopped is started again
+// once the node is restarted.
 func (peer *Peer) start() {
-	go peer.update()
-	log.Trace("start", "peer", peer.ID())
+	peer.quit = make(chan struct{})
+	go peer.update(peer.quit)
+	peer.log.Trace("start")
 }
 
 // stop terminates the peer updater, stopping message forwarding to it.
 func (peer *Peer) stop() {
 	close(peer.quit)
-	log.Trace("stop", "peer", peer.ID())
+	peer.log.Trace("stop")
 }
 
 // handshake sends the protocol initiation status message to the remote peer and
@@ -83,7 +116,8 @@ func (peer *Peer) handshake() error {
 		pow := peer.host.MinPow()
 		powConverted := math.Float64bits(pow)
 		bloom := peer.host.BloomFilter()
-		errc <- p2p.SendItems(peer.ws, statusCode, ProtocolVersion, powConverted, bloom)
+		params := peer.host.BloomParams()
+		errc <- p2p.SendItems(peer.ws, statusCode, ProtocolVersion, powConverted, bloom, uint64(params.Size), uint64(params.Hashes), envelopeFlagsSupported, peer.host.features())
 	}()
 
 	// Fetch the remote status packet and verify protocol match
@@ -106,6 +140,9 @@ func (peer *Peer) handshake() error {
 	if peerVersion != ProtocolVersion {
 		return fmt.Errorf("peer [%x]: protocol version mismatch %d != %d", peer.ID(), peerVersion, ProtocolVersion)
 	}
+	if peer.schema, err = schemaFor(peerVersion); err != nil {
+		return fmt.Errorf("peer [%x]: %v", peer.ID(), err)
+	}
 
 	// only version is mandatory, subsequent parameters are optional
 	powRaw, err := s.Uint()
@@ -114,14 +151,32 @@ func (peer *Peer) handshake() error {
 		if math.IsInf(pow, 0) || math.IsNaN(pow) || pow < 0.0 {
 			return fmt.Errorf("peer [%x] sent bad status message: invalid pow", peer.ID())
 		}
-		peer.powRequirement = pow
+		peer.setPoWRequirement(pow)
 
 		var bloom []byte
 		err = s.Decode(&bloom)
 		if err == nil {
-			sz := len(bloom)
-			if sz != BloomFilterSize && sz != 0 {
-				return fmt.Errorf("peer [%x] sent bad status message: wrong bloom filter size %d", peer.ID(), sz)
+			// the bloom filter parameters are optional too, the peers not
+			// advertising them use the protocol defaults
+			if size, err := s.Uint(); err == nil {
+				hashes, err := s.Uint()
+				if err != nil {
+					return fmt.Errorf("peer [%x] sent bad status message: missing bloom filter hashes", peer.ID())
+				}
+				peer.bloomParams = BloomParams{Size: int(size), Hashes: int(hashes)}
+				if err := peer.bloomParams.Validate(); err != nil {
+					return fmt.Errorf("peer [%x] sent bad status message: %v", peer.ID(), err)
+				}
+				// the peers supporting the extended envelope format advertise the flags
+				if flags, err := s.Uint(); err == nil {
+					peer.envelopeFlags = flags
+					if features, err := s.Uint(); err == nil {
+						peer.features = features
+					}
+				}
+			}
+			if err := peer.validBloom(bloom, true); err != nil {
+				return fmt.Errorf("peer [%x] sent bad status message: %v", peer.ID(), err)
 			}
 			peer.setBloomFilter(bloom)
 		}
@@ -130,15 +185,47 @@ func (peer *Peer) handshake() error {
 	if err := <-errc; err != nil {
 		return fmt.Errorf("peer [%x] failed to send status packet: %v", peer.ID(), err)
 	}
+	peer.warmUntil = time.Now().Add(peer.host.peerWarmUp)
 	return nil
 }
 
+// supports checks whether the peer advertised the protocol feature in the handshake.
+func (peer *Peer) supports(feature uint64) bool {
+	return peer.features&feature != 0
+}
+
+// warmingUp checks if the peer is still in the grace period following the
+// handshake, during which the envelopes violating the requirements advertised
+// in the handshake are dropped without penalizing the peer, since they might
+// have been sent before the requirements were processed.
+func (peer *Peer) warmingUp() bool {
+	return time.Now().Before(peer.warmUntil)
+}
+
 // update executes periodic operations on the peer, including message transmission
 // and expiration.
-func (peer *Peer) update() {
+func (peer *Peer) update(quit chan struct{}) {
 	// Start the tickers for the updates
-	expire := time.NewTicker(expirationCycle)
-	transmit := time.NewTicker(transmissionCycle)
+	expire := time.NewTicker(peer.host.expirationCycle)
+
+	// with the latency-aware scheduling the host triggers the broadcasts
+	var transmit, probe <-chan time.Time
+	if peer.host.latencyScheduling {
+		ticker := time.NewTicker(latencyProbeCycle)
+		defer ticker.Stop()
+		probe = ticker.C
+	} else {
+		ticker := time.NewTicker(peer.host.transmissionCycle)
+		defer ticker.Stop()
+		transmit = ticker.C
+	}
+
+	var sync <-chan time.Time
+	if peer.host.antiEntropyCycle > 0 {
+		ticker := time.NewTicker(peer.host.antiEntropyCycle)
+		defer ticker.Stop()
+		sync = ticker.C
+	}
 
 	// Loop and transmit until termination is requested
 	for {
@@ -146,13 +233,31 @@ func (peer *Peer) update() {
 		case <-expire.C:
 			peer.expire()
 
-		case <-transmit.C:
+		case <-transmit:
 			if err := peer.broadcast(); err != nil {
-				log.Trace("broadcast failed", "reason", err, "peer", peer.ID())
+				peer.log.Trace("broadcast failed", "reason", err)
+				return
+			}
+
+		case <-peer.transmit:
+			if err := peer.broadcast(); err != nil {
+				peer.log.Trace("broadcast failed", "reason", err)
+				return
+			}
+
+		case <-probe:
+			if err := peer.sendProbe(); err != nil {
+				peer.log.Trace("latency probe failed", "reason", err)
 				return
 			}
 
-		case <-peer.quit:
+		case <-sync:
+			if err := peer.sendDigests(); err != nil {
+				peer.log.Trace("sync failed", "reason", err)
+				return
+			}
+
+		case <-quit:
 			return
 		}
 	}
@@ -187,14 +292,24 @@ func (peer *Peer) expire() {
 // broadcast iterates over the collection of envelopes and transmits yet unknown
 // ones over the network.
 func (peer *Peer) broadcast() error {
-	envelopes := peer.host.Envelopes()
+	envelopes := peer.host.outgoingEnvelopes()
 	bundle := make([]*Envelope, 0, len(envelopes))
 	for _, envelope := range envelopes {
-		if !peer.marked(envelope) && envelope.PoW() >= peer.powRequirement && peer.bloomMatch(envelope) {
+		if !peer.marked(envelope) && peer.accepts(envelope) {
+			if gossip := peer.host.gossip; gossip != nil && !gossip.selected(peer.host, envelope, peer) {
+				continue
+			}
 			bundle = append(bundle, envelope)
 		}
 	}
 
+	// shuffle the bundle, so that the order of envelopes reveals nothing about
+	// their origin or the time of their arrival
+	for i := len(bundle) - 1; i > 0; i-- {
+		j := mrand.Intn(i + 1)
+		bundle[i], bundle[j] = bundle[j], bundle[i]
+	}
+
 	if len(bundle) > 0 {
 		// transmit the batch of envelopes
 		if err := p2p.Send(peer.ws, messagesCode, bundle); err != nil {
@@ -205,8 +320,12 @@ func (peer *Peer) broadcast() error {
 		for _, e := range bundle {
 			peer.mark(e)
 		}
+		peer.host.propagated(peer, bundle)
+		if err := peer.requestAcks(bundle); err != nil {
+			return err
+		}
 
-		log.Trace("broadcast", "num. messages", len(bundle))
+		peer.log.Trace("broadcast", "num. messages", len(bundle))
 	}
 	return nil
 }
@@ -217,6 +336,37 @@ func (peer *Peer) ID() []byte {
 	return id[:]
 }
 
+// PoWRequirement returns the minimum PoW advertised by the peer.
+func (peer *Peer) PoWRequirement() float64 {
+	peer.stateMu.RLock()
+	defer peer.stateMu.RUnlock()
+	return peer.powRequirement
+}
+
+func (peer *Peer) setPoWRequirement(pow float64) {
+	peer.stateMu.Lock()
+	defer peer.stateMu.Unlock()
+	peer.powRequirement = pow
+}
+
+// Trusted indicates if the peer was marked trusted.
+func (peer *Peer) Trusted() bool {
+	peer.stateMu.RLock()
+	defer peer.stateMu.RUnlock()
+	return peer.trusted
+}
+
+// setTrusted marks the peer trusted, reporting if it was not trusted before.
+func (peer *Peer) setTrusted() bool {
+	peer.stateMu.Lock()
+	defer peer.stateMu.Unlock()
+	if peer.trusted {
+		return false
+	}
+	peer.trusted = true
+	return true
+}
+
 func (peer *Peer) notifyAboutPowRequirementChange(pow float64) error {
 	i := math.Float64bits(pow)
 	return p2p.Send(peer.ws, powRequirementCode, i)
@@ -226,10 +376,28 @@ func (peer *Peer) notifyAboutBloomFilterChange(bloom []byte) error {
 	return p2p.Send(peer.ws, bloomFilterExCode, bloom)
 }
 
+// accepts checks if the envelope may be sent to the peer: it satisfies the
+// requirements advertised by the peer, and the routing domains permit it.
+func (peer *Peer) accepts(envelope *Envelope) bool {
+	return envelope.PoW() >= peer.PoWRequirement() && peer.bloomMatch(envelope) && peer.understands(envelope) && peer.routes(envelope)
+}
+
 func (peer *Peer) bloomMatch(env *Envelope) bool {
 	peer.bloomMu.Lock()
 	defer peer.bloomMu.Unlock()
-	return peer.fullNode || BloomFilterMatch(peer.bloomFilter, env.Bloom())
+	return peer.fullNode || BloomFilterMatch(peer.bloomFilter, peer.bloomParams.envelopeBloom(env))
+}
+
+// validBloom checks the length of the bloom filter sent by the peer, according
+// to the parameters advertised in the handshake.
+func (peer *Peer) validBloom(bloom []byte, allowEmpty bool) error {
+	if peer.bloomParams == DefaultBloomParams {
+		return peer.schema.validBloom(bloom, allowEmpty)
+	}
+	if len(bloom) == peer.bloomParams.Size || (allowEmpty && len(bloom) == 0) {
+		return nil
+	}
+	return fmt.Errorf("wrong bloom filter size %d", len(bloom))
 }
 
 func (peer *Peer) setBloomFilter(bloom []byte) {
@@ -18,8 +18,10 @@ package whisperv6
 
 import (
 	"bytes"
+	"context"
 	"crypto/ecdsa"
 	"fmt"
+	"math"
 	mrand "math/rand"
 	"net"
 	"sync"
@@ -439,7 +441,7 @@ func checkPowExchangeForNodeZeroOnce(t *testing.T, mustPass bool) bool {
 		for peer := range node.shh.peers {
 			if peer.peer.ID() == discover.PubkeyID(&nodes[0].id.PublicKey) {
 				cnt++
-				if peer.powRequirement != masterPow {
+				if peer.PoWRequirement() != masterPow {
 					if mustPass {
 						t.Fatalf("node %d: failed to set the new pow requirement for node zero.", i)
 					} else {
@@ -459,9 +461,9 @@ func checkPowExchange(t *testing.T) {
 	for i, node := range nodes {
 		for peer := range node.shh.peers {
 			if peer.peer.ID() != discover.PubkeyID(&nodes[0].id.PublicKey) {
-				if peer.powRequirement != masterPow {
+				if peer.PoWRequirement() != masterPow {
 					t.Fatalf("node %d: failed to exchange pow requirement in round %d; expected %f, got %f",
-						i, round, masterPow, peer.powRequirement)
+						i, round, masterPow, peer.PoWRequirement())
 				}
 			}
 		}
@@ -512,3 +514,406 @@ func waitForServersToStart(t *testing.T) {
 	}
 	t.Fatalf("Failed to start all the servers, running: %d", started)
 }
+
+// connectTestPeer runs the whisper protocol handler against a simulated remote
+// peer, and returns the remote end of the connection after the handshake,
+// together with the channel receiving the result of the handler.
+func connectTestPeer(t *testing.T, w *Whisper, id discover.NodeID) (*p2p.MsgPipeRW, chan error) {
+	local, remote := p2p.MsgPipe()
+	errc := make(chan error, 1)
+	go func() {
+		errc <- w.HandlePeer(p2p.NewPeer(id, "test", nil), local)
+	}()
+
+	// consume the status message of the node, and reply with our own
+	packet, err := remote.ReadMsg()
+	if err != nil {
+		t.Fatalf("failed to read status message: %s.", err)
+	}
+	if packet.Code != statusCode {
+		t.Fatalf("unexpected handshake message code: %d.", packet.Code)
+	}
+	packet.Discard()
+	if err = p2p.SendItems(remote, statusCode, ProtocolVersion, math.Float64bits(0.0), MakeFullNodeBloom()); err != nil {
+		t.Fatalf("failed to send status message: %s.", err)
+	}
+	return remote, errc
+}
+
+func TestMaxPeers(t *testing.T) {
+	cfg := DefaultConfig
+	cfg.MaxPeers = 3
+	cfg.ReservedPeers = 1
+	w := New(&cfg)
+	w.Start(nil)
+	defer w.Stop()
+
+	// two regular peers fill the unreserved slots
+	for i := byte(1); i <= 2; i++ {
+		remote, _ := connectTestPeer(t, w, discover.NodeID{i})
+		defer remote.Close()
+	}
+
+	// the third regular peer must be rejected, since the last slot is reserved
+	local, remote := p2p.MsgPipe()
+	defer remote.Close()
+	err := w.HandlePeer(p2p.NewPeer(discover.NodeID{3}, "test", nil), local)
+	if err != p2p.DiscTooManyPeers {
+		t.Fatalf("regular peer was not rejected: %v.", err)
+	}
+	if n := len(w.getPeers()); n != 2 {
+		t.Fatalf("wrong number of peers: %d.", n)
+	}
+}
+
+func TestPeerAllowlist(t *testing.T) {
+	allowed, stranger := discover.NodeID{1}, discover.NodeID{2}
+
+	cfg := DefaultConfig
+	cfg.PeerAllowlist = []discover.NodeID{allowed}
+	w := New(&cfg)
+	w.Start(nil)
+	defer w.Stop()
+
+	// the peer on the allowlist completes the handshake
+	remote, _ := connectTestPeer(t, w, allowed)
+	defer remote.Close()
+
+	// everyone else is rejected before the status message is sent
+	local, remote2 := p2p.MsgPipe()
+	defer remote2.Close()
+	err := w.HandlePeer(p2p.NewPeer(stranger, "test", nil), local)
+	if err != p2p.DiscUnexpectedIdentity {
+		t.Fatalf("peer off the allowlist was not rejected: %v.", err)
+	}
+	if !waitFor(time.Second, func() bool { _, err := w.getPeer(allowed[:]); return err == nil }) {
+		t.Fatalf("allowed peer was not accepted.")
+	}
+	if _, err := w.getPeer(stranger[:]); err == nil {
+		t.Fatalf("rejected peer is tracked.")
+	}
+}
+
+// expectPacket reads the messages from the pipe, skipping the unrelated ones,
+// until a message with the specified code arrives.
+func expectPacket(t *testing.T, rw p2p.MsgReader, code uint64, val interface{}) {
+	for {
+		packet, err := rw.ReadMsg()
+		if err != nil {
+			t.Fatalf("failed to read message with code %d: %s.", code, err)
+		}
+		if packet.Code == code {
+			if err = packet.Decode(val); err != nil {
+				t.Fatalf("failed to decode message with code %d: %s.", code, err)
+			}
+			return
+		}
+		packet.Discard()
+	}
+}
+
+func TestAntiEntropySync(t *testing.T) {
+	InitSingleTest()
+
+	w := New(&DefaultConfig)
+	w.SetMinimumPowTest(0.0000001)
+	defer w.SetMinimumPowTest(DefaultMinimumPoW)
+	w.Start(nil)
+	defer w.Stop()
+
+	now := uint32(time.Now().Unix())
+	env := &Envelope{Expiry: now + DefaultTTL, TTL: DefaultTTL, Data: []byte{1}, Nonce: uint64(seed)}
+	if _, err := w.add(env, false); err != nil {
+		t.Fatalf("failed to add envelope with seed %d: %s.", seed, err)
+	}
+	index := bucketIndex(env.Expiry)
+
+	remote, _ := connectTestPeer(t, w, discover.NodeID{1})
+	defer remote.Close()
+
+	// the bucket is missing on the remote side, the node must list its hashes
+	if err := p2p.Send(remote, syncDigestCode, []bucketDigest{}); err != nil {
+		t.Fatalf("failed to send digests: %s.", err)
+	}
+	var hashes []bucketHashes
+	expectPacket(t, remote, syncHashesCode, &hashes)
+	if len(hashes) != 1 || hashes[0].Index != index || len(hashes[0].Hashes) != 1 || hashes[0].Hashes[0] != env.Hash() {
+		t.Fatalf("wrong hashes received: %v.", hashes)
+	}
+
+	// the node must request the envelope it lacks
+	unknown := common.Hash{0xff}
+	if err := p2p.Send(remote, syncHashesCode, []bucketHashes{{Index: index, Hashes: []common.Hash{env.Hash(), unknown}}}); err != nil {
+		t.Fatalf("failed to send hashes: %s.", err)
+	}
+	var request []common.Hash
+	expectPacket(t, remote, syncRequestCode, &request)
+	if len(request) != 1 || request[0] != unknown {
+		t.Fatalf("wrong sync request received: %v.", request)
+	}
+
+	// the node must deliver the requested envelope
+	if err := p2p.Send(remote, syncRequestCode, []common.Hash{env.Hash()}); err != nil {
+		t.Fatalf("failed to send sync request: %s.", err)
+	}
+	var envelopes []*Envelope
+	expectPacket(t, remote, messagesCode, &envelopes)
+	if len(envelopes) != 1 || envelopes[0].Hash() != env.Hash() {
+		t.Fatalf("requested envelope was not delivered.")
+	}
+}
+
+func TestRestart(t *testing.T) {
+	cfg := DefaultConfig
+	cfg.SealWorkers = 1
+	w := New(&cfg)
+	if err := w.Start(nil); err != nil {
+		t.Fatalf("failed to start: %s.", err)
+	}
+	if err := w.Start(nil); err == nil {
+		t.Fatalf("started twice.")
+	}
+
+	remote, errc := connectTestPeer(t, w, discover.NodeID{1})
+	if err := w.Stop(); err != nil {
+		t.Fatalf("failed to stop: %s.", err)
+	}
+	if err := w.Stop(); err != nil {
+		t.Fatalf("failed to stop twice: %s.", err)
+	}
+	if w.Running() {
+		t.Fatalf("running after stop.")
+	}
+
+	// the peer served by HandlePeer is released by the stop
+	remote.Close()
+	select {
+	case err := <-errc:
+		if err != errWhisperStopped {
+			t.Fatalf("wrong error of the stopped peer: %v.", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("peer not released after stop.")
+	}
+	if n := len(w.getPeers()); n != 0 {
+		t.Fatalf("wrong number of peers after stop: %d.", n)
+	}
+
+	if err := w.Start(nil); err != nil {
+		t.Fatalf("failed to restart: %s.", err)
+	}
+	defer w.Stop()
+	if sub := w.SubscribePeerEvents(make(chan *PeerEvent, 1)); sub == nil {
+		t.Fatalf("failed to subscribe after restart.")
+	} else {
+		sub.Unsubscribe()
+	}
+	connectTestPeer(t, w, discover.NodeID{2})
+	deadline := time.Now().Add(time.Second)
+	for len(w.getPeers()) != 1 {
+		if time.Now().After(deadline) {
+			t.Fatalf("peer not accepted after restart.")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	env := &Envelope{Expiry: uint32(time.Now().Unix()) + 10, TTL: 10, Data: []byte{1}}
+	if err := w.Seal(context.Background(), env, &MessageParams{PoW: 0.0001, WorkTime: 1}, nil); err != nil {
+		t.Fatalf("failed to seal after restart: %s.", err)
+	}
+}
+
+func TestRestartKeepsPeers(t *testing.T) {
+	InitSingleTest()
+
+	w := New(&DefaultConfig)
+	w.SetMinimumPowTest(0.0000001)
+	w.Start(nil)
+	defer w.Stop()
+
+	local, remote := p2p.MsgPipe()
+	errc := make(chan error, 1)
+	go func() {
+		errc <- w.runPeer(p2p.NewPeer(discover.NodeID{1}, "test", nil), local)
+	}()
+	packet, err := remote.ReadMsg()
+	if err != nil || packet.Code != statusCode {
+		t.Fatalf("failed to read status message: %v.", err)
+	}
+	packet.Discard()
+	if err = p2p.SendItems(remote, statusCode, ProtocolVersion, math.Float64bits(0.0), MakeFullNodeBloom()); err != nil {
+		t.Fatalf("failed to send status message: %s.", err)
+	}
+	defer func() {
+		remote.Close()
+		<-errc
+	}()
+
+	// the connection shared with the other protocols survives the stop
+	w.Stop()
+	if err = p2p.Send(remote, messagesCode, []*Envelope{}); err != nil {
+		t.Fatalf("failed to send to the stopped node: %s.", err)
+	}
+	select {
+	case err := <-errc:
+		t.Fatalf("peer disconnected by the stop: %v.", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	// and the peer is served again after the restart, without a new handshake
+	if err = w.Start(nil); err != nil {
+		t.Fatalf("failed to restart: %s.", err)
+	}
+	env := &Envelope{Expiry: uint32(time.Now().Unix()) + DefaultTTL, TTL: DefaultTTL, Data: []byte{1}, Nonce: uint64(seed)}
+	if err = p2p.Send(remote, messagesCode, []*Envelope{env}); err != nil {
+		t.Fatalf("failed to send to the restarted node: %s.", err)
+	}
+	if !waitFor(time.Second, func() bool { return w.isEnvelopeCached(env.Hash()) }) {
+		t.Fatalf("envelope of the resumed peer not pooled with seed %d.", seed)
+	}
+	if n := len(w.getPeers()); n != 1 {
+		t.Fatalf("wrong number of peers after restart: %d.", n)
+	}
+}
+
+func TestPeerWarmUp(t *testing.T) {
+	cfg := DefaultConfig
+	cfg.PeerWarmUp = 500 * time.Millisecond
+	w := New(&cfg)
+	w.SetMinimumPowTest(1000) // never reached by the unsealed envelopes by chance
+	w.Start(nil)
+	defer w.Stop()
+
+	// the envelopes below the required PoW, sent right after the handshake as
+	// if the peer had not processed our status yet
+	remote, errc := connectTestPeer(t, w, discover.NodeID{1})
+	now := uint32(time.Now().Unix())
+	if err := p2p.Send(remote, messagesCode, []*Envelope{{Expiry: now + 10, TTL: 10, Data: []byte{1}}}); err != nil {
+		t.Fatalf("failed to send envelope: %s.", err)
+	}
+	select {
+	case err := <-errc:
+		t.Fatalf("peer disconnected during warm-up: %v.", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+	if len(w.Envelopes()) != 0 {
+		t.Fatalf("invalid envelope accepted during warm-up.")
+	}
+
+	time.Sleep(cfg.PeerWarmUp)
+	if err := p2p.Send(remote, messagesCode, []*Envelope{{Expiry: now + 10, TTL: 10, Data: []byte{2}}}); err != nil {
+		t.Fatalf("failed to send envelope: %s.", err)
+	}
+	select {
+	case err := <-errc:
+		if err == nil {
+			t.Fatalf("peer disconnected without error.")
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("peer not disconnected after warm-up.")
+	}
+}
+
+func TestSessionTranscript(t *testing.T) {
+	InitSingleTest()
+
+	w := New(&DefaultConfig)
+	w.Start(nil)
+	defer w.Stop()
+
+	params, err := generateMessageParams()
+	if err != nil {
+		t.Fatalf("failed generateMessageParams with seed %d: %s.", seed, err)
+	}
+	params.PoW = 0.0000001
+	filter := &Filter{KeySym: params.KeySym, Topics: [][]byte{params.Topic[:]}, AllowP2P: true, Messages: make(map[common.Hash]*ReceivedMessage)}
+	if _, err = w.Subscribe(filter); err != nil {
+		t.Fatalf("failed to subscribe with seed %d: %s.", seed, err)
+	}
+	msg, err := NewSentMessage(params)
+	if err != nil {
+		t.Fatalf("failed to create new message with seed %d: %s.", seed, err)
+	}
+	env, err := msg.Wrap(params)
+	if err != nil {
+		t.Fatalf("failed Wrap with seed %d: %s.", seed, err)
+	}
+
+	id := discover.NodeID{1}
+	remote, errc := connectTestPeer(t, w, id)
+	defer remote.Close()
+	if err = w.AllowP2PMessagesFromPeer(id[:]); err != nil {
+		t.Fatalf("failed to mark peer trusted: %s.", err)
+	}
+
+	// the trusted peer answers the session initiation with its own nonce
+	var local []byte
+	expectPacket(t, remote, sessionInitCode, &local)
+	nonce := make([]byte, sessionNonceLength)
+	nonce[0] = 1
+	if err = p2p.Send(remote, sessionInitCode, nonce); err != nil {
+		t.Fatalf("failed to send session nonce: %s.", err)
+	}
+	transcript := sessionTranscript(id, nonce, discover.NodeID{}, local)
+
+	// the legacy peer-to-peer messages are ignored once the session is established
+	time.Sleep(100 * time.Millisecond)
+	if err = p2p.Send(remote, p2pMessageCode, env); err != nil {
+		t.Fatalf("failed to send p2p message: %s.", err)
+	}
+	if err = p2p.Send(remote, sessionMessageCode, &sessionMessage{Transcript: transcript, Envelope: env}); err != nil {
+		t.Fatalf("failed to send session message: %s.", err)
+	}
+	var delivered int
+	for i := 0; i < 10 && delivered == 0; i++ {
+		time.Sleep(50 * time.Millisecond)
+		delivered += len(filter.Retrieve())
+	}
+	if delivered != 1 {
+		t.Fatalf("wrong number of delivered messages with seed %d: %d.", seed, delivered)
+	}
+
+	// the message bound to another session is dropped after the decryption,
+	// even if it is sent within this one
+	bound := func(session common.Hash) *Envelope {
+		params.Session = session
+		msg, err := NewSentMessage(params)
+		if err != nil {
+			t.Fatalf("failed to create new message with seed %d: %s.", seed, err)
+		}
+		env, err := msg.Wrap(params)
+		if err != nil {
+			t.Fatalf("failed Wrap with seed %d: %s.", seed, err)
+		}
+		return env
+	}
+	spliced, own := bound(common.Hash{2}), bound(transcript)
+	for _, env := range []*Envelope{spliced, own} {
+		if err = p2p.Send(remote, sessionMessageCode, &sessionMessage{Transcript: transcript, Envelope: env}); err != nil {
+			t.Fatalf("failed to send session message: %s.", err)
+		}
+	}
+	var mail []*ReceivedMessage
+	for i := 0; i < 10 && len(mail) == 0; i++ {
+		time.Sleep(50 * time.Millisecond)
+		mail = filter.Retrieve()
+	}
+	if len(mail) != 1 || mail[0].EnvelopeHash != own.Hash() {
+		t.Fatalf("spliced message delivered with seed %d: %d messages.", seed, len(mail))
+	}
+	if mail[0].Session != transcript {
+		t.Fatalf("wrong session of the delivered message with seed %d: %x.", seed, mail[0].Session)
+	}
+
+	// a message spliced from another session must get the peer disconnected
+	if err = p2p.Send(remote, sessionMessageCode, &sessionMessage{Transcript: common.Hash{1}, Envelope: env}); err != nil {
+		t.Fatalf("failed to send session message: %s.", err)
+	}
+	select {
+	case err = <-errc:
+		if err == nil {
+			t.Fatalf("peer disconnected without error.")
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("peer not disconnected after transcript mismatch.")
+	}
+}
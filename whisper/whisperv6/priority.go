@@ -0,0 +1,115 @@
+// Copyright 2017 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+// Contains the priority inbox of the filters. The importance of each message
+// is scored when it arrives, either by the scoring function of the filter or by
+// the static priority of its sender, and the queued messages are drained in the
+// order of their priority (e.g. by the notification UIs of the wallets). Once
+// the queue is full, the new messages displace the less important ones.
+
+package whisperv6
+
+import (
+	"bytes"
+	"sort"
+
+	"github.com/ethereum/go-ethereum/crypto"
+)
+
+// prioritized checks if the filter scores the importance of the messages.
+func (f *Filter) prioritized() bool {
+	return f.Score != nil || len(f.Priorities) > 0
+}
+
+// score returns the message carrying its priority according to the filter.
+// The message is copied, since it is shared by all the matching filters. The
+// filter must be locked by the caller, so the scoring function must not call
+// the filter back.
+func (f *Filter) score(msg *ReceivedMessage) *ReceivedMessage {
+	if !f.prioritized() {
+		return msg
+	}
+	scored := *msg
+	switch {
+	case f.Score != nil:
+		scored.Priority = f.Score(msg)
+	case msg.Src != nil:
+		scored.Priority = f.Priorities[crypto.PubkeyToAddress(*msg.Src)]
+	default:
+		scored.Priority = 0 // anonymous sender
+	}
+	return &scored
+}
+
+// evictBelow drops the least important queued message to make room for a
+// message of the given priority, reporting if it succeeded. The filters not
+// scoring the messages never evict them. The filter must be locked by the caller.
+func (f *Filter) evictBelow(priority int) bool {
+	if !f.prioritized() {
+		return false
+	}
+	var lowest *ReceivedMessage
+	for _, msg := range f.Messages {
+		if lowest == nil || morePrioritized(lowest, msg) {
+			lowest = msg
+		}
+	}
+	if lowest == nil || lowest.Priority >= priority {
+		return false
+	}
+	delete(f.Messages, lowest.EnvelopeHash)
+	return true
+}
+
+// morePrioritized reports if the message a is drained before the message b:
+// the more important messages first, and the older ones among the equal.
+func morePrioritized(a, b *ReceivedMessage) bool {
+	if a.Priority != b.Priority {
+		return a.Priority > b.Priority
+	}
+	if a.Sent != b.Sent {
+		return a.Sent < b.Sent
+	}
+	return bytes.Compare(a.EnvelopeHash[:], b.EnvelopeHash[:]) < 0
+}
+
+// queued returns the queued messages in the order of their priority. The
+// filter must be locked by the caller.
+func (f *Filter) queued() []*ReceivedMessage {
+	all := make([]*ReceivedMessage, 0, len(f.Messages))
+	for _, msg := range f.Messages {
+		all = append(all, msg)
+	}
+	sort.Slice(all, func(i, j int) bool { return morePrioritized(all[i], all[j]) })
+	return all
+}
+
+// RetrieveTop returns up to n most important messages of the filter, leaving
+// the rest queued for the subsequent calls.
+func (f *Filter) RetrieveTop(n int) []*ReceivedMessage {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	all := f.queued()
+	if n < len(all) {
+		all = all[:n]
+	}
+	for _, msg := range all {
+		f.deliver(msg)
+		delete(f.Messages, msg.EnvelopeHash)
+	}
+	return all
+}
@@ -0,0 +1,75 @@
+// Copyright 2017 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package whisperv6
+
+import (
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+)
+
+func TestPriorityInbox(t *testing.T) {
+	InitSingleTest()
+
+	important, err := crypto.GenerateKey()
+	if err != nil {
+		t.Fatalf("failed to generate key with seed %d: %s.", seed, err)
+	}
+	casual, err := crypto.GenerateKey()
+	if err != nil {
+		t.Fatalf("failed to generate key with seed %d: %s.", seed, err)
+	}
+	f := &Filter{
+		Messages: make(map[common.Hash]*ReceivedMessage),
+		Priorities: map[common.Address]int{
+			crypto.PubkeyToAddress(important.PublicKey): 5,
+			crypto.PubkeyToAddress(casual.PublicKey):    1,
+		},
+		maxMessages: 2,
+	}
+	fromCasual := &ReceivedMessage{Src: &casual.PublicKey, Sent: 1, EnvelopeHash: common.Hash{1}}
+	anonymous := &ReceivedMessage{Sent: 2, EnvelopeHash: common.Hash{2}}
+	fromImportant := &ReceivedMessage{Src: &important.PublicKey, Sent: 3, EnvelopeHash: common.Hash{3}}
+	lateAnonymous := &ReceivedMessage{Sent: 4, EnvelopeHash: common.Hash{4}}
+
+	// the important message displaces the anonymous one from the full queue,
+	// while the late anonymous message does not displace anything
+	for _, msg := range []*ReceivedMessage{fromCasual, anonymous, fromImportant, lateAnonymous} {
+		f.Trigger(msg)
+	}
+	top := f.RetrieveTop(1)
+	if len(top) != 1 || top[0].EnvelopeHash != fromImportant.EnvelopeHash || top[0].Priority != 5 {
+		t.Fatalf("wrong most important message with seed %d: %v.", seed, top)
+	}
+	if fromImportant.Priority != 0 {
+		t.Fatalf("priority leaked into the message shared by the filters with seed %d.", seed)
+	}
+	rest := f.Retrieve()
+	if len(rest) != 1 || rest[0].EnvelopeHash != fromCasual.EnvelopeHash || rest[0].Priority != 1 {
+		t.Fatalf("wrong remaining messages with seed %d: %v.", seed, rest)
+	}
+
+	// the scoring function overrides the static priorities
+	f.Score = func(msg *ReceivedMessage) int { return int(msg.Sent) }
+	f.Trigger(&ReceivedMessage{Sent: 7, EnvelopeHash: common.Hash{5}})
+	f.Trigger(&ReceivedMessage{Src: &important.PublicKey, Sent: 6, EnvelopeHash: common.Hash{6}})
+	all := f.Retrieve()
+	if len(all) != 2 || all[0].Priority != 7 || all[1].Priority != 6 {
+		t.Fatalf("messages not drained in the order of the scores with seed %d: %v.", seed, all)
+	}
+}
@@ -0,0 +1,105 @@
+// Copyright 2017 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+// Contains the propagation tracking of the locally originated envelopes.
+//
+// The node counts the distinct peers it forwarded each of its own envelopes
+// to, which gives the senders a rough signal that the message left the node,
+// without the end-to-end acknowledgements (see SendWithDelivery). The peers are
+// counted by their node IDs, so a reconnecting peer is only counted once.
+
+package whisperv6
+
+import (
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/event"
+	"github.com/ethereum/go-ethereum/p2p/discover"
+)
+
+// PropagationEvent is an event emitted when a locally originated envelope is
+// forwarded to another distinct peer.
+type PropagationEvent struct {
+	Hash  common.Hash `json:"hash"`
+	Peers int         `json:"peers"` // Number of the distinct peers the envelope was forwarded to so far
+}
+
+// SubscribePropagation subscribes the given channel to the propagation of the
+// locally originated envelopes. The events are delivered synchronously from
+// the broadcast path, so the channel should be sufficiently buffered.
+func (whisper *Whisper) SubscribePropagation(ch chan<- *PropagationEvent) event.Subscription {
+	return whisper.track(whisper.propagationFeed.Subscribe(ch))
+}
+
+// Propagation returns the number of the distinct peers the locally originated
+// envelope was forwarded to, and false if the envelope was not sent by this
+// node or already expired.
+func (whisper *Whisper) Propagation(hash common.Hash) (int, bool) {
+	whisper.propagationMu.RLock()
+	defer whisper.propagationMu.RUnlock()
+
+	peers, ok := whisper.propagation[hash]
+	return len(peers), ok
+}
+
+// trackPropagation starts tracking the propagation of the envelope being sent.
+func (whisper *Whisper) trackPropagation(hash common.Hash) {
+	whisper.propagationMu.Lock()
+	defer whisper.propagationMu.Unlock()
+	if _, ok := whisper.propagation[hash]; !ok {
+		whisper.propagation[hash] = make(map[discover.NodeID]struct{})
+	}
+}
+
+// forgetPropagation stops tracking the propagation of the envelopes.
+func (whisper *Whisper) forgetPropagation(envelopes []*Envelope) {
+	whisper.propagationMu.Lock()
+	defer whisper.propagationMu.Unlock()
+	if len(whisper.propagation) == 0 {
+		return
+	}
+	for _, envelope := range envelopes {
+		delete(whisper.propagation, envelope.Hash())
+	}
+}
+
+// propagated records the envelopes sent to the peer, notifying the subscribers
+// about the own envelopes reaching another distinct peer.
+func (whisper *Whisper) propagated(p *Peer, envelopes []*Envelope) {
+	var events []*PropagationEvent
+
+	whisper.propagationMu.Lock()
+	if len(whisper.propagation) > 0 {
+		id := p.peer.ID()
+		for _, envelope := range envelopes {
+			hash := envelope.Hash()
+			peers, ok := whisper.propagation[hash]
+			if !ok {
+				continue
+			}
+			if _, seen := peers[id]; seen {
+				continue
+			}
+			peers[id] = struct{}{}
+			events = append(events, &PropagationEvent{Hash: hash, Peers: len(peers)})
+		}
+	}
+	whisper.propagationMu.Unlock()
+
+	for _, ev := range events {
+		p.log.Trace("own envelope propagated", "hash", ev.Hash.Hex(), "peers", ev.Peers)
+		whisper.propagationFeed.Send(ev)
+	}
+}
@@ -0,0 +1,85 @@
+// Copyright 2017 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package whisperv6
+
+import (
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/p2p"
+	"github.com/ethereum/go-ethereum/p2p/discover"
+)
+
+func TestPropagationTracking(t *testing.T) {
+	InitSingleTest()
+
+	w := New(&DefaultConfig)
+	w.SetMinimumPowTest(0.0000001)
+	defer w.SetMinimumPowTest(DefaultMinimumPoW)
+	w.Start(nil)
+	defer w.Stop()
+
+	events := make(chan *PropagationEvent, 10)
+	sub := w.SubscribePropagation(events)
+	defer sub.Unsubscribe()
+
+	first, _ := connectTestPeer(t, w, discover.NodeID{1})
+	defer first.Close()
+	second, _ := connectTestPeer(t, w, discover.NodeID{2})
+	defer second.Close()
+
+	now := uint32(time.Now().Unix())
+	own := &Envelope{Expiry: now + DefaultTTL, TTL: DefaultTTL, Data: []byte{1}, Nonce: uint64(seed)}
+	relayed := &Envelope{Expiry: now + DefaultTTL, TTL: DefaultTTL, Data: []byte{2}, Nonce: uint64(seed)}
+	if err := w.Send(own); err != nil {
+		t.Fatalf("failed to send envelope with seed %d: %s.", seed, err)
+	}
+	if _, err := w.add(relayed, false); err != nil {
+		t.Fatalf("failed to add envelope with seed %d: %s.", seed, err)
+	}
+
+	// both envelopes are broadcast, but only the own one is tracked
+	for _, remote := range []*p2p.MsgPipeRW{first, second} {
+		for received := 0; received < 2; {
+			var envelopes []*Envelope
+			expectPacket(t, remote, messagesCode, &envelopes)
+			received += len(envelopes)
+		}
+	}
+	for i := 1; i <= 2; i++ {
+		select {
+		case ev := <-events:
+			if ev.Hash != own.Hash() || ev.Peers != i {
+				t.Fatalf("wrong propagation event with seed %d: %+v.", seed, ev)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("propagation event %d not received with seed %d.", i, seed)
+		}
+	}
+	if peers, ok := w.Propagation(own.Hash()); !ok || peers != 2 {
+		t.Fatalf("wrong propagation of own envelope with seed %d: %d, %v.", seed, peers, ok)
+	}
+	if _, ok := w.Propagation(relayed.Hash()); ok {
+		t.Fatalf("propagation of relayed envelope tracked with seed %d.", seed)
+	}
+
+	// the tracking ends with the envelope
+	w.forgetPropagation([]*Envelope{own})
+	if _, ok := w.Propagation(own.Hash()); ok {
+		t.Fatalf("propagation of expired envelope still tracked with seed %d.", seed)
+	}
+}
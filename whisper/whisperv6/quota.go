@@ -0,0 +1,294 @@
+// Copyright 2017 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+// +build !whisperlite
+
+package whisperv6
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/ethereum/go-ethereum/rpc"
+)
+
+// Names of the per-client RPC quotas.
+const (
+	QuotaIdentities     = "identities"       // key pairs and symmetric keys
+	QuotaFilters        = "filters"          // message filters and subscriptions
+	QuotaPostsPerMinute = "posts per minute" // posted messages
+
+	QuotaIdentitiesPerMinute = "identities per minute" // created or imported keys
+)
+
+// QuotaExceededError is returned if the RPC client exceeds one of its quotas.
+type QuotaExceededError struct {
+	Quota string
+	Limit int
+}
+
+func (e *QuotaExceededError) Error() string {
+	return fmt.Sprintf("%s quota exceeded (limit %d)", e.Quota, e.Limit)
+}
+
+// sharedClient is the key of the quota usage shared by the in-process callers,
+// which are not associated with any connection.
+type sharedClient struct{}
+
+// httpClient is the key of the quota usage of the HTTP clients connecting from
+// the host. The usage outlives the single requests, and is forgotten once the
+// host stays idle for httpClientIdleTimeout. All the clients behind a single
+// reverse proxy or NAT appear as one host, and thus share one quota.
+type httpClient string
+
+const (
+	httpClientIdleTimeout = 30 * time.Minute // Time after which the usage of an idle HTTP client is forgotten
+	httpClientSweepCycle  = time.Minute      // Minimum interval between the checks of the idle HTTP clients
+)
+
+// clientUsage tracks the resources used by a single RPC client.
+type clientUsage struct {
+	identities map[string]struct{}
+	filters    map[string]func(id string) // uninstallers of the filters (nil if uninstalled with the connection anyway)
+	posts      []time.Time                // times of the posts within the last minute
+	created    []time.Time                // times of the identities created within the last minute
+	lastUsed   time.Time                  // time of the last call subject to the quotas
+}
+
+// withinRate checks if another event fits into the limit within the last
+// minute, and records the event if so.
+func withinRate(events *[]time.Time, limit int, now time.Time) bool {
+	for len(*events) > 0 && now.Sub((*events)[0]) >= time.Minute {
+		*events = (*events)[1:]
+	}
+	if len(*events) >= limit {
+		return false
+	}
+	*events = append(*events, now)
+	return true
+}
+
+// clientQuotas enforces the limits on the resources used by each RPC client.
+// The clients with a persistent connection (websocket, IPC) are identified by
+// the connection, and their keys and filters are deleted when the connection
+// is closed, so that reconnecting never escapes the quotas. The HTTP clients
+// are identified by their host, and their keys and filters are deleted alike
+// once the host stays idle for httpClientIdleTimeout.
+type clientQuotas struct {
+	limits quotaLimits
+	exists func(id string) bool // Checks if the identity was not deleted meanwhile
+	delete func(id string) bool // Deletes the identity of the disconnected client
+
+	mu      sync.Mutex
+	clients map[interface{}]*clientUsage
+	swept   time.Time // time of the last check of the idle HTTP clients
+}
+
+func newClientQuotas(limits quotaLimits, exists func(id string) bool, delete func(id string) bool) *clientQuotas {
+	return &clientQuotas{
+		limits:  limits,
+		exists:  exists,
+		delete:  delete,
+		clients: make(map[interface{}]*clientUsage),
+	}
+}
+
+// clientKey returns the key identifying the client calling the API, and its
+// connection if persistent.
+func clientKey(ctx context.Context) (interface{}, *rpc.Notifier) {
+	if notifier, ok := rpc.NotifierFromContext(ctx); ok {
+		return notifier, notifier
+	}
+	if addr, ok := rpc.RemoteAddrFromContext(ctx); ok {
+		if host, _, err := net.SplitHostPort(addr); err == nil {
+			addr = host
+		}
+		return httpClient(addr), nil
+	}
+	return sharedClient{}, nil
+}
+
+// usage returns the usage of the client calling the API, creating it if
+// necessary. The quotas must be locked by the caller.
+func (q *clientQuotas) usage(ctx context.Context) *clientUsage {
+	now := time.Now()
+	if now.Sub(q.swept) >= httpClientSweepCycle {
+		q.sweep(now)
+	}
+	key, notifier := clientKey(ctx)
+	u, ok := q.clients[key]
+	if !ok {
+		u = &clientUsage{
+			identities: make(map[string]struct{}),
+			filters:    make(map[string]func(id string)),
+		}
+		q.clients[key] = u
+		if notifier != nil {
+			go func() {
+				<-notifier.Closed()
+				q.release(key)
+			}()
+		}
+	}
+	u.lastUsed = now
+	return u
+}
+
+// sweep releases the HTTP clients idle for httpClientIdleTimeout. The quotas
+// must be locked by the caller, hence their resources are deleted in the
+// background, as the API lock is acquired before the quotas.
+func (q *clientQuotas) sweep(now time.Time) {
+	q.swept = now
+	for key, u := range q.clients {
+		if _, ok := key.(httpClient); ok && now.Sub(u.lastUsed) >= httpClientIdleTimeout {
+			delete(q.clients, key)
+			go q.free(u)
+		}
+	}
+}
+
+// release deletes the keys and the filters of the disconnected client, and
+// forgets its usage.
+func (q *clientQuotas) release(key interface{}) {
+	q.mu.Lock()
+	u := q.clients[key]
+	delete(q.clients, key)
+	q.mu.Unlock()
+
+	if u != nil {
+		q.free(u)
+	}
+}
+
+// free deletes the keys and the filters of the forgotten client.
+func (q *clientQuotas) free(u *clientUsage) {
+	for id := range u.identities {
+		if q.delete != nil {
+			q.delete(id)
+		}
+	}
+	for id, uninstall := range u.filters {
+		if uninstall != nil {
+			uninstall(id)
+		}
+	}
+}
+
+// addIdentity reserves an identity for the client, creating it by the given
+// function if the quota allows.
+func (q *clientQuotas) addIdentity(ctx context.Context, create func() (string, error)) (string, error) {
+	if q == nil || (q.limits.identities <= 0 && q.limits.identitiesPerMinute <= 0) {
+		return create()
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	u := q.usage(ctx)
+	if q.limits.identities > 0 && len(u.identities) >= q.limits.identities {
+		// the idle identities might have been deleted by the node
+		for id := range u.identities {
+			if q.exists != nil && !q.exists(id) {
+				delete(u.identities, id)
+			}
+		}
+		if len(u.identities) >= q.limits.identities {
+			return "", &QuotaExceededError{Quota: QuotaIdentities, Limit: q.limits.identities}
+		}
+	}
+	if q.limits.identitiesPerMinute > 0 && !withinRate(&u.created, q.limits.identitiesPerMinute, time.Now()) {
+		return "", &QuotaExceededError{Quota: QuotaIdentitiesPerMinute, Limit: q.limits.identitiesPerMinute}
+	}
+	id, err := create()
+	if err == nil {
+		u.identities[id] = struct{}{}
+	}
+	return id, err
+}
+
+// removeIdentity releases the identity of the client.
+func (q *clientQuotas) removeIdentity(ctx context.Context, id string) {
+	if q == nil {
+		return
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	key, _ := clientKey(ctx)
+	if u, ok := q.clients[key]; ok {
+		delete(u.identities, id)
+	}
+}
+
+// addFilter reserves a filter for the client, installing it by the given
+// function if the quota allows. The filter is uninstalled by the given function
+// when the client disconnects, unless it is nil.
+func (q *clientQuotas) addFilter(ctx context.Context, install func() (string, error), uninstall func(id string)) (string, error) {
+	if q == nil || q.limits.filters <= 0 {
+		return install()
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	u := q.usage(ctx)
+	if len(u.filters) >= q.limits.filters {
+		return "", &QuotaExceededError{Quota: QuotaFilters, Limit: q.limits.filters}
+	}
+	id, err := install()
+	if err == nil {
+		u.filters[id] = uninstall
+	}
+	return id, err
+}
+
+// removeFilter releases the filter of the client.
+func (q *clientQuotas) removeFilter(ctx context.Context, id string) {
+	if q == nil {
+		return
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	key, _ := clientKey(ctx)
+	if u, ok := q.clients[key]; ok {
+		delete(u.filters, id)
+	}
+}
+
+// allowPost checks if the client may post another message within the current
+// minute, and records the post if so.
+func (q *clientQuotas) allowPost(ctx context.Context) error {
+	if q == nil || q.limits.postsPerMinute <= 0 {
+		return nil
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if !withinRate(&q.usage(ctx).posts, q.limits.postsPerMinute, time.Now()) {
+		return &QuotaExceededError{Quota: QuotaPostsPerMinute, Limit: q.limits.postsPerMinute}
+	}
+	return nil
+}
+
+// queuedMessages returns the maximum number of messages waiting in a filter.
+func (q *clientQuotas) queuedMessages() int {
+	if q == nil {
+		return 0
+	}
+	return q.limits.queuedMessages
+}
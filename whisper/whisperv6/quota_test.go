@@ -0,0 +1,185 @@
+// Copyright 2017 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+// +build !whisperlite
+
+package whisperv6
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/rpc"
+)
+
+func TestClientQuotas(t *testing.T) {
+	cfg := DefaultConfig
+	cfg.ClientMaxIdentities = 2
+	cfg.ClientMaxFilters = 1
+	cfg.ClientMaxPostsPerMinute = 1
+	cfg.ClientMaxQueuedMessages = 1
+	w := New(&cfg)
+	api := NewPublicWhisperAPI(w)
+	ctx := context.Background()
+
+	id, err := api.NewKeyPair(ctx)
+	if err != nil {
+		t.Fatalf("failed to create key pair: %s.", err)
+	}
+	symID, err := api.NewSymKey(ctx)
+	if err != nil {
+		t.Fatalf("failed to create symmetric key: %s.", err)
+	}
+	if _, err = api.NewSymKey(ctx); err == nil {
+		t.Fatalf("identity quota was not enforced.")
+	} else if qerr, ok := err.(*QuotaExceededError); !ok || qerr.Quota != QuotaIdentities {
+		t.Fatalf("wrong quota error: %v.", err)
+	}
+	if _, err = api.DeleteKeyPair(ctx, id); err != nil {
+		t.Fatalf("failed to delete key pair: %s.", err)
+	}
+	if _, err = api.NewKeyPair(ctx); err != nil {
+		t.Fatalf("released identity quota was not reused: %s.", err)
+	}
+
+	crit := Criteria{SymKeyID: symID, Topics: []TopicType{{1}}}
+	filterID, err := api.NewMessageFilter(ctx, crit)
+	if err != nil {
+		t.Fatalf("failed to create filter: %s.", err)
+	}
+	if _, err = api.NewMessageFilter(ctx, crit); err == nil {
+		t.Fatalf("filter quota was not enforced.")
+	}
+
+	f := w.GetFilter(filterID)
+	f.Trigger(&ReceivedMessage{EnvelopeHash: common.Hash{1}})
+	f.Trigger(&ReceivedMessage{EnvelopeHash: common.Hash{2}})
+	if n := len(f.Retrieve()); n != 1 {
+		t.Fatalf("queued messages quota was not enforced: %d.", n)
+	}
+
+	if _, err = api.DeleteMessageFilter(ctx, filterID); err != nil {
+		t.Fatalf("failed to delete filter: %s.", err)
+	}
+	if _, err = api.NewMessageFilter(ctx, crit); err != nil {
+		t.Fatalf("released filter quota was not reused: %s.", err)
+	}
+
+	if err = api.quotas.allowPost(ctx); err != nil {
+		t.Fatalf("first post was rejected: %s.", err)
+	}
+	if err = api.quotas.allowPost(ctx); err == nil {
+		t.Fatalf("post quota was not enforced.")
+	}
+}
+
+func TestClientQuotasTeardown(t *testing.T) {
+	cfg := DefaultConfig
+	cfg.ClientMaxIdentities = 1
+	cfg.ClientMaxFilters = 1
+	w := New(&cfg)
+	api := NewPublicWhisperAPI(w)
+
+	server := rpc.NewServer()
+	defer server.Stop()
+	if err := server.RegisterName(ProtocolName, api); err != nil {
+		t.Fatalf("failed to register the API: %s.", err)
+	}
+	client := rpc.DialInProc(server)
+
+	var symID, filterID string
+	if err := client.Call(&symID, "shh_newSymKey"); err != nil {
+		t.Fatalf("failed to create symmetric key: %s.", err)
+	}
+	if err := client.Call(&filterID, "shh_newMessageFilter", Criteria{SymKeyID: symID, Topics: []TopicType{{1}}}); err != nil {
+		t.Fatalf("failed to create filter: %s.", err)
+	}
+	if err := client.Call(new(string), "shh_newKeyPair"); err == nil {
+		t.Fatalf("identity quota was not enforced.")
+	}
+
+	// the resources of the disconnected client must not escape the quotas
+	client.Close()
+	if !waitFor(time.Second, func() bool { return !w.HasSymKey(symID) && w.GetFilter(filterID) == nil }) {
+		t.Fatalf("resources of the disconnected client not deleted.")
+	}
+	api.quotas.mu.Lock()
+	clients := len(api.quotas.clients)
+	api.quotas.mu.Unlock()
+	if clients != 0 {
+		t.Fatalf("usage of the disconnected client not forgotten: %d clients.", clients)
+	}
+}
+
+func TestClientQuotasIdleHTTPClient(t *testing.T) {
+	cfg := DefaultConfig
+	cfg.ClientMaxIdentities = 1
+	w := New(&cfg)
+	api := NewPublicWhisperAPI(w)
+
+	symID, err := w.GenerateSymKey()
+	if err != nil {
+		t.Fatalf("failed to create symmetric key: %s.", err)
+	}
+	idle := &clientUsage{
+		identities: map[string]struct{}{symID: {}},
+		filters:    make(map[string]func(id string)),
+		lastUsed:   time.Now().Add(-httpClientIdleTimeout),
+	}
+	active := &clientUsage{
+		identities: make(map[string]struct{}),
+		filters:    make(map[string]func(id string)),
+		lastUsed:   time.Now(),
+	}
+	api.quotas.clients[httpClient("10.0.0.1")] = idle
+	api.quotas.clients[httpClient("10.0.0.2")] = active
+
+	if _, err = api.NewKeyPair(context.Background()); err != nil {
+		t.Fatalf("failed to create key pair: %s.", err)
+	}
+	api.quotas.mu.Lock()
+	_, forgotten := api.quotas.clients[httpClient("10.0.0.1")]
+	_, kept := api.quotas.clients[httpClient("10.0.0.2")]
+	api.quotas.mu.Unlock()
+	if forgotten {
+		t.Fatalf("usage of the idle HTTP client not forgotten.")
+	}
+	if !kept {
+		t.Fatalf("usage of the active HTTP client forgotten.")
+	}
+	if !waitFor(time.Second, func() bool { return !w.HasSymKey(symID) }) {
+		t.Fatalf("resources of the idle HTTP client not deleted.")
+	}
+}
+
+func TestClientQuotasDisabled(t *testing.T) {
+	api := NewPublicWhisperAPI(New(&DefaultConfig))
+	ctx := context.Background()
+
+	id, err := api.NewKeyPair(ctx)
+	if err != nil {
+		t.Fatalf("failed to create key pair: %s.", err)
+	}
+	if _, err = api.DeleteKeyPair(ctx, id); err != nil {
+		t.Fatalf("failed to delete key pair: %s.", err)
+	}
+	api.quotas.removeFilter(ctx, "unknown")
+	if n := len(api.quotas.clients); n != 0 {
+		t.Fatalf("usage tracked with the quotas disabled: %d clients.", n)
+	}
+}
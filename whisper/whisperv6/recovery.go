@@ -0,0 +1,168 @@
+// Copyright 2017 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+// Contains the recovery of the missed messages from a mail server.
+
+package whisperv6
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/ethereum/go-ethereum/crypto"
+)
+
+const (
+	defaultRecoveryTimeout = 10 * time.Second
+	recoveryPollInterval   = 100 * time.Millisecond
+	maxRecoveryGap         = 1024 // maximum number of messages recovered at once
+)
+
+// MailRequestParams identifies the mail server and the credentials used to
+// request the archived messages from it.
+type MailRequestParams struct {
+	Peer     []byte            // ID of the mail server peer
+	KeySym   []byte            // Symmetric key of the mail server
+	Src      *ecdsa.PrivateKey // Identity signing the requests
+	PoW      float64           // PoW required by the mail server
+	WorkTime uint32            // Time limit of the PoW calculation
+	Timeout  time.Duration     // Time to wait for the archived messages, defaults to 10 seconds
+}
+
+// NewMailRequest creates the envelope requesting the messages archived by the
+// mail server, which were sent within [lower, upper) and match the bloom.
+func NewMailRequest(lower, upper uint32, bloom []byte, params *MailRequestParams) (*Envelope, error) {
+	if params.Src == nil {
+		return nil, errors.New("mail requests must be signed")
+	}
+	data := make([]byte, 8, 8+len(bloom))
+	binary.BigEndian.PutUint32(data, lower)
+	binary.BigEndian.PutUint32(data[4:], upper)
+	data = append(data, bloom...)
+
+	msgParams := &MessageParams{
+		Src:      params.Src,
+		KeySym:   params.KeySym,
+		PoW:      params.PoW,
+		WorkTime: params.WorkTime,
+		Payload:  data,
+	}
+	msg, err := NewSentMessage(msgParams)
+	if err != nil {
+		return nil, err
+	}
+	return msg.Wrap(msgParams)
+}
+
+// GapRecovery reports the outcome of the recovery of a gap.
+type GapRecovery struct {
+	Recovered     []uint64 `json:"recovered"`
+	Unrecoverable []uint64 `json:"unrecoverable"`
+}
+
+// RecoverGap requests the messages of the gap from the mail server, and
+// delivers the recovered ones to the filter. The time range of the request is
+// derived from the messages received around the gap, and only the messages of
+// the sender within the gap are delivered, each of them once.
+func (whisper *Whisper) RecoverGap(ctx context.Context, filterID string, gap *GapEvent, params *MailRequestParams) (*GapRecovery, error) {
+	if gap.From == 0 || gap.From > gap.To {
+		return nil, fmt.Errorf("invalid gap %d-%d", gap.From, gap.To)
+	}
+	if gap.To-gap.From >= maxRecoveryGap {
+		return nil, fmt.Errorf("gap %d-%d too large, at most %d messages can be recovered at once", gap.From, gap.To, maxRecoveryGap)
+	}
+	target := whisper.GetFilter(filterID)
+	if target == nil {
+		return nil, fmt.Errorf("filter %s not found", filterID)
+	}
+	sender := crypto.ToECDSAPub(gap.Sender)
+	if sender == nil {
+		return nil, ErrInvalidSigningPubKey
+	}
+
+	// the archived messages are collected by a private filter
+	collector := &Filter{
+		Src:      sender,
+		KeySym:   target.KeySym,
+		KeyAsym:  target.KeyAsym,
+		Topics:   [][]byte{gap.Topic[:]},
+		PoW:      target.PoW,
+		AllowP2P: true,
+	}
+	collectorID, err := whisper.Subscribe(collector)
+	if err != nil {
+		return nil, err
+	}
+	defer whisper.Unsubscribe(collectorID)
+
+	lower, upper := whisper.sequences.bounds(channelOf(gap.Sender, gap.Topic), gap.From, gap.To)
+	if upper == 0 {
+		upper = uint32(time.Now().Unix())
+	}
+	if upper < math.MaxUint32 {
+		upper++ // the upper bound of the request is exclusive
+	}
+	request, err := NewMailRequest(lower, upper, TopicToBloom(gap.Topic), params)
+	if err != nil {
+		return nil, err
+	}
+	if err = whisper.RequestHistoricMessages(params.Peer, request); err != nil {
+		return nil, err
+	}
+
+	timeout := params.Timeout
+	if timeout == 0 {
+		timeout = defaultRecoveryTimeout
+	}
+	deadline := time.NewTimer(timeout)
+	defer deadline.Stop()
+	ticker := time.NewTicker(recoveryPollInterval)
+	defer ticker.Stop()
+
+	recovered := make(map[uint64]bool)
+loop:
+	for uint64(len(recovered)) <= gap.To-gap.From {
+		select {
+		case <-ticker.C:
+			for _, msg := range collector.Retrieve() {
+				if msg.Seq < gap.From || msg.Seq > gap.To || recovered[msg.Seq] {
+					continue // outside of the gap, or a duplicate
+				}
+				recovered[msg.Seq] = true
+				target.Trigger(msg)
+			}
+		case <-deadline.C:
+			break loop
+		case <-ctx.Done():
+			break loop
+		}
+	}
+
+	result := new(GapRecovery)
+	for i := uint64(0); i <= gap.To-gap.From; i++ {
+		if seq := gap.From + i; recovered[seq] {
+			result.Recovered = append(result.Recovered, seq)
+		} else {
+			result.Unrecoverable = append(result.Unrecoverable, seq)
+		}
+	}
+	return result, nil
+}
@@ -0,0 +1,130 @@
+// Copyright 2017 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package whisperv6
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/p2p"
+	"github.com/ethereum/go-ethereum/p2p/discover"
+)
+
+func TestRecoverGap(t *testing.T) {
+	InitSingleTest()
+
+	w := New(&DefaultConfig)
+	w.SetMinimumPowTest(0.0000001)
+	defer w.SetMinimumPowTest(DefaultMinimumPoW)
+	w.Start(nil)
+	defer w.Stop()
+
+	params, err := generateMessageParams()
+	if err != nil {
+		t.Fatalf("failed generateMessageParams with seed %d: %s.", seed, err)
+	}
+	params.PoW = 0.0000001
+	params.TTL = DefaultTTL
+	filter := &Filter{KeySym: params.KeySym, Topics: [][]byte{params.Topic[:]}}
+	filterID, err := w.Subscribe(filter)
+	if err != nil {
+		t.Fatalf("failed to subscribe with seed %d: %s.", seed, err)
+	}
+	envelopes := make(map[uint64]*Envelope)
+	for seq := uint64(1); seq <= 5; seq++ {
+		params.Seq = seq
+		msg, err := NewSentMessage(params)
+		if err != nil {
+			t.Fatalf("failed to create new message with seed %d: %s.", seed, err)
+		}
+		if envelopes[seq], err = msg.Wrap(params); err != nil {
+			t.Fatalf("failed Wrap with seed %d: %s.", seed, err)
+		}
+	}
+	// the messages 3 and 4 are missed
+	for _, seq := range []uint64{1, 2, 5} {
+		w.filters.NotifyWatchers(envelopes[seq], false)
+	}
+	filter.Retrieve()
+
+	id := discover.NodeID{1}
+	remote, _ := connectTestPeer(t, w, id)
+	defer remote.Close()
+
+	mailKey := make([]byte, aesKeyLength)
+	mailKey[0] = 1
+	client, err := crypto.GenerateKey()
+	if err != nil {
+		t.Fatalf("failed to generate key: %s.", err)
+	}
+	gap := &GapEvent{Sender: crypto.FromECDSAPub(&params.Src.PublicKey), Topic: params.Topic, From: 3, To: 4}
+	mail := &MailRequestParams{Peer: id[:], KeySym: mailKey, Src: client, PoW: 0.0000001, WorkTime: 1, Timeout: 500 * time.Millisecond}
+
+	type result struct {
+		recovery *GapRecovery
+		err      error
+	}
+	done := make(chan result, 1)
+	go func() {
+		recovery, err := w.RecoverGap(context.Background(), filterID, gap, mail)
+		done <- result{recovery, err}
+	}()
+
+	// the request covers the time between the messages around the gap
+	var request Envelope
+	expectPacket(t, remote, p2pRequestCode, &request)
+	decrypted, err := request.OpenSymmetric(mailKey)
+	if err != nil || !decrypted.ValidateAndParse() {
+		t.Fatalf("failed to open mail request: %v.", err)
+	}
+	lower := binary.BigEndian.Uint32(decrypted.Payload)
+	upper := binary.BigEndian.Uint32(decrypted.Payload[4:])
+	if sent := envelopes[2].Expiry - envelopes[2].TTL; lower != sent {
+		t.Fatalf("wrong lower bound of the mail request: %d, want %d.", lower, sent)
+	}
+	if sent := envelopes[5].Expiry - envelopes[5].TTL; upper != sent+1 {
+		t.Fatalf("wrong upper bound of the mail request: %d, want %d.", upper, sent+1)
+	}
+	if !bytes.Equal(decrypted.Payload[8:], TopicToBloom(params.Topic)) {
+		t.Fatalf("wrong bloom filter of the mail request.")
+	}
+
+	// the mail server delivers the whole time range, including a duplicate
+	for _, seq := range []uint64{2, 3, 3, 5} {
+		if err = p2p.Send(remote, p2pMessageCode, envelopes[seq]); err != nil {
+			t.Fatalf("failed to send archived message: %s.", err)
+		}
+	}
+
+	res := <-done
+	if res.err != nil {
+		t.Fatalf("failed to recover gap with seed %d: %s.", seed, res.err)
+	}
+	if len(res.recovery.Recovered) != 1 || res.recovery.Recovered[0] != 3 {
+		t.Fatalf("wrong recovered messages with seed %d: %v.", seed, res.recovery.Recovered)
+	}
+	if len(res.recovery.Unrecoverable) != 1 || res.recovery.Unrecoverable[0] != 4 {
+		t.Fatalf("wrong unrecoverable messages with seed %d: %v.", seed, res.recovery.Unrecoverable)
+	}
+	if received := filter.Retrieve(); len(received) != 1 || received[0].Seq != 3 {
+		t.Fatalf("recovered message not delivered once with seed %d: %d messages.", seed, len(received))
+	}
+}
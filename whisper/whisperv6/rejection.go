@@ -0,0 +1,136 @@
+// Copyright 2017 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+// Contains the rejection notices. Optionally the node tells the peer why its
+// envelopes were rejected, instead of dropping them silently, which helps the
+// honest peers to debug the configuration mismatches (e.g. the PoW or the
+// message size limits). The notices are rate limited in both directions, and
+// the notices are never answered with other notices.
+
+package whisperv6
+
+import (
+	"sync"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/event"
+	"github.com/ethereum/go-ethereum/p2p"
+	"github.com/ethereum/go-ethereum/p2p/discover"
+)
+
+// rejectionLimit is the maximum number of the notices sent to, or accepted
+// from, a single peer per second.
+const rejectionLimit = 16
+
+// rejectionReasons maps the compact reason codes of the notices to the drop
+// reasons. The code zero is reserved for the reasons unknown to the node.
+var rejectionReasons = []DropReason{
+	"",
+	DropReasonFuture,
+	DropReasonVeryOld,
+	DropReasonExpired,
+	DropReasonOversized,
+	DropReasonLowPoW,
+	DropReasonBloomMismatch,
+	DropReasonMalformed,
+}
+
+// rejectionNotice tells the peer that its envelope was rejected.
+type rejectionNotice struct {
+	Hash   common.Hash
+	Reason uint8
+}
+
+// rejectionReasonCode returns the compact code of the drop reason.
+func rejectionReasonCode(reason DropReason) uint8 {
+	for i, r := range rejectionReasons {
+		if i > 0 && r == reason {
+			return uint8(i)
+		}
+	}
+	return 0
+}
+
+// RejectionEvent is an event emitted when a peer notifies the node that one
+// of the envelopes sent to it was rejected.
+type RejectionEvent struct {
+	Peer   discover.NodeID `json:"peer"`
+	Hash   common.Hash     `json:"hash"`
+	Reason DropReason      `json:"reason"` // empty if unknown to the node
+}
+
+// SubscribeRejectionEvents subscribes the given channel to the rejection
+// notices received from the peers.
+func (whisper *Whisper) SubscribeRejectionEvents(ch chan<- *RejectionEvent) event.Subscription {
+	return whisper.track(whisper.rejectionFeed.Subscribe(ch))
+}
+
+// rejectionLimiter counts the notices within a window of one second.
+type rejectionLimiter struct {
+	mu     sync.Mutex
+	window time.Time
+	count  int
+}
+
+// allow reserves up to n notices, returning the number actually allowed.
+func (l *rejectionLimiter) allow(n int) int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if now := time.Now(); now.Sub(l.window) >= time.Second {
+		l.window, l.count = now, 0
+	}
+	if left := rejectionLimit - l.count; n > left {
+		n = left
+	}
+	l.count += n
+	return n
+}
+
+// rejection creates the notice for the envelope rejected with the error,
+// reporting false if the error is not a drop.
+func rejection(envelope *Envelope, err error) (rejectionNotice, bool) {
+	drop, ok := err.(*dropError)
+	if !ok {
+		return rejectionNotice{}, false
+	}
+	return rejectionNotice{Hash: envelope.Hash(), Reason: rejectionReasonCode(drop.reason)}, true
+}
+
+// sendRejections notifies the peer about its rejected envelopes, within the
+// rate limit. The notices above the limit are dropped.
+func (peer *Peer) sendRejections(notices []rejectionNotice) error {
+	notices = notices[:peer.rejectionsOut.allow(len(notices))]
+	if len(notices) == 0 {
+		return nil
+	}
+	return p2p.Send(peer.ws, rejectionNoticeCode, notices)
+}
+
+// handleRejections emits the events of the notices received from the peer,
+// within the rate limit. The notices above the limit are ignored.
+func (peer *Peer) handleRejections(notices []rejectionNotice) {
+	notices = notices[:peer.rejectionsIn.allow(len(notices))]
+	for _, n := range notices {
+		ev := &RejectionEvent{Peer: peer.peer.ID(), Hash: n.Hash}
+		if int(n.Reason) < len(rejectionReasons) {
+			ev.Reason = rejectionReasons[n.Reason]
+		}
+		peer.log.Debug("envelope rejected by the peer", "hash", n.Hash.Hex(), "reason", ev.Reason)
+		peer.host.rejectionFeed.Send(ev)
+	}
+}
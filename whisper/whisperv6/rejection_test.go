@@ -0,0 +1,101 @@
+// Copyright 2017 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package whisperv6
+
+import (
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/p2p"
+	"github.com/ethereum/go-ethereum/p2p/discover"
+)
+
+func TestRejectionNotices(t *testing.T) {
+	InitSingleTest()
+
+	cfg := DefaultConfig
+	cfg.RejectionNotices = true
+	cfg.MinimumAcceptedPOW = 1000000.0
+	w := New(&cfg)
+	w.Start(nil)
+	defer w.Stop()
+
+	remote, errc := connectTestPeer(t, w, discover.NodeID{1})
+	defer func() {
+		remote.Close()
+		<-errc
+	}()
+
+	// the low PoW is tolerated during the warm-up, but still notified
+	now := uint32(time.Now().Unix())
+	env := &Envelope{Expiry: now + DefaultTTL, TTL: DefaultTTL, Data: []byte{1}, Nonce: uint64(seed)}
+	if err := p2p.Send(remote, messagesCode, []*Envelope{env}); err != nil {
+		t.Fatalf("failed to send envelope with seed %d: %s.", seed, err)
+	}
+	var notices []rejectionNotice
+	expectPacket(t, remote, rejectionNoticeCode, &notices)
+	if len(notices) != 1 || notices[0].Hash != env.Hash() || rejectionReasons[notices[0].Reason] != DropReasonLowPoW {
+		t.Fatalf("wrong rejection notices: %v.", notices)
+	}
+}
+
+func TestRejectionEvents(t *testing.T) {
+	w := New(&DefaultConfig)
+	w.Start(nil)
+	defer w.Stop()
+
+	events := make(chan *RejectionEvent, 2*rejectionLimit)
+	sub := w.SubscribeRejectionEvents(events)
+	defer sub.Unsubscribe()
+
+	id := discover.NodeID{1}
+	remote, errc := connectTestPeer(t, w, id)
+	defer func() {
+		remote.Close()
+		<-errc
+	}()
+
+	notices := make([]rejectionNotice, 2*rejectionLimit)
+	for i := range notices {
+		notices[i] = rejectionNotice{Hash: common.Hash{byte(i)}, Reason: rejectionReasonCode(DropReasonOversized)}
+	}
+	notices[0].Reason = 200
+	if err := p2p.Send(remote, rejectionNoticeCode, notices); err != nil {
+		t.Fatalf("failed to send rejection notices: %s.", err)
+	}
+
+	for i := 0; i < rejectionLimit; i++ {
+		select {
+		case ev := <-events:
+			want := DropReasonOversized
+			if i == 0 {
+				want = ""
+			}
+			if ev.Peer != id || ev.Hash != notices[i].Hash || ev.Reason != want {
+				t.Fatalf("wrong rejection event %d: %v.", i, ev)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("rejection event %d timed out.", i)
+		}
+	}
+	select {
+	case ev := <-events:
+		t.Fatalf("rejection event above the rate limit: %v.", ev)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
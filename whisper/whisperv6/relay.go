@@ -0,0 +1,568 @@
+// Copyright 2017 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+// +build !whisperlite
+
+// Contains the relay serving the browser clients over websocket, so that the
+// web dapps can take part in the whisper network without running a full node
+// or posting through the RPC of a centralized one.
+//
+// The relay speaks a reduced version of the protocol: the clients post the
+// envelopes, and advertise their bloom filter and PoW requirement, while the
+// relay forwards the matching envelopes of the pool, and announces its own
+// requirements on connect and whenever they change, within the allowance the
+// peers get as well. The envelopes posted by the clients are validated
+// and propagated exactly as the ones received from the devp2p peers. The
+// clients are anonymous, so the relay refuses them all on the nodes admitting
+// only the allowlisted peers, which would otherwise be bypassed. The clients
+// declare the envelope flags they understand in the "flags" query parameter of
+// the websocket URL, like the peers do in their status, and only the envelopes
+// carrying no other flags are forwarded to them.
+//
+// Every packet is carried in a single websocket frame, in one of two formats
+// negotiated as the websocket sub-protocol. The JSON frames are objects with
+// the packet code and its fields, hex encoding the binary values. The RLP frames
+// are lists of the packet code and its devp2p payload, so the clients may reuse
+// the devp2p encoders (the status payload is a list of the PoW requirement and
+// the bloom filter).
+
+package whisperv6
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/log"
+	"github.com/ethereum/go-ethereum/rlp"
+	"golang.org/x/net/websocket"
+)
+
+// The websocket sub-protocols of the relay.
+const (
+	RelayProtocolJSON = "shh-json" // JSON frames (the default)
+	RelayProtocolRLP  = "shh-rlp"  // RLP frames
+)
+
+const (
+	relayQueueLimit   = 256              // number of envelopes awaiting the delivery to a single client
+	relayMaxClients   = 64               // default maximum number of the connected clients
+	relayWriteTimeout = 10 * time.Second // time allowed to deliver a single frame to a client
+)
+
+var (
+	errRelayFull       = errors.New("too many relay clients")
+	errRelayRestricted = errors.New("relay clients refused by the peer allowlist")
+)
+
+// relayPacket is a single packet exchanged with a client, decoded from either
+// frame format. Only the fields of the given code are meaningful.
+type relayPacket struct {
+	code      uint64
+	envelopes []*Envelope
+	bloom     []byte
+	pow       float64
+}
+
+// relayCodec reads and writes the packets in one of the frame formats.
+type relayCodec interface {
+	read(conn *websocket.Conn) (*relayPacket, error)
+	write(conn *websocket.Conn, packet *relayPacket) error
+}
+
+// relayEnvelope is the JSON representation of an envelope.
+type relayEnvelope struct {
+	Expiry uint32         `json:"expiry"`
+	TTL    uint32         `json:"ttl"`
+	Topic  TopicType      `json:"topic"`
+	Data   hexutil.Bytes  `json:"data"`
+	Nonce  hexutil.Uint64 `json:"nonce"`
+	Flags  []uint64       `json:"flags,omitempty"`
+}
+
+// relayJSONFrame is the JSON representation of a packet.
+type relayJSONFrame struct {
+	Code      uint64           `json:"code"`
+	Envelopes []*relayEnvelope `json:"envelopes,omitempty"`
+	Bloom     hexutil.Bytes    `json:"bloom,omitempty"`
+	PoW       float64          `json:"pow,omitempty"`
+}
+
+type jsonRelayCodec struct{}
+
+func (jsonRelayCodec) read(conn *websocket.Conn) (*relayPacket, error) {
+	var frame relayJSONFrame
+	if err := websocket.JSON.Receive(conn, &frame); err != nil {
+		return nil, err
+	}
+	packet := &relayPacket{code: frame.Code, bloom: frame.Bloom, pow: frame.PoW}
+	for _, e := range frame.Envelopes {
+		if e == nil {
+			return nil, errors.New("null envelope")
+		}
+		packet.envelopes = append(packet.envelopes, &Envelope{
+			Expiry: e.Expiry,
+			TTL:    e.TTL,
+			Topic:  e.Topic,
+			Data:   e.Data,
+			Nonce:  uint64(e.Nonce),
+			Flags:  e.Flags,
+		})
+	}
+	return packet, nil
+}
+
+func (jsonRelayCodec) write(conn *websocket.Conn, packet *relayPacket) error {
+	frame := &relayJSONFrame{Code: packet.code, Bloom: packet.bloom, PoW: packet.pow}
+	for _, e := range packet.envelopes {
+		frame.Envelopes = append(frame.Envelopes, &relayEnvelope{
+			Expiry: e.Expiry,
+			TTL:    e.TTL,
+			Topic:  e.Topic,
+			Data:   e.Data,
+			Nonce:  hexutil.Uint64(e.Nonce),
+			Flags:  e.Flags,
+		})
+	}
+	return websocket.JSON.Send(conn, frame)
+}
+
+// relayRLPFrame is the RLP representation of a packet.
+type relayRLPFrame struct {
+	Code    uint64
+	Payload rlp.RawValue
+}
+
+// relayStatus is the RLP payload of the status packet.
+type relayStatus struct {
+	PoW   uint64 // math.Float64bits of the PoW requirement
+	Bloom []byte
+}
+
+type rlpRelayCodec struct{}
+
+func (rlpRelayCodec) read(conn *websocket.Conn) (*relayPacket, error) {
+	var data []byte
+	if err := websocket.Message.Receive(conn, &data); err != nil {
+		return nil, err
+	}
+	var frame relayRLPFrame
+	if err := rlp.DecodeBytes(data, &frame); err != nil {
+		return nil, err
+	}
+	packet := &relayPacket{code: frame.Code}
+	var err error
+	switch frame.Code {
+	case statusCode:
+		var status relayStatus
+		err = rlp.DecodeBytes(frame.Payload, &status)
+		packet.pow, packet.bloom = math.Float64frombits(status.PoW), status.Bloom
+	case messagesCode:
+		err = rlp.DecodeBytes(frame.Payload, &packet.envelopes)
+	case powRequirementCode:
+		var bits uint64
+		err = rlp.DecodeBytes(frame.Payload, &bits)
+		packet.pow = math.Float64frombits(bits)
+	case bloomFilterExCode:
+		err = rlp.DecodeBytes(frame.Payload, &packet.bloom)
+	}
+	return packet, err
+}
+
+func (rlpRelayCodec) write(conn *websocket.Conn, packet *relayPacket) error {
+	var payload interface{}
+	switch packet.code {
+	case statusCode:
+		payload = &relayStatus{PoW: math.Float64bits(packet.pow), Bloom: packet.bloom}
+	case messagesCode:
+		payload = packet.envelopes
+	case powRequirementCode:
+		payload = math.Float64bits(packet.pow)
+	case bloomFilterExCode:
+		payload = packet.bloom
+	default:
+		return fmt.Errorf("unsupported relay packet code %d", packet.code)
+	}
+	raw, err := rlp.EncodeToBytes(payload)
+	if err != nil {
+		return err
+	}
+	data, err := rlp.EncodeToBytes(&relayRLPFrame{Code: packet.code, Payload: raw})
+	if err != nil {
+		return err
+	}
+	return websocket.Message.Send(conn, data)
+}
+
+// relayClient is a single browser client connected to the relay.
+type relayClient struct {
+	conn  *websocket.Conn
+	codec relayCodec
+	queue chan *Envelope // envelopes of the pool awaiting the delivery
+
+	bloomParams BloomParams // Parameters of the bloom filters, the ones of the node
+	flags       uint64      // Envelope flags understood by the client
+
+	mu    sync.Mutex
+	bloom []byte                 // Bloom filter of the client (nothing is delivered before it is advertised)
+	pow   float64                // PoW requirement of the client
+	own   map[common.Hash]uint32 // Expiry of the envelopes posted by the client, not to be echoed back
+}
+
+// wants reports if the envelope should be delivered to the client.
+func (c *relayClient) wants(envelope *Envelope) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.own[envelope.Hash()]; ok {
+		return false
+	}
+	if c.bloom == nil || envelope.PoW() < c.pow {
+		return false
+	}
+	if envelope.flags()&^c.flags != 0 {
+		return false
+	}
+	return BloomFilterMatch(c.bloom, c.bloomParams.envelopeBloom(envelope))
+}
+
+// expire forgets the posted envelopes which expired.
+func (c *relayClient) expire(now uint32) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for hash, expiry := range c.own {
+		if expiry < now {
+			delete(c.own, hash)
+		}
+	}
+}
+
+// Relay serves the browser clients over websocket, translating between them
+// and the devp2p network of the node. It implements http.Handler, so it can be
+// mounted on any HTTP server, or started on its own address along with the node
+// (see Config.WebSocketRelay).
+type Relay struct {
+	whisper    *Whisper
+	maxClients int
+	server     websocket.Server
+
+	mu      sync.Mutex
+	clients map[*relayClient]struct{}
+	running bool
+	quit    chan struct{}
+	wg      sync.WaitGroup
+}
+
+// NewRelay creates a relay for the node, accepting at most the given number
+// of clients (zero means the default).
+func NewRelay(whisper *Whisper, maxClients int) *Relay {
+	if maxClients == 0 {
+		maxClients = relayMaxClients
+	}
+	relay := &Relay{
+		whisper:    whisper,
+		maxClients: maxClients,
+		clients:    make(map[*relayClient]struct{}),
+	}
+	// the dapps are served from any origin, so the origin is not checked
+	relay.server = websocket.Server{Handshake: relay.handshake, Handler: relay.serve}
+	return relay
+}
+
+// Start starts forwarding the envelopes of the pool to the clients. The node
+// must be started before.
+func (relay *Relay) Start() {
+	relay.mu.Lock()
+	defer relay.mu.Unlock()
+
+	relay.quit = make(chan struct{})
+	relay.running = true
+	ch := make(chan *Envelope, relayQueueLimit)
+	sub := relay.whisper.SubscribeEnvelopes(ch)
+
+	relay.wg.Add(1)
+	go func() {
+		defer relay.wg.Done()
+		defer sub.Unsubscribe()
+		relay.dispatch(ch, sub.Err())
+	}()
+}
+
+// Stop disconnects all the clients and stops the relay.
+func (relay *Relay) Stop() {
+	relay.mu.Lock()
+	if !relay.running {
+		relay.mu.Unlock()
+		return
+	}
+	relay.running = false
+	close(relay.quit)
+	for c := range relay.clients {
+		c.conn.Close()
+	}
+	relay.mu.Unlock()
+	relay.wg.Wait()
+}
+
+// ServeHTTP implements http.Handler, upgrading the request to the websocket.
+func (relay *Relay) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	relay.server.ServeHTTP(w, r)
+}
+
+// Clients returns the number of the connected clients.
+func (relay *Relay) Clients() int {
+	relay.mu.Lock()
+	defer relay.mu.Unlock()
+	return len(relay.clients)
+}
+
+// handshake selects the frame format among the sub-protocols requested by the
+// client, defaulting to JSON if none was requested.
+func (relay *Relay) handshake(config *websocket.Config, req *http.Request) error {
+	if len(config.Protocol) == 0 {
+		return nil
+	}
+	for _, protocol := range config.Protocol {
+		if protocol == RelayProtocolJSON || protocol == RelayProtocolRLP {
+			config.Protocol = []string{protocol}
+			return nil
+		}
+	}
+	return fmt.Errorf("unsupported relay sub-protocols %v", config.Protocol)
+}
+
+// register adds the client to the relay, unless it is stopped or full.
+func (relay *Relay) register(c *relayClient) error {
+	relay.mu.Lock()
+	defer relay.mu.Unlock()
+	if !relay.running {
+		return errors.New("relay not running")
+	}
+	if relay.whisper.peerAllow != nil {
+		return errRelayRestricted
+	}
+	if len(relay.clients) >= relay.maxClients {
+		return errRelayFull
+	}
+	relay.clients[c] = struct{}{}
+	relay.wg.Add(1)
+	return nil
+}
+
+func (relay *Relay) unregister(c *relayClient) {
+	relay.mu.Lock()
+	delete(relay.clients, c)
+	relay.mu.Unlock()
+	relay.wg.Done()
+}
+
+// serve runs the session of a single client, until either side disconnects.
+func (relay *Relay) serve(conn *websocket.Conn) {
+	defer conn.Close()
+
+	c := &relayClient{
+		conn:  conn,
+		codec: jsonRelayCodec{},
+		queue: make(chan *Envelope, relayQueueLimit),
+		own:   make(map[common.Hash]uint32),
+
+		bloomParams: relay.whisper.bloomParams,
+	}
+	logger := relay.whisper.Logger(LogSubsystemPeer).New("relay", conn.Request().RemoteAddr)
+	if flags := conn.Request().URL.Query().Get("flags"); flags != "" {
+		var err error
+		if c.flags, err = strconv.ParseUint(flags, 0, 64); err != nil {
+			logger.Debug("relay client rejected, invalid envelope flags", "flags", flags)
+			return
+		}
+	}
+	if protocol := conn.Config().Protocol; len(protocol) > 0 && protocol[0] == RelayProtocolRLP {
+		conn.PayloadType = websocket.BinaryFrame
+		c.codec = rlpRelayCodec{}
+	}
+	conn.MaxPayloadBytes = int(relay.whisper.MaxMessageSize())
+
+	if err := relay.register(c); err != nil {
+		logger.Debug("relay client rejected", "err", err)
+		return
+	}
+	defer relay.unregister(c)
+	logger.Debug("relay client connected")
+
+	done := make(chan struct{})
+	defer close(done)
+	go relay.deliver(c, done)
+
+	for {
+		packet, err := c.codec.read(conn)
+		if err != nil {
+			logger.Debug("relay client disconnected", "err", err)
+			return
+		}
+		if err := relay.handle(c, packet); err != nil {
+			logger.Warn("invalid relay packet, client will be disconnected", "err", err)
+			return
+		}
+	}
+}
+
+// handle processes a single packet of the client, the same way as the packets
+// of the devp2p peers. Invalid packets disconnect the client.
+func (relay *Relay) handle(c *relayClient, packet *relayPacket) error {
+	switch packet.code {
+	case messagesCode:
+		for _, envelope := range packet.envelopes {
+			c.mu.Lock()
+			c.own[envelope.Hash()] = envelope.Expiry
+			c.mu.Unlock()
+			if _, err := relay.whisper.add(envelope, false); err != nil {
+				return err
+			}
+		}
+	case powRequirementCode:
+		if math.IsInf(packet.pow, 0) || math.IsNaN(packet.pow) || packet.pow < 0 {
+			return fmt.Errorf("invalid PoW requirement %f", packet.pow)
+		}
+		c.mu.Lock()
+		c.pow = packet.pow
+		c.mu.Unlock()
+	case bloomFilterExCode:
+		// the clients use the bloom filters of the node, as announced on connect
+		if len(packet.bloom) != relay.whisper.bloomParams.Size {
+			return fmt.Errorf("wrong bloom filter size %d", len(packet.bloom))
+		}
+		c.mu.Lock()
+		c.bloom = packet.bloom
+		c.mu.Unlock()
+	default:
+		// the packets of the newer versions are ignored, as by the peers
+	}
+	return nil
+}
+
+// deliver announces the requirements of the node to the client, and writes
+// the envelopes queued for it, until the session is over.
+func (relay *Relay) deliver(c *relayClient, done <-chan struct{}) {
+	defer c.conn.Close() // unblocks the reader if a write failed
+
+	pow, bloom := relay.whisper.MinPow(), relay.whisper.BloomFilter()
+	status := &relayPacket{code: statusCode, pow: pow, bloom: bloom}
+	if err := relay.write(c, status); err != nil {
+		return
+	}
+	expire := time.NewTicker(expirationCycle)
+	defer expire.Stop()
+
+	for {
+		select {
+		case envelope := <-c.queue:
+			if err := relay.write(c, &relayPacket{code: messagesCode, envelopes: []*Envelope{envelope}}); err != nil {
+				return
+			}
+		case <-expire.C:
+			c.expire(uint32(time.Now().Unix()))
+
+			// the changed requirements are announced well within the sync
+			// allowance, during which the node still tolerates the old ones
+			if current := relay.whisper.MinPow(); current != pow {
+				pow = current
+				if err := relay.write(c, &relayPacket{code: powRequirementCode, pow: pow}); err != nil {
+					return
+				}
+			}
+			if current := relay.whisper.BloomFilter(); !bytes.Equal(current, bloom) {
+				bloom = current
+				if err := relay.write(c, &relayPacket{code: bloomFilterExCode, bloom: bloom}); err != nil {
+					return
+				}
+			}
+		case <-done:
+			return
+		}
+	}
+}
+
+func (relay *Relay) write(c *relayClient, packet *relayPacket) error {
+	c.conn.SetWriteDeadline(time.Now().Add(relayWriteTimeout))
+	return c.codec.write(c.conn, packet)
+}
+
+// dispatch queues the envelopes newly added to the pool for the interested
+// clients, until the relay or the node is stopped. The subscription must not
+// be blocked by a slow client, so the envelopes not fitting into its queue are
+// dropped.
+func (relay *Relay) dispatch(ch <-chan *Envelope, errc <-chan error) {
+	for {
+		select {
+		case envelope := <-ch:
+			// the clients are outside of the node, subject to the default routing
+			if !relay.whisper.routing.forwards(DefaultPeerGroup, envelope) {
+				continue
+			}
+			relay.mu.Lock()
+			for c := range relay.clients {
+				if !c.wants(envelope) {
+					continue
+				}
+				select {
+				case c.queue <- envelope:
+				default:
+					relay.whisper.poolLog.Debug("relay client queue overflow", "client", c.conn.Request().RemoteAddr)
+				}
+			}
+			relay.mu.Unlock()
+		case <-errc:
+			return
+		case <-relay.quit:
+			return
+		}
+	}
+}
+
+// relayServer is the relay started on its own address along with the node.
+type relayServer struct {
+	relay  *Relay
+	server *http.Server
+}
+
+// startRelay starts the relay on the configured address.
+func (whisper *Whisper) startRelay() error {
+	listener, err := net.Listen("tcp", whisper.relayAddr)
+	if err != nil {
+		return err
+	}
+	relay := NewRelay(whisper, whisper.relayMaxClients)
+	relay.Start()
+	server := &http.Server{Handler: relay}
+	go server.Serve(listener)
+
+	whisper.relay = &relayServer{relay: relay, server: server}
+	log.Info("whisper websocket relay started", "addr", listener.Addr())
+	return nil
+}
+
+func (s *relayServer) Close() error {
+	err := s.server.Close()
+	s.relay.Stop()
+	return err
+}
@@ -0,0 +1,364 @@
+// Copyright 2017 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+// +build !whisperlite
+
+package whisperv6
+
+import (
+	"bytes"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/p2p/discover"
+	"golang.org/x/net/websocket"
+)
+
+func TestRelay(t *testing.T) {
+	InitSingleTest()
+
+	w := New(&DefaultConfig)
+	w.SetMinimumPowTest(0.0000001)
+	w.Start(nil)
+	defer w.Stop()
+
+	relay := NewRelay(w, 0)
+	relay.Start()
+	defer relay.Stop()
+	server := httptest.NewServer(relay)
+	defer server.Close()
+	url := "ws" + strings.TrimPrefix(server.URL, "http")
+
+	for i, protocol := range []string{RelayProtocolJSON, RelayProtocolRLP} {
+		conn, err := websocket.Dial(url, protocol, "http://localhost/")
+		if err != nil {
+			t.Fatalf("failed to dial relay over %s with seed %d: %s.", protocol, seed, err)
+		}
+		defer conn.Close()
+		var codec relayCodec = jsonRelayCodec{}
+		if protocol == RelayProtocolRLP {
+			conn.PayloadType = websocket.BinaryFrame
+			codec = rlpRelayCodec{}
+		}
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+		status, err := codec.read(conn)
+		if err != nil || status.code != statusCode {
+			t.Fatalf("failed to read relay status over %s with seed %d: %v.", protocol, seed, err)
+		}
+		if status.pow != w.MinPow() {
+			t.Fatalf("wrong PoW requirement announced over %s with seed %d: %f.", protocol, seed, status.pow)
+		}
+		if err := codec.write(conn, &relayPacket{code: bloomFilterExCode, bloom: MakeFullNodeBloom()}); err != nil {
+			t.Fatalf("failed to send bloom filter over %s with seed %d: %s.", protocol, seed, err)
+		}
+
+		// the envelope posted by the client is added to the pool, but not echoed back
+		now := uint32(time.Now().Unix())
+		posted := &Envelope{Expiry: now + DefaultTTL, TTL: DefaultTTL, Topic: TopicType{0xc1, byte(i)}, Data: []byte{1, 2, 3}, Nonce: uint64(seed)}
+		if err := codec.write(conn, &relayPacket{code: messagesCode, envelopes: []*Envelope{posted}}); err != nil {
+			t.Fatalf("failed to post envelope over %s with seed %d: %s.", protocol, seed, err)
+		}
+		if !waitFor(5*time.Second, func() bool { return w.isEnvelopeCached(posted.Hash()) }) {
+			t.Fatalf("posted envelope not added to the pool over %s with seed %d.", protocol, seed)
+		}
+
+		// the envelopes of the network are delivered to the client
+		env := &Envelope{Expiry: now + DefaultTTL, TTL: DefaultTTL, Topic: TopicType{0xc2, byte(i)}, Data: []byte{4, 5, 6}, Nonce: uint64(seed)}
+		if err := w.Send(env); err != nil {
+			t.Fatalf("failed to send envelope with seed %d: %s.", seed, err)
+		}
+		packet, err := codec.read(conn)
+		if err != nil {
+			t.Fatalf("failed to read envelope over %s with seed %d: %s.", protocol, seed, err)
+		}
+		if packet.code != messagesCode || len(packet.envelopes) != 1 || packet.envelopes[0].Hash() != env.Hash() {
+			t.Fatalf("wrong envelope delivered over %s with seed %d: %+v.", protocol, seed, packet)
+		}
+		if !bytes.Equal(packet.envelopes[0].Data, env.Data) {
+			t.Fatalf("envelope data mangled over %s with seed %d.", protocol, seed)
+		}
+	}
+	if n := relay.Clients(); n != 2 {
+		t.Fatalf("wrong number of relay clients with seed %d: %d.", seed, n)
+	}
+}
+
+func TestRelayRejectsInvalid(t *testing.T) {
+	InitSingleTest()
+
+	w := New(&DefaultConfig)
+	w.Start(nil)
+	defer w.Stop()
+
+	relay := NewRelay(w, 1)
+	relay.Start()
+	defer relay.Stop()
+	server := httptest.NewServer(relay)
+	defer server.Close()
+	url := "ws" + strings.TrimPrefix(server.URL, "http")
+
+	if _, err := websocket.Dial(url, "shh-xml", "http://localhost/"); err == nil {
+		t.Fatalf("unsupported sub-protocol accepted with seed %d.", seed)
+	}
+	conn, err := websocket.Dial(url, "", "http://localhost/")
+	if err != nil {
+		t.Fatalf("failed to dial relay with seed %d: %s.", seed, err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := (jsonRelayCodec{}).read(conn); err != nil {
+		t.Fatalf("failed to read relay status with seed %d: %s.", seed, err)
+	}
+
+	// the relay is full
+	second, err := websocket.Dial(url, "", "http://localhost/")
+	if err == nil {
+		second.SetReadDeadline(time.Now().Add(5 * time.Second))
+		if _, err := (jsonRelayCodec{}).read(second); err == nil {
+			t.Fatalf("client accepted over the limit with seed %d.", seed)
+		}
+		second.Close()
+	}
+
+	// a malformed bloom filter disconnects the client
+	if err := (jsonRelayCodec{}).write(conn, &relayPacket{code: bloomFilterExCode, bloom: []byte{1, 2}}); err != nil {
+		t.Fatalf("failed to send bloom filter with seed %d: %s.", seed, err)
+	}
+	if _, err := (jsonRelayCodec{}).read(conn); err == nil {
+		t.Fatalf("client not disconnected after invalid bloom filter with seed %d.", seed)
+	}
+	if !waitFor(5*time.Second, func() bool { return relay.Clients() == 0 }) {
+		t.Fatalf("disconnected client not unregistered with seed %d.", seed)
+	}
+}
+
+func TestRelayBloomParams(t *testing.T) {
+	InitSingleTest()
+
+	cfg := DefaultConfig
+	cfg.BloomFilterSize = 128
+	w := New(&cfg)
+	w.SetMinimumPowTest(0.0000001)
+	w.Start(nil)
+	defer w.Stop()
+
+	relay := NewRelay(w, 0)
+	relay.Start()
+	defer relay.Stop()
+	server := httptest.NewServer(relay)
+	defer server.Close()
+	url := "ws" + strings.TrimPrefix(server.URL, "http")
+
+	dial := func() *websocket.Conn {
+		conn, err := websocket.Dial(url, "", "http://localhost/")
+		if err != nil {
+			t.Fatalf("failed to dial relay with seed %d: %s.", seed, err)
+		}
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		if _, err := (jsonRelayCodec{}).read(conn); err != nil {
+			t.Fatalf("failed to read relay status with seed %d: %s.", seed, err)
+		}
+		return conn
+	}
+
+	// the bloom filter of the protocol default size does not fit the node
+	conn := dial()
+	defer conn.Close()
+	if err := (jsonRelayCodec{}).write(conn, &relayPacket{code: bloomFilterExCode, bloom: MakeFullNodeBloom()}); err != nil {
+		t.Fatalf("failed to send bloom filter with seed %d: %s.", seed, err)
+	}
+	if _, err := (jsonRelayCodec{}).read(conn); err == nil {
+		t.Fatalf("bloom filter of the default size accepted with seed %d.", seed)
+	}
+
+	topic := TopicType{0xc3, 0x01}
+	conn = dial()
+	defer conn.Close()
+	if err := (jsonRelayCodec{}).write(conn, &relayPacket{code: bloomFilterExCode, bloom: w.BloomParams().TopicToBloom(topic)}); err != nil {
+		t.Fatalf("failed to send bloom filter with seed %d: %s.", seed, err)
+	}
+	accepted := func() bool {
+		relay.mu.Lock()
+		defer relay.mu.Unlock()
+		for c := range relay.clients {
+			c.mu.Lock()
+			defer c.mu.Unlock()
+			return c.bloom != nil
+		}
+		return false
+	}
+	if !waitFor(5*time.Second, accepted) {
+		t.Fatalf("bloom filter of the node not accepted with seed %d.", seed)
+	}
+	now := uint32(time.Now().Unix())
+	env := &Envelope{Expiry: now + DefaultTTL, TTL: DefaultTTL, Topic: topic, Data: []byte{1, 2, 3}, Nonce: uint64(seed)}
+	if err := w.Send(env); err != nil {
+		t.Fatalf("failed to send envelope with seed %d: %s.", seed, err)
+	}
+	packet, err := (jsonRelayCodec{}).read(conn)
+	if err != nil || packet.code != messagesCode || len(packet.envelopes) != 1 || packet.envelopes[0].Hash() != env.Hash() {
+		t.Fatalf("envelope matching the bloom filter not delivered with seed %d: %v.", seed, err)
+	}
+}
+
+func TestRelayPeerAllowlist(t *testing.T) {
+	InitSingleTest()
+
+	cfg := DefaultConfig
+	cfg.PeerAllowlist = []discover.NodeID{{1}}
+	w := New(&cfg)
+	w.Start(nil)
+	defer w.Stop()
+
+	relay := NewRelay(w, 0)
+	relay.Start()
+	defer relay.Stop()
+	server := httptest.NewServer(relay)
+	defer server.Close()
+	url := "ws" + strings.TrimPrefix(server.URL, "http")
+
+	conn, err := websocket.Dial(url, "", "http://localhost/")
+	if err == nil {
+		defer conn.Close()
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		if _, err := (jsonRelayCodec{}).read(conn); err == nil {
+			t.Fatalf("relay client accepted despite the peer allowlist with seed %d.", seed)
+		}
+	}
+	if n := relay.Clients(); n != 0 {
+		t.Fatalf("wrong number of relay clients with seed %d: %d.", seed, n)
+	}
+}
+
+func TestRelayEnvelopeFlags(t *testing.T) {
+	InitSingleTest()
+
+	w := New(&DefaultConfig)
+	w.SetMinimumPowTest(0.0000001)
+	w.Start(nil)
+	defer w.Stop()
+
+	relay := NewRelay(w, 0)
+	relay.Start()
+	defer relay.Stop()
+	server := httptest.NewServer(relay)
+	defer server.Close()
+	url := "ws" + strings.TrimPrefix(server.URL, "http")
+
+	if conn, err := websocket.Dial(url+"/?flags=seq", "", "http://localhost/"); err == nil {
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		if _, err := (jsonRelayCodec{}).read(conn); err == nil {
+			t.Fatalf("relay client accepted with invalid envelope flags with seed %d.", seed)
+		}
+		conn.Close()
+	}
+	dial := func(query string) *websocket.Conn {
+		conn, err := websocket.Dial(url+query, "", "http://localhost/")
+		if err != nil {
+			t.Fatalf("failed to dial relay with seed %d: %s.", seed, err)
+		}
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		if _, err := (jsonRelayCodec{}).read(conn); err != nil {
+			t.Fatalf("failed to read relay status with seed %d: %s.", seed, err)
+		}
+		if err := (jsonRelayCodec{}).write(conn, &relayPacket{code: bloomFilterExCode, bloom: MakeFullNodeBloom()}); err != nil {
+			t.Fatalf("failed to send bloom filter with seed %d: %s.", seed, err)
+		}
+		return conn
+	}
+	legacy := dial("")
+	defer legacy.Close()
+	aware := dial("/?flags=2")
+	defer aware.Close()
+	if !waitFor(5*time.Second, func() bool {
+		relay.mu.Lock()
+		defer relay.mu.Unlock()
+		for c := range relay.clients {
+			c.mu.Lock()
+			ready := c.bloom != nil
+			c.mu.Unlock()
+			if !ready {
+				return false
+			}
+		}
+		return len(relay.clients) == 2
+	}) {
+		t.Fatalf("bloom filters of the relay clients not accepted with seed %d.", seed)
+	}
+
+	// the sequenced envelope only reaches the client aware of the layout
+	now := uint32(time.Now().Unix())
+	sequenced := &Envelope{Expiry: now + DefaultTTL, TTL: DefaultTTL, Topic: TopicType{0xc4, 0x01}, Data: []byte{1, 2, 3}, Nonce: uint64(seed), Flags: []uint64{EnvelopeSequenced}}
+	if err := w.Send(sequenced); err != nil {
+		t.Fatalf("failed to send sequenced envelope with seed %d: %s.", seed, err)
+	}
+	plain := &Envelope{Expiry: now + DefaultTTL, TTL: DefaultTTL, Topic: TopicType{0xc4, 0x02}, Data: []byte{4, 5, 6}, Nonce: uint64(seed)}
+	if err := w.Send(plain); err != nil {
+		t.Fatalf("failed to send plain envelope with seed %d: %s.", seed, err)
+	}
+	packet, err := (jsonRelayCodec{}).read(aware)
+	if err != nil || packet.code != messagesCode || len(packet.envelopes) == 0 || packet.envelopes[0].Hash() != sequenced.Hash() {
+		t.Fatalf("sequenced envelope not delivered to the aware client with seed %d: %v.", seed, err)
+	}
+	packet, err = (jsonRelayCodec{}).read(legacy)
+	if err != nil || packet.code != messagesCode || len(packet.envelopes) != 1 || packet.envelopes[0].Hash() != plain.Hash() {
+		t.Fatalf("wrong envelopes delivered to the legacy client with seed %d: %v.", seed, err)
+	}
+}
+
+func TestRelayRequirementChanges(t *testing.T) {
+	InitSingleTest()
+
+	w := New(&DefaultConfig)
+	w.SetMinimumPowTest(0.0000001)
+	w.Start(nil)
+	defer w.Stop()
+
+	relay := NewRelay(w, 0)
+	relay.Start()
+	defer relay.Stop()
+	server := httptest.NewServer(relay)
+	defer server.Close()
+	url := "ws" + strings.TrimPrefix(server.URL, "http")
+
+	conn, err := websocket.Dial(url, "", "http://localhost/")
+	if err != nil {
+		t.Fatalf("failed to dial relay with seed %d: %s.", seed, err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := (jsonRelayCodec{}).read(conn); err != nil {
+		t.Fatalf("failed to read relay status with seed %d: %s.", seed, err)
+	}
+
+	// the changes made after the connect are announced to the client
+	w.SetMinimumPowTest(0.5)
+	packet, err := (jsonRelayCodec{}).read(conn)
+	if err != nil || packet.code != powRequirementCode || packet.pow != 0.5 {
+		t.Fatalf("PoW requirement change not announced with seed %d: %v, %+v.", seed, err, packet)
+	}
+	bloom := w.BloomParams().TopicToBloom(TopicType{0xc5, 0x01})
+	if err := w.setBloomFilter(bloom); err != nil {
+		t.Fatalf("failed to set bloom filter with seed %d: %s.", seed, err)
+	}
+	packet, err = (jsonRelayCodec{}).read(conn)
+	if err != nil || packet.code != bloomFilterExCode || !bytes.Equal(packet.bloom, bloom) {
+		t.Fatalf("bloom filter change not announced with seed %d: %v, %+v.", seed, err, packet)
+	}
+}
@@ -0,0 +1,198 @@
+// Copyright 2017 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+// Contains the rendezvous helper, allowing two light clients sharing a secret
+// to find a relay (or mail server) reachable by both of them.
+//
+// Both clients derive the same topic and symmetric key from the secret, and
+// announce the enode URLs of the relays and mail servers they are connected to.
+// Once the announcement of the other side arrives, the first relay present in
+// both announcements is the meeting point, to which both clients may connect
+// directly (e.g. as a static peer), which is particularly helpful for the
+// mobile clients behind NAT.
+
+package whisperv6
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"sync"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/crypto"
+)
+
+// RendezvousAnnouncement lists the nodes reachable by one of the parties.
+type RendezvousAnnouncement struct {
+	ID          hexutil.Bytes `json:"id"`          // Random identifier of the announcing party
+	Relays      []string      `json:"relays"`      // Enode URLs of the reachable relays
+	MailServers []string      `json:"mailServers"` // Enode URLs of the reachable mail servers
+}
+
+// Rendezvous exchanges the announcements over the topic derived from a secret
+// shared by the parties.
+type Rendezvous struct {
+	whisper  *Whisper
+	id       []byte
+	topic    TopicType
+	key      []byte
+	filterID string
+
+	mu     sync.Mutex
+	remote map[string]*RendezvousAnnouncement // Latest announcements of the other parties by ID
+}
+
+// RendezvousTopic returns the topic of the rendezvous derived from the secret.
+func RendezvousTopic(secret []byte) TopicType {
+	return BytesToTopic(crypto.Keccak256([]byte("rendezvous-topic"), secret))
+}
+
+// rendezvousKey returns the symmetric key of the rendezvous derived from the secret.
+func rendezvousKey(secret []byte) []byte {
+	return crypto.Keccak256([]byte("rendezvous-key"), secret)
+}
+
+// NewRendezvous subscribes to the announcements of the rendezvous identified by
+// the shared secret.
+func (whisper *Whisper) NewRendezvous(secret []byte) (*Rendezvous, error) {
+	if len(secret) == 0 {
+		return nil, fmt.Errorf("empty rendezvous secret")
+	}
+	id, err := generateSecureRandomData(keyIDSize)
+	if err != nil {
+		return nil, err
+	}
+	r := &Rendezvous{
+		whisper: whisper,
+		id:      id,
+		topic:   RendezvousTopic(secret),
+		key:     rendezvousKey(secret),
+		remote:  make(map[string]*RendezvousAnnouncement),
+	}
+	filter := &Filter{
+		KeySym:   r.key,
+		Topics:   [][]byte{r.topic[:]},
+		Messages: make(map[common.Hash]*ReceivedMessage),
+	}
+	if r.filterID, err = whisper.Subscribe(filter); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Topic returns the topic of the rendezvous.
+func (r *Rendezvous) Topic() TopicType {
+	return r.topic
+}
+
+// Announce posts the nodes reachable by this party to the rendezvous.
+func (r *Rendezvous) Announce(relays, mailServers []string) error {
+	payload, err := json.Marshal(&RendezvousAnnouncement{ID: r.id, Relays: relays, MailServers: mailServers})
+	if err != nil {
+		return err
+	}
+	params := &MessageParams{
+		TTL:      DefaultTTL,
+		KeySym:   r.key,
+		Topic:    r.topic,
+		WorkTime: 5,
+		PoW:      r.whisper.MinPow(),
+		Payload:  payload,
+	}
+	msg, err := NewSentMessage(params)
+	if err != nil {
+		return err
+	}
+	env, err := msg.Wrap(params)
+	if err != nil {
+		return err
+	}
+	return r.whisper.Send(env)
+}
+
+// Announcements returns the latest announcements of the other parties.
+func (r *Rendezvous) Announcements() []*RendezvousAnnouncement {
+	r.update()
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	all := make([]*RendezvousAnnouncement, 0, len(r.remote))
+	for _, a := range r.remote {
+		all = append(all, a)
+	}
+	return all
+}
+
+// update collects the announcements received since the last call.
+func (r *Rendezvous) update() {
+	f := r.whisper.GetFilter(r.filterID)
+	if f == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, msg := range f.Retrieve() {
+		var a RendezvousAnnouncement
+		if err := json.Unmarshal(msg.Payload, &a); err != nil {
+			r.whisper.Logger(LogSubsystemFilter).Debug("invalid rendezvous announcement", "err", err)
+			continue
+		}
+		if bytes.Equal(a.ID, r.id) {
+			continue // own announcement
+		}
+		r.remote[string(a.ID)] = &a
+	}
+}
+
+// Meet returns the mail server or relay reachable by both this party (as
+// listed) and any of the other parties, preferring the mail servers.
+func (r *Rendezvous) Meet(relays, mailServers []string) (string, bool) {
+	announcements := r.Announcements()
+	for _, a := range announcements {
+		if node, ok := firstCommon(mailServers, a.MailServers); ok {
+			return node, true
+		}
+	}
+	for _, a := range announcements {
+		if node, ok := firstCommon(relays, a.Relays); ok {
+			return node, true
+		}
+	}
+	return "", false
+}
+
+// Close unsubscribes from the rendezvous.
+func (r *Rendezvous) Close() error {
+	return r.whisper.Unsubscribe(r.filterID)
+}
+
+// firstCommon returns the first element of a present in b.
+func firstCommon(a, b []string) (string, bool) {
+	set := make(map[string]struct{}, len(b))
+	for _, s := range b {
+		set[s] = struct{}{}
+	}
+	for _, s := range a {
+		if _, ok := set[s]; ok {
+			return s, true
+		}
+	}
+	return "", false
+}
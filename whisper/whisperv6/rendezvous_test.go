@@ -0,0 +1,69 @@
+// Copyright 2017 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package whisperv6
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRendezvous(t *testing.T) {
+	InitSingleTest()
+
+	w := New(&DefaultConfig)
+	w.SetMinimumPowTest(0.0000001)
+	defer w.SetMinimumPowTest(DefaultMinimumPoW)
+	w.Start(nil)
+	defer w.Stop()
+
+	secret := []byte("shared secret")
+	alice, err := w.NewRendezvous(secret)
+	if err != nil {
+		t.Fatalf("failed to create rendezvous: %s.", err)
+	}
+	defer alice.Close()
+	bob, err := w.NewRendezvous(secret)
+	if err != nil {
+		t.Fatalf("failed to create rendezvous: %s.", err)
+	}
+	defer bob.Close()
+
+	if alice.Topic() != bob.Topic() || alice.Topic() == RendezvousTopic([]byte("other secret")) {
+		t.Fatalf("wrong rendezvous topics.")
+	}
+
+	aliceRelays := []string{"enode://a@10.0.0.1:30303", "enode://c@10.0.0.3:30303"}
+	bobRelays := []string{"enode://b@10.0.0.2:30303", "enode://c@10.0.0.3:30303"}
+	if err = bob.Announce(bobRelays, nil); err != nil {
+		t.Fatalf("failed to announce: %s.", err)
+	}
+
+	var (
+		node string
+		ok   bool
+	)
+	for i := 0; i < 100 && !ok; i++ {
+		time.Sleep(10 * time.Millisecond)
+		node, ok = alice.Meet(aliceRelays, nil)
+	}
+	if !ok || node != "enode://c@10.0.0.3:30303" {
+		t.Fatalf("wrong meeting point: %q.", node)
+	}
+	if len(bob.Announcements()) != 0 {
+		t.Fatalf("own announcement was not ignored.")
+	}
+}
@@ -0,0 +1,363 @@
+// Copyright 2017 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+// Contains the warm standby replication of the gateway state. The active node
+// streams the snapshots of its keys, filters, trusted peers and the hashes of
+// its hot envelopes to the standby node, which mirrors them and fetches the
+// envelopes it lacks from its own peers. On failover the standby serves the
+// clients of the active node under the same IDs, with the messages received
+// in the meantime already waiting in their filters.
+//
+// The stream starts with the version and the salt deriving the encryption key
+// from the shared secret. The snapshots follow, each one prefixed by its length
+// and sealed together with its sequence number, so that the frames can not be
+// replayed or reordered. Every snapshot carries the time it was taken, and the
+// standby rejects the snapshots not newer than the last applied one, so that
+// the recorded streams can not be replayed to roll the standby back.
+
+package whisperv6
+
+import (
+	"crypto/cipher"
+	"crypto/ecdsa"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/p2p"
+	"github.com/ethereum/go-ethereum/p2p/discover"
+)
+
+const (
+	replicationVersion = byte(1)
+	maxReplicaFrame    = 64 * 1024 * 1024 // Maximum size of a single snapshot in the stream
+)
+
+// replicaSnapshot is the state of the active node sent to the standby.
+type replicaSnapshot struct {
+	Time    int64           `json:"time"` // Time the snapshot was taken at, in nanoseconds
+	Keys    keyBundle       `json:"keys"`
+	Trusted []hexutil.Bytes `json:"trusted"`
+	Hot     []common.Hash   `json:"hot"`
+}
+
+// standbyState tracks the state replicated from the active node, so that the
+// state dropped by the active node is dropped by the standby as well, while
+// the own state of the standby is left intact. The trust is the exception: the
+// connected peers dropped from the trusted set of the active node stay trusted
+// until they reconnect, since the trust of a peer is never revoked.
+type standbyState struct {
+	mu         sync.Mutex
+	identities map[string]struct{}
+	symKeys    map[string]struct{}
+	filters    map[string]struct{}
+	trusted    map[discover.NodeID]struct{}
+	applied    int64 // Time of the last applied snapshot
+}
+
+// trusts checks if the peer is trusted by the active node.
+func (s *standbyState) trusts(id discover.NodeID) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, ok := s.trusted[id]
+	return ok
+}
+
+// StreamReplica writes the replication stream to the standby node, sending a
+// snapshot of the state right away and then once per interval, until the quit
+// channel is closed or the write fails.
+func (whisper *Whisper) StreamReplica(w io.Writer, secret string, interval time.Duration, quit <-chan struct{}) error {
+	salt, err := generateSecureRandomData(keyBundleSaltSize)
+	if err != nil {
+		return err
+	}
+	aesgcm, err := whisper.bundleKey(secret, salt)
+	if err != nil {
+		return err
+	}
+	if _, err = w.Write(append([]byte{replicationVersion}, salt...)); err != nil {
+		return err
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for seq := uint64(0); ; seq++ {
+		if err = whisper.sendReplica(w, aesgcm, seq); err != nil {
+			return err
+		}
+		select {
+		case <-ticker.C:
+		case <-quit:
+			return nil
+		}
+	}
+}
+
+// FollowReplica applies the replication stream of the active node, until the
+// stream ends. An error is returned if the stream is corrupted or forged.
+func (whisper *Whisper) FollowReplica(r io.Reader, secret string) error {
+	header := make([]byte, 1+keyBundleSaltSize)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return err
+	}
+	if header[0] != replicationVersion {
+		return fmt.Errorf("unsupported replication version %d", header[0])
+	}
+	aesgcm, err := whisper.bundleKey(secret, header[1:])
+	if err != nil {
+		return err
+	}
+	for seq := uint64(0); ; seq++ {
+		snapshot, err := readReplica(r, aesgcm, seq)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if err = whisper.applyReplica(snapshot); err != nil {
+			return err
+		}
+	}
+}
+
+// replicaData returns the additional data authenticated with the snapshot.
+func replicaData(seq uint64) []byte {
+	data := make([]byte, 9)
+	data[0] = replicationVersion
+	binary.BigEndian.PutUint64(data[1:], seq)
+	return data
+}
+
+// replicaSnapshot collects the replicated state of the node.
+func (whisper *Whisper) replicaSnapshot() *replicaSnapshot {
+	snapshot := &replicaSnapshot{Time: time.Now().UnixNano(), Keys: whisper.keyBundle()}
+
+	whisper.peerMu.RLock()
+	for p := range whisper.peers {
+		if p.Trusted() {
+			id := p.peer.ID()
+			snapshot.Trusted = append(snapshot.Trusted, id[:])
+		}
+	}
+	whisper.peerMu.RUnlock()
+
+	whisper.poolMu.RLock()
+	for hash := range whisper.envelopes {
+		if len(snapshot.Hot) >= maxSyncHashes {
+			break
+		}
+		if !whisper.isHeld(hash) {
+			snapshot.Hot = append(snapshot.Hot, hash)
+		}
+	}
+	whisper.poolMu.RUnlock()
+	return snapshot
+}
+
+// sendReplica writes a single snapshot into the stream.
+func (whisper *Whisper) sendReplica(w io.Writer, aesgcm cipher.AEAD, seq uint64) error {
+	plaintext, err := json.Marshal(whisper.replicaSnapshot())
+	if err != nil {
+		return err
+	}
+	nonce, err := generateSecureRandomData(aesgcm.NonceSize())
+	if err != nil {
+		return err
+	}
+	frame := aesgcm.Seal(nonce, nonce, plaintext, replicaData(seq))
+	if len(frame) > maxReplicaFrame {
+		return fmt.Errorf("replica snapshot too large: %d bytes", len(frame))
+	}
+	out := make([]byte, 4, 4+len(frame))
+	binary.BigEndian.PutUint32(out, uint32(len(frame)))
+	_, err = w.Write(append(out, frame...))
+	return err
+}
+
+// readReplica reads a single snapshot from the stream, returning io.EOF if the
+// stream ended cleanly before the snapshot.
+func readReplica(r io.Reader, aesgcm cipher.AEAD, seq uint64) (*replicaSnapshot, error) {
+	var size [4]byte
+	if _, err := io.ReadFull(r, size[:]); err != nil {
+		return nil, err
+	}
+	n := binary.BigEndian.Uint32(size[:])
+	nonceLength := aesgcm.NonceSize()
+	if n > maxReplicaFrame || n < uint32(nonceLength) {
+		return nil, fmt.Errorf("invalid replica snapshot size %d", n)
+	}
+	frame := make([]byte, n)
+	if _, err := io.ReadFull(r, frame); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	plaintext, err := aesgcm.Open(nil, frame[:nonceLength], frame[nonceLength:], replicaData(seq))
+	if err != nil {
+		return nil, errors.New("failed to decrypt replica snapshot, wrong secret?")
+	}
+	snapshot := new(replicaSnapshot)
+	if err = json.Unmarshal(plaintext, snapshot); err != nil {
+		return nil, fmt.Errorf("invalid replica snapshot: %v", err)
+	}
+	return snapshot, nil
+}
+
+// applyReplica mirrors the snapshot of the active node.
+func (whisper *Whisper) applyReplica(snapshot *replicaSnapshot) error {
+	identities, filters, err := snapshot.Keys.decode()
+	if err != nil {
+		return err
+	}
+	trusted := make(map[discover.NodeID]struct{}, len(snapshot.Trusted))
+	for _, raw := range snapshot.Trusted {
+		var id discover.NodeID
+		if len(raw) != len(id) {
+			return fmt.Errorf("invalid trusted peer %x", raw)
+		}
+		copy(id[:], raw)
+		trusted[id] = struct{}{}
+	}
+
+	// the peers are notified about the bloom filter and marked trusted without
+	// holding the locks, since both may block on the peers and the subscribers
+	peers, fresh, err := whisper.mirrorReplica(snapshot, identities, filters, trusted)
+	if err != nil {
+		return err
+	}
+	for _, f := range fresh {
+		whisper.updateBloomFilter(f)
+	}
+	for _, p := range peers {
+		whisper.markTrusted(p)
+	}
+	whisper.requestEnvelopes(snapshot.Hot)
+	return nil
+}
+
+// mirrorReplica replaces the state replicated from the active node, returning
+// the connected peers trusted by the active node and the newly installed filters.
+func (whisper *Whisper) mirrorReplica(snapshot *replicaSnapshot, identities map[string]*ecdsa.PrivateKey, filters []*Filter, trusted map[discover.NodeID]struct{}) ([]*Peer, []*Filter, error) {
+	s := &whisper.standby
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if snapshot.Time <= s.applied {
+		return nil, nil, fmt.Errorf("stale replica snapshot taken at %v", time.Unix(0, snapshot.Time))
+	}
+
+	// the filters are immutable, only the new ones are installed
+	current := make(map[string]struct{}, len(filters))
+	var fresh []*Filter
+	for _, f := range filters {
+		current[f.id] = struct{}{}
+		if _, ok := s.filters[f.id]; !ok {
+			fresh = append(fresh, f)
+		}
+	}
+	if err := whisper.filters.installAll(fresh); err != nil {
+		return nil, nil, err
+	}
+	for id := range s.filters {
+		if _, ok := current[id]; !ok {
+			whisper.filters.Uninstall(id)
+		}
+	}
+	s.filters = current
+
+	whisper.keyMu.Lock()
+	for id := range s.identities {
+		if identities[id] == nil {
+			delete(whisper.privateKeys, id)
+		}
+	}
+	for id := range s.symKeys {
+		if snapshot.Keys.SymKeys[id] == nil {
+			delete(whisper.symKeys, id)
+		}
+	}
+	s.identities = make(map[string]struct{}, len(identities))
+	for id, key := range identities {
+		whisper.privateKeys[id] = key
+		s.identities[id] = struct{}{}
+	}
+	s.symKeys = make(map[string]struct{}, len(snapshot.Keys.SymKeys))
+	for id, key := range snapshot.Keys.SymKeys {
+		whisper.symKeys[id] = key
+		s.symKeys[id] = struct{}{}
+	}
+	whisper.keyMu.Unlock()
+
+	s.trusted = trusted
+	s.applied = snapshot.Time
+	var peers []*Peer
+	whisper.peerMu.RLock()
+	for p := range whisper.peers {
+		if _, ok := trusted[p.peer.ID()]; ok {
+			peers = append(peers, p)
+		}
+	}
+	whisper.peerMu.RUnlock()
+	return peers, fresh, nil
+}
+
+// requestEnvelopes requests the envelopes missing from the pool, spreading the
+// requests over the connected peers.
+func (whisper *Whisper) requestEnvelopes(hashes []common.Hash) {
+	var missing []common.Hash
+	for _, hash := range hashes {
+		if len(missing) >= maxSyncHashes {
+			break
+		}
+		if !whisper.isEnvelopeCached(hash) {
+			missing = append(missing, hash)
+		}
+	}
+	if len(missing) == 0 {
+		return
+	}
+
+	whisper.peerMu.RLock()
+	peers := make([]*Peer, 0, len(whisper.peers))
+	for p := range whisper.peers {
+		peers = append(peers, p)
+	}
+	whisper.peerMu.RUnlock()
+	if len(peers) == 0 {
+		return
+	}
+
+	shares := make([][]common.Hash, len(peers))
+	for i, hash := range missing {
+		shares[i%len(peers)] = append(shares[i%len(peers)], hash)
+	}
+	for i, p := range peers {
+		if len(shares[i]) == 0 {
+			continue
+		}
+		if err := p2p.Send(p.ws, syncRequestCode, shares[i]); err != nil {
+			p.log.Trace("failed to request replicated envelopes", "err", err)
+		}
+	}
+}
@@ -0,0 +1,160 @@
+// Copyright 2017 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package whisperv6
+
+import (
+	"bytes"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/p2p/discover"
+)
+
+// waitFor polls the condition until it holds or the timeout expires.
+func waitFor(timeout time.Duration, cond func() bool) bool {
+	for deadline := time.Now().Add(timeout); time.Now().Before(deadline); time.Sleep(5 * time.Millisecond) {
+		if cond() {
+			return true
+		}
+	}
+	return cond()
+}
+
+func TestReplication(t *testing.T) {
+	active := New(&DefaultConfig)
+	standby := New(&DefaultConfig)
+	pairID, err := active.NewKeyPair()
+	if err != nil {
+		t.Fatalf("failed to create key pair: %s.", err)
+	}
+	symID, err := active.GenerateSymKey()
+	if err != nil {
+		t.Fatalf("failed to create symmetric key: %s.", err)
+	}
+	key, _ := active.GetSymKey(symID)
+	filterID, err := active.Subscribe(&Filter{KeySym: key, Topics: [][]byte{{1, 2, 3, 4}}})
+	if err != nil {
+		t.Fatalf("failed to subscribe: %s.", err)
+	}
+
+	r, w := io.Pipe()
+	quit := make(chan struct{})
+	streamErr, followErr := make(chan error, 1), make(chan error, 1)
+	go func() {
+		streamErr <- active.StreamReplica(w, "secret", 10*time.Millisecond, quit)
+		w.Close()
+	}()
+	go func() { followErr <- standby.FollowReplica(r, "secret") }()
+
+	if !waitFor(time.Second, func() bool {
+		return standby.HasKeyPair(pairID) && standby.HasSymKey(symID) && standby.GetFilter(filterID) != nil
+	}) {
+		t.Fatalf("state was not replicated.")
+	}
+	active.DeleteSymKey(symID)
+	active.Unsubscribe(filterID)
+	if !waitFor(time.Second, func() bool {
+		return !standby.HasSymKey(symID) && standby.GetFilter(filterID) == nil
+	}) {
+		t.Fatalf("deletion was not replicated.")
+	}
+	if !standby.HasKeyPair(pairID) {
+		t.Fatalf("retained key pair was deleted.")
+	}
+
+	close(quit)
+	if err = <-streamErr; err != nil {
+		t.Fatalf("stream failed: %s.", err)
+	}
+	if err = <-followErr; err != nil {
+		t.Fatalf("follower failed: %s.", err)
+	}
+}
+
+func TestReplicationWrongSecret(t *testing.T) {
+	active := New(&DefaultConfig)
+	standby := New(&DefaultConfig)
+
+	r, w := io.Pipe()
+	quit := make(chan struct{})
+	defer close(quit)
+	go func() {
+		active.StreamReplica(w, "secret", time.Second, quit)
+	}()
+	if err := standby.FollowReplica(r, "guess"); err == nil {
+		t.Fatalf("forged stream was accepted.")
+	}
+	r.Close()
+}
+
+func TestReplicationReplay(t *testing.T) {
+	active := New(&DefaultConfig)
+	standby := New(&DefaultConfig)
+	symID, err := active.GenerateSymKey()
+	if err != nil {
+		t.Fatalf("failed to create symmetric key: %s.", err)
+	}
+
+	// record a stream of a single snapshot, still holding the key
+	var recorded bytes.Buffer
+	quit := make(chan struct{})
+	close(quit)
+	if err = active.StreamReplica(&recorded, "secret", time.Hour, quit); err != nil {
+		t.Fatalf("stream failed: %s.", err)
+	}
+	stream := recorded.Bytes()
+
+	active.DeleteSymKey(symID)
+	recorded.Reset()
+	if err = active.StreamReplica(&recorded, "secret", time.Hour, quit); err != nil {
+		t.Fatalf("stream failed: %s.", err)
+	}
+	if err = standby.FollowReplica(&recorded, "secret"); err != nil {
+		t.Fatalf("follower failed: %s.", err)
+	}
+
+	// the replayed stream must not resurrect the deleted key
+	if err = standby.FollowReplica(bytes.NewReader(stream), "secret"); err == nil {
+		t.Fatalf("replayed stream was accepted.")
+	}
+	if standby.HasSymKey(symID) {
+		t.Fatalf("deleted key was resurrected by the replayed stream.")
+	}
+}
+
+func TestReplicationTrustedPeers(t *testing.T) {
+	w := New(&DefaultConfig)
+	var id discover.NodeID
+	id[0] = 1
+	if err := w.applyReplica(&replicaSnapshot{Time: 1, Trusted: []hexutil.Bytes{id[:]}}); err != nil {
+		t.Fatalf("failed to apply snapshot: %s.", err)
+	}
+	if !w.standby.trusts(id) {
+		t.Fatalf("replicated peer is not trusted.")
+	}
+	if err := w.applyReplica(&replicaSnapshot{Time: 2}); err != nil {
+		t.Fatalf("failed to apply snapshot: %s.", err)
+	}
+	if w.standby.trusts(id) {
+		t.Fatalf("dropped peer is still trusted.")
+	}
+	if err := w.applyReplica(&replicaSnapshot{Time: 3, Trusted: []hexutil.Bytes{{1, 2}}}); err == nil {
+		t.Fatalf("invalid peer id was accepted.")
+	}
+}
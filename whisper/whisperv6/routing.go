@@ -0,0 +1,241 @@
+// Copyright 2017 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+// Contains the routing domains. The operator tags the peers into the named
+// groups, and restricts the topics forwarded to each group. The peers without
+// a tag belong to DefaultPeerGroup. In a gateway topology the internal nodes
+// form one group, and the internal topics are blocked for the default group,
+// so that the application traffic never leaks to the public network.
+//
+// The restrictions apply to all the envelopes forwarded by the node, be it by
+// the broadcast or by the anti-entropy sync. The hashes exchanged by the sync
+// are not filtered, but the envelopes themselves are never pushed. A batch is
+// forwarded only if all the contained topics are permitted, and the websocket
+// relay clients belong to DefaultPeerGroup.
+//
+// An invalid configuration fails closed: nothing is forwarded, and Start
+// returns the error.
+
+package whisperv6
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/ethereum/go-ethereum/p2p/discover"
+)
+
+// DefaultPeerGroup is the group of the peers without a tag.
+const DefaultPeerGroup = "default"
+
+// PeerGroup configures a routing domain.
+type PeerGroup struct {
+	Name        string            // Name of the group, DefaultPeerGroup configures the untagged peers
+	Peers       []discover.NodeID `toml:",omitempty"` // Peers tagged into the group
+	AllowTopics []TopicType       `toml:",omitempty"` // Topics forwarded to the group (empty means any)
+	BlockTopics []TopicType       `toml:",omitempty"` // Topics never forwarded to the group
+}
+
+// routingRule holds the topic restrictions of a single group.
+type routingRule struct {
+	allow map[TopicType]struct{} // nil means any
+	block map[TopicType]struct{}
+}
+
+// permits checks if the envelopes with the topic may be forwarded.
+func (r *routingRule) permits(topic TopicType) bool {
+	if _, blocked := r.block[topic]; blocked {
+		return false
+	}
+	if r.allow == nil {
+		return true
+	}
+	_, allowed := r.allow[topic]
+	return allowed
+}
+
+// routingDomains maps the peers to the groups and the groups to the rules.
+type routingDomains struct {
+	mu      sync.RWMutex
+	members map[discover.NodeID]string // Tags of the peers
+	rules   map[string]*routingRule    // Restrictions of the groups (missing means none)
+	invalid error                      // Configuration error, blocking all the topics
+}
+
+// closedRoutingDomains returns the routing domains of an invalid configuration,
+// which forward nothing.
+func closedRoutingDomains(err error) *routingDomains {
+	return &routingDomains{
+		members: make(map[discover.NodeID]string),
+		rules:   make(map[string]*routingRule),
+		invalid: err,
+	}
+}
+
+func newRoutingDomains(groups []PeerGroup) (*routingDomains, error) {
+	r := &routingDomains{
+		members: make(map[discover.NodeID]string),
+		rules:   make(map[string]*routingRule),
+	}
+	for _, g := range groups {
+		if g.Name == "" {
+			return nil, fmt.Errorf("peer group without a name")
+		}
+		if _, exist := r.rules[g.Name]; exist {
+			return nil, fmt.Errorf("duplicate peer group %q", g.Name)
+		}
+		rule := &routingRule{block: make(map[TopicType]struct{})}
+		if len(g.AllowTopics) > 0 {
+			rule.allow = make(map[TopicType]struct{})
+			for _, topic := range g.AllowTopics {
+				rule.allow[topic] = struct{}{}
+			}
+		}
+		for _, topic := range g.BlockTopics {
+			rule.block[topic] = struct{}{}
+		}
+		r.rules[g.Name] = rule
+
+		for _, id := range g.Peers {
+			if other, exist := r.members[id]; exist {
+				return nil, fmt.Errorf("peer %x tagged into both %q and %q", id[:8], other, g.Name)
+			}
+			r.members[id] = g.Name
+		}
+	}
+	return r, nil
+}
+
+// group returns the group of the peer.
+func (r *routingDomains) group(id discover.NodeID) string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	if g, ok := r.members[id]; ok {
+		return g
+	}
+	return DefaultPeerGroup
+}
+
+// tag moves the peer into the group, the empty group reverting to the default.
+func (r *routingDomains) tag(id discover.NodeID, group string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if group == "" || group == DefaultPeerGroup {
+		delete(r.members, id)
+	} else {
+		r.members[id] = group
+	}
+}
+
+// permits checks if the envelopes with the topic may be forwarded to the peer.
+func (r *routingDomains) permits(id discover.NodeID, topic TopicType) bool {
+	return r.permitsGroup(r.group(id), topic)
+}
+
+// permitsGroup checks if the envelopes with all the topics may be forwarded to
+// the group.
+func (r *routingDomains) permitsGroup(group string, topics ...TopicType) bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	if r.invalid != nil {
+		return false
+	}
+	rule, ok := r.rules[group]
+	if !ok {
+		return true
+	}
+	for _, topic := range topics {
+		if !rule.permits(topic) {
+			return false
+		}
+	}
+	return true
+}
+
+// consistent checks if each of the groups is permitted either all or none of
+// the topics, so that a batch of them never withholds a permitted one.
+func (r *routingDomains) consistent(topics []TopicType) bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	for _, rule := range r.rules {
+		permitted := 0
+		for _, topic := range topics {
+			if rule.permits(topic) {
+				permitted++
+			}
+		}
+		if permitted != 0 && permitted != len(topics) {
+			return false
+		}
+	}
+	return true
+}
+
+// restricted checks if any of the topics may be withheld from any group.
+func (r *routingDomains) restricted() bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.invalid != nil || len(r.rules) > 0
+}
+
+// forwards checks if the envelope may be forwarded to the group. The batch is
+// decoded and forwarded only if all the contained topics are permitted.
+func (r *routingDomains) forwards(group string, envelope *Envelope) bool {
+	if envelope.Topic != BatchTopic || !r.restricted() {
+		return r.permitsGroup(group, envelope.Topic)
+	}
+	items, err := envelope.unbatch()
+	if err != nil {
+		return false
+	}
+	topics := make([]TopicType, 0, len(items)+1)
+	topics = append(topics, BatchTopic)
+	for _, item := range items {
+		topics = append(topics, item.Topic)
+	}
+	return r.permitsGroup(group, topics...)
+}
+
+// SetPeerGroup tags the peer into the routing group, which restricts the
+// topics forwarded to it. The peer does not need to be connected. The empty
+// group name reverts the peer to DefaultPeerGroup.
+func (whisper *Whisper) SetPeerGroup(peerID []byte, group string) error {
+	if len(peerID) != len(discover.NodeID{}) {
+		return fmt.Errorf("invalid peer ID length: %d", len(peerID))
+	}
+	var id discover.NodeID
+	copy(id[:], peerID)
+	whisper.routing.tag(id, group)
+	return nil
+}
+
+// PeerGroup returns the routing group of the peer.
+func (whisper *Whisper) PeerGroup(peerID []byte) string {
+	var id discover.NodeID
+	copy(id[:], peerID)
+	return whisper.routing.group(id)
+}
+
+// routes checks if the envelope may be forwarded to the peer according to
+// the routing domains.
+func (peer *Peer) routes(envelope *Envelope) bool {
+	routing := peer.host.routing
+	return routing.forwards(routing.group(peer.peer.ID()), envelope)
+}
@@ -0,0 +1,133 @@
+// Copyright 2017 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package whisperv6
+
+import (
+	"testing"
+
+	"github.com/ethereum/go-ethereum/p2p/discover"
+)
+
+func TestRoutingDomains(t *testing.T) {
+	internalTopic := TopicType{0xaa}
+	publicTopic := TopicType{0xbb}
+	gateway, other := discover.NodeID{1}, discover.NodeID{2}
+
+	cfg := DefaultConfig
+	cfg.PeerGroups = []PeerGroup{
+		{Name: "internal", Peers: []discover.NodeID{gateway}},
+		{Name: DefaultPeerGroup, BlockTopics: []TopicType{internalTopic}},
+		{Name: "partners", AllowTopics: []TopicType{publicTopic}},
+	}
+	w := New(&cfg)
+
+	if g := w.PeerGroup(gateway[:]); g != "internal" {
+		t.Fatalf("wrong group of the tagged peer: %s.", g)
+	}
+	if g := w.PeerGroup(other[:]); g != DefaultPeerGroup {
+		t.Fatalf("wrong group of the untagged peer: %s.", g)
+	}
+
+	tests := []struct {
+		group string
+		topic TopicType
+		want  bool
+	}{
+		{"internal", internalTopic, true},
+		{"internal", publicTopic, true},
+		{DefaultPeerGroup, internalTopic, false},
+		{DefaultPeerGroup, publicTopic, true},
+		{"partners", internalTopic, false},
+		{"partners", publicTopic, true},
+	}
+	for i, tt := range tests {
+		if err := w.SetPeerGroup(other[:], tt.group); err != nil {
+			t.Fatalf("test %d: failed to tag the peer: %s.", i, err)
+		}
+		if got := w.routing.permits(other, tt.topic); got != tt.want {
+			t.Fatalf("test %d: topic %x forwarded to group %s: %v, want %v.", i, tt.topic, tt.group, got, tt.want)
+		}
+	}
+
+	w.SetPeerGroup(other[:], "")
+	if g := w.PeerGroup(other[:]); g != DefaultPeerGroup {
+		t.Fatalf("peer not reverted to the default group: %s.", g)
+	}
+	if err := w.SetPeerGroup([]byte{1}, "internal"); err == nil {
+		t.Fatalf("invalid peer ID accepted.")
+	}
+
+	// without any rules everything is forwarded
+	if !New(&DefaultConfig).routing.permits(other, internalTopic) {
+		t.Fatalf("topic not forwarded without the routing domains.")
+	}
+	if _, err := newRoutingDomains([]PeerGroup{{Name: "a", Peers: []discover.NodeID{gateway}}, {Name: "b", Peers: []discover.NodeID{gateway}}}); err == nil {
+		t.Fatalf("peer tagged into two groups accepted.")
+	}
+}
+
+func TestRoutingInvalidGroups(t *testing.T) {
+	cfg := DefaultConfig
+	cfg.PeerGroups = []PeerGroup{{Name: DefaultPeerGroup, BlockTopics: []TopicType{{0xaa}}}, {Name: DefaultPeerGroup}}
+	w := New(&cfg)
+
+	if w.routing.permits(discover.NodeID{1}, TopicType{0xbb}) {
+		t.Fatalf("topic forwarded with the invalid peer groups.")
+	}
+	if err := w.Start(nil); err == nil {
+		w.Stop()
+		t.Fatalf("started with the invalid peer groups.")
+	}
+}
+
+func TestRoutingBatch(t *testing.T) {
+	InitSingleTest()
+
+	internalTopic := TopicType{0xaa}
+	cfg := DefaultConfig
+	cfg.PeerGroups = []PeerGroup{{Name: DefaultPeerGroup, BlockTopics: []TopicType{internalTopic}}}
+	w := New(&cfg)
+
+	messages := make([]*MessageParams, 2)
+	for i := range messages {
+		params, err := generateMessageParams()
+		if err != nil {
+			t.Fatalf("failed generateMessageParams with seed %d: %s.", seed, err)
+		}
+		params.Topic = TopicType{0xbb, byte(i)}
+		messages[i] = params
+	}
+	env, err := w.NewBatchEnvelope(messages, &MessageParams{TTL: DefaultTTL, WorkTime: 1, PoW: 0.01})
+	if err != nil {
+		t.Fatalf("failed NewBatchEnvelope with seed %d: %s.", seed, err)
+	}
+	if !w.routing.forwards(DefaultPeerGroup, env) {
+		t.Fatalf("batch of the permitted topics not forwarded.")
+	}
+
+	messages[1].Topic = internalTopic
+	if _, err = w.NewBatchEnvelope(messages, &MessageParams{TTL: DefaultTTL, WorkTime: 1, PoW: 0.01}); err == nil {
+		t.Fatalf("batch of the differently routed topics accepted.")
+	}
+	// a batch sealed by a node without the routing domains
+	if env, err = New(&DefaultConfig).NewBatchEnvelope(messages, &MessageParams{TTL: DefaultTTL, WorkTime: 1, PoW: 0.01}); err != nil {
+		t.Fatalf("failed NewBatchEnvelope with seed %d: %s.", seed, err)
+	}
+	if w.routing.forwards(DefaultPeerGroup, env) {
+		t.Fatalf("batch containing the blocked topic forwarded.")
+	}
+}
@@ -0,0 +1,185 @@
+// Copyright 2017 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+// Contains the JSON representations of the messages, the filter criteria and
+// the node information used by the RPC API, along with its errors. They are part of the core, since
+// the RPC clients (e.g. shhclient) need them even in the builds without the
+// RPC service.
+
+package whisperv6
+
+import (
+	"errors"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/crypto"
+)
+
+// List of errors
+var (
+	ErrSymAsym              = errors.New("specify either a symmetric or an asymmetric key")
+	ErrInvalidSymmetricKey  = errors.New("invalid symmetric key")
+	ErrInvalidPublicKey     = errors.New("invalid public key")
+	ErrInvalidSigningPubKey = errors.New("invalid signing public key")
+	ErrTooLowPoW            = errors.New("message rejected, PoW too low")
+	ErrNoTopics             = errors.New("missing topic(s)")
+	ErrTopicNotAllowed      = errors.New("topic not allowed for outbound messages")
+	ErrWatchOnly            = errors.New("keys and filters are disabled on watch-only nodes")
+)
+
+//go:generate gencodec -type NewMessage -field-override newMessageOverride -out gen_newmessage_json.go
+
+// Info contains diagnostic information.
+type Info struct {
+	Memory         int     `json:"memory"`         // Memory size of the floating messages in bytes.
+	Messages       int     `json:"messages"`       // Number of floating messages.
+	MinPow         float64 `json:"minPow"`         // Minimal accepted PoW
+	MaxMessageSize uint32  `json:"maxMessageSize"` // Maximum accepted message size
+	HashRate       float64 `json:"hashRate"`       // Hashes per second of a single thread, measured on startup
+}
+
+// EnvelopeInfo contains the public metadata of a pooled envelope, which is
+// available without decrypting it.
+type EnvelopeInfo struct {
+	Hash    common.Hash   `json:"hash"`
+	Version uint64        `json:"version"` // Version of the protocol the envelope conforms to
+	Topic   TopicType     `json:"topic"`
+	Bloom   hexutil.Bytes `json:"bloom"`
+	Size    int           `json:"size"` // Size of the RLP encoded envelope in bytes
+	TTL     uint32        `json:"ttl"`
+	Expiry  uint32        `json:"expiry"`
+	PoW     float64       `json:"pow"`
+	Nonce   uint64        `json:"nonce"`
+
+	// Salt (AES-GCM nonce) trailing the data of the symmetrically encrypted
+	// envelopes. Without the key the encryption can not be told apart, so the
+	// trailing bytes are reported for any envelope long enough to carry it.
+	AESNonce hexutil.Bytes `json:"aesNonce,omitempty"`
+}
+
+// NewMessage represents a new whisper message that is posted through the RPC.
+type NewMessage struct {
+	SymKeyID   string       `json:"symKeyID"`
+	PublicKey  []byte       `json:"pubKey"`
+	Sig        string       `json:"sig"`
+	TTL        uint32       `json:"ttl"`
+	Topic      TopicType    `json:"topic"`
+	Payload    []byte       `json:"payload"`
+	Padding    []byte       `json:"padding"`
+	PowTime    uint32       `json:"powTime"`
+	PowTarget  float64      `json:"powTarget"`
+	TargetPeer string       `json:"targetPeer"`
+	Delivery   DeliveryMode `json:"delivery"`  // Delivery guarantee, best effort by default
+	Seq        uint64       `json:"seq"`       // Sequence number in the channel of the sender, see GapEvent
+	Redacts    common.Hash  `json:"redacts"`   // Envelope hash of the message redacted by this tombstone (requires sig)
+	NoArchive  bool         `json:"noArchive"` // Request the mail servers not to archive the message
+
+	DeterministicPadding bool `json:"deterministicPadding"` // Derive the padding from the payload and the key
+}
+
+type newMessageOverride struct {
+	PublicKey hexutil.Bytes
+	Payload   hexutil.Bytes
+	Padding   hexutil.Bytes
+}
+
+//go:generate gencodec -type Criteria -field-override criteriaOverride -out gen_criteria_json.go
+
+// Criteria holds various filter options for inbound messages.
+type Criteria struct {
+	SymKeyID     string                 `json:"symKeyID"`
+	PrivateKeyID string                 `json:"privateKeyID"`
+	Sig          []byte                 `json:"sig"`
+	MinPow       float64                `json:"minPow"`
+	Topics       []TopicType            `json:"topics"`
+	AllowP2P     bool                   `json:"allowP2P"`
+	Priorities   map[common.Address]int `json:"priorities"` // Static priorities of the senders, see Filter.Priorities
+}
+
+type criteriaOverride struct {
+	Sig hexutil.Bytes
+}
+
+//go:generate gencodec -type Message -field-override messageOverride -out gen_message_json.go
+
+// Message is the RPC representation of a whisper message.
+type Message struct {
+	Sig       []byte    `json:"sig,omitempty"`
+	TTL       uint32    `json:"ttl"`
+	Timestamp uint32    `json:"timestamp"`
+	Topic     TopicType `json:"topic"`
+	Payload   []byte    `json:"payload"`
+	Padding   []byte    `json:"padding"`
+	PoW       float64   `json:"pow"`
+	Hash      []byte    `json:"hash"`
+	Dst       []byte    `json:"recipientPublicKey,omitempty"`
+	Seq       uint64    `json:"seq,omitempty"`
+	Redacts   []byte    `json:"redacts,omitempty"`
+	Priority  int       `json:"priority,omitempty"`
+}
+
+type messageOverride struct {
+	Sig     hexutil.Bytes
+	Payload hexutil.Bytes
+	Padding hexutil.Bytes
+	Hash    hexutil.Bytes
+	Dst     hexutil.Bytes
+	Redacts hexutil.Bytes
+}
+
+// ToWhisperMessage converts an internal message into an API version.
+func ToWhisperMessage(message *ReceivedMessage) *Message {
+	msg := Message{
+		Payload:   message.Payload,
+		Padding:   message.Padding,
+		Timestamp: message.Sent,
+		TTL:       message.TTL,
+		PoW:       message.PoW,
+		Hash:      message.EnvelopeHash.Bytes(),
+		Topic:     message.Topic,
+		Seq:       message.Seq,
+		Priority:  message.Priority,
+	}
+	if message.IsTombstone() {
+		msg.Redacts = message.Redacts.Bytes()
+	}
+
+	if message.Dst != nil {
+		b := crypto.FromECDSAPub(message.Dst)
+		if b != nil {
+			msg.Dst = b
+		}
+	}
+
+	if isMessageSigned(message.Raw[0]) {
+		b := crypto.FromECDSAPub(message.SigToPubKey())
+		if b != nil {
+			msg.Sig = b
+		}
+	}
+
+	return &msg
+}
+
+// toMessage converts a set of messages to its RPC representation.
+func toMessage(messages []*ReceivedMessage) []*Message {
+	msgs := make([]*Message, len(messages))
+	for i, msg := range messages {
+		msgs[i] = ToWhisperMessage(msg)
+	}
+	return msgs
+}
@@ -0,0 +1,177 @@
+// Copyright 2017 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+// +build !whisperlite
+
+// Contains the traffic sampler, exporting the anonymized metadata of the
+// envelopes for the network research.
+//
+// The samples are built from scratch out of the coarse metadata only: the
+// payload (encrypted or not) is never touched, and the topics are replaced by
+// their keyed hashes. The key is random and never leaves the sampler, so the
+// hashed topics can be correlated within a single export, but neither reversed
+// by trying all the topics, nor linked across the nodes or the restarts.
+
+package whisperv6
+
+import (
+	"crypto/hmac"
+	crand "crypto/rand"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	mrand "math/rand"
+	"sync"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common/hexutil"
+)
+
+const (
+	samplerQueueLimit = 1024 // number of samples awaiting the export
+	sampleTopicLength = 8    // length of the hashed topics in bytes
+	sampleTimeBucket  = 60   // granularity of the sample timestamps in seconds
+)
+
+// TrafficSample is the anonymized metadata of a single envelope.
+type TrafficSample struct {
+	Time  int64         `json:"time"`  // Arrival time, rounded down to the minute
+	Size  int           `json:"size"`  // Envelope size, rounded up to a power of two
+	PoW   float64       `json:"pow"`   // Proof of work, rounded down to a power of two
+	TTL   uint32        `json:"ttl"`   // Time-to-live in seconds
+	Topic hexutil.Bytes `json:"topic"` // Keyed hash of the topic
+}
+
+// Sampler exports the anonymized samples of the envelopes added to the pool of
+// the node as a stream of JSON objects, e.g. to a file or a network connection.
+type Sampler struct {
+	whisper *Whisper
+	out     io.Writer
+	rate    float64
+	key     []byte
+
+	mu   sync.Mutex
+	err  error // First export error, which stops the sampler
+	quit chan struct{}
+	wg   sync.WaitGroup
+}
+
+// NewSampler creates a sampler of the envelopes of the node, exporting the
+// given fraction of them (in the range (0, 1]) to the writer.
+func NewSampler(whisper *Whisper, out io.Writer, rate float64) (*Sampler, error) {
+	if rate <= 0 || rate > 1 {
+		return nil, fmt.Errorf("invalid sampling rate: %f", rate)
+	}
+	key := make([]byte, sha256.Size)
+	if _, err := crand.Read(key); err != nil {
+		return nil, err
+	}
+	return &Sampler{whisper: whisper, out: out, rate: rate, key: key}, nil
+}
+
+// Start starts sampling the envelopes. The node must be started before.
+func (s *Sampler) Start() {
+	s.quit = make(chan struct{})
+	ch := make(chan *Envelope, samplerQueueLimit)
+	sub := s.whisper.SubscribeEnvelopes(ch)
+	queue := make(chan *TrafficSample, samplerQueueLimit)
+
+	s.wg.Add(2)
+	go func() {
+		defer s.wg.Done()
+		defer sub.Unsubscribe()
+		defer close(queue)
+		s.collect(ch, sub.Err(), queue)
+	}()
+	go func() {
+		defer s.wg.Done()
+		s.export(queue)
+	}()
+}
+
+// collect samples the envelopes, until the sampler or the node is stopped. The
+// subscription must not be blocked by a slow writer, so the samples not fitting
+// into the queue are dropped.
+func (s *Sampler) collect(ch <-chan *Envelope, errc <-chan error, queue chan<- *TrafficSample) {
+	for {
+		select {
+		case envelope := <-ch:
+			if mrand.Float64() >= s.rate {
+				continue
+			}
+			select {
+			case queue <- s.sample(envelope, time.Now()):
+			default:
+				s.whisper.poolLog.Debug("traffic sample queue overflow")
+			}
+		case <-errc:
+			return
+		case <-s.quit:
+			return
+		}
+	}
+}
+
+// export writes the samples, until the queue is closed or the writer fails.
+func (s *Sampler) export(queue <-chan *TrafficSample) {
+	enc := json.NewEncoder(s.out)
+	for sample := range queue {
+		if err := enc.Encode(sample); err != nil {
+			s.mu.Lock()
+			s.err = err
+			s.mu.Unlock()
+			s.whisper.poolLog.Warn("traffic sample export failed", "err", err)
+			for range queue {
+				// keep draining until the collector is stopped
+			}
+			return
+		}
+	}
+}
+
+// Stop stops the sampler, returning the export error (if any).
+func (s *Sampler) Stop() error {
+	close(s.quit)
+	s.wg.Wait()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.err
+}
+
+// sample builds the anonymized sample of the envelope.
+func (s *Sampler) sample(envelope *Envelope, now time.Time) *TrafficSample {
+	mac := hmac.New(sha256.New, s.key)
+	mac.Write(envelope.Topic[:])
+
+	size := 1
+	for size < envelope.size() {
+		size <<= 1
+	}
+	var pow float64
+	if p := envelope.PoW(); p > 0 {
+		pow = math.Exp2(math.Floor(math.Log2(p)))
+	}
+	return &TrafficSample{
+		Time:  now.Unix() - now.Unix()%sampleTimeBucket,
+		Size:  size,
+		PoW:   pow,
+		TTL:   envelope.TTL,
+		Topic: mac.Sum(nil)[:sampleTopicLength],
+	}
+}
@@ -0,0 +1,89 @@
+// Copyright 2017 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+// +build !whisperlite
+
+package whisperv6
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestSampler(t *testing.T) {
+	InitSingleTest()
+
+	w := New(&DefaultConfig)
+	w.SetMinimumPowTest(0.0000001)
+	defer w.SetMinimumPowTest(DefaultMinimumPoW)
+	w.Start(nil)
+	defer w.Stop()
+
+	if _, err := NewSampler(w, new(bytes.Buffer), 0); err == nil {
+		t.Fatalf("zero sampling rate accepted.")
+	}
+	out := new(bytes.Buffer)
+	sampler, err := NewSampler(w, out, 1)
+	if err != nil {
+		t.Fatalf("failed to create sampler: %s.", err)
+	}
+	sampler.Start()
+
+	now := uint32(time.Now().Unix())
+	payload := []byte("secret payload of the sampled envelope")
+	topics := []TopicType{{0xde, 0xad, 0xbe, 0xef}, {0xde, 0xad, 0xbe, 0xef}, {0xca, 0xfe, 0xba, 0xbe}}
+	for i, topic := range topics {
+		env := &Envelope{Expiry: now + DefaultTTL, TTL: DefaultTTL, Topic: topic, Data: append(payload, byte(i)), Nonce: uint64(seed)}
+		if err := w.Send(env); err != nil {
+			t.Fatalf("failed to send envelope with seed %d: %s.", seed, err)
+		}
+	}
+	time.Sleep(100 * time.Millisecond)
+	if err := sampler.Stop(); err != nil {
+		t.Fatalf("failed to export samples: %s.", err)
+	}
+
+	// neither the payload nor the raw topics may leave the node
+	for _, secret := range [][]byte{payload, topics[0][:], topics[2][:]} {
+		if bytes.Contains(out.Bytes(), secret) || bytes.Contains(out.Bytes(), []byte(hex.EncodeToString(secret))) {
+			t.Fatalf("sample exported the raw data %x.", secret)
+		}
+	}
+
+	var samples []TrafficSample
+	dec := json.NewDecoder(out)
+	for dec.More() {
+		var sample TrafficSample
+		if err := dec.Decode(&sample); err != nil {
+			t.Fatalf("failed to decode sample: %s.", err)
+		}
+		samples = append(samples, sample)
+	}
+	if len(samples) != len(topics) {
+		t.Fatalf("wrong number of samples: %d.", len(samples))
+	}
+	for i, sample := range samples {
+		if sample.Size&(sample.Size-1) != 0 || sample.Time%sampleTimeBucket != 0 || sample.TTL != DefaultTTL {
+			t.Fatalf("sample %d not anonymized: %+v.", i, sample)
+		}
+	}
+	if !bytes.Equal(samples[0].Topic, samples[1].Topic) || bytes.Equal(samples[0].Topic, samples[2].Topic) {
+		t.Fatalf("hashed topics do not preserve the topic identity.")
+	}
+}
@@ -0,0 +1,108 @@
+// Copyright 2017 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package whisperv6
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"fmt"
+)
+
+// envelopeSchema describes the lengths of the fields of the envelopes (and the
+// related protocol messages) of a particular version, so that the validation
+// does not depend on the constants of the current version.
+type envelopeSchema struct {
+	version         uint64
+	aesKeyLength    int // length of the symmetric keys
+	aesNonceLength  int // length of the salt (AES-GCM nonce) appended to the symmetric ciphertext
+	signatureLength int // length of the signature appended to the signed payload
+	bloomFilterSize int // length of the bloom filters exchanged by the peers
+	minDataSize     int // minimum length of the (encrypted) envelope data, zero if not enforced
+}
+
+// envelopeSchemas lists the schemas of all the supported versions.
+var envelopeSchemas = map[uint64]*envelopeSchema{
+	6: {
+		version:         6,
+		aesKeyLength:    aesKeyLength,
+		aesNonceLength:  aesNonceLength,
+		signatureLength: signatureLength,
+		bloomFilterSize: BloomFilterSize,
+	},
+}
+
+// defaultSchema is the schema of the current version, used for the envelopes
+// originated by the node and for its local encrypted formats.
+var defaultSchema = envelopeSchemas[ProtocolVersion]
+
+// schemaFor returns the schema of the specified version.
+func schemaFor(version uint64) (*envelopeSchema, error) {
+	schema, ok := envelopeSchemas[version]
+	if !ok {
+		return nil, unknownVersionError(version)
+	}
+	return schema, nil
+}
+
+// validate checks the lengths of the envelope fields against the schema.
+func (s *envelopeSchema) validate(e *Envelope) error {
+	if len(e.Data) < s.minDataSize {
+		return fmt.Errorf("envelope data too short for version %d: %d < %d", s.version, len(e.Data), s.minDataSize)
+	}
+	return e.validFlags()
+}
+
+// schemaOf returns the schema of the protocol version the envelope was received
+// in, or the schema of the node for its own envelopes.
+func (whisper *Whisper) schemaOf(envelope *Envelope) *envelopeSchema {
+	if envelope.schema != nil {
+		return envelope.schema
+	}
+	return whisper.schema
+}
+
+// newGCM creates the AES-GCM cipher with the key and the nonce lengths of the
+// schema.
+func (s *envelopeSchema) newGCM(key []byte) (cipher.AEAD, error) {
+	if len(key) != s.aesKeyLength {
+		return nil, fmt.Errorf("invalid key length for version %d: %d", s.version, len(key))
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCMWithNonceSize(block, s.aesNonceLength)
+}
+
+// salt returns the trailing bytes of the envelope data, which are the salt
+// (AES-GCM nonce) if the envelope is symmetrically encrypted, or nil if the data
+// is too short to carry it.
+func (s *envelopeSchema) salt(e *Envelope) []byte {
+	if len(e.Data) <= s.aesNonceLength {
+		return nil
+	}
+	return e.Data[len(e.Data)-s.aesNonceLength:]
+}
+
+// validBloom checks the length of the bloom filter against the schema. If
+// allowEmpty is set, the empty bloom filter (meaning no filter) is also valid.
+func (s *envelopeSchema) validBloom(bloom []byte, allowEmpty bool) error {
+	if len(bloom) == s.bloomFilterSize || (allowEmpty && len(bloom) == 0) {
+		return nil
+	}
+	return fmt.Errorf("wrong bloom filter size %d", len(bloom))
+}
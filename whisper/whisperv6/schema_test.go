@@ -0,0 +1,104 @@
+// Copyright 2017 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package whisperv6
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/crypto"
+)
+
+func TestEnvelopeSchema(t *testing.T) {
+	if _, err := schemaFor(ProtocolVersion - 1); err == nil {
+		t.Fatalf("schema of unsupported version found.")
+	}
+	schema, err := schemaFor(ProtocolVersion)
+	if err != nil {
+		t.Fatalf("schema of the current version not found: %s.", err)
+	}
+
+	if err = schema.validBloom(make([]byte, BloomFilterSize), false); err != nil {
+		t.Fatalf("valid bloom filter rejected: %s.", err)
+	}
+	if err = schema.validBloom(nil, false); err == nil {
+		t.Fatalf("empty bloom filter accepted.")
+	}
+	if err = schema.validBloom(nil, true); err != nil {
+		t.Fatalf("empty bloom filter rejected: %s.", err)
+	}
+
+	strict := *schema
+	strict.minDataSize = strict.aesNonceLength
+	if err = strict.validate(&Envelope{Data: make([]byte, strict.aesNonceLength-1)}); err == nil {
+		t.Fatalf("short envelope data accepted.")
+	}
+	if err = strict.validate(&Envelope{Data: make([]byte, strict.aesNonceLength)}); err != nil {
+		t.Fatalf("envelope data rejected: %s.", err)
+	}
+}
+
+func TestEnvelopeSchemaLengths(t *testing.T) {
+	InitSingleTest()
+
+	// a schema with the shorter keys and the longer nonces than the default
+	custom := *defaultSchema
+	custom.version, custom.aesKeyLength, custom.aesNonceLength = ProtocolVersion+1, 16, 16
+
+	params, err := generateMessageParams()
+	if err != nil {
+		t.Fatalf("failed generateMessageParams with seed %d: %s.", seed, err)
+	}
+	msg, err := NewSentMessage(params)
+	if err != nil {
+		t.Fatalf("failed to create new message with seed %d: %s.", seed, err)
+	}
+	if err = msg.sign(params.Src); err != nil {
+		t.Fatalf("failed to sign with seed %d: %s.", seed, err)
+	}
+	key := params.KeySym[:custom.aesKeyLength]
+	aesgcm, err := custom.newGCM(key)
+	if err != nil {
+		t.Fatalf("failed to create the cipher of the custom schema: %s.", err)
+	}
+	nonce := make([]byte, custom.aesNonceLength)
+	env := &Envelope{
+		Expiry: params.TTL + 1,
+		TTL:    params.TTL,
+		Topic:  params.Topic,
+		Data:   append(aesgcm.Seal(nil, nonce, msg.Raw, nil), nonce...),
+		schema: &custom,
+	}
+
+	filter := &Filter{KeySym: key, Topics: [][]byte{params.Topic[:]}}
+	received := env.Open(filter)
+	if received == nil {
+		t.Fatalf("failed to open the envelope of the custom schema with seed %d.", seed)
+	}
+	if !bytes.Equal(received.Payload, params.Payload) {
+		t.Fatalf("wrong payload with seed %d.", seed)
+	}
+	if !IsPubKeyEqual(received.Src, &params.Src.PublicKey) {
+		t.Fatalf("wrong signer with seed %d: %x.", seed, crypto.FromECDSAPub(received.Src))
+	}
+
+	// the same envelope received from a peer of the default version
+	env.schema = nil
+	if env.Open(filter) != nil {
+		t.Fatalf("envelope of the custom schema opened with the default one.")
+	}
+}
@@ -0,0 +1,260 @@
+// Copyright 2017 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package whisperv6
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"runtime"
+	"sync"
+	"time"
+
+	"github.com/ethereum/go-ethereum/log"
+)
+
+// workBankBenchmarkTime is the time each worker spends hashing on startup,
+// in order to warm up and to measure the local hash rate.
+const workBankBenchmarkTime = 50 * time.Millisecond
+
+var errWorkBankStopped = errors.New("work bank stopped")
+
+// sealJob is a part of the nonce space to be searched by a single worker.
+type sealJob struct {
+	ctx    context.Context
+	env    *Envelope
+	start  uint64
+	step   uint64
+	target int
+	finish int64
+	report func(int, uint64)
+	result chan<- sealResult
+}
+
+// sealResult is the outcome of a single sealJob.
+type sealResult struct {
+	nonce   uint64
+	bestBit int
+	err     error
+}
+
+// WorkBank keeps a fixed number of sealing workers running in the background,
+// each locked to its own OS thread. The workers are reserved by the interactive
+// sends, which therefore start sealing without any queueing delay, and with a
+// guaranteed number of threads searching the nonce space in parallel.
+type WorkBank struct {
+	size  int
+	jobs  chan *sealJob // jobs dispatched to the idle workers
+	slots chan struct{} // tokens of the workers not reserved by any send
+
+	reserveMu sync.Mutex // serializes the reservations, preventing deadlocks
+	rateMu    sync.RWMutex
+	hashRate  float64 // total hashes per second, measured on startup
+
+	quit chan struct{}
+	wg   sync.WaitGroup
+}
+
+// NewWorkBank creates a work bank with the specified number of workers. If the
+// size is not positive, the number of available CPUs is used.
+func NewWorkBank(size int) *WorkBank {
+	if size <= 0 {
+		size = runtime.NumCPU()
+	}
+	bank := &WorkBank{
+		size:  size,
+		jobs:  make(chan *sealJob),
+		slots: make(chan struct{}, size),
+		quit:  make(chan struct{}),
+	}
+	for i := 0; i < size; i++ {
+		bank.slots <- struct{}{}
+	}
+	return bank
+}
+
+// Start launches the workers, each of them benchmarking its hash rate first.
+func (bank *WorkBank) Start() {
+	bank.wg.Add(bank.size)
+	for i := 0; i < bank.size; i++ {
+		go bank.work()
+	}
+}
+
+// Stop terminates the workers and waits for them to exit.
+func (bank *WorkBank) Stop() {
+	close(bank.quit)
+	bank.wg.Wait()
+}
+
+// Size returns the total number of workers in the bank.
+func (bank *WorkBank) Size() int {
+	return bank.size
+}
+
+// HashRate returns the total number of hashes per second achievable by all
+// the workers, as measured on startup.
+func (bank *WorkBank) HashRate() float64 {
+	bank.rateMu.RLock()
+	defer bank.rateMu.RUnlock()
+	return bank.hashRate
+}
+
+// work is the main loop of a single worker.
+func (bank *WorkBank) work() {
+	defer bank.wg.Done()
+
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+
+	bank.benchmark()
+	for {
+		select {
+		case job := <-bank.jobs:
+			nonce, bestBit, err := job.env.mine(job.ctx, job.start, job.step, job.target, job.finish, job.report)
+			job.result <- sealResult{nonce: nonce, bestBit: bestBit, err: err}
+		case <-bank.quit:
+			return
+		}
+	}
+}
+
+// benchmark measures the hash rate of the worker and adds it to the total.
+func (bank *WorkBank) benchmark() {
+	rate := measureHashRate(workBankBenchmarkTime)
+
+	bank.rateMu.Lock()
+	bank.hashRate += rate
+	bank.rateMu.Unlock()
+}
+
+// reserve blocks until the requested number of workers is available, or the
+// context is cancelled.
+func (bank *WorkBank) reserve(ctx context.Context, threads int) error {
+	bank.reserveMu.Lock()
+	defer bank.reserveMu.Unlock()
+
+	for i := 0; i < threads; i++ {
+		select {
+		case <-bank.slots:
+		case <-ctx.Done():
+			bank.release(i)
+			return ctx.Err()
+		case <-bank.quit:
+			bank.release(i)
+			return errWorkBankStopped
+		}
+	}
+	return nil
+}
+
+// release returns the reserved workers back to the bank.
+func (bank *WorkBank) release(threads int) {
+	for i := 0; i < threads; i++ {
+		bank.slots <- struct{}{}
+	}
+}
+
+// Seal closes the envelope as Envelope.SealContext does, but splits the work
+// between the specified number of reserved workers. If threads is not positive,
+// all the workers of the bank are used.
+func (bank *WorkBank) Seal(ctx context.Context, env *Envelope, options *MessageParams, threads int, progress SealProgress) error {
+	if options.PoW == 0 {
+		// PoW is not required
+		return nil
+	}
+	if threads <= 0 {
+		threads = bank.size
+	}
+	if threads > bank.size {
+		return fmt.Errorf("too many threads requested [%d>%d]", threads, bank.size)
+	}
+	if err := bank.reserve(ctx, threads); err != nil {
+		return err
+	}
+	defer bank.release(threads)
+
+	target := env.sealTarget(options)
+	finish := time.Now().Add(time.Duration(options.WorkTime) * time.Second).UnixNano()
+
+	var (
+		mu      sync.Mutex
+		bestBit int
+		tried   = make([]uint64, threads)
+		results = make(chan sealResult, threads)
+	)
+	mineCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	for i := 0; i < threads; i++ {
+		job := &sealJob{
+			ctx:    mineCtx,
+			env:    env,
+			start:  uint64(i),
+			step:   uint64(threads),
+			target: target,
+			finish: finish,
+			result: results,
+		}
+		if progress != nil {
+			id := i
+			job.report = func(bits int, n uint64) {
+				mu.Lock()
+				defer mu.Unlock()
+				if bits > bestBit {
+					bestBit = bits
+				}
+				tried[id] = n
+				var total uint64
+				for _, t := range tried {
+					total += t
+				}
+				progress(env.bitsToPoW(bestBit), total)
+			}
+		}
+		select {
+		case bank.jobs <- job:
+		case <-bank.quit:
+			return errWorkBankStopped
+		}
+	}
+
+	var best sealResult
+	var err error
+	for i := 0; i < threads; i++ {
+		res := <-results
+		if res.err != nil && err == nil && ctx.Err() != nil {
+			err = res.err
+		}
+		if res.bestBit > best.bestBit {
+			best = res
+		}
+		if target > 0 && res.bestBit >= target {
+			cancel() // target reached, stop the other workers
+		}
+	}
+	env.Nonce, env.pow = best.nonce, 0
+	if err != nil {
+		return err
+	}
+
+	if target > 0 && best.bestBit < target {
+		return fmt.Errorf("failed to reach the PoW target, specified pow time (%d seconds) was insufficient", options.WorkTime)
+	}
+	log.Trace("envelope sealed by work bank", "threads", threads, "pow", env.bitsToPoW(best.bestBit))
+	return nil
+}
@@ -0,0 +1,132 @@
+// Copyright 2017 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package whisperv6
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestWorkBankSeal(t *testing.T) {
+	InitSingleTest()
+
+	bank := NewWorkBank(4)
+	bank.Start()
+	defer bank.Stop()
+
+	params, err := generateMessageParams()
+	if err != nil {
+		t.Fatalf("failed generateMessageParams with seed %d: %s.", seed, err)
+	}
+	// the target must be reachable within the work time even with the race
+	// detector, regardless of the seed
+	params.TTL = 10
+	params.Payload = make([]byte, 64)
+	params.Padding = nil
+	msg, err := NewSentMessage(params)
+	if err != nil {
+		t.Fatalf("failed to create new message with seed %d: %s.", seed, err)
+	}
+	env, err := msg.wrap(params)
+	if err != nil {
+		t.Fatalf("failed to wrap with seed %d: %s.", seed, err)
+	}
+
+	params.WorkTime = 4
+	params.PoW = 0.01
+	var reports int
+	progress := func(float64, uint64) { reports++ }
+	if err = bank.Seal(context.Background(), env, params, 2, progress); err != nil {
+		t.Fatalf("failed to seal with seed %d: %s.", seed, err)
+	}
+	if env.PoW() < params.PoW {
+		t.Fatalf("failed to reach the target with seed %d: %f < %f.", seed, env.PoW(), params.PoW)
+	}
+	if reports == 0 {
+		t.Fatalf("no progress reported with seed %d.", seed)
+	}
+	if bank.HashRate() <= 0 {
+		t.Fatalf("hash rate not measured: %f.", bank.HashRate())
+	}
+	if err = bank.Seal(context.Background(), env, params, 5, nil); err == nil {
+		t.Fatalf("reserved more threads than available.")
+	}
+}
+
+func TestWorkBankReservation(t *testing.T) {
+	InitSingleTest()
+
+	bank := NewWorkBank(2)
+	bank.Start()
+	defer bank.Stop()
+
+	if err := bank.reserve(context.Background(), 2); err != nil {
+		t.Fatalf("failed to reserve workers: %s.", err)
+	}
+
+	// all the workers are busy, the next reservation must wait
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if err := bank.reserve(ctx, 1); err != context.DeadlineExceeded {
+		t.Fatalf("reservation did not block: %v.", err)
+	}
+
+	bank.release(2)
+	if err := bank.reserve(context.Background(), 2); err != nil {
+		t.Fatalf("failed to reserve the released workers: %s.", err)
+	}
+	bank.release(2)
+}
+
+func TestHashRateCalibration(t *testing.T) {
+	w := New(&DefaultConfig)
+	if w.Stats().HashRate() != 0 || w.ExpectedPoW(typicalEnvelopeSize, DefaultTTL, time.Second) != 0 || w.SealTime(1, typicalEnvelopeSize, DefaultTTL) != 0 {
+		t.Fatalf("estimates available before the calibration.")
+	}
+
+	w.calibrate()
+	if w.Stats().HashRate() <= 0 {
+		t.Fatalf("hash rate not measured: %f.", w.Stats().HashRate())
+	}
+	short := w.ExpectedPoW(typicalEnvelopeSize, DefaultTTL, time.Second)
+	long := w.ExpectedPoW(typicalEnvelopeSize, DefaultTTL, 10*time.Second)
+	if short <= 0 || long <= short {
+		t.Fatalf("wrong expected PoW: %f, %f.", short, long)
+	}
+	if d := w.SealTime(short, typicalEnvelopeSize, DefaultTTL); d <= 0 || d > time.Second {
+		t.Fatalf("wrong seal time of the expected PoW: %v.", d)
+	}
+	if w.SealTime(2*long, typicalEnvelopeSize, DefaultTTL) <= w.SealTime(long, typicalEnvelopeSize, DefaultTTL) {
+		t.Fatalf("seal time does not grow with the PoW.")
+	}
+}
+
+func TestSealThreadsConfig(t *testing.T) {
+	for _, threads := range []int{-1, 3} {
+		cfg := DefaultConfig
+		cfg.SealWorkers, cfg.SealThreads = 2, threads
+		if w := New(&cfg); w.sealThreads != 0 {
+			t.Fatalf("invalid seal threads %d not replaced by all the workers: %d.", threads, w.sealThreads)
+		}
+	}
+	cfg := DefaultConfig
+	cfg.SealWorkers, cfg.SealThreads = 2, 1
+	if w := New(&cfg); w.sealThreads != 1 {
+		t.Fatalf("valid seal threads not kept: %d.", w.sealThreads)
+	}
+}
@@ -0,0 +1,159 @@
+// Copyright 2017 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+// +build !whisperlite
+
+// Contains the self-test of the whisper node, validating the builds and the
+// deployments.
+
+package whisperv6
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"sort"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+)
+
+// selfTestPoW is the PoW of the loopback envelopes, low enough to be sealed instantly.
+const selfTestPoW = 0.001
+
+// SelfTestCheck is the outcome of a single loopback check.
+type SelfTestCheck struct {
+	Name   string `json:"name"`
+	Passed bool   `json:"passed"`
+	Error  string `json:"error,omitempty"`
+}
+
+// SelfTestReport is the outcome of the self-test.
+type SelfTestReport struct {
+	Passed bool            `json:"passed"`
+	Checks []SelfTestCheck `json:"checks"`
+}
+
+// selfTestMode is a cipher mode exercised by the self-test.
+type selfTestMode struct {
+	name      string
+	symmetric bool
+	signed    bool
+}
+
+var selfTestModes = []selfTestMode{
+	{"symmetric", true, false},
+	{"symmetric-signed", true, true},
+	{"asymmetric", false, false},
+	{"asymmetric-signed", false, true},
+}
+
+// SelfTest posts loopback messages in every supported envelope version and
+// cipher mode, using a throwaway identity and symmetric key, and verifies their
+// proof of work and delivery to the filters. The envelopes are delivered to a
+// private set of filters, they are neither pooled nor broadcast.
+func (whisper *Whisper) SelfTest(ctx context.Context) *SelfTestReport {
+	report := &SelfTestReport{Passed: true}
+
+	versions := make([]uint64, 0, len(envelopeSchemas))
+	for version := range envelopeSchemas {
+		versions = append(versions, version)
+	}
+	sort.Slice(versions, func(i, j int) bool { return versions[i] < versions[j] })
+
+	for _, version := range versions {
+		for _, mode := range selfTestModes {
+			check := SelfTestCheck{Name: fmt.Sprintf("v%d/%s", version, mode.name), Passed: true}
+			if err := ctx.Err(); err != nil {
+				check.Passed, check.Error = false, err.Error()
+			} else if err := whisper.selfTestLoopback(envelopeSchemas[version], mode); err != nil {
+				check.Passed, check.Error = false, err.Error()
+			}
+			report.Passed = report.Passed && check.Passed
+			report.Checks = append(report.Checks, check)
+		}
+	}
+	return report
+}
+
+// selfTestLoopback seals a message in the given version and cipher mode, and
+// checks that it is delivered to a matching filter.
+func (whisper *Whisper) selfTestLoopback(schema *envelopeSchema, mode selfTestMode) error {
+	identity, err := crypto.GenerateKey()
+	if err != nil {
+		return fmt.Errorf("failed to generate identity: %v", err)
+	}
+	symKey, err := generateSecureRandomData(schema.aesKeyLength)
+	if err != nil {
+		return fmt.Errorf("failed to generate symmetric key: %v", err)
+	}
+	payload, err := generateSecureRandomData(32)
+	if err != nil {
+		return fmt.Errorf("failed to generate payload: %v", err)
+	}
+
+	params := &MessageParams{
+		TTL:      DefaultTTL,
+		Topic:    TopicType{0x5e, 0x1f, 0x7e, 0x57},
+		Payload:  payload,
+		PoW:      selfTestPoW,
+		WorkTime: 1,
+	}
+	filter := &Filter{
+		Topics:   [][]byte{params.Topic[:]},
+		Messages: make(map[common.Hash]*ReceivedMessage),
+	}
+	if mode.symmetric {
+		params.KeySym, filter.KeySym = symKey, symKey
+	} else {
+		params.Dst, filter.KeyAsym = &identity.PublicKey, identity
+	}
+	if mode.signed {
+		params.Src, filter.Src = identity, &identity.PublicKey
+	}
+
+	msg, err := NewSentMessage(params)
+	if err != nil {
+		return fmt.Errorf("failed to create message: %v", err)
+	}
+	env, err := msg.Wrap(params)
+	if err != nil {
+		return fmt.Errorf("failed to seal envelope: %v", err)
+	}
+	if err = schema.validate(env); err != nil {
+		return err
+	}
+	if env.PoW() < selfTestPoW {
+		return fmt.Errorf("insufficient proof of work: %f < %f", env.PoW(), selfTestPoW)
+	}
+
+	filters := NewFilters(whisper)
+	if _, err = filters.Install(filter); err != nil {
+		return fmt.Errorf("failed to install filter: %v", err)
+	}
+	filters.NotifyWatchers(env, false)
+	mail := filter.Retrieve()
+	if len(mail) != 1 {
+		return fmt.Errorf("wrong number of delivered messages: %d", len(mail))
+	}
+	if !bytes.Equal(mail[0].Payload, payload) {
+		return fmt.Errorf("payload corrupted")
+	}
+	if mode.signed && !IsPubKeyEqual(mail[0].Src, &identity.PublicKey) {
+		return fmt.Errorf("wrong signature")
+	}
+	return nil
+}
@@ -0,0 +1,44 @@
+// Copyright 2017 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+// +build !whisperlite
+
+package whisperv6
+
+import (
+	"context"
+	"testing"
+)
+
+func TestSelfTest(t *testing.T) {
+	w := New(&DefaultConfig)
+	report := w.SelfTest(context.Background())
+	if !report.Passed {
+		t.Fatalf("self-test failed: %+v.", report.Checks)
+	}
+	if n := len(report.Checks); n != len(envelopeSchemas)*len(selfTestModes) {
+		t.Fatalf("wrong number of checks: %d.", n)
+	}
+	if len(w.Envelopes()) != 0 || len(w.filters.watchers) != 0 {
+		t.Fatalf("self-test left traces in the node.")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if report = w.SelfTest(ctx); report.Passed || report.Checks[0].Error == "" {
+		t.Fatalf("cancelled self-test passed.")
+	}
+}
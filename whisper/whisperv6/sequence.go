@@ -0,0 +1,148 @@
+// Copyright 2017 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+// Contains the detection of the gaps in the sequence numbers of the messages,
+// which allows the applications to recover the missed messages.
+
+package whisperv6
+
+import (
+	"sync"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/event"
+	lru "github.com/hashicorp/golang-lru"
+)
+
+// GapEvent is an event emitted when the messages From to To (inclusive) of the
+// channel of the sender were missed by the node.
+type GapEvent struct {
+	Sender hexutil.Bytes `json:"sender"` // public key of the sender
+	Topic  TopicType     `json:"topic"`
+	From   uint64        `json:"from"`
+	To     uint64        `json:"to"`
+}
+
+// channelKey identifies the channel of the sender, i.e. the messages signed by
+// the same key with the same topic.
+type channelKey struct {
+	sender common.Hash
+	topic  TopicType
+}
+
+// sequenceTracker remembers the recent sequence numbers of the recently active
+// channels, detecting the gaps.
+type sequenceTracker struct {
+	mu       sync.Mutex
+	channels *lru.Cache // channelKey -> *channelState
+}
+
+// channelState is the state of the channel of the sender.
+type channelState struct {
+	last uint64     // highest sequence number received so far
+	seen []seenItem // recently received sequence numbers, oldest first
+}
+
+// seenItem records when the message with the sequence number was sent.
+type seenItem struct {
+	seq  uint64
+	sent uint32
+}
+
+func newSequenceTracker() *sequenceTracker {
+	channels, _ := lru.New(sequenceLimit)
+	return &sequenceTracker{channels: channels}
+}
+
+// channelOf returns the key of the channel of the sender.
+func channelOf(sender []byte, topic TopicType) channelKey {
+	return channelKey{sender: crypto.Keccak256Hash(sender), topic: topic}
+}
+
+// observe records the sequence number of the message, returning the gap since
+// the previous message of the channel, if any. The unsigned messages, as well
+// as the duplicate and the reordered ones, do not produce gaps.
+func (t *sequenceTracker) observe(msg *ReceivedMessage) *GapEvent {
+	if msg.Seq == 0 || msg.Src == nil {
+		return nil
+	}
+	sender := crypto.FromECDSAPub(msg.Src)
+	key := channelOf(sender, msg.Topic)
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	var state *channelState
+	if cached, ok := t.channels.Get(key); ok {
+		state = cached.(*channelState)
+	} else {
+		state = new(channelState)
+		t.channels.Add(key, state)
+	}
+	state.seen = append(state.seen, seenItem{seq: msg.Seq, sent: msg.Sent})
+	if len(state.seen) > sequenceHistory {
+		state.seen = state.seen[1:]
+	}
+
+	last := state.last
+	if msg.Seq <= last {
+		return nil
+	}
+	state.last = msg.Seq
+	if last == 0 || msg.Seq == last+1 {
+		return nil
+	}
+	return &GapEvent{Sender: sender, Topic: msg.Topic, From: last + 1, To: msg.Seq - 1}
+}
+
+// bounds returns the time range within which the messages From to To of the
+// channel were sent, according to the messages received around the gap. The
+// upper bound is zero if unknown.
+func (t *sequenceTracker) bounds(key channelKey, from, to uint64) (lower, upper uint32) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	cached, ok := t.channels.Get(key)
+	if !ok {
+		return 0, 0
+	}
+	var before, after uint64
+	for _, item := range cached.(*channelState).seen {
+		if item.seq < from && item.seq >= before {
+			before, lower = item.seq, item.sent
+		}
+		if item.seq > to && (after == 0 || item.seq <= after) {
+			after, upper = item.seq, item.sent
+		}
+	}
+	return lower, upper
+}
+
+// SubscribeGapEvents subscribes the given channel to the gaps detected in the
+// sequence numbers of the received messages.
+func (whisper *Whisper) SubscribeGapEvents(ch chan<- *GapEvent) event.Subscription {
+	return whisper.track(whisper.gapFeed.Subscribe(ch))
+}
+
+// observeSequence checks the sequence number of the received message,
+// notifying the subscribers about the detected gap.
+func (whisper *Whisper) observeSequence(msg *ReceivedMessage) {
+	if ev := whisper.sequences.observe(msg); ev != nil {
+		whisper.gapFeed.Send(ev)
+	}
+}
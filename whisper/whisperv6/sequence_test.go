@@ -0,0 +1,83 @@
+// Copyright 2017 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package whisperv6
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+func TestSequenceGaps(t *testing.T) {
+	InitSingleTest()
+
+	w := New(&DefaultConfig)
+	gaps := make(chan *GapEvent, 10)
+	sub := w.SubscribeGapEvents(gaps)
+	defer sub.Unsubscribe()
+
+	params, err := generateMessageParams()
+	if err != nil {
+		t.Fatalf("failed generateMessageParams with seed %d: %s.", seed, err)
+	}
+	params.PoW = 0.0000001
+	filter := &Filter{KeySym: params.KeySym, Topics: [][]byte{params.Topic[:]}}
+	if _, err = w.Subscribe(filter); err != nil {
+		t.Fatalf("failed to subscribe with seed %d: %s.", seed, err)
+	}
+	payload := params.Payload
+
+	for _, seq := range []uint64{1, 2, 5, 5, 3, 6, 9} {
+		params.Seq = seq
+		msg, err := NewSentMessage(params)
+		if err != nil {
+			t.Fatalf("failed to create new message with seed %d: %s.", seed, err)
+		}
+		env, err := msg.Wrap(params)
+		if err != nil {
+			t.Fatalf("failed Wrap with seed %d: %s.", seed, err)
+		}
+		w.filters.NotifyWatchers(env, false)
+	}
+
+	received := filter.Retrieve()
+	if len(received) != 7 {
+		t.Fatalf("wrong number of received messages with seed %d: %d.", seed, len(received))
+	}
+	for _, msg := range received {
+		if msg.Seq == 0 || !bytes.Equal(msg.Payload, payload) {
+			t.Fatalf("sequence header not stripped with seed %d: seq %d.", seed, msg.Seq)
+		}
+	}
+
+	// the duplicate and the late messages do not produce any gaps
+	for _, want := range [][2]uint64{{3, 4}, {7, 8}} {
+		select {
+		case ev := <-gaps:
+			if ev.From != want[0] || ev.To != want[1] || ev.Topic != params.Topic {
+				t.Fatalf("wrong gap with seed %d: %+v, want %v.", seed, ev, want)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("gap %v not detected with seed %d.", want, seed)
+		}
+	}
+	select {
+	case ev := <-gaps:
+		t.Fatalf("unexpected gap with seed %d: %+v.", seed, ev)
+	default:
+	}
+}
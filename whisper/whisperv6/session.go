@@ -0,0 +1,137 @@
+// Copyright 2017 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+// Contains the sessions of the trusted links (e.g. client and mail server),
+// binding the peer-to-peer messages to the identities of both peers. The
+// messages posted to the peer are bound to the session inside the encrypted
+// payload, and the bound messages received outside of their session are
+// dropped after the decryption, so that an envelope spliced from another
+// session is never delivered.
+
+package whisperv6
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/p2p"
+	"github.com/ethereum/go-ethereum/p2p/discover"
+)
+
+const sessionNonceLength = 32
+
+// peerSession is the state of the session with a trusted peer. Once both
+// nonces are exchanged, the transcript hash binds the identities of both peers
+// and the nonces, and is included in every peer-to-peer message.
+type peerSession struct {
+	localNonce  []byte
+	remoteNonce []byte
+	transcript  common.Hash
+	established bool
+}
+
+// sessionMessage is a peer-to-peer message bound to a session.
+type sessionMessage struct {
+	Transcript common.Hash
+	Envelope   *Envelope
+}
+
+// sessionTranscript computes the transcript hash of the session between the
+// two nodes. Both ends compute the same hash, regardless of their roles.
+func sessionTranscript(a discover.NodeID, nonceA []byte, b discover.NodeID, nonceB []byte) common.Hash {
+	if bytes.Compare(a[:], b[:]) > 0 {
+		a, b, nonceA, nonceB = b, a, nonceB, nonceA
+	}
+	return crypto.Keccak256Hash([]byte("shh-session"), a[:], b[:], nonceA, nonceB)
+}
+
+// initSession starts a new session with the peer, sending a fresh nonce.
+func (peer *Peer) initSession() error {
+	nonce, err := generateSecureRandomData(sessionNonceLength)
+	if err != nil {
+		return err
+	}
+	peer.sessionMu.Lock()
+	peer.session = &peerSession{localNonce: nonce}
+	peer.sessionMu.Unlock()
+
+	return p2p.Send(peer.ws, sessionInitCode, nonce)
+}
+
+// handleSessionInit processes the nonce of the peer, replying with a fresh
+// nonce of our own unless the peer answers our own initiation.
+func (peer *Peer) handleSessionInit(nonce []byte) error {
+	if len(nonce) != sessionNonceLength {
+		return fmt.Errorf("invalid session nonce length: %d", len(nonce))
+	}
+	peer.sessionMu.Lock()
+	defer peer.sessionMu.Unlock()
+
+	reply := peer.session == nil || peer.session.established
+	if reply {
+		local, err := generateSecureRandomData(sessionNonceLength)
+		if err != nil {
+			return err
+		}
+		peer.session = &peerSession{localNonce: local}
+	}
+	peer.session.remoteNonce = nonce
+	peer.session.transcript = sessionTranscript(peer.host.self, peer.session.localNonce, peer.peer.ID(), nonce)
+	peer.session.established = true
+
+	if reply {
+		return p2p.Send(peer.ws, sessionInitCode, peer.session.localNonce)
+	}
+	return nil
+}
+
+// sessionTranscript returns the transcript hash of the established session
+// with the peer, if any.
+func (peer *Peer) sessionTranscript() (common.Hash, bool) {
+	peer.sessionMu.Lock()
+	defer peer.sessionMu.Unlock()
+
+	if peer.session == nil || !peer.session.established {
+		return common.Hash{}, false
+	}
+	return peer.session.transcript, true
+}
+
+// sessionWith returns the transcript of the session established with the
+// peer, zero if none.
+func (whisper *Whisper) sessionWith(peerID []byte) common.Hash {
+	p, err := whisper.getPeer(peerID)
+	if err != nil {
+		return common.Hash{}
+	}
+	transcript, _ := p.sessionTranscript()
+	return transcript
+}
+
+// verifySession checks that the peer-to-peer message belongs to the session.
+func (peer *Peer) verifySession(msg *sessionMessage) error {
+	transcript, ok := peer.sessionTranscript()
+	if !ok {
+		return errors.New("no session established")
+	}
+	if msg.Transcript != transcript {
+		return errors.New("session transcript mismatch")
+	}
+	return nil
+}
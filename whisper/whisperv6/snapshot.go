@@ -0,0 +1,93 @@
+// Copyright 2017 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+// Contains the read snapshots of the envelope pool, giving the tools (e.g. mail
+// archival and debugging) a consistent view, unaffected by the expiry.
+
+package whisperv6
+
+import (
+	"bytes"
+	"sort"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+// PoolSnapshot is an immutable view of the envelope pool at a point in time.
+// The envelopes must not be modified.
+type PoolSnapshot struct {
+	taken     time.Time
+	envelopes map[common.Hash]*Envelope
+}
+
+// Snapshot returns the view of the envelopes currently pooled by the node.
+// Unlike the subsequent calls of Envelopes, all the queries of the snapshot
+// see the same set of envelopes, even if some of them expire meanwhile.
+func (whisper *Whisper) Snapshot() *PoolSnapshot {
+	whisper.poolMu.RLock()
+	defer whisper.poolMu.RUnlock()
+
+	envelopes := make(map[common.Hash]*Envelope, len(whisper.envelopes))
+	for hash, envelope := range whisper.envelopes {
+		envelopes[hash] = envelope
+	}
+	return &PoolSnapshot{taken: time.Now(), envelopes: envelopes}
+}
+
+// Time returns the time the snapshot was taken at.
+func (s *PoolSnapshot) Time() time.Time {
+	return s.taken
+}
+
+// Len returns the number of the envelopes in the snapshot.
+func (s *PoolSnapshot) Len() int {
+	return len(s.envelopes)
+}
+
+// Has checks if the envelope was pooled when the snapshot was taken.
+func (s *PoolSnapshot) Has(hash common.Hash) bool {
+	_, ok := s.envelopes[hash]
+	return ok
+}
+
+// Envelope returns the envelope with the given hash, or nil if it was not pooled.
+func (s *PoolSnapshot) Envelope(hash common.Hash) *Envelope {
+	return s.envelopes[hash]
+}
+
+// Hashes returns the hashes of all the envelopes in the snapshot, in ascending
+// order, so that the snapshots of the different nodes are easily compared.
+func (s *PoolSnapshot) Hashes() []common.Hash {
+	hashes := make([]common.Hash, 0, len(s.envelopes))
+	for hash := range s.envelopes {
+		hashes = append(hashes, hash)
+	}
+	sort.Slice(hashes, func(i, j int) bool {
+		return bytes.Compare(hashes[i][:], hashes[j][:]) < 0
+	})
+	return hashes
+}
+
+// Envelopes returns all the envelopes in the snapshot, in the order of Hashes.
+func (s *PoolSnapshot) Envelopes() []*Envelope {
+	hashes := s.Hashes()
+	all := make([]*Envelope, len(hashes))
+	for i, hash := range hashes {
+		all[i] = s.envelopes[hash]
+	}
+	return all
+}
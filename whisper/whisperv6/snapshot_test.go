@@ -0,0 +1,68 @@
+// Copyright 2017 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package whisperv6
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+func TestPoolSnapshot(t *testing.T) {
+	InitSingleTest()
+
+	w := New(&DefaultConfig)
+	w.SetMinimumPowTest(0.0000001)
+	defer w.SetMinimumPowTest(DefaultMinimumPoW)
+
+	now := uint32(time.Now().Unix())
+	short := &Envelope{Expiry: now + 1, TTL: 1, Data: []byte{1}, Nonce: uint64(seed)}
+	long := &Envelope{Expiry: now + DefaultTTL, TTL: DefaultTTL, Data: []byte{2}, Nonce: uint64(seed)}
+	for _, env := range []*Envelope{short, long} {
+		if _, err := w.add(env, false); err != nil {
+			t.Fatalf("failed to add envelope with seed %d: %s.", seed, err)
+		}
+	}
+	snap := w.Snapshot()
+
+	// neither the expiry nor the new envelopes may change the snapshot
+	time.Sleep(2 * time.Second)
+	w.expire()
+	late := &Envelope{Expiry: now + DefaultTTL, TTL: DefaultTTL, Data: []byte{3}, Nonce: uint64(seed)}
+	if _, err := w.add(late, false); err != nil {
+		t.Fatalf("failed to add envelope with seed %d: %s.", seed, err)
+	}
+	if w.isEnvelopeCached(short.Hash()) {
+		t.Fatalf("short-lived envelope did not expire with seed %d.", seed)
+	}
+
+	if snap.Len() != 2 || !snap.Has(short.Hash()) || !snap.Has(long.Hash()) || snap.Has(late.Hash()) {
+		t.Fatalf("snapshot changed after it was taken with seed %d.", seed)
+	}
+	if snap.Envelope(short.Hash()) != short || snap.Envelope(late.Hash()) != nil {
+		t.Fatalf("wrong envelope returned by the snapshot with seed %d.", seed)
+	}
+	hashes := snap.Hashes()
+	if bytes.Compare(hashes[0][:], hashes[1][:]) >= 0 {
+		t.Fatalf("snapshot hashes are not sorted with seed %d.", seed)
+	}
+	for i, env := range snap.Envelopes() {
+		if env.Hash() != hashes[i] {
+			t.Fatalf("snapshot envelopes are not in the order of the hashes with seed %d.", seed)
+		}
+	}
+}
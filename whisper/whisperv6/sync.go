@@ -0,0 +1,223 @@
+// Copyright 2017 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+// Contains the anti-entropy sync of the envelope pools between the peers.
+//
+// Periodically each node sends the digests of its expiry buckets to the peers.
+// The peer replies with the hashes of the envelopes in the buckets with the
+// mismatching digests, and the node in turn requests the envelopes it lacks,
+// and pushes the envelopes the peer lacks. This repairs the gaps left by the
+// push propagation (e.g. envelopes broadcast while the peers were connecting).
+
+package whisperv6
+
+import (
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/p2p"
+)
+
+// maxSyncHashes is the maximum number of hashes in a single sync message,
+// limiting the work a peer can request in one go, and keeping the messages
+// well below the protocol size limit. The hashes of a bucket are listed in a
+// single message, so a listing of maxSyncHashes hashes may be truncated, and
+// is never treated as the complete content of the bucket.
+const maxSyncHashes = 4096
+
+// bucketDigest is the digest of a single expiry bucket, as exchanged by the peers.
+type bucketDigest struct {
+	Index  uint32
+	Digest common.Hash
+}
+
+// bucketHashes lists the hashes of the envelopes in a single expiry bucket.
+type bucketHashes struct {
+	Index  uint32
+	Hashes []common.Hash
+}
+
+// bucketHashes returns the hashes of the envelopes in the specified bucket,
+// excluding the own envelopes which are still held back.
+func (whisper *Whisper) bucketHashes(index uint32) []common.Hash {
+	whisper.poolMu.RLock()
+	defer whisper.poolMu.RUnlock()
+
+	b := whisper.buckets[index]
+	if b == nil {
+		return nil
+	}
+	hashes := make([]common.Hash, 0, len(b.envelopes))
+	for hash := range b.envelopes {
+		if !whisper.isHeld(hash) {
+			hashes = append(hashes, hash)
+		}
+	}
+	return hashes
+}
+
+// syncEnvelopes retrieves the pooled envelopes with the specified hashes,
+// excluding the own envelopes which are still held back.
+func (whisper *Whisper) syncEnvelopes(hashes []common.Hash) []*Envelope {
+	whisper.poolMu.RLock()
+	defer whisper.poolMu.RUnlock()
+
+	var envelopes []*Envelope
+	for _, hash := range hashes {
+		if envelope, ok := whisper.envelopes[hash]; ok && !whisper.isHeld(hash) {
+			envelopes = append(envelopes, envelope)
+		}
+	}
+	return envelopes
+}
+
+// sendDigests sends the digests of all the non-empty buckets to the peer,
+// starting a new round of the anti-entropy sync.
+func (peer *Peer) sendDigests() error {
+	local := peer.host.bucketDigests()
+	if len(local) == 0 {
+		return nil
+	}
+	digests := make([]bucketDigest, 0, len(local))
+	for index, digest := range local {
+		digests = append(digests, bucketDigest{Index: index, Digest: digest})
+	}
+	return p2p.Send(peer.ws, syncDigestCode, digests)
+}
+
+// handleDigests compares the digests received from the peer with the local
+// ones, and replies with the hashes of the envelopes in the mismatching buckets.
+// The reply is split into the messages of at most maxSyncHashes hashes.
+func (peer *Peer) handleDigests(remote []bucketDigest) error {
+	local := peer.host.bucketDigests()
+	seen := make(map[uint32]bool, len(remote))
+
+	var mismatching []uint32
+	for _, d := range remote {
+		seen[d.Index] = true
+		if local[d.Index] != d.Digest {
+			mismatching = append(mismatching, d.Index)
+		}
+	}
+	for index := range local {
+		if !seen[index] {
+			mismatching = append(mismatching, index)
+		}
+	}
+
+	var (
+		page []bucketHashes
+		size int
+	)
+	for _, index := range mismatching {
+		hashes := peer.host.bucketHashes(index)
+		if len(hashes) > maxSyncHashes {
+			hashes = hashes[:maxSyncHashes]
+		}
+		if size+len(hashes) > maxSyncHashes && len(page) > 0 {
+			if err := p2p.Send(peer.ws, syncHashesCode, page); err != nil {
+				return err
+			}
+			page, size = nil, 0
+		}
+		page = append(page, bucketHashes{Index: index, Hashes: hashes})
+		size += len(hashes)
+	}
+	if len(page) == 0 {
+		return nil
+	}
+	return p2p.Send(peer.ws, syncHashesCode, page)
+}
+
+// handleHashes compares the envelopes of the peer with the local ones, requests
+// the missing envelopes and pushes those missing on the other side.
+func (peer *Peer) handleHashes(remote []bucketHashes) error {
+	missing, extra := peer.host.compareHashes(remote)
+	if len(missing) > 0 {
+		if err := p2p.Send(peer.ws, syncRequestCode, missing); err != nil {
+			return err
+		}
+		peer.log.Trace("sync requested missing envelopes", "count", len(missing))
+	}
+	return peer.push(extra)
+}
+
+// compareHashes compares the listed envelopes of the peer with the local ones,
+// returning the hashes of the missing envelopes and the envelopes the peer
+// lacks. At most maxSyncHashes hashes are processed, and the envelopes are
+// only pushed for the buckets listed completely.
+func (whisper *Whisper) compareHashes(remote []bucketHashes) ([]common.Hash, []*Envelope) {
+	var (
+		missing []common.Hash
+		extra   []*Envelope
+		total   int
+	)
+	for _, b := range remote {
+		if total >= maxSyncHashes {
+			break
+		}
+		hashes := b.Hashes
+		complete := len(hashes) < maxSyncHashes
+		if room := maxSyncHashes - total; len(hashes) > room {
+			hashes, complete = hashes[:room], false
+		}
+		total += len(hashes)
+
+		known := make(map[common.Hash]bool, len(hashes))
+		for _, hash := range hashes {
+			known[hash] = true
+			if !whisper.isEnvelopeCached(hash) {
+				missing = append(missing, hash)
+			}
+		}
+		if !complete {
+			continue // the rest of the bucket is unknown, the peer may hold it
+		}
+		for _, envelope := range whisper.syncEnvelopes(whisper.bucketHashes(b.Index)) {
+			if !known[envelope.Hash()] {
+				extra = append(extra, envelope)
+			}
+		}
+	}
+	return missing, extra
+}
+
+// handleSyncRequest delivers the envelopes requested by the peer.
+func (peer *Peer) handleSyncRequest(hashes []common.Hash) error {
+	if len(hashes) > maxSyncHashes {
+		hashes = hashes[:maxSyncHashes]
+	}
+	return peer.push(peer.host.syncEnvelopes(hashes))
+}
+
+// push transmits the envelopes acceptable by the peer, and marks them known.
+func (peer *Peer) push(envelopes []*Envelope) error {
+	bundle := make([]*Envelope, 0, len(envelopes))
+	for _, envelope := range envelopes {
+		if peer.accepts(envelope) {
+			bundle = append(bundle, envelope)
+		}
+	}
+	if len(bundle) == 0 {
+		return nil
+	}
+	if err := p2p.Send(peer.ws, messagesCode, bundle); err != nil {
+		return err
+	}
+	for _, envelope := range bundle {
+		peer.mark(envelope)
+	}
+	peer.log.Trace("sync pushed envelopes", "count", len(bundle))
+	return nil
+}
@@ -0,0 +1,132 @@
+// Copyright 2017 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package whisperv6
+
+import (
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/p2p"
+	"github.com/ethereum/go-ethereum/p2p/discover"
+)
+
+func TestSyncHashesPaginated(t *testing.T) {
+	InitSingleTest()
+
+	w := New(&DefaultConfig)
+	w.SetMinimumPowTest(0.0000001)
+	defer w.SetMinimumPowTest(DefaultMinimumPoW)
+	w.Start(nil)
+	defer w.Stop()
+
+	// more envelopes than fit into a single message, spread over the buckets
+	const count = maxSyncHashes + 100
+	now := uint32(time.Now().Unix())
+	for i := 0; i < count; i++ {
+		ttl := uint32(bucketSpan*(1+i%8) + 1)
+		env := &Envelope{Expiry: now + ttl, TTL: ttl, Data: []byte{byte(i), byte(i >> 8)}, Nonce: uint64(seed)}
+		if _, err := w.add(env, false); err != nil {
+			t.Fatalf("failed to add envelope %d with seed %d: %s.", i, seed, err)
+		}
+	}
+
+	remote, _ := connectTestPeer(t, w, discover.NodeID{1})
+	defer remote.Close()
+	if err := p2p.Send(remote, syncDigestCode, []bucketDigest{}); err != nil {
+		t.Fatalf("failed to send digests: %s.", err)
+	}
+	for total := 0; total < count; {
+		var page []bucketHashes
+		expectPacket(t, remote, syncHashesCode, &page)
+		size := 0
+		for _, b := range page {
+			size += len(b.Hashes)
+		}
+		if size > maxSyncHashes {
+			t.Fatalf("oversized sync page with seed %d: %d hashes.", seed, size)
+		}
+		total += size
+	}
+}
+
+func TestSyncCompareHashesLimit(t *testing.T) {
+	InitSingleTest()
+
+	w := New(&DefaultConfig)
+	w.SetMinimumPowTest(0.0000001)
+	defer w.SetMinimumPowTest(DefaultMinimumPoW)
+
+	now := uint32(time.Now().Unix())
+	env := &Envelope{Expiry: now + DefaultTTL, TTL: DefaultTTL, Data: []byte{1}, Nonce: uint64(seed)}
+	if _, err := w.add(env, false); err != nil {
+		t.Fatalf("failed to add envelope with seed %d: %s.", seed, err)
+	}
+	index := bucketIndex(env.Expiry)
+
+	// the bucket listed empty by the peer is pushed
+	if _, extra := w.compareHashes([]bucketHashes{{Index: index}}); len(extra) != 1 || extra[0] != env {
+		t.Fatalf("envelope missing on the peer not pushed with seed %d: %v.", seed, extra)
+	}
+
+	// once the limit is reached, the remaining buckets are not compared at all
+	flood := make([]common.Hash, maxSyncHashes)
+	for i := range flood {
+		flood[i] = common.Hash{byte(i), byte(i >> 8), 0xff}
+	}
+	missing, extra := w.compareHashes([]bucketHashes{{Index: index + 1, Hashes: flood}, {Index: index}})
+	if len(missing) != maxSyncHashes {
+		t.Fatalf("wrong number of missing hashes with seed %d: %d.", seed, len(missing))
+	}
+	if len(extra) != 0 {
+		t.Fatalf("envelopes pushed beyond the limit with seed %d: %d.", seed, len(extra))
+	}
+
+	// the truncated listing of a bucket is not complete
+	if _, extra := w.compareHashes([]bucketHashes{{Index: index, Hashes: flood}}); len(extra) != 0 {
+		t.Fatalf("envelopes pushed for a truncated listing with seed %d: %d.", seed, len(extra))
+	}
+}
+
+func TestSyncDigestsExcludeHeld(t *testing.T) {
+	InitSingleTest()
+
+	cfg := DefaultConfig
+	cfg.DelayOwnEnvelopes = true
+	w := New(&cfg)
+	w.SetMinimumPowTest(0.0000001)
+	defer w.SetMinimumPowTest(DefaultMinimumPoW)
+
+	now := uint32(time.Now().Unix())
+	own := &Envelope{Expiry: now + DefaultTTL, TTL: DefaultTTL, Data: []byte{1}, Nonce: uint64(seed)}
+	if err := w.Send(own); err != nil {
+		t.Fatalf("failed to send envelope with seed %d: %s.", seed, err)
+	}
+	index := bucketIndex(own.Expiry)
+	if _, ok := w.bucketDigests()[index]; ok {
+		t.Fatalf("held envelope revealed by the digest with seed %d.", seed)
+	}
+
+	// the digest of the bucket only covers the relayed envelope
+	relayed := &Envelope{Expiry: own.Expiry, TTL: DefaultTTL, Data: []byte{2}, Nonce: uint64(seed)}
+	if _, err := w.add(relayed, false); err != nil {
+		t.Fatalf("failed to add envelope with seed %d: %s.", seed, err)
+	}
+	if digest := w.bucketDigests()[index]; digest != relayed.Hash() {
+		t.Fatalf("wrong digest with the held envelope with seed %d: %x.", seed, digest)
+	}
+}
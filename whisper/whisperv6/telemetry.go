@@ -0,0 +1,146 @@
+// Copyright 2017 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+// Contains the compact envelope profile for the small high-frequency messages
+// (e.g. sensor readings and other telemetry).
+
+package whisperv6
+
+import (
+	crand "crypto/rand"
+	"errors"
+	"sync"
+	"time"
+)
+
+// TelemetryProfile describes how the telemetry datapoints are packed into the
+// envelopes: with a finer padding, a short TTL and several datapoints sharing
+// a single batch envelope (see Whisper.NewBatchEnvelope).
+type TelemetryProfile struct {
+	TTL       uint32  // Time-to-live of the envelopes in seconds
+	PadSize   int     // Messages are padded to a multiple of this size, instead of padSizeLimit
+	BatchSize int     // Number of datapoints sent in a single envelope
+	WorkTime  uint32  // Maximum time spent on the proof of work of an envelope
+	PoW       float64 // Proof of work of the envelopes
+
+	FlushInterval time.Duration // Maximum time a datapoint waits for the batch to fill (zero waits for a full batch)
+}
+
+// DefaultTelemetryProfile is the profile tuned for the readings of a few dozen bytes.
+var DefaultTelemetryProfile = TelemetryProfile{
+	TTL:       10,
+	PadSize:   16,
+	BatchSize: 16,
+	WorkTime:  2,
+	PoW:       DefaultMinimumPoW,
+
+	FlushInterval: 2 * time.Second,
+}
+
+// apply adjusts the message parameters to the profile, generating the
+// padding unless provided by the caller.
+func (profile *TelemetryProfile) apply(params *MessageParams) error {
+	if params.TTL == 0 {
+		params.TTL = profile.TTL
+	}
+	if len(params.Padding) != 0 || profile.PadSize <= 0 {
+		return nil
+	}
+	params.Padding = make([]byte, profile.PadSize-params.unpaddedSize()%profile.PadSize)
+	if _, err := crand.Read(params.Padding); err != nil {
+		return err
+	}
+	if !validateDataIntegrity(params.Padding, len(params.Padding)) {
+		return errors.New("failed to generate random padding")
+	}
+	return nil
+}
+
+// TelemetrySender accumulates the telemetry datapoints and posts them in
+// batches, according to its profile.
+type TelemetrySender struct {
+	whisper *Whisper
+	profile TelemetryProfile
+
+	mu      sync.Mutex
+	pending []*MessageParams
+	timer   *time.Timer // Flushes the pending datapoints after the interval, nil if none are pending
+}
+
+// NewTelemetrySender creates a sender posting the datapoints into the whisper node.
+func (whisper *Whisper) NewTelemetrySender(profile TelemetryProfile) *TelemetrySender {
+	if profile.BatchSize <= 0 {
+		profile.BatchSize = 1
+	}
+	return &TelemetrySender{whisper: whisper, profile: profile}
+}
+
+// Add queues the datapoint, and posts the batch once it is full, or once the
+// flush interval of the profile passes since the first datapoint queued.
+func (s *TelemetrySender) Add(params *MessageParams) error {
+	if err := s.profile.apply(params); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.pending = append(s.pending, params)
+	if len(s.pending) < s.profile.BatchSize {
+		if s.timer == nil && s.profile.FlushInterval > 0 {
+			s.timer = time.AfterFunc(s.profile.FlushInterval, s.flushLate)
+		}
+		return nil
+	}
+	return s.flush()
+}
+
+// flushLate posts the datapoints which waited for the flush interval.
+func (s *TelemetrySender) flushLate() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.flush(); err != nil {
+		s.whisper.Logger(LogSubsystemPool).Warn("failed to flush telemetry", "err", err)
+	}
+}
+
+// Flush posts the queued datapoints, even if the batch is not full.
+func (s *TelemetrySender) Flush() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.flush()
+}
+
+func (s *TelemetrySender) flush() error {
+	if s.timer != nil {
+		s.timer.Stop()
+		s.timer = nil
+	}
+	if len(s.pending) == 0 {
+		return nil
+	}
+	env, err := s.whisper.NewBatchEnvelope(s.pending, &MessageParams{
+		TTL:      s.profile.TTL,
+		WorkTime: s.profile.WorkTime,
+		PoW:      s.profile.PoW,
+	})
+	s.pending = nil
+	if err != nil {
+		return err
+	}
+	return s.whisper.Send(env)
+}
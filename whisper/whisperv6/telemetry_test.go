@@ -0,0 +1,109 @@
+// Copyright 2017 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package whisperv6
+
+import (
+	mrand "math/rand"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+func TestTelemetrySender(t *testing.T) {
+	InitSingleTest()
+
+	w := New(&DefaultConfig)
+	w.SetMinimumPowTest(0.0000001)
+
+	profile := DefaultTelemetryProfile
+	profile.BatchSize = 3
+	profile.PoW = 0.00001
+	sender := w.NewTelemetrySender(profile)
+
+	key := make([]byte, aesKeyLength)
+	mrand.Read(key)
+	for i := 0; i < 4; i++ {
+		params := &MessageParams{KeySym: key, Topic: TopicType{0x7e}, Payload: []byte{byte(i), 1, 2, 3}}
+		if err := sender.Add(params); err != nil {
+			t.Fatalf("failed Add with seed %d: %s.", seed, err)
+		}
+		if params.TTL != profile.TTL {
+			t.Fatalf("wrong TTL: %d.", params.TTL)
+		}
+		if size := flagsLength + 1 + len(params.Payload) + len(params.Padding); size%profile.PadSize != 0 {
+			t.Fatalf("wrong padding: %d.", len(params.Padding))
+		}
+	}
+	if n := len(w.Envelopes()); n != 1 {
+		t.Fatalf("wrong number of envelopes after the first batch: %d.", n)
+	}
+	if err := sender.Flush(); err != nil {
+		t.Fatalf("failed Flush with seed %d: %s.", seed, err)
+	}
+	if n := len(w.Envelopes()); n != 2 {
+		t.Fatalf("wrong number of envelopes after flush: %d.", n)
+	}
+	for _, env := range w.Envelopes() {
+		if env.Topic != BatchTopic || env.TTL != profile.TTL {
+			t.Fatalf("unexpected envelope: topic %x, ttl %d.", env.Topic, env.TTL)
+		}
+	}
+}
+
+func TestTelemetryPaddingHeader(t *testing.T) {
+	InitSingleTest()
+
+	profile := DefaultTelemetryProfile
+	key := make([]byte, aesKeyLength)
+	mrand.Read(key)
+	params := &MessageParams{KeySym: key, Topic: TopicType{0x7e}, Payload: []byte{1, 2, 3}, Seq: 7, Session: common.Hash{1}}
+	if err := profile.apply(params); err != nil {
+		t.Fatalf("failed to apply the profile with seed %d: %s.", seed, err)
+	}
+	msg, err := NewSentMessage(params)
+	if err != nil {
+		t.Fatalf("failed to create new message with seed %d: %s.", seed, err)
+	}
+	if len(msg.Raw)%profile.PadSize != 0 {
+		t.Fatalf("wrong padding of the message with the header: %d bytes.", len(msg.Raw))
+	}
+}
+
+func TestTelemetryFlushInterval(t *testing.T) {
+	InitSingleTest()
+
+	w := New(&DefaultConfig)
+	w.SetMinimumPowTest(0.0000001)
+
+	profile := DefaultTelemetryProfile
+	profile.PoW = 0.00001
+	profile.FlushInterval = 50 * time.Millisecond
+	sender := w.NewTelemetrySender(profile)
+
+	key := make([]byte, aesKeyLength)
+	mrand.Read(key)
+	if err := sender.Add(&MessageParams{KeySym: key, Topic: TopicType{0x7e}, Payload: []byte{1, 2, 3}}); err != nil {
+		t.Fatalf("failed Add with seed %d: %s.", seed, err)
+	}
+	if n := len(w.Envelopes()); n != 0 {
+		t.Fatalf("incomplete batch posted before the interval: %d.", n)
+	}
+	if !waitFor(5*time.Second, func() bool { return len(w.Envelopes()) == 1 }) {
+		t.Fatalf("incomplete batch not posted after the interval with seed %d.", seed)
+	}
+}
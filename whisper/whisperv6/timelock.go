@@ -0,0 +1,301 @@
+// Copyright 2017 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+// Contains the time-locked payloads. Each member of a committee (e.g. a set of
+// mail servers) publishes the public keys of the future epochs in advance, and
+// releases the private key of an epoch only once the epoch has started. The
+// sender encrypts the payload with a random key, splits the key into Shamir
+// shares with the chosen threshold, and encrypts each share to the epoch key
+// of one member. The payload becomes readable once the threshold of members
+// released their epoch keys, i.e. not before the epoch, unless the threshold
+// of members colludes.
+
+package whisperv6
+
+import (
+	"crypto/ecdsa"
+	crand "crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/crypto/ecies"
+	"github.com/ethereum/go-ethereum/rlp"
+)
+
+var (
+	// ErrEpochNotReached is returned when the key of a future epoch is requested.
+	ErrEpochNotReached = errors.New("epoch not reached yet")
+	// ErrTimeLocked is returned when fewer keys than the threshold are available.
+	ErrTimeLocked = errors.New("not enough epoch keys released")
+)
+
+// maxCommitteeSize is the maximum number of the committee members, limited by
+// the x coordinates of the shares in GF(256).
+const maxCommitteeSize = 255
+
+// EpochAuthority derives the keys of the consecutive epochs from a master
+// secret. The public keys can be published in advance, while the private key
+// of an epoch is only released once the epoch has started.
+type EpochAuthority struct {
+	master []byte
+	length time.Duration
+}
+
+// NewEpochAuthority creates an authority with the given master secret and the
+// length of the epochs.
+func NewEpochAuthority(master []byte, length time.Duration) (*EpochAuthority, error) {
+	if len(master) < defaultSchema.aesKeyLength {
+		return nil, fmt.Errorf("master secret too short: %d bytes", len(master))
+	}
+	if length < time.Second {
+		return nil, fmt.Errorf("epoch too short: %v", length)
+	}
+	return &EpochAuthority{master: master, length: length}, nil
+}
+
+// Epoch returns the number of the epoch containing the given time.
+func (a *EpochAuthority) Epoch(t time.Time) uint64 {
+	return uint64(t.Unix() / int64(a.length/time.Second))
+}
+
+// Start returns the beginning of the epoch.
+func (a *EpochAuthority) Start(epoch uint64) time.Time {
+	return time.Unix(int64(epoch)*int64(a.length/time.Second), 0)
+}
+
+// PublicKey returns the public key of the epoch, to be published in advance.
+func (a *EpochAuthority) PublicKey(epoch uint64) *ecdsa.PublicKey {
+	return &a.derive(epoch).PublicKey
+}
+
+// ReleaseKey returns the private key of the epoch, if the epoch has started.
+func (a *EpochAuthority) ReleaseKey(epoch uint64, now time.Time) (*ecdsa.PrivateKey, error) {
+	if now.Before(a.Start(epoch)) {
+		return nil, ErrEpochNotReached
+	}
+	return a.derive(epoch), nil
+}
+
+// derive computes the key of the epoch, retrying with a counter in the
+// (unlikely) case the hash is not a valid private key.
+func (a *EpochAuthority) derive(epoch uint64) *ecdsa.PrivateKey {
+	var seed [16]byte
+	binary.BigEndian.PutUint64(seed[:8], epoch)
+	for counter := uint64(0); ; counter++ {
+		binary.BigEndian.PutUint64(seed[8:], counter)
+		key, err := crypto.ToECDSA(crypto.Keccak256([]byte("shh-epoch"), a.master, seed[:]))
+		if err == nil {
+			return key
+		}
+	}
+}
+
+// timeLocked is the encoding of a time-locked payload.
+type timeLocked struct {
+	Epoch      uint64
+	Threshold  uint
+	Shares     [][]byte // Key shares encrypted to the epoch keys of the members, in the committee order
+	Ciphertext []byte   // Payload encrypted with the shared key, followed by the AES-GCM nonce
+}
+
+// TimeLock encrypts the payload so that it can only be read once the threshold
+// of the committee members released their keys of the epoch. The committee
+// lists the epoch public keys of the members.
+func TimeLock(payload []byte, epoch uint64, committee []*ecdsa.PublicKey, threshold int) ([]byte, error) {
+	if len(committee) == 0 || len(committee) > maxCommitteeSize {
+		return nil, fmt.Errorf("invalid committee size: %d", len(committee))
+	}
+	if threshold < 1 || threshold > len(committee) {
+		return nil, fmt.Errorf("invalid threshold %d for %d members", threshold, len(committee))
+	}
+	key, err := generateSecureRandomData(defaultSchema.aesKeyLength)
+	if err != nil {
+		return nil, err
+	}
+	ciphertext, err := timeLockSeal(key, payload)
+	if err != nil {
+		return nil, err
+	}
+	shares, err := splitSecret(key, len(committee), threshold)
+	if err != nil {
+		return nil, err
+	}
+	sealed := timeLocked{Epoch: epoch, Threshold: uint(threshold), Ciphertext: ciphertext}
+	for i, member := range committee {
+		share, err := ecies.Encrypt(crand.Reader, ecies.ImportECDSAPublic(member), shares[i], nil, nil)
+		if err != nil {
+			return nil, err
+		}
+		sealed.Shares = append(sealed.Shares, share)
+	}
+	return rlp.EncodeToBytes(&sealed)
+}
+
+// TimeLockEpoch returns the epoch whose keys unlock the time-locked payload.
+func TimeLockEpoch(data []byte) (uint64, error) {
+	var sealed timeLocked
+	if err := rlp.DecodeBytes(data, &sealed); err != nil {
+		return 0, err
+	}
+	return sealed.Epoch, nil
+}
+
+// TimeUnlock decrypts the time-locked payload. The keys list the released
+// epoch keys of the members in the committee order, nil for the members which
+// did not release theirs (yet).
+func TimeUnlock(data []byte, keys []*ecdsa.PrivateKey) ([]byte, error) {
+	var sealed timeLocked
+	if err := rlp.DecodeBytes(data, &sealed); err != nil {
+		return nil, err
+	}
+	if len(keys) != len(sealed.Shares) {
+		return nil, fmt.Errorf("wrong number of keys: %d instead of %d", len(keys), len(sealed.Shares))
+	}
+	var shares [][]byte
+	for i, key := range keys {
+		if key == nil {
+			continue
+		}
+		share, err := ecies.ImportECDSA(key).Decrypt(sealed.Shares[i], nil, nil)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decrypt share %d: %v", i, err)
+		}
+		shares = append(shares, share)
+		if uint(len(shares)) == sealed.Threshold {
+			break
+		}
+	}
+	if sealed.Threshold == 0 || uint(len(shares)) < sealed.Threshold {
+		return nil, ErrTimeLocked
+	}
+	key, err := combineShares(shares)
+	if err != nil {
+		return nil, err
+	}
+	return timeLockOpen(key, sealed.Ciphertext)
+}
+
+// timeLockSeal encrypts the payload with AES-GCM, appending the nonce.
+func timeLockSeal(key, payload []byte) ([]byte, error) {
+	aesgcm, err := defaultSchema.newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	nonce, err := generateSecureRandomData(aesgcm.NonceSize())
+	if err != nil {
+		return nil, err
+	}
+	return append(aesgcm.Seal(nil, nonce, payload, nil), nonce...), nil
+}
+
+// timeLockOpen decrypts the payload encrypted by timeLockSeal.
+func timeLockOpen(key, ciphertext []byte) ([]byte, error) {
+	aesgcm, err := defaultSchema.newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(ciphertext) < aesgcm.NonceSize() {
+		return nil, errors.New("time-locked ciphertext too short")
+	}
+	split := len(ciphertext) - aesgcm.NonceSize()
+	return aesgcm.Open(nil, ciphertext[split:], ciphertext[:split], nil)
+}
+
+// splitSecret splits the secret into n Shamir shares over GF(256), any
+// threshold of which recover the secret. Each share is prefixed with its x
+// coordinate.
+func splitSecret(secret []byte, n, threshold int) ([][]byte, error) {
+	shares := make([][]byte, n)
+	for i := range shares {
+		shares[i] = make([]byte, len(secret)+1)
+		shares[i][0] = byte(i + 1)
+	}
+	coefficients := make([]byte, threshold)
+	for b, s := range secret {
+		// random polynomial of the degree threshold-1 with the secret at zero
+		if _, err := crand.Read(coefficients[1:]); err != nil {
+			return nil, err
+		}
+		coefficients[0] = s
+		for i := range shares {
+			x, y := shares[i][0], byte(0)
+			for c := threshold - 1; c >= 0; c-- {
+				y = gfMul(y, x) ^ coefficients[c]
+			}
+			shares[i][b+1] = y
+		}
+	}
+	return shares, nil
+}
+
+// combineShares recovers the secret from the shares by the Lagrange
+// interpolation at zero.
+func combineShares(shares [][]byte) ([]byte, error) {
+	size := len(shares[0])
+	for i, share := range shares {
+		if len(share) != size || size < 2 || share[0] == 0 {
+			return nil, errors.New("malformed key share")
+		}
+		for _, other := range shares[:i] {
+			if other[0] == share[0] {
+				return nil, errors.New("duplicate key share")
+			}
+		}
+	}
+	secret := make([]byte, size-1)
+	for i, share := range shares {
+		// the Lagrange basis polynomial of the share, evaluated at zero
+		basis := byte(1)
+		for j, other := range shares {
+			if i != j {
+				basis = gfMul(basis, gfMul(other[0], gfInv(other[0]^share[0])))
+			}
+		}
+		for b := range secret {
+			secret[b] ^= gfMul(share[b+1], basis)
+		}
+	}
+	return secret, nil
+}
+
+// gfMul multiplies in GF(256) with the AES polynomial.
+func gfMul(a, b byte) byte {
+	var p byte
+	for b > 0 {
+		if b&1 != 0 {
+			p ^= a
+		}
+		carry := a & 0x80
+		a <<= 1
+		if carry != 0 {
+			a ^= 0x1b
+		}
+		b >>= 1
+	}
+	return p
+}
+
+// gfInv returns the multiplicative inverse in GF(256), i.e. a^254.
+func gfInv(a byte) byte {
+	result := byte(1)
+	for i := 0; i < 254; i++ {
+		result = gfMul(result, a)
+	}
+	return result
+}
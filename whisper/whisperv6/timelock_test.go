@@ -0,0 +1,107 @@
+// Copyright 2017 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package whisperv6
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"testing"
+	"time"
+)
+
+func TestShamirShares(t *testing.T) {
+	for a := 1; a < 256; a++ {
+		if gfMul(byte(a), gfInv(byte(a))) != 1 {
+			t.Fatalf("wrong inverse of %d.", a)
+		}
+	}
+	secret := []byte("the secret key of the time lock!")
+	shares, err := splitSecret(secret, 5, 3)
+	if err != nil {
+		t.Fatalf("failed to split the secret: %s.", err)
+	}
+	for _, subset := range [][]int{{0, 1, 2}, {4, 2, 0}, {1, 3, 4}, {0, 1, 2, 3, 4}} {
+		var picked [][]byte
+		for _, i := range subset {
+			picked = append(picked, shares[i])
+		}
+		recovered, err := combineShares(picked)
+		if err != nil || !bytes.Equal(recovered, secret) {
+			t.Fatalf("secret not recovered from shares %v: %v.", subset, err)
+		}
+	}
+	if recovered, _ := combineShares(shares[:2]); bytes.Equal(recovered, secret) {
+		t.Fatalf("secret recovered below the threshold.")
+	}
+}
+
+func TestTimeLock(t *testing.T) {
+	InitSingleTest()
+
+	now := time.Now()
+	var members []*EpochAuthority
+	for i := 0; i < 5; i++ {
+		master, err := generateSecureRandomData(aesKeyLength)
+		if err != nil {
+			t.Fatalf("failed to generate master secret with seed %d: %s.", seed, err)
+		}
+		a, err := NewEpochAuthority(master, time.Hour)
+		if err != nil {
+			t.Fatalf("failed to create authority with seed %d: %s.", seed, err)
+		}
+		members = append(members, a)
+	}
+	epoch := members[0].Epoch(now) + 1
+
+	committee := make([]*ecdsa.PublicKey, len(members))
+	for i, a := range members {
+		committee[i] = a.PublicKey(epoch)
+	}
+	payload := []byte("readable in an hour")
+	sealed, err := TimeLock(payload, epoch, committee, 3)
+	if err != nil {
+		t.Fatalf("failed to time-lock with seed %d: %s.", seed, err)
+	}
+	if e, err := TimeLockEpoch(sealed); err != nil || e != epoch {
+		t.Fatalf("wrong epoch of the time lock: %d, %v.", e, err)
+	}
+
+	if _, err = members[0].ReleaseKey(epoch, now); err != ErrEpochNotReached {
+		t.Fatalf("future epoch key released: %v.", err)
+	}
+	later := members[0].Start(epoch)
+	keys := make([]*ecdsa.PrivateKey, len(members))
+	for _, i := range []int{1, 4} {
+		if keys[i], err = members[i].ReleaseKey(epoch, later); err != nil {
+			t.Fatalf("failed to release key %d with seed %d: %s.", i, seed, err)
+		}
+	}
+	if _, err = TimeUnlock(sealed, keys); err != ErrTimeLocked {
+		t.Fatalf("unlocked below the threshold: %v.", err)
+	}
+	keys[2], _ = members[2].ReleaseKey(epoch, later)
+	unlocked, err := TimeUnlock(sealed, keys)
+	if err != nil || !bytes.Equal(unlocked, payload) {
+		t.Fatalf("failed to unlock with seed %d: %v.", seed, err)
+	}
+
+	// the keys of another epoch do not unlock the payload
+	keys[1], _ = members[1].ReleaseKey(epoch-1, later)
+	if _, err = TimeUnlock(sealed, keys); err == nil {
+		t.Fatalf("unlocked with the key of another epoch.")
+	}
+}
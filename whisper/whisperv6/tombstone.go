@@ -0,0 +1,79 @@
+// Copyright 2017 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+// Contains the tombstone convention. The network can not unsend a message,
+// but the sender can publish a signed tombstone referencing the envelope of
+// the original message, telling the recipients to delete it (empty payload)
+// or to replace it with the payload of the tombstone. The filters surface a
+// tombstone only if they delivered the original message, signed by the same
+// key, so the tombstones can not be forged by third parties.
+
+package whisperv6
+
+import (
+	"crypto/ecdsa"
+	"errors"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+)
+
+// ErrUnsignedTombstone is returned when a tombstone is created without a
+// signing key, since the recipients could not link it to the original.
+var ErrUnsignedTombstone = errors.New("tombstones must be signed")
+
+// Redact turns the message parameters into a tombstone of the message sent
+// in the envelope with the target hash. The empty replacement deletes the
+// message, otherwise the replacement is the new payload of the message. The
+// parameters must carry the same signing key as the original message.
+func Redact(params *MessageParams, target common.Hash, replacement []byte) error {
+	if params.Src == nil {
+		return ErrUnsignedTombstone
+	}
+	params.Redacts = target
+	params.Payload = replacement
+	return nil
+}
+
+// IsTombstone checks if the message redacts a previously delivered message.
+func (msg *ReceivedMessage) IsTombstone() bool {
+	return msg.Redacts != (common.Hash{})
+}
+
+// linksTombstone checks if the filter delivered (or is about to deliver) the
+// message redacted by the tombstone, signed by the same key. The filter must
+// be locked by the caller.
+func (f *Filter) linksTombstone(msg *ReceivedMessage) bool {
+	if msg.Src == nil {
+		return false
+	}
+	if original, pending := f.Messages[msg.Redacts]; pending {
+		return original.Src != nil && IsPubKeyEqual(original.Src, msg.Src)
+	}
+	signer, delivered := f.signers[msg.Redacts]
+	return delivered && signer == crypto.PubkeyToAddress(*msg.Src)
+}
+
+// rememberSigner records the signer of the retrieved message, so that its
+// tombstones can be linked later. The filter must be locked by the caller.
+func (f *Filter) rememberSigner(hash common.Hash, src *ecdsa.PublicKey) {
+	if f.signers == nil {
+		f.signers = make(map[common.Hash]common.Address)
+	}
+	if _, delivered := f.delivered[hash]; delivered {
+		f.signers[hash] = crypto.PubkeyToAddress(*src)
+	}
+}
@@ -0,0 +1,96 @@
+// Copyright 2017 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package whisperv6
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+)
+
+func TestTombstones(t *testing.T) {
+	InitSingleTest()
+
+	params, err := generateMessageParams()
+	if err != nil {
+		t.Fatalf("failed generateMessageParams with seed %d: %s.", seed, err)
+	}
+	params.PoW = 0.0000001
+	params.Seq = 7
+	filter := &Filter{KeySym: params.KeySym, Messages: make(map[common.Hash]*ReceivedMessage)}
+
+	wrap := func(params *MessageParams) *ReceivedMessage {
+		msg, err := NewSentMessage(params)
+		if err != nil {
+			t.Fatalf("failed to create new message with seed %d: %s.", seed, err)
+		}
+		env, err := msg.Wrap(params)
+		if err != nil {
+			t.Fatalf("failed Wrap with seed %d: %s.", seed, err)
+		}
+		received := env.Open(filter)
+		if received == nil {
+			t.Fatalf("failed to open envelope with seed %d.", seed)
+		}
+		return received
+	}
+	original := wrap(params)
+	filter.Trigger(original)
+	filter.Retrieve()
+
+	edit := *params
+	edit.Seq = 8
+	if err = Redact(&edit, original.EnvelopeHash, []byte("edited")); err != nil {
+		t.Fatalf("failed to create tombstone with seed %d: %s.", seed, err)
+	}
+	tombstone := wrap(&edit)
+	if !tombstone.IsTombstone() || tombstone.Redacts != original.EnvelopeHash || tombstone.Seq != 8 || !bytes.Equal(tombstone.Payload, []byte("edited")) {
+		t.Fatalf("wrong tombstone with seed %d: %v.", seed, tombstone)
+	}
+	filter.Trigger(tombstone)
+	if msgs := filter.Retrieve(); len(msgs) != 1 || msgs[0].Redacts != original.EnvelopeHash {
+		t.Fatalf("tombstone not surfaced with seed %d.", seed)
+	}
+	if m := ToWhisperMessage(tombstone); !bytes.Equal(m.Redacts, original.EnvelopeHash[:]) {
+		t.Fatalf("tombstone not exposed over RPC with seed %d.", seed)
+	}
+
+	// a tombstone signed by another key must not be linked
+	forged := edit
+	if forged.Src, err = crypto.GenerateKey(); err != nil {
+		t.Fatalf("failed to generate key with seed %d: %s.", seed, err)
+	}
+	filter.Trigger(wrap(&forged))
+	if msgs := filter.Retrieve(); len(msgs) != 0 {
+		t.Fatalf("forged tombstone surfaced with seed %d.", seed)
+	}
+
+	// neither is a tombstone of an unknown message
+	unknown := edit
+	unknown.Redacts = common.Hash{1}
+	filter.Trigger(wrap(&unknown))
+	if msgs := filter.Retrieve(); len(msgs) != 0 {
+		t.Fatalf("tombstone of unknown message surfaced with seed %d.", seed)
+	}
+
+	edit.Src = nil
+	if _, err = NewSentMessage(&edit); err != ErrUnsignedTombstone {
+		t.Fatalf("unsigned tombstone created with seed %d: %v.", seed, err)
+	}
+}
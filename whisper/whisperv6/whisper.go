@@ -18,24 +18,27 @@ package whisperv6
 
 import (
 	"bytes"
+	"context"
 	"crypto/ecdsa"
 	"crypto/sha256"
 	"fmt"
+	"io"
 	"math"
+	mrand "math/rand"
 	"runtime"
 	"sync"
 	"time"
 
 	"github.com/ethereum/go-ethereum/common"
 	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/event"
 	"github.com/ethereum/go-ethereum/log"
 	"github.com/ethereum/go-ethereum/p2p"
+	"github.com/ethereum/go-ethereum/p2p/discover"
 	"github.com/ethereum/go-ethereum/rlp"
-	"github.com/ethereum/go-ethereum/rpc"
 	"github.com/syndtr/goleveldb/leveldb/errors"
 	"golang.org/x/crypto/pbkdf2"
 	"golang.org/x/sync/syncmap"
-	set "gopkg.in/fatih/set.v0"
 )
 
 // Statistics holds several message-related counter for analytics
@@ -46,6 +49,7 @@ type Statistics struct {
 	memoryUsed           int
 	cycles               int
 	totalMessagesCleared int
+	hashRate             float64 // hashes per second of a single thread, measured on startup
 }
 
 const (
@@ -57,37 +61,138 @@ const (
 	bloomFilterToleranceIdx        // Bloom filter tolerated by the whisper node for a limited time
 )
 
+// errWhisperStopped is returned by HandlePeer if the node is stopped, either
+// before or during the peer connection.
+var errWhisperStopped = errors.New("whisper stopped")
+
+// futurePoW is the cached PoW of a future-dated envelope, valid until the
+// envelope is no longer future-dated.
+type futurePoW struct {
+	bits int    // Number of leading zero bits of the PoW hash
+	sent uint32 // Creation time of the envelope
+}
+
 // Whisper represents a dark communication interface through the Ethereum
 // network, using its very own P2P communication layer.
 type Whisper struct {
 	protocol p2p.Protocol // Protocol description and parameters
 	filters  *Filters     // Message filters installed with Subscribe function
 
-	privateKeys map[string]*ecdsa.PrivateKey // Private key storage
-	symKeys     map[string][]byte            // Symmetric key storage
-	keyMu       sync.RWMutex                 // Mutex associated with key storages
+	privateKeys    map[string]*ecdsa.PrivateKey // Private key storage
+	symKeys        map[string][]byte            // Symmetric key storage
+	legacyKeyNames map[string]string            // IDs of the migrated symmetric keys by their legacy names
+	keyMu          sync.RWMutex                 // Mutex associated with key storages
 
-	poolMu      sync.RWMutex              // Mutex to sync the message and expiration pools
-	envelopes   map[common.Hash]*Envelope // Pool of envelopes currently tracked by this node
-	expirations map[uint32]*set.SetNonTS  // Message expiration pool
+	poolMu    sync.RWMutex               // Mutex to sync the message and expiration pools
+	envelopes map[common.Hash]*Envelope  // Pool of envelopes currently tracked by this node
+	buckets   map[uint32]*envelopeBucket // Envelopes indexed by the expiry buckets
+	held      map[common.Hash]time.Time  // Own envelopes not to be broadcast before the specified time
+
+	envelopesPeak   highWater // Peak size of the envelope pool, triggering its compaction
+	privateKeysPeak highWater // Peak size of the private key storage, triggering its compaction
+	symKeysPeak     highWater // Peak size of the symmetric key storage, triggering its compaction
 
 	peerMu sync.RWMutex       // Mutex to sync the active peer set
 	peers  map[*Peer]struct{} // Set of currently active peers
+	self   discover.NodeID    // Identity of the local node, bound into the session transcripts
+
+	maxPeers      int // Maximum number of peers (zero means unlimited)
+	reservedPeers int // Number of peer slots only available to the privileged peers
+
+	deliveryMu sync.RWMutex                     // Mutex to sync the pending deliveries
+	deliveries map[common.Hash]*pendingDelivery // Sent envelopes awaiting the acknowledgement
+
+	lateMu sync.Mutex             // Mutex to sync the late deliveries
+	late   map[common.Hash]uint32 // Expiry of the envelopes delivered, whose late copies are ignored
+
+	expiryMu        sync.Mutex                       // Mutex to sync the expiration callbacks
+	expiryCallbacks map[common.Hash][]ExpiryCallback // Callbacks invoked when the envelopes expire
+
+	peerFeed event.Feed // Feed of peer connection events
+	dropFeed event.Feed // Feed of dropped envelope events
+	gapFeed  event.Feed // Feed of gaps detected in the sequence numbers
+
+	rejectionFeed   event.Feed // Feed of the rejection notices received from the peers
+	envelopeFeed    event.Feed // Feed of the envelopes newly added to the pool
+	propagationFeed event.Feed // Feed of the propagation of the own envelopes
+
+	propagationMu sync.RWMutex                                 // Mutex to sync the propagation tracking
+	propagation   map[common.Hash]map[discover.NodeID]struct{} // Peers the own envelopes were forwarded to
+
+	sequences *sequenceTracker         // Last sequence numbers of the channels of the senders
+	scope     *event.SubscriptionScope // Tracks the event subscriptions of the current run
 
 	messageQueue chan *Envelope // Message queue for normal whisper messages
 	p2pMsgQueue  chan *Envelope // Message queue for peer-to-peer messages (not to be forwarded any further)
-	quit         chan struct{}  // Channel used for graceful exit
+
+	lifecycleMu sync.Mutex    // Mutex to sync the start and stop of the node
+	running     bool          // Indicates if the node is started
+	quit        chan struct{} // Channel used for graceful exit, closed when the node is stopped
+	started     chan struct{} // Channel closed when the node is started, replaced when it is stopped
 
 	settings syncmap.Map // holds configuration settings that can be dynamically changed
 
-	syncAllowance int // maximum time in seconds allowed to process the whisper-related messages
+	syncAllowance     int           // maximum time in seconds allowed to process the whisper-related messages
+	expirationCycle   time.Duration // interval of the envelope expiration
+	transmissionCycle time.Duration // interval of the envelope broadcast to the peers
+	antiEntropyCycle  time.Duration // interval of the digest sync with the peers (zero if disabled)
+	peerWarmUp        time.Duration // grace period of the new peers, tolerating the in-flight envelopes
+	deliveryGrace     time.Duration // grace window of the delivery of the late envelopes to the filters
+	bloomParams       BloomParams   // parameters of the topic bloom filter of this node
 
 	lightClient bool // indicates is this node is pure light client (does not forward any messages)
 
+	watchOnly bool // indicates if the RPC clients are refused to store keys or install filters
+
+	localLoopback bool // indicates if the messages addressed to the local identities skip the network
+	localBus      bool // indicates if the node serves as a local bus only, without peers and PoW
+
+	rejectionNotices bool // indicates if the peers are notified about their rejected envelopes
+
+	latencyScheduling bool // indicates if the peers are transmitted to in the order of their latency
+
+	adaptiveBloom bool           // indicates if the bloom filter shrinks as the filters are removed
+	acceptBatches bool           // indicates if the filters attract the batches of messages
+	bloomRefresh  bloomRefresher // staleness of the advertised bloom filter
+
+	delayOwnEnvelopes bool // indicates if the own envelopes are held back for a random cycle
+
+	outboundAllow map[TopicType]struct{}       // topics the node may originate (nil means any)
+	outboundBlock map[TopicType]struct{}       // topics the node must not originate
+	routing       *routingDomains              // groups of the peers restricting the forwarded topics
+	peerAllow     map[discover.NodeID]struct{} // peers admitted to the handshake (nil means any)
+
+	quotaLimits quotaLimits     // limits of the resources used by each RPC client
+	idle        *idleIdentities // RPC created identities which did not decrypt any message yet
+	standby     standbyState    // state replicated from the active node
+
 	statsMu sync.Mutex // guard stats
 	stats   Statistics // Statistics of whisper node
 
 	mailServer MailServer // MailServer interface
+
+	logs    *subsystemLoggers // Loggers of the whisper subsystems
+	poolLog log.Logger        // Logger of the envelope pool
+	peerLog log.Logger        // Logger of the peer connections
+
+	gossip *gossipSampler // Peer sampling of the fanout-limited gossip (nil if flooding)
+
+	sealer      *WorkBank // Background workers sealing the outgoing envelopes (optional)
+	sealThreads int       // Number of sealer workers reserved per envelope
+
+	powVerifier *powVerifier // Workers verifying the PoW of the received envelopes, shared by the peers
+
+	relayAddr       string    // listening address of the websocket relay (empty if disabled)
+	relayMaxClients int       // maximum number of the websocket relay clients
+	relay           io.Closer // websocket relay of the current run (nil if disabled)
+
+	meters    *envelopeMeters // Meters of the envelope pool
+	dashboard *dashboard      // Time series of the relay statistics
+	hooks     failureHooks    // Failure injection of the resilience tests (see chaos.go)
+
+	futurePoWMu sync.Mutex                // Mutex to sync the future-dated PoW cache
+	futurePoW   map[common.Hash]futurePoW // PoW of the recently verified future-dated envelopes
+	schema      *envelopeSchema           // Validation schema of the envelopes
 }
 
 // New creates a Whisper client ready to communicate through the Ethereum P2P network.
@@ -96,21 +201,158 @@ func New(cfg *Config) *Whisper {
 		cfg = &DefaultConfig
 	}
 
+	queueLimit := messageQueueLimit
+	if cfg.MessageQueueLimit > 0 {
+		queueLimit = cfg.MessageQueueLimit
+	}
+	metricsPrefix := DefaultMetricsPrefix
+	if cfg.MetricsPrefix != "" {
+		metricsPrefix = cfg.MetricsPrefix
+	}
+
 	whisper := &Whisper{
-		privateKeys:   make(map[string]*ecdsa.PrivateKey),
-		symKeys:       make(map[string][]byte),
-		envelopes:     make(map[common.Hash]*Envelope),
-		expirations:   make(map[uint32]*set.SetNonTS),
-		peers:         make(map[*Peer]struct{}),
-		messageQueue:  make(chan *Envelope, messageQueueLimit),
-		p2pMsgQueue:   make(chan *Envelope, messageQueueLimit),
-		quit:          make(chan struct{}),
-		syncAllowance: DefaultSyncAllowance,
+		privateKeys:       make(map[string]*ecdsa.PrivateKey),
+		symKeys:           make(map[string][]byte),
+		legacyKeyNames:    make(map[string]string),
+		envelopes:         make(map[common.Hash]*Envelope),
+		buckets:           make(map[uint32]*envelopeBucket),
+		held:              make(map[common.Hash]time.Time),
+		deliveries:        make(map[common.Hash]*pendingDelivery),
+		expiryCallbacks:   make(map[common.Hash][]ExpiryCallback),
+		propagation:       make(map[common.Hash]map[discover.NodeID]struct{}),
+		futurePoW:         make(map[common.Hash]futurePoW),
+		peers:             make(map[*Peer]struct{}),
+		messageQueue:      make(chan *Envelope, queueLimit),
+		p2pMsgQueue:       make(chan *Envelope, queueLimit),
+		quit:              make(chan struct{}),
+		started:           make(chan struct{}),
+		scope:             new(event.SubscriptionScope),
+		syncAllowance:     DefaultSyncAllowance,
+		expirationCycle:   expirationCycle,
+		transmissionCycle: transmissionCycle,
+		antiEntropyCycle:  cfg.AntiEntropyCycle,
+		peerWarmUp:        peerWarmUp,
+		late:              make(map[common.Hash]uint32),
+		bloomParams:       DefaultBloomParams,
+		maxPeers:          cfg.MaxPeers,
+		watchOnly:         cfg.WatchOnly,
+		localLoopback:     cfg.LocalLoopback,
+		localBus:          cfg.LocalBus,
+		rejectionNotices:  cfg.RejectionNotices,
+		latencyScheduling: cfg.LatencyScheduling,
+		adaptiveBloom:     cfg.AdaptiveBloom,
+		acceptBatches:     cfg.AcceptBatches,
+		reservedPeers:     cfg.ReservedPeers,
+		relayAddr:         cfg.WebSocketRelay,
+		relayMaxClients:   cfg.RelayMaxClients,
+		meters:            newEnvelopeMeters(metricsPrefix),
+		dashboard:         newDashboard(),
+		sequences:         newSequenceTracker(),
+		schema:            defaultSchema,
+	}
+	if cfg.SyncAllowance > 0 {
+		whisper.syncAllowance = cfg.SyncAllowance
+	}
+	if cfg.ExpirationCycle > 0 {
+		whisper.expirationCycle = cfg.ExpirationCycle
+	}
+	if cfg.TransmissionCycle > 0 {
+		whisper.transmissionCycle = cfg.TransmissionCycle
+	}
+	if cfg.PeerWarmUp > 0 {
+		whisper.peerWarmUp = cfg.PeerWarmUp
+	}
+	if cfg.DeliveryGrace > 0 {
+		whisper.deliveryGrace = cfg.DeliveryGrace
+	}
+	if cfg.GossipFanout > 0 || cfg.GossipFanout == FanoutSqrt {
+		whisper.gossip = newGossipSampler(cfg.GossipFanout)
+		if whisper.antiEntropyCycle == 0 {
+			// the envelopes missed by the sampling are only repaired by the sync
+			whisper.antiEntropyCycle = gossipRepairCycle
+		}
+	}
+	if cfg.BloomFilterSize > 0 || cfg.BloomHashes > 0 {
+		params := DefaultBloomParams
+		if cfg.BloomFilterSize > 0 {
+			params.Size = cfg.BloomFilterSize
+		}
+		if cfg.BloomHashes > 0 {
+			params.Hashes = cfg.BloomHashes
+		}
+		if err := params.Validate(); err != nil {
+			log.Warn("Invalid whisper bloom filter parameters, using the defaults", "err", err)
+		} else {
+			whisper.bloomParams = params
+		}
+	}
+
+	whisper.logs = newSubsystemLoggers()
+	whisper.poolLog = whisper.Logger(LogSubsystemPool)
+	whisper.peerLog = whisper.Logger(LogSubsystemPeer)
+	for subsystem, level := range cfg.LogLevels {
+		lvl, err := log.LvlFromString(level)
+		if err == nil {
+			err = whisper.SetLogLevel(subsystem, lvl)
+		}
+		if err != nil {
+			log.Warn("Invalid whisper log level", "subsystem", subsystem, "level", level, "err", err)
+		}
 	}
 
 	whisper.filters = NewFilters(whisper)
+	whisper.delayOwnEnvelopes = cfg.DelayOwnEnvelopes
+	whisper.idle = newIdleIdentities(cfg.IdleIdentityExpiry, cfg.MaxIdleIdentities)
+	whisper.quotaLimits = quotaLimits{
+		identities:          cfg.ClientMaxIdentities,
+		filters:             cfg.ClientMaxFilters,
+		postsPerMinute:      cfg.ClientMaxPostsPerMinute,
+		identitiesPerMinute: cfg.ClientMaxIdentitiesPerMinute,
+		queuedMessages:      cfg.ClientMaxQueuedMessages,
+	}
+
+	if len(cfg.OutboundTopicAllowlist) > 0 {
+		whisper.outboundAllow = make(map[TopicType]struct{})
+		for _, topic := range cfg.OutboundTopicAllowlist {
+			whisper.outboundAllow[topic] = struct{}{}
+		}
+	}
+	if len(cfg.PeerAllowlist) > 0 {
+		whisper.peerAllow = make(map[discover.NodeID]struct{})
+		for _, id := range cfg.PeerAllowlist {
+			whisper.peerAllow[id] = struct{}{}
+		}
+	}
+	whisper.outboundBlock = make(map[TopicType]struct{})
+	for _, topic := range cfg.OutboundTopicBlocklist {
+		whisper.outboundBlock[topic] = struct{}{}
+	}
+	routing, err := newRoutingDomains(cfg.PeerGroups)
+	if err != nil {
+		log.Error("Invalid whisper peer groups, forwarding nothing", "err", err)
+		routing = closedRoutingDomains(err)
+	}
+	whisper.routing = routing
+
+	if cfg.SealWorkers > 0 {
+		whisper.sealer = NewWorkBank(cfg.SealWorkers)
+		whisper.sealThreads = cfg.SealThreads
+		if cfg.SealThreads < 0 || cfg.SealThreads > cfg.SealWorkers {
+			log.Warn("Invalid whisper seal threads, reserving all the workers", "threads", cfg.SealThreads, "workers", cfg.SealWorkers)
+			whisper.sealThreads = 0
+		}
+	}
+	verifiers := cfg.PoWVerifiers
+	if verifiers <= 0 {
+		verifiers = runtime.NumCPU()
+	}
+	whisper.powVerifier = newPowVerifier(verifiers)
 
-	whisper.settings.Store(minPowIdx, cfg.MinimumAcceptedPOW)
+	if cfg.LocalBus {
+		whisper.settings.Store(minPowIdx, 0.0)
+	} else {
+		whisper.settings.Store(minPowIdx, cfg.MinimumAcceptedPOW)
+	}
 	whisper.settings.Store(maxMsgSizeIdx, cfg.MaxMessageSize)
 	whisper.settings.Store(overflowIdx, false)
 
@@ -119,7 +361,7 @@ func New(cfg *Config) *Whisper {
 		Name:    ProtocolName,
 		Version: uint(ProtocolVersion),
 		Length:  NumberOfMessageCodes,
-		Run:     whisper.HandlePeer,
+		Run:     whisper.runPeer,
 		NodeInfo: func() interface{} {
 			return map[string]interface{}{
 				"version":        ProtocolVersionStr,
@@ -140,7 +382,7 @@ func (whisper *Whisper) MinPow() float64 {
 	}
 	v, ok := val.(float64)
 	if !ok {
-		log.Error("Error loading minPowIdx, using default")
+		whisper.poolLog.Error("Error loading minPowIdx, using default")
 		return DefaultMinimumPoW
 	}
 	return v
@@ -193,18 +435,6 @@ func (whisper *Whisper) Overflow() bool {
 	return val.(bool)
 }
 
-// APIs returns the RPC descriptors the Whisper implementation offers
-func (whisper *Whisper) APIs() []rpc.API {
-	return []rpc.API{
-		{
-			Namespace: ProtocolName,
-			Version:   ProtocolVersionStr,
-			Service:   NewPublicWhisperAPI(whisper),
-			Public:    true,
-		},
-	}
-}
-
 // RegisterServer registers MailServer interface.
 // MailServer will process all the incoming messages with p2pRequestCode.
 func (whisper *Whisper) RegisterServer(server MailServer) {
@@ -212,7 +442,11 @@ func (whisper *Whisper) RegisterServer(server MailServer) {
 }
 
 // Protocols returns the whisper sub-protocols ran by this particular client.
+// The local bus does not run any, so that it never connects to peers.
 func (whisper *Whisper) Protocols() []p2p.Protocol {
+	if whisper.localBus {
+		return nil
+	}
 	return []p2p.Protocol{whisper.protocol}
 }
 
@@ -230,13 +464,42 @@ func (whisper *Whisper) SetMaxMessageSize(size uint32) error {
 	return nil
 }
 
-// SetBloomFilter sets the new bloom filter
+// WatchOnly indicates if the node only relays and archives the envelopes, refusing
+// to store any keys or install any decrypting filters on behalf of the RPC clients.
+func (whisper *Whisper) WatchOnly() bool {
+	return whisper.watchOnly
+}
+
+// LocalBus returns true if the node serves as an in-process pub/sub bus only,
+// without peers and PoW.
+func (whisper *Whisper) LocalBus() bool {
+	return whisper.localBus
+}
+
+// BloomParams returns the parameters of the topic bloom filter of this node.
+func (whisper *Whisper) BloomParams() BloomParams {
+	return whisper.bloomParams
+}
+
+// SetBloomFilter sets the new bloom filter. Its bits are kept by the adaptive
+// refresh along with the ones of the installed filters.
 func (whisper *Whisper) SetBloomFilter(bloom []byte) error {
-	if len(bloom) != BloomFilterSize {
+	if err := whisper.setBloomFilter(bloom); err != nil {
+		return err
+	}
+	b := make([]byte, len(bloom))
+	copy(b, bloom)
+	whisper.bloomRefresh.setManual(b)
+	return nil
+}
+
+// setBloomFilter sets and announces the new bloom filter, computed by the node.
+func (whisper *Whisper) setBloomFilter(bloom []byte) error {
+	if len(bloom) != whisper.bloomParams.Size {
 		return fmt.Errorf("invalid bloom filter size: %d", len(bloom))
 	}
 
-	b := make([]byte, BloomFilterSize)
+	b := make([]byte, len(bloom))
 	copy(b, bloom)
 
 	whisper.settings.Store(bloomFilterIdx, b)
@@ -285,7 +548,7 @@ func (whisper *Whisper) notifyPeersAboutPowRequirementChange(pow float64) {
 			err = p.notifyAboutPowRequirementChange(pow)
 		}
 		if err != nil {
-			log.Warn("failed to notify peer about new pow requirement", "peer", p.ID(), "error", err)
+			p.log.Warn("failed to notify peer about new pow requirement", "error", err)
 		}
 	}
 }
@@ -299,7 +562,7 @@ func (whisper *Whisper) notifyPeersAboutBloomFilterChange(bloom []byte) {
 			err = p.notifyAboutBloomFilterChange(bloom)
 		}
 		if err != nil {
-			log.Warn("failed to notify peer about new bloom filter", "peer", p.ID(), "error", err)
+			p.log.Warn("failed to notify peer about new bloom filter", "error", err)
 		}
 	}
 }
@@ -336,10 +599,22 @@ func (whisper *Whisper) AllowP2PMessagesFromPeer(peerID []byte) error {
 	if err != nil {
 		return err
 	}
-	p.trusted = true
+	whisper.markTrusted(p)
 	return nil
 }
 
+// markTrusted marks the peer trusted, notifying the subscribers if necessary.
+func (whisper *Whisper) markTrusted(p *Peer) {
+	if p.setTrusted() {
+		whisper.sendPeerEvent(PeerEventTypeTrust, p, nil)
+		go func() {
+			if err := p.initSession(); err != nil {
+				p.log.Warn("failed to initiate session", "err", err)
+			}
+		}()
+	}
+}
+
 // RequestHistoricMessages sends a message with p2pRequestCode to a specific peer,
 // which is known to implement MailServer interface, and is supposed to process this
 // request and respond with a number of peer-to-peer messages (possibly expired),
@@ -350,12 +625,15 @@ func (whisper *Whisper) RequestHistoricMessages(peerID []byte, envelope *Envelop
 	if err != nil {
 		return err
 	}
-	p.trusted = true
+	whisper.markTrusted(p)
 	return p2p.Send(p.ws, p2pRequestCode, envelope)
 }
 
 // SendP2PMessage sends a peer-to-peer message to a specific peer.
 func (whisper *Whisper) SendP2PMessage(peerID []byte, envelope *Envelope) error {
+	if !whisper.mayOriginate(envelope.Topic) {
+		return ErrTopicNotAllowed
+	}
 	p, err := whisper.getPeer(peerID)
 	if err != nil {
 		return err
@@ -363,8 +641,12 @@ func (whisper *Whisper) SendP2PMessage(peerID []byte, envelope *Envelope) error
 	return whisper.SendP2PDirect(p, envelope)
 }
 
-// SendP2PDirect sends a peer-to-peer message to a specific peer.
+// SendP2PDirect sends a peer-to-peer message to a specific peer. If a session
+// is established with the peer, the message is bound to its transcript.
 func (whisper *Whisper) SendP2PDirect(peer *Peer, envelope *Envelope) error {
+	if transcript, ok := peer.sessionTranscript(); ok {
+		return p2p.Send(peer.ws, sessionMessageCode, &sessionMessage{Transcript: transcript, Envelope: envelope})
+	}
 	return p2p.Send(peer.ws, p2pMessageCode, envelope)
 }
 
@@ -403,7 +685,9 @@ func (whisper *Whisper) DeleteKeyPair(key string) bool {
 	defer whisper.keyMu.Unlock()
 
 	if whisper.privateKeys[key] != nil {
+		whisper.privateKeysPeak.observe(len(whisper.privateKeys))
 		delete(whisper.privateKeys, key)
+		whisper.idle.forget(key)
 		return true
 	}
 	return false
@@ -521,15 +805,19 @@ func (whisper *Whisper) AddSymKeyFromPassword(password string) (string, error) {
 func (whisper *Whisper) HasSymKey(id string) bool {
 	whisper.keyMu.RLock()
 	defer whisper.keyMu.RUnlock()
-	return whisper.symKeys[id] != nil
+	return whisper.symKeys[whisper.symKeyID(id)] != nil
 }
 
 // DeleteSymKey deletes the key associated with the name string if it exists.
 func (whisper *Whisper) DeleteSymKey(id string) bool {
 	whisper.keyMu.Lock()
 	defer whisper.keyMu.Unlock()
+	id = whisper.symKeyID(id)
 	if whisper.symKeys[id] != nil {
+		whisper.symKeysPeak.observe(len(whisper.symKeys))
 		delete(whisper.symKeys, id)
+		whisper.forgetLegacyNames(id)
+		whisper.idle.forget(id)
 		return true
 	}
 	return false
@@ -539,8 +827,8 @@ func (whisper *Whisper) DeleteSymKey(id string) bool {
 func (whisper *Whisper) GetSymKey(id string) ([]byte, error) {
 	whisper.keyMu.RLock()
 	defer whisper.keyMu.RUnlock()
-	if whisper.symKeys[id] != nil {
-		return whisper.symKeys[id], nil
+	if key := whisper.symKeys[whisper.symKeyID(id)]; key != nil {
+		return key, nil
 	}
 	return nil, fmt.Errorf("non-existent key ID")
 }
@@ -558,17 +846,12 @@ func (whisper *Whisper) Subscribe(f *Filter) (string, error) {
 // updateBloomFilter recalculates the new value of bloom filter,
 // and informs the peers if necessary.
 func (whisper *Whisper) updateBloomFilter(f *Filter) {
-	aggregate := make([]byte, BloomFilterSize)
-	for _, t := range f.Topics {
-		top := BytesToTopic(t)
-		b := TopicToBloom(top)
-		aggregate = addBloom(aggregate, b)
-	}
-
+	aggregate := whisper.filterBloom(f)
 	if !BloomFilterMatch(whisper.BloomFilter(), aggregate) {
 		// existing bloom filter must be updated
 		aggregate = addBloom(whisper.BloomFilter(), aggregate)
-		whisper.SetBloomFilter(aggregate)
+		whisper.setBloomFilter(aggregate)
+		whisper.bloomRefresh.announced(time.Now())
 	}
 }
 
@@ -586,149 +869,507 @@ func (whisper *Whisper) Unsubscribe(id string) error {
 	return nil
 }
 
+// mayOriginate checks if the outbound topic firewall allows the node to
+// originate messages with the topic. The relayed messages are not affected.
+func (whisper *Whisper) mayOriginate(topic TopicType) bool {
+	if _, blocked := whisper.outboundBlock[topic]; blocked {
+		return false
+	}
+	if whisper.outboundAllow != nil {
+		_, allowed := whisper.outboundAllow[topic]
+		return allowed
+	}
+	return true
+}
+
 // Send injects a message into the whisper send queue, to be distributed in the
 // network in the coming cycles.
 func (whisper *Whisper) Send(envelope *Envelope) error {
+	if !whisper.mayOriginate(envelope.Topic) {
+		return ErrTopicNotAllowed
+	}
+	if whisper.delayOwnEnvelopes {
+		// hold the envelope back for a full transmission cycle plus a random
+		// fraction of another one, so that the peers can not tell it apart from
+		// the envelopes relayed by this node.
+		delay := whisper.transmissionCycle + time.Duration(mrand.Int63n(int64(whisper.transmissionCycle)))
+		whisper.poolMu.Lock()
+		whisper.held[envelope.Hash()] = time.Now().Add(delay)
+		whisper.poolMu.Unlock()
+	}
+	whisper.trackPropagation(envelope.Hash())
 	ok, err := whisper.add(envelope, false)
 	if err == nil && !ok {
-		return fmt.Errorf("failed to add envelope")
+		err = fmt.Errorf("failed to add envelope")
+	}
+	if err != nil {
+		whisper.forgetPropagation([]*Envelope{envelope})
+	}
+	if err != nil && whisper.delayOwnEnvelopes {
+		whisper.poolMu.Lock()
+		delete(whisper.held, envelope.Hash())
+		whisper.poolMu.Unlock()
 	}
 	return err
 }
 
+// Seal closes the envelope, using the background work bank if it is configured.
+// Otherwise the PoW is calculated on the calling goroutine. The envelopes of
+// the local bus are left unsealed.
+func (whisper *Whisper) Seal(ctx context.Context, envelope *Envelope, options *MessageParams, progress SealProgress) error {
+	if whisper.localBus {
+		return nil // the envelopes never leave the node
+	}
+	whisper.lifecycleMu.Lock()
+	sealer := whisper.sealer
+	whisper.lifecycleMu.Unlock()
+
+	if sealer == nil {
+		return envelope.SealContext(ctx, options, progress)
+	}
+	return sealer.Seal(ctx, envelope, options, whisper.sealThreads, progress)
+}
+
 // Start implements node.Service, starting the background data propagation thread
-// of the Whisper protocol.
-func (whisper *Whisper) Start(*p2p.Server) error {
+// of the Whisper protocol. The node is started after the p2p server, and may be
+// stopped and started again while the server is running (e.g. to toggle whisper
+// without restarting the whole node).
+func (whisper *Whisper) Start(server *p2p.Server) error {
+	whisper.lifecycleMu.Lock()
+	defer whisper.lifecycleMu.Unlock()
+
+	if whisper.running {
+		return errors.New("whisper already running")
+	}
+	if err := whisper.routing.invalid; err != nil {
+		return fmt.Errorf("invalid peer groups: %v", err)
+	}
+	select {
+	case <-whisper.quit:
+		// restarted after a stop, the closed resources must be recreated
+		whisper.quit = make(chan struct{})
+		whisper.scope = new(event.SubscriptionScope)
+		if whisper.sealer != nil {
+			whisper.sealer = NewWorkBank(whisper.sealer.Size())
+		}
+	default:
+	}
+	if whisper.relayAddr != "" {
+		if err := whisper.startRelay(); err != nil {
+			return err
+		}
+	}
+	whisper.running = true
+	close(whisper.started)
+	if server != nil {
+		whisper.self = server.Self().ID
+	}
+
 	log.Info("started whisper v." + ProtocolVersionStr)
-	go whisper.update()
+	go whisper.update(whisper.quit)
+	go whisper.calibrate()
+	if whisper.sealer != nil {
+		whisper.sealer.Start()
+	}
 
 	numCPU := runtime.NumCPU()
 	for i := 0; i < numCPU; i++ {
-		go whisper.processQueue()
+		go whisper.processQueue(whisper.quit)
 	}
 
 	return nil
 }
 
 // Stop implements node.Service, stopping the background data propagation thread
-// of the Whisper protocol.
+// of the Whisper protocol. The connected peers are not disconnected, since the
+// connection may be shared with other protocols, but they stay idle until the
+// node is restarted. The pool, the keys and the filters are retained for the next start.
 func (whisper *Whisper) Stop() error {
+	whisper.lifecycleMu.Lock()
+	defer whisper.lifecycleMu.Unlock()
+
+	if !whisper.running {
+		return nil
+	}
+	whisper.running = false
+	whisper.started = make(chan struct{})
+
+	if whisper.relay != nil {
+		whisper.relay.Close()
+		whisper.relay = nil
+	}
 	close(whisper.quit)
+	whisper.scope.Close()
+	if whisper.sealer != nil {
+		whisper.sealer.Stop()
+	}
 	log.Info("whisper stopped")
 	return nil
 }
 
-// HandlePeer is called by the underlying P2P layer when the whisper sub-protocol
-// connection is negotiated.
+// Running indicates if the node is started.
+func (whisper *Whisper) Running() bool {
+	whisper.lifecycleMu.Lock()
+	defer whisper.lifecycleMu.Unlock()
+	return whisper.running
+}
+
+// lifecycle returns the quit channel of the current run of the node, and
+// whether the node is running.
+func (whisper *Whisper) lifecycle() (chan struct{}, bool) {
+	whisper.lifecycleMu.Lock()
+	defer whisper.lifecycleMu.Unlock()
+	return whisper.quit, whisper.running
+}
+
+// startSignal returns the channel closed once the node is started.
+func (whisper *Whisper) startSignal() chan struct{} {
+	whisper.lifecycleMu.Lock()
+	defer whisper.lifecycleMu.Unlock()
+	return whisper.started
+}
+
+// track adds the subscription to the scope of the current run of the node.
+func (whisper *Whisper) track(sub event.Subscription) event.Subscription {
+	whisper.lifecycleMu.Lock()
+	defer whisper.lifecycleMu.Unlock()
+	return whisper.scope.Track(sub)
+}
+
+// runPeer runs the whisper sub-protocol of the peer for as long as it stays
+// connected. Returning from the protocol would tear down the connection for all
+// the other protocols too, so while the node is stopped the peer is kept idle,
+// its packets discarded, and it is served again once the node is restarted.
+func (whisper *Whisper) runPeer(peer *p2p.Peer, rw p2p.MsgReadWriter) error {
+	whisperPeer, err := whisper.connectPeer(peer, rw)
+	if err != nil {
+		return err
+	}
+	defer whisper.disconnectPeer(whisperPeer)
+
+	reader := newPacketReader(whisperPeer.ws)
+	defer reader.close()
+	for {
+		if quit, running := whisper.lifecycle(); running {
+			err := whisper.servePeer(whisperPeer, reader, quit)
+			if err != errWhisperStopped {
+				return err
+			}
+		}
+		whisperPeer.log.Debug("whisper peer idle while stopped")
+		if err := idlePeer(reader, whisper.startSignal()); err != nil {
+			return err
+		}
+	}
+}
+
+// idlePeer discards the packets of the peer until the node is started.
+func idlePeer(reader *packetReader, started <-chan struct{}) error {
+	for {
+		packet, err := reader.next(started)
+		if err == errIngestFailed {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		packet.Discard()
+	}
+}
+
+// HandlePeer runs the whisper sub-protocol of the peer until either the peer
+// disconnects or the node is stopped.
 func (whisper *Whisper) HandlePeer(peer *p2p.Peer, rw p2p.MsgReadWriter) error {
+	quit, running := whisper.lifecycle()
+	if !running {
+		return errWhisperStopped
+	}
+	whisperPeer, err := whisper.connectPeer(peer, rw)
+	if err != nil {
+		return err
+	}
+	defer whisper.disconnectPeer(whisperPeer)
+
+	reader := newPacketReader(whisperPeer.ws)
+	defer reader.close()
+	return whisper.servePeer(whisperPeer, reader, quit)
+}
+
+// connectPeer admits the peer and runs the handshake, tracking the peer until
+// disconnectPeer is called.
+func (whisper *Whisper) connectPeer(peer *p2p.Peer, rw p2p.MsgReadWriter) (*Peer, error) {
 	// Create the new peer and start tracking it
+	rw = &dashboardRW{MsgReadWriter: whisper.hooks.wrap(peer.ID(), rw), dashboard: whisper.dashboard}
 	whisperPeer := newPeer(whisper, peer, rw)
+	info := peer.Info()
+	whisperPeer.privileged = info.Network.Trusted || info.Network.Static
+
+	if !whisper.admits(peer.ID()) {
+		whisperPeer.log.Debug("whisper peer rejected, not on the allowlist")
+		return nil, p2p.DiscUnexpectedIdentity
+	}
 
 	whisper.peerMu.Lock()
+	if !whisper.hasPeerSlot(whisperPeer) {
+		whisper.peerMu.Unlock()
+		whisperPeer.log.Debug("whisper peer rejected, too many peers")
+		return nil, p2p.DiscTooManyPeers
+	}
 	whisper.peers[whisperPeer] = struct{}{}
 	whisper.peerMu.Unlock()
 
-	defer func() {
-		whisper.peerMu.Lock()
-		delete(whisper.peers, whisperPeer)
-		whisper.peerMu.Unlock()
-	}()
-
-	// Run the peer handshake and state updates
+	// Run the peer handshake
 	if err := whisperPeer.handshake(); err != nil {
-		return err
+		whisper.disconnectPeer(whisperPeer)
+		return nil, err
+	}
+	if whisper.standby.trusts(peer.ID()) {
+		whisper.markTrusted(whisperPeer)
 	}
-	whisperPeer.start()
-	defer whisperPeer.stop()
+	return whisperPeer, nil
+}
 
-	return whisper.runMessageLoop(whisperPeer, rw)
+// disconnectPeer stops tracking the peer.
+func (whisper *Whisper) disconnectPeer(p *Peer) {
+	whisper.peerMu.Lock()
+	delete(whisper.peers, p)
+	whisper.peerMu.Unlock()
+}
+
+// servePeer runs the state updates and the message loop of the connected peer
+// until either the peer disconnects or the node is stopped.
+func (whisper *Whisper) servePeer(p *Peer, reader *packetReader, quit chan struct{}) error {
+	p.start()
+	defer p.stop()
+
+	whisper.sendPeerEvent(PeerEventTypeConnect, p, nil)
+	err := whisper.runMessageLoop(p, reader, quit)
+	whisper.sendPeerEvent(PeerEventTypeDisconnect, p, err)
+	return err
+}
+
+// admits checks if the peer may complete the handshake. Unless the allowlist
+// is configured, all the peers are admitted, regardless of the base p2p layer
+// accepting them.
+func (whisper *Whisper) admits(id discover.NodeID) bool {
+	if whisper.peerAllow == nil {
+		return true
+	}
+	_, ok := whisper.peerAllow[id]
+	return ok
+}
+
+// hasPeerSlot checks if the peer can be accepted without exceeding the peer limit.
+// The reserved slots are only available to the privileged (trusted or static)
+// peers. It must be called with the peerMu held.
+func (whisper *Whisper) hasPeerSlot(p *Peer) bool {
+	if whisper.maxPeers <= 0 {
+		return true
+	}
+	if len(whisper.peers) >= whisper.maxPeers {
+		return false
+	}
+	if p.privileged {
+		return true
+	}
+	regular := 0
+	for other := range whisper.peers {
+		if !other.privileged {
+			regular++
+		}
+	}
+	return regular < whisper.maxPeers-whisper.reservedPeers
 }
 
 // runMessageLoop reads and processes inbound messages directly to merge into client-global state.
-func (whisper *Whisper) runMessageLoop(p *Peer, rw p2p.MsgReadWriter) error {
+func (whisper *Whisper) runMessageLoop(p *Peer, reader *packetReader, quit chan struct{}) error {
+	ingest := whisper.startIngest(p)
+	defer ingest.stop()
+
+	// the wait for the next packet is aborted by the stop of the node too, so
+	// that the peer turns idle right away (the requested packet is then
+	// discarded by the idle loop)
+	abort := make(chan struct{})
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ingest.failed:
+		case <-quit:
+		case <-done:
+		}
+		close(abort)
+	}()
+
 	for {
-		// fetch the next packet
-		packet, err := rw.ReadMsg()
+		// fetch the next packet, unless the envelopes received before failed
+		packet, err := reader.next(abort)
+		if err == errIngestFailed {
+			select {
+			case <-ingest.failed:
+				return ingest.error()
+			default:
+				return errWhisperStopped
+			}
+		}
 		if err != nil {
-			log.Warn("message loop", "peer", p.peer.ID(), "err", err)
+			p.log.Warn("message loop", "err", err)
 			return err
 		}
+		select {
+		case <-quit:
+			packet.Discard()
+			return errWhisperStopped
+		default:
+		}
 		if packet.Size > whisper.MaxMessageSize() {
-			log.Warn("oversized message received", "peer", p.peer.ID())
+			p.log.Warn("oversized message received")
 			return errors.New("oversized message received")
 		}
+		if packet.Code != messagesCode {
+			// handle the other messages after the envelopes sent before them
+			if err := ingest.flush(); err != nil {
+				packet.Discard()
+				return err
+			}
+		}
 
 		switch packet.Code {
 		case statusCode:
 			// this should not happen, but no need to panic; just ignore this message.
-			log.Warn("unxepected status message received", "peer", p.peer.ID())
+			p.log.Warn("unxepected status message received")
 		case messagesCode:
 			// decode the contained envelopes
 			var envelopes []*Envelope
 			if err := packet.Decode(&envelopes); err != nil {
-				log.Warn("failed to decode envelopes, peer will be disconnected", "peer", p.peer.ID(), "err", err)
+				p.log.Warn("failed to decode envelopes, peer will be disconnected", "err", err)
 				return errors.New("invalid envelopes")
 			}
 
-			trouble := false
-			for _, env := range envelopes {
-				cached, err := whisper.add(env, whisper.lightClient)
-				if err != nil {
-					trouble = true
-					log.Error("bad envelope received, peer will be disconnected", "peer", p.peer.ID(), "err", err)
-				}
-				if cached {
-					p.mark(env)
-				}
-			}
-
-			if trouble {
-				return errors.New("invalid envelope")
+			if err := ingest.submit(envelopes); err != nil {
+				return err
 			}
 		case powRequirementCode:
 			s := rlp.NewStream(packet.Payload, uint64(packet.Size))
 			i, err := s.Uint()
 			if err != nil {
-				log.Warn("failed to decode powRequirementCode message, peer will be disconnected", "peer", p.peer.ID(), "err", err)
+				p.log.Warn("failed to decode powRequirementCode message, peer will be disconnected", "err", err)
 				return errors.New("invalid powRequirementCode message")
 			}
 			f := math.Float64frombits(i)
 			if math.IsInf(f, 0) || math.IsNaN(f) || f < 0.0 {
-				log.Warn("invalid value in powRequirementCode message, peer will be disconnected", "peer", p.peer.ID(), "err", err)
+				p.log.Warn("invalid value in powRequirementCode message, peer will be disconnected", "err", err)
 				return errors.New("invalid value in powRequirementCode message")
 			}
-			p.powRequirement = f
+			p.setPoWRequirement(f)
 		case bloomFilterExCode:
 			var bloom []byte
 			err := packet.Decode(&bloom)
-			if err == nil && len(bloom) != BloomFilterSize {
-				err = fmt.Errorf("wrong bloom filter size %d", len(bloom))
+			if err == nil {
+				err = p.validBloom(bloom, false)
 			}
 
 			if err != nil {
-				log.Warn("failed to decode bloom filter exchange message, peer will be disconnected", "peer", p.peer.ID(), "err", err)
+				p.log.Warn("failed to decode bloom filter exchange message, peer will be disconnected", "err", err)
 				return errors.New("invalid bloom filter exchange message")
 			}
 			p.setBloomFilter(bloom)
+		case syncDigestCode:
+			var digests []bucketDigest
+			if err := packet.Decode(&digests); err != nil {
+				p.log.Warn("failed to decode sync digests, peer will be disconnected", "err", err)
+				return errors.New("invalid sync digests")
+			}
+			if err := p.handleDigests(digests); err != nil {
+				return err
+			}
+		case syncHashesCode:
+			var hashes []bucketHashes
+			if err := packet.Decode(&hashes); err != nil {
+				p.log.Warn("failed to decode sync hashes, peer will be disconnected", "err", err)
+				return errors.New("invalid sync hashes")
+			}
+			if err := p.handleHashes(hashes); err != nil {
+				return err
+			}
+		case syncRequestCode:
+			var hashes []common.Hash
+			if err := packet.Decode(&hashes); err != nil {
+				p.log.Warn("failed to decode sync request, peer will be disconnected", "err", err)
+				return errors.New("invalid sync request")
+			}
+			if err := p.handleSyncRequest(hashes); err != nil {
+				return err
+			}
+		case ackRequestCode:
+			var hashes []common.Hash
+			if err := packet.Decode(&hashes); err != nil {
+				p.log.Warn("failed to decode ack request, peer will be disconnected", "err", err)
+				return errors.New("invalid ack request")
+			}
+			if err := p.handleAckRequest(hashes); err != nil {
+				return err
+			}
+		case ackCode:
+			var ack envelopeAck
+			if err := packet.Decode(&ack); err != nil {
+				p.log.Warn("failed to decode ack, peer will be disconnected", "err", err)
+				return errors.New("invalid ack")
+			}
+			whisper.confirmDelivery(p, &ack)
+			p.observeAck(&ack)
 		case p2pMessageCode:
 			// peer-to-peer message, sent directly to peer bypassing PoW checks, etc.
 			// this message is not supposed to be forwarded to other peers, and
 			// therefore might not satisfy the PoW, expiry and other requirements.
-			// these messages are only accepted from the trusted peer.
-			if p.trusted {
+			// these messages are only accepted from the trusted peer, and only
+			// bound to the session once it is established.
+			if _, session := p.sessionTranscript(); p.Trusted() && !session {
 				var envelope Envelope
 				if err := packet.Decode(&envelope); err != nil {
-					log.Warn("failed to decode direct message, peer will be disconnected", "peer", p.peer.ID(), "err", err)
+					p.log.Warn("failed to decode direct message, peer will be disconnected", "err", err)
 					return errors.New("invalid direct message")
 				}
+				envelope.schema = p.schema
 				whisper.postEvent(&envelope, true)
 			}
+		case sessionInitCode:
+			var nonce []byte
+			if err := packet.Decode(&nonce); err != nil {
+				p.log.Warn("failed to decode session nonce, peer will be disconnected", "err", err)
+				return errors.New("invalid session nonce")
+			}
+			if err := p.handleSessionInit(nonce); err != nil {
+				p.log.Warn("failed to establish session, peer will be disconnected", "err", err)
+				return err
+			}
+		case sessionMessageCode:
+			if p.Trusted() {
+				var msg sessionMessage
+				if err := packet.Decode(&msg); err != nil || msg.Envelope == nil {
+					p.log.Warn("failed to decode session message, peer will be disconnected", "err", err)
+					return errors.New("invalid session message")
+				}
+				if err := p.verifySession(&msg); err != nil {
+					p.log.Warn("session message rejected, peer will be disconnected", "err", err)
+					return err
+				}
+				msg.Envelope.session, msg.Envelope.schema = msg.Transcript, p.schema
+				whisper.postEvent(msg.Envelope, true)
+			}
+		case rejectionNoticeCode:
+			var notices []rejectionNotice
+			if err := packet.Decode(&notices); err != nil {
+				p.log.Warn("failed to decode rejection notices, peer will be disconnected", "err", err)
+				return errors.New("invalid rejection notices")
+			}
+			p.handleRejections(notices)
 		case p2pRequestCode:
 			// Must be processed if mail server is implemented. Otherwise ignore.
 			if whisper.mailServer != nil {
 				var request Envelope
 				if err := packet.Decode(&request); err != nil {
-					log.Warn("failed to decode p2p request message, peer will be disconnected", "peer", p.peer.ID(), "err", err)
+					p.log.Warn("failed to decode p2p request message, peer will be disconnected", "err", err)
 					return errors.New("invalid p2p request")
 				}
 				whisper.mailServer.DeliverMail(p, &request)
@@ -747,71 +1388,80 @@ func (whisper *Whisper) runMessageLoop(p *Peer, rw p2p.MsgReadWriter) error {
 // appropriate time-stamp. In case of error, connection should be dropped.
 // param isP2P indicates whether the message is peer-to-peer (should not be forwarded).
 func (whisper *Whisper) add(envelope *Envelope, isP2P bool) (bool, error) {
-	now := uint32(time.Now().Unix())
+	now := uint32(whisper.hooks.now().Unix())
 	sent := envelope.Expiry - envelope.TTL
+	allowance := uint32(whisper.syncAllowance)
 
-	if sent > now {
-		if sent-DefaultSyncAllowance > now {
-			return false, fmt.Errorf("envelope created in the future [%x]", envelope.Hash())
-		}
-		// recalculate PoW, adjusted for the time difference, plus one second for latency
-		envelope.calculatePoW(sent - now + 1)
+	if sent > now && sent-allowance > now {
+		return false, whisper.drop(DropReasonFuture, envelope, fmt.Errorf("envelope created in the future [%x]", envelope.Hash()))
 	}
 
 	if envelope.Expiry < now {
-		if envelope.Expiry+DefaultSyncAllowance*2 < now {
-			return false, fmt.Errorf("very old message")
+		if envelope.Expiry+allowance*2 < now {
+			return false, whisper.drop(DropReasonVeryOld, envelope, fmt.Errorf("very old message"))
+		}
+		if whisper.inGrace(envelope, now) && whisper.acceptsLate(envelope, sent, now) {
+			// expired on the way, still delivered to the filters
+			whisper.deliverLate(envelope, isP2P)
 		}
-		log.Debug("expired envelope dropped", "hash", envelope.Hash().Hex())
-		return false, nil // drop envelope without error
+		whisper.poolLog.Debug("expired envelope dropped", "hash", envelope.Hash().Hex())
+		return false, whisper.drop(DropReasonExpired, envelope, nil) // drop envelope without error
 	}
 
 	if uint32(envelope.size()) > whisper.MaxMessageSize() {
-		return false, fmt.Errorf("huge messages are not allowed [%x]", envelope.Hash())
+		return false, whisper.drop(DropReasonOversized, envelope, fmt.Errorf("huge messages are not allowed [%x]", envelope.Hash()))
 	}
 
-	if envelope.PoW() < whisper.MinPow() {
-		// maybe the value was recently changed, and the peers did not adjust yet.
-		// in this case the previous value is retrieved by MinPowTolerance()
-		// for a short period of peer synchronization.
-		if envelope.PoW() < whisper.MinPowTolerance() {
-			return false, fmt.Errorf("envelope with low PoW received: PoW=%f, hash=[%v]", envelope.PoW(), envelope.Hash().Hex())
-		}
+	if err := whisper.schemaOf(envelope).validate(envelope); err != nil {
+		return false, whisper.drop(DropReasonMalformed, envelope, err)
 	}
 
-	if !BloomFilterMatch(whisper.BloomFilter(), envelope.Bloom()) {
+	if bloom := whisper.bloomParams.envelopeBloom(envelope); !BloomFilterMatch(whisper.BloomFilter(), bloom) {
 		// maybe the value was recently changed, and the peers did not adjust yet.
 		// in this case the previous value is retrieved by BloomFilterTolerance()
 		// for a short period of peer synchronization.
-		if !BloomFilterMatch(whisper.BloomFilterTolerance(), envelope.Bloom()) {
-			return false, fmt.Errorf("envelope does not match bloom filter, hash=[%v], bloom: \n%x \n%x \n%x",
-				envelope.Hash().Hex(), whisper.BloomFilter(), envelope.Bloom(), envelope.Topic)
+		if !BloomFilterMatch(whisper.BloomFilterTolerance(), bloom) {
+			return false, whisper.drop(DropReasonBloomMismatch, envelope, fmt.Errorf("envelope does not match bloom filter, hash=[%v], bloom: \n%x \n%x \n%x",
+				envelope.Hash().Hex(), whisper.BloomFilter(), bloom, envelope.Topic))
 		}
 	}
 
 	hash := envelope.Hash()
+	if whisper.isEnvelopeCached(hash) {
+		// identical envelope was already verified, no need to calculate the PoW again
+		whisper.poolLog.Trace("whisper envelope already cached", "hash", hash.Hex())
+		return true, nil
+	}
+
+	if err := whisper.verifyPoW(envelope, sent, now); err != nil {
+		return false, whisper.drop(DropReasonLowPoW, envelope, err)
+	}
 
 	whisper.poolMu.Lock()
 	_, alreadyCached := whisper.envelopes[hash]
 	if !alreadyCached {
 		whisper.envelopes[hash] = envelope
-		if whisper.expirations[envelope.Expiry] == nil {
-			whisper.expirations[envelope.Expiry] = set.NewNonTS()
-		}
-		if !whisper.expirations[envelope.Expiry].Has(hash) {
-			whisper.expirations[envelope.Expiry].Add(hash)
+		index := bucketIndex(envelope.Expiry)
+		if whisper.buckets[index] == nil {
+			whisper.buckets[index] = newEnvelopeBucket(index)
 		}
+		whisper.buckets[index].add(hash, envelope)
 	}
 	whisper.poolMu.Unlock()
 
 	if alreadyCached {
-		log.Trace("whisper envelope already cached", "hash", envelope.Hash().Hex())
+		whisper.poolLog.Trace("whisper envelope already cached", "hash", envelope.Hash().Hex())
 	} else {
-		log.Trace("cached whisper envelope", "hash", envelope.Hash().Hex())
+		whisper.poolLog.Trace("cached whisper envelope", "hash", envelope.Hash().Hex())
+		whisper.meters.added.Mark(1)
+		whisper.dashboard.added(envelope)
 		whisper.statsMu.Lock()
 		whisper.stats.memoryUsed += envelope.size()
 		whisper.statsMu.Unlock()
 		whisper.postEvent(envelope, isP2P) // notify the local node about the new message
+		if !isP2P {
+			whisper.envelopeFeed.Send(envelope)
+		}
 		if whisper.mailServer != nil {
 			whisper.mailServer.Archive(envelope)
 		}
@@ -819,6 +1469,61 @@ func (whisper *Whisper) add(envelope *Envelope, isP2P bool) (bool, error) {
 	return true, nil
 }
 
+// verifyPoW checks if the envelope satisfies the PoW requirement of the node.
+// The PoW of the envelopes created in the future (within the allowed time skew)
+// is adjusted for the time difference.
+func (whisper *Whisper) verifyPoW(envelope *Envelope, sent, now uint32) error {
+	// maybe the value was recently changed, and the peers did not adjust yet.
+	// in this case the previous value is retrieved by MinPowTolerance()
+	// for a short period of peer synchronization.
+	required := whisper.MinPow()
+	if tolerance := whisper.MinPowTolerance(); tolerance < required {
+		required = tolerance
+	}
+
+	var diff uint32
+	if sent > now {
+		// plus one second for latency
+		diff = sent - now + 1
+	}
+
+	// the hashing cost grows with the size of the envelope, so the envelopes
+	// which could never satisfy the requirement are rejected without hashing.
+	if envelope.powBeyondHash(required, diff) {
+		return fmt.Errorf("envelope with unreachable PoW received: size=%d, TTL=%d, hash=[%v]", envelope.size(), envelope.TTL, envelope.Hash().Hex())
+	}
+
+	if diff > 0 {
+		whisper.adjustPoW(envelope, sent, diff)
+	}
+	if envelope.PoW() < required {
+		return fmt.Errorf("envelope with low PoW received: PoW=%f, hash=[%v]", envelope.PoW(), envelope.Hash().Hex())
+	}
+	return nil
+}
+
+// adjustPoW calculates the PoW of the future-dated envelope adjusted for the time
+// difference. The PoW hash of the copies of the same envelope received until it
+// is no longer future-dated is reused, except for the copies verified at once.
+func (whisper *Whisper) adjustPoW(envelope *Envelope, sent, diff uint32) {
+	hash := envelope.Hash()
+
+	whisper.futurePoWMu.Lock()
+	cached, ok := whisper.futurePoW[hash]
+	whisper.futurePoWMu.Unlock()
+
+	if ok {
+		envelope.setPoWBits(cached.bits, diff)
+		return
+	}
+	// the hashing is done outside of the lock, not to serialize the peers
+	envelope.calculatePoW(diff)
+
+	whisper.futurePoWMu.Lock()
+	whisper.futurePoW[hash] = futurePoW{bits: envelope.powBits, sent: sent}
+	whisper.futurePoWMu.Unlock()
+}
+
 // postEvent queues the message for further processing.
 func (whisper *Whisper) postEvent(envelope *Envelope, isP2P bool) {
 	if isP2P {
@@ -832,26 +1537,27 @@ func (whisper *Whisper) postEvent(envelope *Envelope, isP2P bool) {
 // checkOverflow checks if message queue overflow occurs and reports it if necessary.
 func (whisper *Whisper) checkOverflow() {
 	queueSize := len(whisper.messageQueue)
+	queueLimit := cap(whisper.messageQueue)
 
-	if queueSize == messageQueueLimit {
+	if queueSize == queueLimit {
 		if !whisper.Overflow() {
 			whisper.settings.Store(overflowIdx, true)
-			log.Warn("message queue overflow")
+			whisper.poolLog.Warn("message queue overflow")
 		}
-	} else if queueSize <= messageQueueLimit/2 {
+	} else if queueSize <= queueLimit/2 {
 		if whisper.Overflow() {
 			whisper.settings.Store(overflowIdx, false)
-			log.Warn("message queue overflow fixed (back to normal)")
+			whisper.poolLog.Warn("message queue overflow fixed (back to normal)")
 		}
 	}
 }
 
 // processQueue delivers the messages to the watchers during the lifetime of the whisper node.
-func (whisper *Whisper) processQueue() {
+func (whisper *Whisper) processQueue(quit chan struct{}) {
 	var e *Envelope
 	for {
 		select {
-		case <-whisper.quit:
+		case <-quit:
 			return
 
 		case e = <-whisper.messageQueue:
@@ -865,47 +1571,117 @@ func (whisper *Whisper) processQueue() {
 
 // update loops until the lifetime of the whisper node, updating its internal
 // state by expiring stale messages from the pool.
-func (whisper *Whisper) update() {
+func (whisper *Whisper) update(quit chan struct{}) {
 	// Start a ticker to check for expirations
-	expire := time.NewTicker(expirationCycle)
+	expire := time.NewTicker(whisper.expirationCycle)
+	sample := time.NewTicker(dashboardInterval)
+	defer sample.Stop()
+
+	var transmit <-chan time.Time
+	if whisper.latencyScheduling {
+		ticker := time.NewTicker(whisper.transmissionCycle)
+		defer ticker.Stop()
+		transmit = ticker.C
+	}
 
 	// Repeat updates until termination is requested
 	for {
 		select {
 		case <-expire.C:
 			whisper.expire()
+			whisper.expireIdleIdentities()
+			whisper.refreshBloom(time.Now())
+			whisper.compact()
+
+		case now := <-sample.C:
+			whisper.dashboard.sample(whisper, now)
 
-		case <-whisper.quit:
+		case <-transmit:
+			whisper.transmit(quit)
+
+		case <-quit:
 			return
 		}
 	}
 }
 
 // expire iterates over all the expiration timestamps, removing all stale
-// messages from the pools.
+// messages from the pools and invoking their expiration callbacks.
 func (whisper *Whisper) expire() {
+	expired := whisper.removeExpired()
+	whisper.forgetPropagation(expired)
+	whisper.notifyExpired(expired)
+}
+
+// removeExpired removes the stale messages from the pools, returning the
+// removed envelopes.
+func (whisper *Whisper) removeExpired() []*Envelope {
 	whisper.poolMu.Lock()
 	defer whisper.poolMu.Unlock()
 
 	whisper.statsMu.Lock()
 	defer whisper.statsMu.Unlock()
 	whisper.stats.reset()
-	now := uint32(time.Now().Unix())
-	for expiry, hashSet := range whisper.expirations {
-		if expiry < now {
-			// Dump all expired messages and remove timestamp
-			hashSet.Each(func(v interface{}) bool {
-				sz := whisper.envelopes[v.(common.Hash)].size()
-				delete(whisper.envelopes, v.(common.Hash))
-				whisper.stats.messagesCleared++
-				whisper.stats.memoryCleared += sz
-				whisper.stats.memoryUsed -= sz
-				return true
-			})
-			whisper.expirations[expiry].Clear()
-			delete(whisper.expirations, expiry)
+	now := uint32(whisper.hooks.now().Unix())
+	var expired []*Envelope
+	for index, b := range whisper.buckets {
+		switch {
+		case b.end() <= now:
+			// Dump the whole bucket, all its messages are expired
+			for hash, envelope := range b.envelopes {
+				whisper.clearEnvelope(hash, envelope)
+				expired = append(expired, envelope)
+			}
+			delete(whisper.buckets, index)
+
+		case b.start() < now:
+			// The bucket is partially expired, dump the expired messages only
+			for hash, envelope := range b.envelopes {
+				if envelope.Expiry < now {
+					whisper.clearEnvelope(hash, envelope)
+					b.remove(hash)
+					expired = append(expired, envelope)
+				}
+			}
+			if len(b.envelopes) == 0 {
+				delete(whisper.buckets, index)
+			}
+		}
+	}
+	if whisper.gossip != nil && len(expired) > 0 {
+		hashes := make([]common.Hash, len(expired))
+		for i, envelope := range expired {
+			hashes[i] = envelope.Hash()
+		}
+		whisper.gossip.forget(hashes)
+	}
+
+	whisper.futurePoWMu.Lock()
+	for hash, cached := range whisper.futurePoW {
+		if cached.sent <= now {
+			delete(whisper.futurePoW, hash)
 		}
 	}
+	whisper.futurePoWMu.Unlock()
+
+	for hash, release := range whisper.held {
+		if _, cached := whisper.envelopes[hash]; !cached || release.Before(time.Now()) {
+			delete(whisper.held, hash)
+		}
+	}
+	whisper.rememberExpired(expired, now)
+	return expired
+}
+
+// clearEnvelope removes the expired envelope from the pool and updates the
+// statistics. Both the pool and the statistics must be locked by the caller.
+func (whisper *Whisper) clearEnvelope(hash common.Hash, envelope *Envelope) {
+	sz := envelope.size()
+	whisper.envelopesPeak.observe(len(whisper.envelopes))
+	delete(whisper.envelopes, hash)
+	whisper.stats.messagesCleared++
+	whisper.stats.memoryCleared += sz
+	whisper.stats.memoryUsed -= sz
 }
 
 // Stats returns the whisper node statistics.
@@ -917,6 +1693,7 @@ func (whisper *Whisper) Stats() Statistics {
 }
 
 // Envelopes retrieves all the messages currently pooled by the node.
+// Tools running several queries of the pool should use Snapshot instead.
 func (whisper *Whisper) Envelopes() []*Envelope {
 	whisper.poolMu.RLock()
 	defer whisper.poolMu.RUnlock()
@@ -928,6 +1705,28 @@ func (whisper *Whisper) Envelopes() []*Envelope {
 	return all
 }
 
+// outgoingEnvelopes retrieves all the messages currently pooled by the node,
+// which are ready to be broadcast to the peers.
+func (whisper *Whisper) outgoingEnvelopes() []*Envelope {
+	whisper.poolMu.RLock()
+	defer whisper.poolMu.RUnlock()
+
+	all := make([]*Envelope, 0, len(whisper.envelopes))
+	for hash, envelope := range whisper.envelopes {
+		if !whisper.isHeld(hash) {
+			all = append(all, envelope)
+		}
+	}
+	return all
+}
+
+// isHeld checks if the own envelope is still held back from the broadcast.
+// The pool must be locked by the caller.
+func (whisper *Whisper) isHeld(hash common.Hash) bool {
+	release, held := whisper.held[hash]
+	return held && time.Now().Before(release)
+}
+
 // isEnvelopeCached checks if envelope with specific hash has already been received and cached.
 func (whisper *Whisper) isEnvelopeCached(hash common.Hash) bool {
 	whisper.poolMu.Lock()
@@ -1029,8 +1828,11 @@ func BloomFilterMatch(filter, sample []byte) bool {
 	if filter == nil {
 		return true
 	}
+	if len(sample) != len(filter) {
+		return false
+	}
 
-	for i := 0; i < BloomFilterSize; i++ {
+	for i := 0; i < len(filter); i++ {
 		f := filter[i]
 		s := sample[i]
 		if (f | s) != f {
@@ -1042,8 +1844,8 @@ func BloomFilterMatch(filter, sample []byte) bool {
 }
 
 func addBloom(a, b []byte) []byte {
-	c := make([]byte, BloomFilterSize)
-	for i := 0; i < BloomFilterSize; i++ {
+	c := make([]byte, len(a))
+	for i := 0; i < len(a); i++ {
 		c[i] = a[i] | b[i]
 	}
 	return c
@@ -21,10 +21,12 @@ import (
 	"crypto/ecdsa"
 	"crypto/sha256"
 	mrand "math/rand"
+	"strings"
 	"testing"
 	"time"
 
 	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/metrics"
 	"golang.org/x/crypto/pbkdf2"
 )
 
@@ -883,3 +885,268 @@ func TestBloom(t *testing.T) {
 		t.Fatalf("retireved wrong bloom filter")
 	}
 }
+
+func TestDelayOwnEnvelopes(t *testing.T) {
+	InitSingleTest()
+
+	cfg := DefaultConfig
+	cfg.DelayOwnEnvelopes = true
+	w := New(&cfg)
+	w.SetMinimumPowTest(0.0000001)
+	defer w.SetMinimumPowTest(DefaultMinimumPoW)
+	w.Start(nil)
+	defer w.Stop()
+
+	params, err := generateMessageParams()
+	if err != nil {
+		t.Fatalf("failed generateMessageParams with seed %d: %s.", seed, err)
+	}
+	msg, err := NewSentMessage(params)
+	if err != nil {
+		t.Fatalf("failed to create new message with seed %d: %s.", seed, err)
+	}
+	env, err := msg.Wrap(params)
+	if err != nil {
+		t.Fatalf("failed Wrap with seed %d: %s.", seed, err)
+	}
+	if err = w.Send(env); err != nil {
+		t.Fatalf("failed to send envelope with seed %d: %s.", seed, err)
+	}
+
+	if len(w.Envelopes()) != 1 {
+		t.Fatalf("envelope was not pooled, seed: %d.", seed)
+	}
+	if len(w.outgoingEnvelopes()) != 0 {
+		t.Fatalf("own envelope was not held back, seed: %d.", seed)
+	}
+	time.Sleep(2 * w.transmissionCycle)
+	if len(w.outgoingEnvelopes()) != 1 {
+		t.Fatalf("own envelope was not released, seed: %d.", seed)
+	}
+}
+
+func TestPoWShortcuts(t *testing.T) {
+	InitSingleTest()
+
+	w := New(&DefaultConfig)
+	w.SetMinimumPowTest(0.0000001)
+	defer w.SetMinimumPowTest(DefaultMinimumPoW)
+	w.Start(nil)
+	defer w.Stop()
+
+	params, err := generateMessageParams()
+	if err != nil {
+		t.Fatalf("failed generateMessageParams with seed %d: %s.", seed, err)
+	}
+	msg, err := NewSentMessage(params)
+	if err != nil {
+		t.Fatalf("failed to create new message with seed %d: %s.", seed, err)
+	}
+	env, err := msg.Wrap(params)
+	if err != nil {
+		t.Fatalf("failed Wrap with seed %d: %s.", seed, err)
+	}
+	if _, err = w.add(env, false); err != nil {
+		t.Fatalf("failed to add envelope with seed %d: %s.", seed, err)
+	}
+
+	// the duplicate must be accepted without verifying the PoW again
+	w.SetMinimumPowTest(1e9)
+	dup := *env
+	dup.pow = 0
+	if _, err = w.add(&dup, false); err != nil {
+		t.Fatalf("failed to add duplicate with seed %d: %s.", seed, err)
+	}
+	if dup.pow != 0 {
+		t.Fatalf("PoW of the duplicate was calculated, seed: %d.", seed)
+	}
+
+	// the envelope which can not reach the required PoW must be rejected without hashing
+	w.SetMinimumPowTest(1e80)
+	unreachable := *env
+	unreachable.pow, unreachable.hash = 0, common.Hash{}
+	unreachable.Nonce++
+	if _, err = w.add(&unreachable, false); err == nil {
+		t.Fatalf("envelope with unreachable PoW was accepted, seed: %d.", seed)
+	}
+	if unreachable.pow != 0 {
+		t.Fatalf("PoW of the unreachable envelope was calculated, seed: %d.", seed)
+	}
+}
+
+func TestMultipleInstances(t *testing.T) {
+	InitSingleTest()
+
+	cfg1 := DefaultConfig
+	cfg1.MetricsPrefix = "whisper/test1"
+	cfg1.MessageQueueLimit = 16
+	w1 := New(&cfg1)
+
+	cfg2 := DefaultConfig
+	cfg2.MetricsPrefix = "whisper/test2"
+	cfg2.TransmissionCycle = 100 * time.Millisecond
+	cfg2.SyncAllowance = 20
+	w2 := New(&cfg2)
+
+	w1.Start(nil)
+	defer w1.Stop()
+	w2.Start(nil)
+	defer w2.Stop()
+
+	if cap(w1.messageQueue) != 16 || cap(w2.messageQueue) != messageQueueLimit {
+		t.Fatalf("wrong queue limits: %d, %d.", cap(w1.messageQueue), cap(w2.messageQueue))
+	}
+	if w1.transmissionCycle != transmissionCycle || w2.transmissionCycle != cfg2.TransmissionCycle {
+		t.Fatalf("wrong transmission cycles: %v, %v.", w1.transmissionCycle, w2.transmissionCycle)
+	}
+	if w1.syncAllowance != DefaultSyncAllowance || w2.syncAllowance != cfg2.SyncAllowance {
+		t.Fatalf("wrong sync allowances: %d, %d.", w1.syncAllowance, w2.syncAllowance)
+	}
+
+	w1.SetMinimumPowTest(0.0000001)
+	if w2.MinPow() != DefaultMinimumPoW {
+		t.Fatalf("PoW requirement leaked between instances: %f.", w2.MinPow())
+	}
+
+	id, err := w1.GenerateSymKey()
+	if err != nil {
+		t.Fatalf("failed GenerateSymKey with seed %d: %s.", seed, err)
+	}
+	if w2.HasSymKey(id) {
+		t.Fatalf("symmetric key leaked between instances, seed: %d.", seed)
+	}
+
+	params, err := generateMessageParams()
+	if err != nil {
+		t.Fatalf("failed generateMessageParams with seed %d: %s.", seed, err)
+	}
+	params.PoW = 0.0000001
+	msg, err := NewSentMessage(params)
+	if err != nil {
+		t.Fatalf("failed to create new message with seed %d: %s.", seed, err)
+	}
+	env, err := msg.Wrap(params)
+	if err != nil {
+		t.Fatalf("failed Wrap with seed %d: %s.", seed, err)
+	}
+	if err = w1.Send(env); err != nil {
+		t.Fatalf("failed to send envelope with seed %d: %s.", seed, err)
+	}
+	if len(w1.Envelopes()) != 1 || len(w2.Envelopes()) != 0 {
+		t.Fatalf("envelope pools are not isolated: %d, %d.", len(w1.Envelopes()), len(w2.Envelopes()))
+	}
+}
+
+func TestFuturePoWCache(t *testing.T) {
+	InitSingleTest()
+
+	w := New(&DefaultConfig)
+	w.SetMinimumPowTest(0.0000001)
+	defer w.SetMinimumPowTest(DefaultMinimumPoW)
+
+	now := uint32(time.Now().Unix())
+	sent := now + 5
+	env := &Envelope{Expiry: sent + DefaultTTL, TTL: DefaultTTL, Data: []byte{1}, Nonce: uint64(seed)}
+	if err := w.verifyPoW(env, sent, now); err != nil {
+		t.Fatalf("failed to verify PoW with seed %d: %s.", seed, err)
+	}
+	cached, ok := w.futurePoW[env.Hash()]
+	if !ok || cached.sent != sent {
+		t.Fatalf("PoW of the future-dated envelope was not cached, seed: %d.", seed)
+	}
+
+	// a copy must reuse the cached PoW, the fake value proves no hashing took place
+	w.futurePoW[env.Hash()] = futurePoW{bits: cached.bits + 1, sent: sent}
+	dup := &Envelope{Expiry: env.Expiry, TTL: env.TTL, Data: env.Data, Nonce: env.Nonce}
+	if err := w.verifyPoW(dup, sent, now); err != nil {
+		t.Fatalf("failed to verify PoW of the copy with seed %d: %s.", seed, err)
+	}
+	if dup.powBits != cached.bits+1 {
+		t.Fatalf("cached PoW was not reused, seed: %d.", seed)
+	}
+
+	// the cache is cleaned up once the envelope is no longer future-dated
+	w.futurePoW[env.Hash()] = futurePoW{bits: cached.bits, sent: now - 1}
+	w.expire()
+	if _, ok := w.futurePoW[env.Hash()]; ok {
+		t.Fatalf("stale PoW cache entry was not removed, seed: %d.", seed)
+	}
+}
+
+func TestOutboundTopicFirewall(t *testing.T) {
+	InitSingleTest()
+
+	allowed, blocked, other := TopicType{1}, TopicType{2}, TopicType{3}
+	cfg := DefaultConfig
+	cfg.OutboundTopicAllowlist = []TopicType{allowed, blocked}
+	cfg.OutboundTopicBlocklist = []TopicType{blocked}
+	w := New(&cfg)
+	w.SetMinimumPowTest(0.0000001)
+	defer w.SetMinimumPowTest(DefaultMinimumPoW)
+
+	now := uint32(time.Now().Unix())
+	for i, topic := range []TopicType{allowed, blocked, other} {
+		env := &Envelope{Expiry: now + DefaultTTL, TTL: DefaultTTL, Topic: topic, Data: []byte{byte(i)}, Nonce: uint64(seed)}
+		err := w.Send(env)
+		if topic == allowed && err != nil {
+			t.Fatalf("failed to send allowed topic with seed %d: %s.", seed, err)
+		}
+		if topic != allowed && err != ErrTopicNotAllowed {
+			t.Fatalf("topic %x was not rejected: %v.", topic, err)
+		}
+
+		// relaying is not affected by the firewall
+		if topic != allowed {
+			if _, err = w.add(env, false); err != nil {
+				t.Fatalf("failed to relay topic %x with seed %d: %s.", topic, seed, err)
+			}
+		}
+	}
+}
+
+func TestCapabilities(t *testing.T) {
+	cfg := DefaultConfig
+	cfg.WatchOnly = true
+	cfg.BloomFilterSize = 128
+	w := New(&cfg)
+
+	caps := w.Capabilities()
+	if caps.ProtocolVersion != ProtocolVersion || len(caps.EnvelopeVersions) != len(envelopeSchemas) {
+		t.Fatalf("wrong versions: %d, %v.", caps.ProtocolVersion, caps.EnvelopeVersions)
+	}
+	if caps.MaxMessageSize != cfg.MaxMessageSize || caps.MinPoW != cfg.MinimumAcceptedPOW {
+		t.Fatalf("wrong limits: %d, %f.", caps.MaxMessageSize, caps.MinPoW)
+	}
+	if !caps.WatchOnly || caps.MailServer || caps.LightClient || caps.Bloom.Size != 128 {
+		t.Fatalf("wrong features: %+v.", caps)
+	}
+
+	w.lightClient = true
+	if caps = w.Capabilities(); !caps.LightClient {
+		t.Fatalf("light client mode not reported.")
+	}
+}
+
+func TestEnvelopeMetersReused(t *testing.T) {
+	enabled := metrics.Enabled
+	metrics.Enabled = true
+	defer func() { metrics.Enabled = enabled }()
+
+	prefix := "whisper/test/reused"
+	first, second := newEnvelopeMeters(prefix), newEnvelopeMeters(prefix)
+	defer func() {
+		metrics.DefaultRegistry.Each(func(name string, _ interface{}) {
+			if strings.HasPrefix(name, prefix) {
+				metrics.DefaultRegistry.Unregister(name)
+			}
+		})
+	}()
+
+	first.added.Mark(1)
+	if second.added.Count() != 1 {
+		t.Fatalf("meters of the same prefix are not shared: %d.", second.added.Count())
+	}
+	if metrics.Get(prefix+"/envelopes/added") != first.added {
+		t.Fatalf("meter of the node is not registered.")
+	}
+}